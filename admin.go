@@ -0,0 +1,497 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// adminPrefix is the path under which the admin API is served.
+const adminPrefix = "/api/repos"
+
+// serverAdminPrefix is the path under which the admin API manages the
+// server itself.
+const serverAdminPrefix = "/api/server"
+
+// AdminAPI enables the repository management API:
+//
+//	GET    /api/repos         lists repositories, or those of a tenant with ?tenant={name}
+//	POST   /api/repos         creates a repository, body: {"name": "foo.git"}
+//	GET    /api/repos/{name}  describes a repository, including its disk usage
+//	DELETE /api/repos/{name}  deletes a repository
+//	POST   /api/repos/{name}/undelete     restores the repository deleted last, with Trash
+//	POST   /api/repos/{name}/maintenance  runs maintenance on a repository
+//	POST   /api/repos/{name}/sync         syncs a mirror with its upstream
+//	POST   /api/repos/{name}/move         renames a repository, body: {"name": "bar.git", "redirect": true}
+//	POST   /api/repos/{name}/fork         forks a repository, body: {"name": "alice/foo.git"}
+//	POST   /api/repos/{name}/archive      archives a repository
+//	POST   /api/repos/{name}/restore      restores an archived repository
+//	POST   /api/repos/{name}/readonly     makes a repository read-only, body: {"reason": "migrating"}
+//	POST   /api/repos/{name}/writable     makes a read-only repository writable again
+//	GET    /api/repos/{name}/default_branch  returns the branch HEAD points to
+//	PUT    /api/repos/{name}/default_branch  points HEAD to a branch, body: {"default_branch": "main"}
+//	GET    /api/server                    describes the server status
+//	POST   /api/server/readonly           makes every repository read-only, body: {"reason": "migrating"}
+//	POST   /api/server/writable           makes repositories writable again
+//	POST   /api/server/maintenance        puts the server in maintenance mode, body: {"retry_after": 300}
+//	POST   /api/server/resume             puts the server back in service
+//
+// Repositories can be created with a default_branch, the one set with
+// DefaultBranch otherwise, a description and a template, the name of a
+// repository to copy hooks and configuration from.
+// The description is stored in the description file of repositories.
+// Moving and deleting repositories waits for the operations running on them
+// to finish, rejecting new ones meanwhile. Moving can leave a redirect so
+// fetches of the old name get a 301 response pointing to the new one. Forks
+// get the branches and tags of their parent, borrowing its objects rather
+// than copying them, so parents can be neither deleted nor moved while they
+// have forks, unless object pools are enabled. Archived
+// repositories are read-only and only listed with archived=true, until
+// restored. Read-only repositories and servers reject pushes, telling
+// clients the reason given, while still serving fetches. In maintenance
+// mode, new Git operations get a 503 response asking clients to retry after
+// retry_after seconds, a minute by default, while running ones finish; the
+// server status reports once none is left. Requests go through the
+// authenticator set with AdminAuth, or the one checking Git requests if
+// none is, and the authorization callback using the Admin operation.
+func AdminAPI() Option {
+	return func(h *handler) {
+		h.adminAPI = true
+	}
+}
+
+// TemplateDir sets the template directory used when creating repositories
+// through the admin API. See git-init(1) for details.
+func TemplateDir(dir string) Option {
+	return func(h *handler) {
+		h.templateDir = dir
+	}
+}
+
+// repoInfo describes a repository in admin API responses.
+type repoInfo struct {
+	Name          string `json:"name"`
+	DefaultBranch string `json:"default_branch,omitempty"`
+	Description   string `json:"description,omitempty"`
+	// Template is the repository hooks and configuration were copied from
+	// on creation.
+	Template string `json:"template,omitempty"`
+	Archived bool   `json:"archived,omitempty"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+	// Size is the disk usage of the repository, in bytes.
+	Size int64 `json:"size,omitempty"`
+	// Quota is the disk usage limit of the repository, as set by RepoQuota.
+	Quota int64 `json:"quota,omitempty"`
+	// Pool is the object pool the repository borrows objects from, and
+	// PoolSavings the disk space the pool saves its members, in bytes.
+	Pool        string `json:"pool,omitempty"`
+	PoolSavings int64  `json:"pool_savings,omitempty"`
+	// Tenant is the tenant the repository belongs to, as set by Tenants.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// serverStatus describes the server in admin API responses.
+type serverStatus struct {
+	ReadOnly bool `json:"read_only"`
+	// ReadOnlyReason is the reason given to clients for rejecting pushes.
+	ReadOnlyReason string `json:"read_only_reason,omitempty"`
+	Maintenance    bool   `json:"maintenance"`
+	// Running is the number of Git operations running.
+	Running int `json:"running"`
+	// Drained is set in maintenance mode once no Git operation is running.
+	Drained bool `json:"drained"`
+}
+
+func isAdminPath(p string) bool {
+	return p == adminPrefix || strings.HasPrefix(p, adminPrefix+"/")
+}
+
+func isServerAdminPath(p string) bool {
+	return p == serverAdminPrefix || strings.HasPrefix(p, serverAdminPrefix+"/")
+}
+
+// serveAdmin dispatches admin API requests.
+func (h *handler) serveAdmin(w http.ResponseWriter, req *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, adminPrefix), "/")
+	var action string
+	if i := strings.LastIndex(name, "/"); i >= 0 && (req.Method == "POST" || name[i+1:] == "default_branch") {
+		name, action = name[:i], name[i+1:]
+	}
+
+	// Listing the repositories of a tenant is authorized as its own.
+	scope := name
+	if name == "" && req.Method == "GET" {
+		scope = req.URL.Query().Get("tenant")
+	}
+
+	req, ok := h.authenticateAdmin(w, req, scope)
+	if !ok || !h.authorizeRepo(w, req, scope, Admin) {
+		return
+	}
+
+	switch {
+	case action == "maintenance":
+		h.maintainRepoNow(w, req, name)
+	case action == "sync":
+		h.syncMirrorNow(w, req, name)
+	case action == "move":
+		h.moveRepo(w, req, name)
+	case action == "fork":
+		h.forkRepo(w, req, name)
+	case action == "undelete":
+		h.undeleteRepo(w, req, name)
+	case action == "archive" || action == "restore":
+		h.archiveRepo(w, req, name, action == "archive")
+	case action == "readonly" || action == "writable":
+		h.setRepoReadOnly(w, req, name, action == "readonly")
+	case action == "default_branch":
+		h.serveDefaultBranch(w, req, name)
+	case action != "":
+		writeError(w, http.StatusNotFound, "unknown action")
+	case name == "" && req.Method == "GET":
+		h.listRepos(w, req)
+	case name == "" && req.Method == "POST":
+		h.createRepo(w, req)
+	case name != "" && req.Method == "GET":
+		h.getRepo(w, req, name)
+	case name != "" && req.Method == "DELETE":
+		h.deleteRepo(w, req, name)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// serveServerAdmin dispatches admin API requests managing the server.
+func (h *handler) serveServerAdmin(w http.ResponseWriter, req *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(req.URL.Path, serverAdminPrefix), "/")
+
+	req, ok := h.authenticateAdmin(w, req, "")
+	if !ok || !h.authorizeRepo(w, req, "", Admin) {
+		return
+	}
+
+	switch {
+	case action == "" && req.Method == "GET":
+		var status serverStatus
+		status.ReadOnly, status.ReadOnlyReason = h.readOnly.get()
+		status.Maintenance, status.Running = h.activity.status()
+		status.Drained = status.Maintenance && status.Running == 0
+		writeJSON(w, http.StatusOK, status)
+	case action == "readonly" || action == "writable":
+		if req.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		h.setServerReadOnly(w, req, action == "readonly")
+	case action == "maintenance" || action == "resume":
+		if req.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		h.setMaintenance(w, req, action == "maintenance")
+	case action != "":
+		writeError(w, http.StatusNotFound, "unknown action")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// listRepos walks the repositories root looking for bare repositories.
+func (h *handler) listRepos(w http.ResponseWriter, req *http.Request) {
+	archived := req.URL.Query().Get("archived") == "true"
+	tenant := req.URL.Query().Get("tenant")
+	repos := []repoInfo{}
+	err := h.walkRepos(func(name, dir string) error {
+		info := repoInfo{Name: name, Tenant: h.tenantName(name), Archived: isArchived(dir)}
+		if tenant != "" && info.Tenant != tenant {
+			return nil
+		}
+		info.ReadOnly, _ = readOnly(dir)
+		if archived || !info.Archived {
+			repos = append(repos, info)
+		}
+		return nil
+	})
+
+	if err != nil {
+		h.logger.Error("Listing repositories failed", Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to list repositories")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, repos)
+}
+
+// createRepo initializes a new bare repository.
+func (h *handler) createRepo(w http.ResponseWriter, req *http.Request) {
+	var info repoInfo
+	if err := json.NewDecoder(req.Body).Decode(&info); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	dir, err := h.newRepo(req.Context(), info, remoteUser(req))
+	switch err {
+	case nil:
+	case ErrInvalidRepoName, ErrInvalidDefaultBranch, ErrInvalidDescription, ErrTemplateNotFound:
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	case ErrRepoExists:
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	default:
+		writeError(w, http.StatusInternalServerError, "unable to create repository")
+		return
+	}
+
+	info.DefaultBranch = defaultBranch(dir)
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// newRepo creates the bare repository info describes on behalf of user,
+// returning its directory.
+func (h *handler) newRepo(ctx context.Context, info repoInfo, user string) (string, error) {
+	if !validRepoName(info.Name) {
+		return "", ErrInvalidRepoName
+	}
+	if info.DefaultBranch != "" && !h.validBranchName(info.DefaultBranch) {
+		return "", ErrInvalidDefaultBranch
+	}
+	if strings.ContainsAny(info.Description, "\r\n") {
+		return "", ErrInvalidDescription
+	}
+
+	var template string
+	if info.Template != "" {
+		if !validRepoName(info.Template) {
+			return "", ErrTemplateNotFound
+		}
+		var err error
+		if template, err = h.storage.Dir(ctx, info.Template); err != nil || !isBareRepo(template) {
+			return "", ErrTemplateNotFound
+		}
+	}
+
+	dir, err := h.storage.Dir(ctx, info.Name)
+	if err == ErrRepoNotFound {
+		return "", ErrInvalidRepoName
+	}
+	if err != nil {
+		h.logger.Error("Locating repository failed", Field{"repo", info.Name}, Field{"error", err})
+		return "", err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return "", ErrRepoExists
+	}
+
+	// Repositories only show up once fully set up.
+	tmp, err := h.initHiddenRepo(dir)
+	if err == nil {
+		err = h.setupRepo(tmp, template, info)
+		if err == nil {
+			err = os.Rename(tmp, dir)
+		}
+		os.RemoveAll(tmp)
+	}
+	if err != nil {
+		h.logger.Error("Creating repository failed", Field{"repo", info.Name}, Field{"error", err})
+		return "", err
+	}
+	h.invalidateRepo(dir)
+
+	// The name is no longer the old name of another repository.
+	if err := h.redirects.remove(info.Name); err != nil {
+		h.logger.Error("Saving redirects failed", Field{"repo", info.Name}, Field{"error", err})
+	}
+
+	h.logger.Info("Repository created", Field{"repo", info.Name}, Field{"user", user})
+	return dir, nil
+}
+
+// setupRepo copies template, if any, to the new repository in dir, and sets
+// its default branch and description.
+func (h *handler) setupRepo(dir, template string, info repoInfo) error {
+	if template != "" {
+		if err := h.copyTemplate(template, dir); err != nil {
+			return err
+		}
+	}
+	if info.DefaultBranch != "" {
+		if err := h.setDefaultBranch(dir, info.DefaultBranch); err != nil {
+			return err
+		}
+	}
+	if info.Description != "" {
+		return setDescription(dir, info.Description)
+	}
+	return nil
+}
+
+// getRepo describes a bare repository.
+func (h *handler) getRepo(w http.ResponseWriter, req *http.Request, name string) {
+	dir, ok := h.locateRepo(w, req, name)
+	if !ok {
+		return
+	}
+
+	size, err := h.repoUsage(dir)
+	if err != nil {
+		h.logger.Error("Computing repository usage failed", Field{"repo", name}, Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to compute repository usage")
+		return
+	}
+
+	info := repoInfo{Name: name, Tenant: h.tenantName(name), DefaultBranch: defaultBranch(dir), Description: description(dir), Archived: isArchived(dir), Size: size}
+	info.ReadOnly, _ = readOnly(dir)
+	if h.quotas != nil {
+		info.Quota = h.quotas.limit(name)
+	}
+	if pool := h.poolOf(dir); pool != "" {
+		info.Pool = filepath.Base(pool)
+		if info.PoolSavings, err = h.poolSavings(pool); err != nil {
+			h.logger.Error("Computing object pool savings failed", Field{"repo", name}, Field{"pool", info.Pool}, Field{"error", err})
+		}
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// serveDefaultBranch returns or sets the branch HEAD of a bare repository
+// points to, which need not exist yet.
+func (h *handler) serveDefaultBranch(w http.ResponseWriter, req *http.Request, name string) {
+	if req.Method != "GET" && req.Method != "PUT" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	dir, ok := h.locateRepo(w, req, name)
+	if !ok {
+		return
+	}
+
+	if req.Method == "GET" {
+		writeJSON(w, http.StatusOK, repoInfo{Name: name, DefaultBranch: defaultBranch(dir)})
+		return
+	}
+
+	var info repoInfo
+	if err := json.NewDecoder(req.Body).Decode(&info); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if !h.validBranchName(info.DefaultBranch) {
+		writeError(w, http.StatusBadRequest, "invalid default branch")
+		return
+	}
+
+	if err := h.setDefaultBranch(dir, info.DefaultBranch); err != nil {
+		h.logger.Error("Setting default branch failed", Field{"repo", name}, Field{"branch", info.DefaultBranch}, Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to set default branch")
+		return
+	}
+
+	// Advertisements name the branch HEAD points to.
+	if h.refsCache != nil {
+		h.refsCache.invalidate(dir)
+	}
+
+	h.logger.Info("Default branch changed", Field{"repo", name}, Field{"branch", info.DefaultBranch}, Field{"user", remoteUser(req)})
+	writeJSON(w, http.StatusOK, repoInfo{Name: name, DefaultBranch: info.DefaultBranch})
+}
+
+// maintainRepoNow runs maintenance on a bare repository, responding once
+// done.
+func (h *handler) maintainRepoNow(w http.ResponseWriter, req *http.Request, name string) {
+	dir, ok := h.locateRepo(w, req, name)
+	if !ok {
+		return
+	}
+
+	h.logger.Info("Repository maintenance requested", Field{"repo", name}, Field{"user", remoteUser(req)})
+	switch err := h.maintainRepo(name, dir); {
+	case err == ErrMaintenanceRunning:
+		writeError(w, http.StatusConflict, "maintenance already running")
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, "maintenance failed")
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// syncMirrorNow syncs a mirror with its upstream, responding once done.
+func (h *handler) syncMirrorNow(w http.ResponseWriter, req *http.Request, name string) {
+	if !h.isMirror(name) {
+		writeError(w, http.StatusNotFound, "mirror not found")
+		return
+	}
+
+	h.logger.Info("Mirror sync requested", Field{"repo", name}, Field{"user", remoteUser(req)})
+	switch err := h.syncMirror(name); {
+	case err == errSyncRunning:
+		writeError(w, http.StatusConflict, "sync already running")
+	case err != nil:
+		writeError(w, http.StatusBadGateway, "sync failed")
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deleteRepo removes a bare repository, or moves it to the trash.
+func (h *handler) deleteRepo(w http.ResponseWriter, req *http.Request, name string) {
+	dir, ok := h.locateRepo(w, req, name)
+	if !ok || !h.checkNoForks(w, name, dir) {
+		return
+	}
+
+	switch err := h.removeRepo(req.Context(), name, dir, remoteUser(req)); {
+	case err == ErrRepoBusy:
+		writeError(w, http.StatusConflict, "repository is busy, try again later")
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, "unable to delete repository")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeRepo removes the repository name in dir, or moves it to the trash,
+// on behalf of user, once the operations running on it finish. Operations
+// starting meanwhile are rejected.
+func (h *handler) removeRepo(ctx context.Context, name, dir, user string) error {
+	idle := h.activity.drain(dir)
+	defer h.activity.undrain(dir)
+	if err := waitIdle(ctx, idle); err != nil {
+		return err
+	}
+
+	var err error
+	if h.trash != nil {
+		err = h.trashRepo(name, dir)
+	} else {
+		err = os.RemoveAll(dir)
+	}
+	if err != nil {
+		h.logger.Error("Deleting repository failed", Field{"repo", name}, Field{"error", err})
+		return err
+	}
+	h.invalidateRepo(dir)
+
+	h.logger.Info("Repository deleted", Field{"repo", name}, Field{"user", user})
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,186 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestAdminAPI(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	template, err := ioutil.TempDir(os.TempDir(), "gitd-template")
+	assert.Ok(t, err)
+	defer os.RemoveAll(template)
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(template, "description"), []byte("from template\n"), 0644))
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AdminAPI(), TemplateDir(template)))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/api/repos", "application/json", strings.NewReader(`{"name": "org/test.git"}`))
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusCreated, res.StatusCode)
+
+	desc, err := ioutil.ReadFile(filepath.Join(rpath, "org", "test.git", "description"))
+	assert.Ok(t, err)
+	assert.Equals(t, "from template\n", string(desc))
+
+	res, err = http.Post(ts.URL+"/api/repos", "application/json", strings.NewReader(`{"name": "org/test.git"}`))
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusConflict, res.StatusCode)
+
+	res, err = http.Post(ts.URL+"/api/repos", "application/json", strings.NewReader(`{"name": "../evil.git"}`))
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusBadRequest, res.StatusCode)
+
+	res, err = http.Get(ts.URL + "/api/repos")
+	assert.Ok(t, err)
+	var repos []repoInfo
+	assert.Ok(t, json.NewDecoder(res.Body).Decode(&repos))
+	res.Body.Close()
+	assert.Equals(t, []repoInfo{{Name: "org/test.git"}}, repos)
+
+	req, err := http.NewRequest("DELETE", ts.URL+"/api/repos/org/test.git", nil)
+	assert.Ok(t, err)
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusNoContent, res.StatusCode)
+
+	_, err = os.Stat(filepath.Join(rpath, "org", "test.git"))
+	assert.Cond(t, os.IsNotExist(err), "repository should have been deleted")
+
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestAdminRepoMetadata(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "template.git")
+
+	template := filepath.Join(rpath, "template.git")
+	git(t, template, "config", "receive.denyDeletes", "true")
+	git(t, template, "config", "remote.origin.url", "https://example.com/template.git")
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(template, "hooks", "pre-receive"), []byte("#!/bin/sh\nexit 0\n"), 0755))
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AdminAPI()))
+	defer ts.Close()
+
+	create := func(body string) (int, repoInfo) {
+		res, err := http.Post(ts.URL+"/api/repos", "application/json", strings.NewReader(body))
+		assert.Ok(t, err)
+		defer res.Body.Close()
+
+		var info repoInfo
+		if res.StatusCode == http.StatusCreated {
+			assert.Ok(t, json.NewDecoder(res.Body).Decode(&info))
+		}
+		return res.StatusCode, info
+	}
+
+	status, info := create(`{"name": "test.git", "default_branch": "main", "description": "A test repository", "template": "template.git"}`)
+	assert.Equals(t, http.StatusCreated, status)
+	assert.Equals(t, "main", info.DefaultBranch)
+
+	dir := filepath.Join(rpath, "test.git")
+	assert.Equals(t, "true", gitOutput(t, dir, "config", "receive.denyDeletes"))
+	assert.Equals(t, "true", gitOutput(t, dir, "config", "core.bare"))
+	cmd := exec.Command("git", "config", "remote.origin.url")
+	cmd.Dir = dir
+	assert.Cond(t, cmd.Run() != nil, "remotes should not be copied from templates")
+	fi, err := os.Stat(filepath.Join(dir, "hooks", "pre-receive"))
+	assert.Ok(t, err)
+	assert.Equals(t, os.FileMode(0755), fi.Mode().Perm())
+
+	res, err := http.Get(ts.URL + "/api/repos/test.git")
+	assert.Ok(t, err)
+	assert.Ok(t, json.NewDecoder(res.Body).Decode(&info))
+	res.Body.Close()
+	assert.Equals(t, "main", info.DefaultBranch)
+	assert.Equals(t, "A test repository", info.Description)
+
+	for _, body := range []string{
+		`{"name": "bad.git", "default_branch": "a..b"}`,
+		`{"name": "bad.git", "template": "missing.git"}`,
+		`{"name": "bad.git", "description": "two\nlines"}`,
+	} {
+		status, _ = create(body)
+		assert.Equals(t, http.StatusBadRequest, status)
+	}
+	_, err = os.Stat(filepath.Join(rpath, "bad.git"))
+	assert.Cond(t, os.IsNotExist(err), "invalid repositories should not be created")
+}
+
+func TestAdminDefaultBranch(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AdminAPI(), DefaultBranch("trunk")))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/api/repos", "application/json", strings.NewReader(`{"name": "org/test.git"}`))
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusCreated, res.StatusCode)
+
+	branch := func(method, body string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+"/api/repos/org/test.git/default_branch", strings.NewReader(body))
+		assert.Ok(t, err)
+		res, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		defer res.Body.Close()
+
+		var info repoInfo
+		json.NewDecoder(res.Body).Decode(&info)
+		return res.StatusCode, info.DefaultBranch
+	}
+
+	status, name := branch("GET", "")
+	assert.Equals(t, http.StatusOK, status)
+	assert.Equals(t, "trunk", name)
+
+	status, name = branch("PUT", `{"default_branch": "main"}`)
+	assert.Equals(t, http.StatusOK, status)
+	assert.Equals(t, "main", name)
+	assert.Equals(t, "refs/heads/main", gitOutput(t, filepath.Join(rpath, "org", "test.git"), "symbolic-ref", "HEAD"))
+
+	status, _ = branch("PUT", `{"default_branch": "a..b"}`)
+	assert.Equals(t, http.StatusBadRequest, status)
+	status, _ = branch("DELETE", "")
+	assert.Equals(t, http.StatusMethodNotAllowed, status)
+
+	// Repositories created by pushes get the default branch too.
+	auto := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AutoInitRepos(true), DefaultBranch("trunk")))
+	defer auto.Close()
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/org/test.git", clone, "blah")
+	git(t, clone, "push", "-q", auto.URL+"/new.git", "HEAD:refs/heads/main")
+	assert.Equals(t, "refs/heads/trunk", gitOutput(t, filepath.Join(rpath, "new.git"), "symbolic-ref", "HEAD"))
+}
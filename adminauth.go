@@ -0,0 +1,54 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"net/http"
+)
+
+// adminIdentity is the identity of admin API clients authenticated by
+// AdminToken.
+const adminIdentity = "admin"
+
+// AdminAuth authenticates admin API requests with a, in place of the
+// authenticator checking Git requests, so credentials granting fetch or push
+// access grant no access to the admin API, such as creating repositories.
+// Admin requests still go through the authorization callback, with the
+// identity a authenticated them as.
+func AdminAuth(a Authenticator) Option {
+	return func(h *handler) {
+		h.adminAuth = a
+	}
+}
+
+// AdminToken requires admin API clients to send an "Authorization: Bearer
+// <token>" header with token, authenticating them as "admin".
+func AdminToken(token string) Option {
+	return AdminAuth(&bearerAuth{validate: func(t string) (string, bool) {
+		ok := token != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1
+		return adminIdentity, ok
+	}})
+}
+
+// AdminClientCertAuth authenticates admin API clients by the TLS certificate
+// they present, as ClientCertAuth does Git clients, so admin API access can
+// be restricted to certificates issued to operators.
+func AdminClientCertAuth(identity func(cert *x509.Certificate) (string, bool)) Option {
+	if identity == nil {
+		identity = certIdentity
+	}
+	return AdminAuth(&clientCertAuth{identity: identity})
+}
+
+// authenticateAdmin authenticates an admin API request for repo, if any,
+// as authenticate does Git requests.
+func (h *handler) authenticateAdmin(w http.ResponseWriter, req *http.Request, repo string) (*http.Request, bool) {
+	if h.adminAuth != nil {
+		return h.authenticateWith(h.adminAuth, w, req, repo, Admin)
+	}
+	return h.authenticate(w, req, repo, Admin)
+}
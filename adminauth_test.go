@@ -0,0 +1,79 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestAdminToken(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	var adminUsers []string
+	authorize := func(user, repo string, op Operation) bool {
+		if op == Admin {
+			adminUsers = append(adminUsers, user)
+		}
+		return true
+	}
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		AdminAPI(),
+		BasicAuth("gitd", func(user, pass string) bool {
+			return user == "alice" && pass == "secret"
+		}),
+		AdminToken("t0ken"),
+		AuthorizeRepo(authorize),
+	))
+	defer ts.Close()
+
+	create := func(auth func(req *http.Request)) *http.Response {
+		req, err := http.NewRequest("POST", ts.URL+"/api/repos", strings.NewReader(`{"name": "test.git"}`))
+		assert.Ok(t, err)
+		auth(req)
+		res, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	// Git credentials grant no access to the admin API.
+	res := create(func(req *http.Request) { req.SetBasicAuth("alice", "secret") })
+	assert.Equals(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Equals(t, "Bearer", res.Header.Get("WWW-Authenticate"))
+
+	res = create(func(req *http.Request) { req.Header.Set("Authorization", "Bearer wrong") })
+	assert.Equals(t, http.StatusUnauthorized, res.StatusCode)
+
+	res = create(func(req *http.Request) { req.Header.Set("Authorization", "Bearer t0ken") })
+	assert.Equals(t, http.StatusCreated, res.StatusCode)
+	assert.Equals(t, []string{"admin"}, adminUsers)
+
+	// Nor does the admin token grant access to repositories.
+	req, err := http.NewRequest("GET", ts.URL+"/test.git/info/refs?service=git-upload-pack", nil)
+	assert.Ok(t, err)
+	req.Header.Set("Authorization", "Bearer t0ken")
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusUnauthorized, res.StatusCode)
+
+	req.Header.Del("Authorization")
+	req.SetBasicAuth("alice", "secret")
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+}
@@ -0,0 +1,105 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// archivePath matches archive downloads after the repository path,
+// capturing the ref and format.
+const archivePath = `/archive/(?P<ref>.+)\.(?P<format>tar\.gz|zip)`
+
+// archiveTypes maps archive formats to their content type.
+var archiveTypes = map[string]string{
+	"tar.gz": "application/gzip",
+	"zip":    "application/zip",
+}
+
+// Archives serves snapshots of repositories made by git archive at
+// /{repo}/archive/{ref}.tar.gz and /{repo}/archive/{ref}.zip, so build
+// systems can download them without cloning. Responses have the commit the
+// ref resolved to as ETag.
+func Archives(enabled bool) Option {
+	return func(h *handler) {
+		h.archives = enabled
+	}
+}
+
+// archive serves an archive of a ref of repo.
+func (h *handler) archive(w http.ResponseWriter, req *http.Request, repo *repository) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method Not Allowed"))
+		return
+	}
+
+	params := PathParams(req.Context())
+	ref, format := params["ref"], params["format"]
+	if namespaced(repo.env) || strings.HasPrefix(ref, "-") || h.revHidden(req.Context(), repo, ref) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return
+	}
+
+	cwd := repo.dir
+	cmd := h.gitCommandContext(req.Context(), cwd, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	cmd.Env = append(os.Environ(), repo.env...)
+	out, _, err := runAndLog(h.logger, cmd)
+	commit := strings.TrimSpace(out)
+	if err != nil || commit == "" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return
+	}
+
+	etag := fmt.Sprintf(`"%s.%s"`, commit, format)
+	headers := w.Header()
+	headers.Set("ETag", etag)
+	if ref == commit {
+		cacheForever(w)
+	} else {
+		noCache(w)
+	}
+
+	if match := req.Header.Get("If-None-Match"); match == etag || match == "*" {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	prefix := archivePrefix(repo.name, ref)
+	headers.Set("Content-Type", archiveTypes[format])
+	headers.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, prefix, format))
+	if req.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	cmd = h.gitCommandContext(req.Context(), cwd, "archive", "--format="+format, "--prefix="+prefix+"/", commit)
+	cmd.Env = append(os.Environ(), repo.env...)
+	h.execute(w, req, strings.NewReader(""), cmd, repo.name, nil)
+}
+
+// archivePrefix returns the directory files of archives are under, and the
+// name of archive files, made of the names of the repository and ref.
+func archivePrefix(repo, ref string) string {
+	return safeFileName(strings.TrimSuffix(path.Base(repo), ".git") + "-" + ref)
+}
+
+// safeFileName replaces the characters of name that are not safe in file
+// names, nor in headers, with dashes.
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '-'
+	}, name)
+}
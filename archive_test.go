@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestArchives(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), Archives(true)))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "origin", "master:feature/x")
+	commit := gitOutput(t, clone, "rev-parse", "HEAD")
+
+	res, err := http.Get(ts.URL + "/test.git/archive/feature/x.tar.gz")
+	assert.Ok(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Ok(t, err)
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+	assert.Equals(t, "application/gzip", res.Header.Get("Content-Type"))
+	assert.Equals(t, `attachment; filename="test-feature-x.tar.gz"`, res.Header.Get("Content-Disposition"))
+	etag := res.Header.Get("ETag")
+	assert.Equals(t, `"`+commit+`.tar.gz"`, etag)
+
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	assert.Ok(t, err)
+	tr := tar.NewReader(zr)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		content, err := ioutil.ReadAll(tr)
+		assert.Ok(t, err)
+		files[hdr.Name] = string(content)
+	}
+	assert.Equals(t, "blah", files["test-feature-x/README.md"])
+
+	req, err := http.NewRequest("GET", ts.URL+"/test.git/archive/feature/x.tar.gz", nil)
+	assert.Ok(t, err)
+	req.Header.Set("If-None-Match", etag)
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusNotModified, res.StatusCode)
+
+	res, err = http.Get(ts.URL + "/test.git/archive/" + commit + ".zip")
+	assert.Ok(t, err)
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Ok(t, err)
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+	assert.Equals(t, "application/zip", res.Header.Get("Content-Type"))
+	zipped, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	assert.Ok(t, err)
+	assert.Equals(t, "test-"+commit+"/README.md", zipped.File[len(zipped.File)-1].Name)
+
+	for _, p := range []string{"/test.git/archive/missing.zip", "/test.git/archive/--output=x.zip", "/missing.git/archive/master.zip"} {
+		res, err = http.Get(ts.URL + p)
+		assert.Ok(t, err)
+		res.Body.Close()
+		assert.Equals(t, http.StatusNotFound, res.StatusCode)
+	}
+}
@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// archivedFile marks repositories as archived.
+const archivedFile = ".archived"
+
+// isArchived returns whether the repository in dir is archived.
+func isArchived(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, archivedFile))
+	return err == nil
+}
+
+// pushBlocked returns why pushes to repo are not accepted, if they are not.
+func (h *handler) pushBlocked(repo *repository) error {
+	if enabled, reason := h.readOnly.get(); enabled {
+		return readOnlyError("server", reason)
+	}
+	if isArchived(repo.dir) {
+		return fmt.Errorf("repository %s is archived and read-only", repo.name)
+	}
+	if enabled, reason := readOnly(repo.dir); enabled {
+		return readOnlyError("repository "+repo.name, reason)
+	}
+	return nil
+}
+
+// advertisePushBlocked answers the ref advertisement of a push blocked for
+// reason with an error, which Git clients show before sending anything.
+func advertisePushBlocked(w http.ResponseWriter, reason error) {
+	w.WriteHeader(http.StatusOK)
+	w.Write(packetWrite("# service=git-receive-pack\n"))
+	w.Write(packetFlush())
+	w.Write(packetWrite("ERR " + reason.Error() + "\n"))
+}
+
+// archiveRepo archives a bare repository, making it read-only and hiding it
+// from listings, or restores it.
+func (h *handler) archiveRepo(w http.ResponseWriter, req *http.Request, name string, archive bool) {
+	dir, ok := h.locateRepo(w, req, name)
+	if !ok {
+		return
+	}
+
+	var err error
+	if archive {
+		err = ioutil.WriteFile(filepath.Join(dir, archivedFile), []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644)
+	} else if err = os.Remove(filepath.Join(dir, archivedFile)); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		h.logger.Error("Archiving repository failed", Field{"repo", name}, Field{"archive", archive}, Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to archive repository")
+		return
+	}
+
+	if archive {
+		h.logger.Info("Repository archived", Field{"repo", name}, Field{"user", remoteUser(req)})
+	} else {
+		h.logger.Info("Repository restored", Field{"repo", name}, Field{"user", remoteUser(req)})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
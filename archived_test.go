@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestArchiveRepo(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+	initBareRepo(t, rpath, "other.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AdminAPI()))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "-q", "origin", "master")
+
+	post := func(p string) int {
+		res, err := http.Post(ts.URL+p, "application/json", nil)
+		assert.Ok(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	list := func(query string) []repoInfo {
+		res, err := http.Get(ts.URL + "/api/repos" + query)
+		assert.Ok(t, err)
+		defer res.Body.Close()
+		var repos []repoInfo
+		assert.Ok(t, json.NewDecoder(res.Body).Decode(&repos))
+		return repos
+	}
+
+	assert.Equals(t, http.StatusNoContent, post("/api/repos/test.git/archive"))
+	assert.Equals(t, []repoInfo{{Name: "other.git"}}, list(""))
+	assert.Equals(t, []repoInfo{{Name: "other.git"}, {Name: "test.git", Archived: true}}, list("?archived=true"))
+
+	// Archived repositories can still be fetched, but not pushed to.
+	git(t, workspace, "clone", "-q", ts.URL+"/test.git", filepath.Join(workspace, "fetched"))
+	git(t, clone, "commit", "--allow-empty", "-qm", "second")
+	cmd := exec.Command("git", "push", "origin", "master")
+	cmd.Dir = clone
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "pushes to archived repositories should fail")
+	assert.Cond(t, strings.Contains(string(out), "repository test.git is archived and read-only"), "unexpected push output: %s", out)
+
+	assert.Equals(t, http.StatusNoContent, post("/api/repos/test.git/restore"))
+	assert.Equals(t, 2, len(list("")))
+	git(t, clone, "push", "-q", "origin", "master")
+
+	assert.Equals(t, http.StatusNotFound, post("/api/repos/missing.git/archive"))
+}
+
+func TestPushBlockedReport(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(rpath, "test.git", archivedFile), nil, 0644))
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath)))
+	defer ts.Close()
+
+	// Clients skipping the ref advertisement get their updates rejected.
+	var body []byte
+	body = append(body, packetWrite(strings.Repeat("0", 40)+" "+strings.Repeat("1", 40)+" refs/heads/master\x00report-status side-band-64k\n")...)
+	body = append(body, packetFlush()...)
+	res, err := http.Post(ts.URL+"/test.git/git-receive-pack", "application/x-git-receive-pack-request", strings.NewReader(string(body)))
+	assert.Ok(t, err)
+	defer res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+	out, err := ioutil.ReadAll(res.Body)
+	assert.Ok(t, err)
+	assert.Cond(t, strings.Contains(string(out), "ng refs/heads/master repository test.git is archived and read-only"), "unexpected report: %q", out)
+}
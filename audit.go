@@ -0,0 +1,139 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Audit results.
+const (
+	AuditSuccess  = "success"
+	AuditFailure  = "failure"
+	AuditRejected = "rejected"
+)
+
+// AuditEvent records a fetch or push.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Identity  string    `json:"identity,omitempty"`
+	RemoteIP  string    `json:"remote_ip,omitempty"`
+	Transport string    `json:"transport"`
+	Repo      string    `json:"repo"`
+	Operation string    `json:"operation"`
+	// Refs are the ref updates a push requested. They were all applied
+	// only if Result is AuditSuccess.
+	Refs          []RefUpdate `json:"refs,omitempty"`
+	BytesSent     int64       `json:"bytes_sent"`
+	BytesReceived int64       `json:"bytes_received"`
+	Result        string      `json:"result"`
+	Error         string      `json:"error,omitempty"`
+	// Tenant is the tenant the repository belongs to, if any.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// AuditSink receives audit events, shipping them to a file, syslog or a
+// message queue. Sinks are called synchronously as operations finish, by
+// concurrent operations.
+type AuditSink interface {
+	Record(e AuditEvent) error
+}
+
+// AuditLog records every fetch and push, whichever the transport, in sink.
+func AuditLog(sink AuditSink) Option {
+	return func(h *handler) {
+		h.audit = sink
+	}
+}
+
+// JSONAuditSink returns an AuditSink appending events to w as JSON, one per
+// line.
+func JSONAuditSink(w io.Writer) AuditSink {
+	return &jsonAuditSink{w: w}
+}
+
+type jsonAuditSink struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (s *jsonAuditSink) Record(e AuditEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// newAuditEvent returns the event recording op on repo, as requested by req.
+func newAuditEvent(req *http.Request, repo string, op Operation) *AuditEvent {
+	return &AuditEvent{
+		Time:      time.Now().UTC(),
+		Identity:  remoteUser(req),
+		RemoteIP:  remoteIP(req.RemoteAddr),
+		Transport: requestTransport(req),
+		Repo:      repo,
+		Operation: op.String(),
+	}
+}
+
+// requestTransport returns the transport req came over.
+func requestTransport(req *http.Request) string {
+	if req.URL.Scheme != "" {
+		return req.URL.Scheme
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// recordAudit records e, with the result of the operation given by err
+// unless already set.
+func (h *handler) recordAudit(e *AuditEvent, err error) {
+	if e.Result == "" {
+		e.Result = AuditSuccess
+		if err != nil {
+			e.Result = AuditFailure
+		}
+	}
+	if err != nil && e.Error == "" {
+		e.Error = err.Error()
+	}
+	if e.Tenant == "" {
+		e.Tenant = h.tenantName(e.Repo)
+	}
+
+	if err := h.audit.Record(*e); err != nil {
+		h.logger.Error("Recording audit event failed", Field{"repo", e.Repo}, Field{"error", err})
+	}
+}
+
+// countingResponseWriter counts the bytes of the response body.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Flush flushes the underlying writer, if it supports it.
+func (c *countingResponseWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,133 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// recordingSink keeps audit events in memory so tests can inspect them.
+type recordingSink struct {
+	sync.Mutex
+	events []AuditEvent
+}
+
+func (s *recordingSink) Record(e AuditEvent) error {
+	s.Lock()
+	defer s.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) last(op string) (AuditEvent, bool) {
+	s.Lock()
+	defer s.Unlock()
+	for i := len(s.events) - 1; i >= 0; i-- {
+		if s.events[i].Operation == op {
+			return s.events[i], true
+		}
+	}
+	return AuditEvent{}, false
+}
+
+func TestAuditLog(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	sink := new(recordingSink)
+	reject := false
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		AuditLog(sink),
+		BasicAuth("git", func(user, pass string) bool { return pass == "secret" }),
+		PreReceive(func(r *http.Request, repo string, updates []RefUpdate) error {
+			if reject {
+				return errors.New("frozen")
+			}
+			return nil
+		}),
+	))
+	defer ts.Close()
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	url := strings.Replace(ts.URL, "http://", "http://alice:secret@", 1) + "/test.git"
+	dir := filepath.Join(workspace, "test")
+	cloneAndCommit(t, url, dir, "hello")
+
+	cmd := exec.Command("git", "push", "origin", "master")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err == nil, "push failed: %s", out)
+
+	e, ok := sink.last("push")
+	assert.Cond(t, ok, "push was not audited")
+	assert.Equals(t, AuditSuccess, e.Result)
+	assert.Equals(t, "alice", e.Identity)
+	assert.Equals(t, "127.0.0.1", e.RemoteIP)
+	assert.Equals(t, "http", e.Transport)
+	assert.Equals(t, "test.git", e.Repo)
+	assert.Equals(t, 1, len(e.Refs))
+	assert.Equals(t, "refs/heads/master", e.Refs[0].Name)
+	assert.Cond(t, e.BytesReceived > 0, "received bytes should be recorded")
+	assert.Cond(t, time.Since(e.Time) < time.Minute, "unexpected time %v", e.Time)
+
+	cmd = exec.Command("git", "clone", url, "copy")
+	cmd.Dir = workspace
+	out, err = cmd.CombinedOutput()
+	assert.Cond(t, err == nil, "clone failed: %s", out)
+
+	e, ok = sink.last("fetch")
+	assert.Cond(t, ok, "fetch was not audited")
+	assert.Equals(t, AuditSuccess, e.Result)
+	assert.Equals(t, "alice", e.Identity)
+	assert.Cond(t, e.BytesSent > 0, "sent bytes should be recorded")
+
+	reject = true
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("bye"), 0644))
+	git(t, dir, "commit", "-qam", "bye")
+	cmd = exec.Command("git", "push", "origin", "master")
+	cmd.Dir = dir
+	_, err = cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "push should have been rejected")
+
+	e, ok = sink.last("push")
+	assert.Cond(t, ok, "rejected push was not audited")
+	assert.Equals(t, AuditRejected, e.Result)
+	assert.Equals(t, "frozen", e.Error)
+}
+
+func TestJSONAuditSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := JSONAuditSink(&buf)
+	assert.Ok(t, sink.Record(AuditEvent{Repo: "a.git", Operation: "fetch", Result: AuditSuccess}))
+	assert.Ok(t, sink.Record(AuditEvent{Repo: "b.git", Operation: "push", Result: AuditFailure, Error: "boom"}))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equals(t, 2, len(lines))
+
+	var e AuditEvent
+	assert.Ok(t, json.Unmarshal([]byte(lines[1]), &e))
+	assert.Equals(t, "b.git", e.Repo)
+	assert.Equals(t, "boom", e.Error)
+}
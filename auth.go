@@ -0,0 +1,307 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Operation identifies the kind of Git operation a client is attempting.
+type Operation int
+
+const (
+	// Fetch covers clones, fetches and pulls, served by git-upload-pack.
+	Fetch Operation = iota
+	// Push covers pushes, served by git-receive-pack.
+	Push
+	// Admin covers repository management through the admin API.
+	Admin
+)
+
+func (op Operation) String() string {
+	switch op {
+	case Fetch:
+		return "fetch"
+	case Push:
+		return "push"
+	case Admin:
+		return "admin"
+	}
+	return "unknown"
+}
+
+// Authenticator verifies the credentials of a request before any Git process
+// is started. Returning a non-nil error rejects the request with 401.
+type Authenticator interface {
+	Authenticate(r *http.Request, repo string, op Operation) error
+}
+
+// AuthenticatorFunc allows ordinary functions to be used as authenticators.
+type AuthenticatorFunc func(r *http.Request, repo string, op Operation) error
+
+// Authenticate calls f(r, repo, op).
+func (f AuthenticatorFunc) Authenticate(r *http.Request, repo string, op Operation) error {
+	return f(r, repo, op)
+}
+
+// Authenticate sets the authenticator used to check every Git request.
+func Authenticate(a Authenticator) Option {
+	return func(h *handler) {
+		h.authenticator = a
+	}
+}
+
+// BasicAuth requires clients to authenticate using HTTP Basic Authentication,
+// challenging them with the given realm so Git prompts for credentials.
+// It replaces any authenticator previously set.
+func BasicAuth(realm string, validate func(user, pass string) bool) Option {
+	return Authenticate(&basicAuth{realm: realm, validate: validate})
+}
+
+// basicAuth implements Authenticator using HTTP Basic Authentication.
+type basicAuth struct {
+	realm    string
+	validate func(user, pass string) bool
+}
+
+func (a *basicAuth) Authenticate(r *http.Request, repo string, op Operation) error {
+	_, err := a.identify(r, repo, op)
+	return err
+}
+
+func (a *basicAuth) identify(r *http.Request, repo string, op Operation) (string, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", &challengeError{scheme: "Basic", realm: a.realm, msg: "missing credentials"}
+	}
+
+	if !a.validate(user, pass) {
+		return "", &challengeError{scheme: "Basic", realm: a.realm, msg: "invalid credentials for " + user}
+	}
+	return user, nil
+}
+
+// BearerAuth requires clients to send an "Authorization: Bearer <token>"
+// header. Validate returns the identity the token belongs to, which is made
+// available to authorization callbacks and through IdentityFromContext.
+// It replaces any authenticator previously set.
+func BearerAuth(validate func(token string) (identity string, ok bool)) Option {
+	return Authenticate(&bearerAuth{validate: validate})
+}
+
+// bearerAuth implements Authenticator using bearer tokens.
+type bearerAuth struct {
+	validate func(token string) (string, bool)
+}
+
+func (a *bearerAuth) Authenticate(r *http.Request, repo string, op Operation) error {
+	_, err := a.identify(r, repo, op)
+	return err
+}
+
+func (a *bearerAuth) identify(r *http.Request, repo string, op Operation) (string, error) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", &challengeError{scheme: "Bearer", msg: "missing bearer token"}
+	}
+
+	identity, ok := a.validate(strings.TrimSpace(header[len(prefix):]))
+	if !ok {
+		return "", &challengeError{scheme: "Bearer", msg: "invalid bearer token"}
+	}
+	return identity, nil
+}
+
+// ClientCertAuth authenticates clients by the TLS certificate they present,
+// which the server must have verified, e.g. by requiring client certificates
+// signed by a trusted CA. Identity maps the certificate to the identity made
+// available to authorization callbacks; if nil, the subject's common name is
+// used, falling back to the first email address or DNS name in the
+// certificate's subject alternative names. It replaces any authenticator
+// previously set.
+func ClientCertAuth(identity func(cert *x509.Certificate) (string, bool)) Option {
+	if identity == nil {
+		identity = certIdentity
+	}
+	return Authenticate(&clientCertAuth{identity: identity})
+}
+
+// clientCertAuth implements Authenticator using TLS client certificates.
+type clientCertAuth struct {
+	identity func(cert *x509.Certificate) (string, bool)
+}
+
+func (a *clientCertAuth) Authenticate(r *http.Request, repo string, op Operation) error {
+	_, err := a.identify(r, repo, op)
+	return err
+}
+
+func (a *clientCertAuth) identify(r *http.Request, repo string, op Operation) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return "", errors.New("missing verified client certificate")
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+	identity, ok := a.identity(cert)
+	if !ok {
+		return "", fmt.Errorf("client certificate %q is not allowed", cert.Subject.CommonName)
+	}
+	return identity, nil
+}
+
+// certIdentity returns the identity a client certificate is issued to.
+func certIdentity(cert *x509.Certificate) (string, bool) {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName, true
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0], true
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0], true
+	}
+	return "", false
+}
+
+// identifier is implemented by authenticators that also know who the
+// request was authenticated as.
+type identifier interface {
+	identify(r *http.Request, repo string, op Operation) (string, error)
+}
+
+// challengeError is returned by authenticators wanting the client to be
+// challenged through the WWW-Authenticate header.
+type challengeError struct {
+	scheme string
+	realm  string
+	msg    string
+}
+
+func (e *challengeError) Error() string {
+	return e.msg
+}
+
+func (e *challengeError) challenge() string {
+	if e.realm == "" {
+		return e.scheme
+	}
+	return fmt.Sprintf("%s realm=%q", e.scheme, e.realm)
+}
+
+// identityKey is the context key under which the authenticated identity
+// is stored.
+type identityKey struct{}
+
+// IdentityFromContext returns the identity a request was authenticated as.
+// Handlers and callbacks receiving the request's context can use it to
+// learn who is pushing or fetching.
+func IdentityFromContext(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(identityKey{}).(string)
+	return identity, ok
+}
+
+// AuthorizeRepo sets a callback deciding whether user may perform op on repo.
+// User is the authenticated identity or, without an authenticator, the
+// username sent by the client, if any. Denied requests get a 403
+// along with a Git error packet so clients display a meaningful message.
+func AuthorizeRepo(fn func(user, repo string, op Operation) bool) Option {
+	return func(h *handler) {
+		h.authorize = fn
+	}
+}
+
+// operation returns the Git operation requested. Ref advertisements for
+// git-receive-pack are considered pushes so that clients are challenged
+// before sending any data, the same as git-http-backend does.
+func operation(req *http.Request) Operation {
+	if strings.HasSuffix(req.URL.Path, "/git-receive-pack") ||
+		req.URL.Query().Get("service") == "git-receive-pack" {
+		return Push
+	}
+	return Fetch
+}
+
+// authenticate runs the configured authenticator, if any, and writes a 401
+// response when the request is rejected. On success, it returns the request
+// with the authenticated identity stored in its context.
+func (h *handler) authenticate(w http.ResponseWriter, req *http.Request, repo string, op Operation) (*http.Request, bool) {
+	return h.authenticateWith(h.authenticator, w, req, repo, op)
+}
+
+// authenticateWith authenticates req with a, as authenticate does.
+func (h *handler) authenticateWith(a Authenticator, w http.ResponseWriter, req *http.Request, repo string, op Operation) (*http.Request, bool) {
+	if a == nil {
+		return req, true
+	}
+
+	identity := remoteUser(req)
+
+	var err error
+	if id, ok := a.(identifier); ok {
+		identity, err = id.identify(req, repo, op)
+	} else {
+		err = a.Authenticate(req, repo, op)
+	}
+
+	if err != nil {
+		h.logger.Info("Authentication failed", Field{"repo", repo}, Field{"operation", op}, Field{"error", err})
+		if c, ok := err.(*challengeError); ok {
+			if t := h.tenantOf(repo); t != nil && t.Realm != "" {
+				tc := *c
+				tc.realm = t.Realm
+				c = &tc
+			}
+			w.Header().Set("WWW-Authenticate", c.challenge())
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized"))
+		return req, false
+	}
+
+	ctx := context.WithValue(req.Context(), identityKey{}, identity)
+	return req.WithContext(ctx), true
+}
+
+// authorizeRepo runs the configured authorization callback, if any, and writes
+// a 403 response when the request is denied.
+func (h *handler) authorizeRepo(w http.ResponseWriter, req *http.Request, repo string, op Operation) bool {
+	if h.authorize == nil {
+		return true
+	}
+
+	user := remoteUser(req)
+	if h.authorize(user, repo, op) {
+		return true
+	}
+
+	h.logger.Info("Authorization denied", Field{"repo", repo}, Field{"operation", op}, Field{"user", user})
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(packetWrite(fmt.Sprintf("ERR %s access denied to %s\n", op, repo)))
+	return false
+}
+
+// requestLogger returns the logger for req, which adds the identity of the
+// user making it to every entry.
+func (h *handler) requestLogger(req *http.Request) Logger {
+	if user := remoteUser(req); user != "" {
+		return fieldLogger{h.logger, []Field{{"user", user}}}
+	}
+	return h.logger
+}
+
+// remoteUser returns the name of the user making the request, the same as
+// REMOTE_USER would be for a CGI script.
+func remoteUser(req *http.Request) string {
+	if identity, ok := IdentityFromContext(req.Context()); ok {
+		return identity
+	}
+	user, _, _ := req.BasicAuth()
+	return user
+}
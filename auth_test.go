@@ -0,0 +1,212 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestAuthenticate(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	initBareRepo(t, rpath, "test.git")
+
+	var gotRepo string
+	auth := AuthenticatorFunc(func(r *http.Request, repo string, op Operation) error {
+		gotRepo = repo
+		if op == Push {
+			return errors.New("pushes are not allowed")
+		}
+		return nil
+	})
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), Authenticate(auth)))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+	assert.Equals(t, "test.git", gotRepo)
+
+	res, err = http.Get(ts.URL + "/test.git/info/refs?service=git-receive-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusUnauthorized, res.StatusCode)
+
+	res, err = http.Post(ts.URL+"/test.git/git-receive-pack", "application/x-git-receive-pack-request", nil)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusUnauthorized, res.StatusCode)
+}
+
+func TestAuthorizeRepo(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	initBareRepo(t, rpath, "test.git")
+
+	authorize := func(user, repo string, op Operation) bool {
+		return op == Fetch || (user == "alice" && repo == "test.git")
+	}
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AuthorizeRepo(authorize)))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+
+	req, err := http.NewRequest("GET", ts.URL+"/test.git/info/refs?service=git-receive-pack", nil)
+	assert.Ok(t, err)
+	req.SetBasicAuth("bob", "secret")
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Ok(t, err)
+	assert.Equals(t, http.StatusForbidden, res.StatusCode)
+	assert.Equals(t, "0027ERR push access denied to test.git\n", string(body))
+
+	req.SetBasicAuth("alice", "secret")
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+}
+
+func TestBasicAuth(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	initBareRepo(t, rpath, "test.git")
+
+	validate := func(user, pass string) bool {
+		return user == "alice" && pass == "secret"
+	}
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), BasicAuth("gitd", validate)))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Equals(t, `Basic realm="gitd"`, res.Header.Get("WWW-Authenticate"))
+
+	req, err := http.NewRequest("GET", ts.URL+"/test.git/info/refs?service=git-upload-pack", nil)
+	assert.Ok(t, err)
+	req.SetBasicAuth("alice", "wrong")
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusUnauthorized, res.StatusCode)
+
+	req.SetBasicAuth("alice", "secret")
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+}
+
+func TestBearerAuth(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	initBareRepo(t, rpath, "test.git")
+
+	validate := func(token string) (string, bool) {
+		return "ci-bot", token == "s3cr3t"
+	}
+
+	var gotUser string
+	authorize := func(user, repo string, op Operation) bool {
+		gotUser = user
+		return true
+	}
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), BearerAuth(validate), AuthorizeRepo(authorize)))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/test.git/info/refs?service=git-receive-pack", nil)
+	assert.Ok(t, err)
+	res, err := http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Equals(t, "Bearer", res.Header.Get("WWW-Authenticate"))
+
+	req.Header.Set("Authorization", "Bearer wrong")
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusUnauthorized, res.StatusCode)
+
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+	assert.Equals(t, "ci-bot", gotUser)
+}
+
+func TestClientCertAuth(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	initBareRepo(t, rpath, "test.git")
+
+	var gotUser string
+	authorize := func(user, repo string, op Operation) bool {
+		gotUser = user
+		return user != "mallory@example.com"
+	}
+	handler := Handler(http.NotFoundHandler(), ReposPath(rpath), ClientCertAuth(nil), AuthorizeRepo(authorize))
+
+	tests := []struct {
+		cert   *x509.Certificate
+		user   string
+		status int
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "ci-runner"}}, "ci-runner", http.StatusOK},
+		{&x509.Certificate{EmailAddresses: []string{"alice@example.com"}}, "alice@example.com", http.StatusOK},
+		{&x509.Certificate{EmailAddresses: []string{"mallory@example.com"}}, "mallory@example.com", http.StatusForbidden},
+		{&x509.Certificate{}, "", http.StatusUnauthorized},
+		{nil, "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		gotUser = ""
+		req := httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack", nil)
+		if tt.cert != nil {
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{tt.cert},
+				VerifiedChains:   [][]*x509.Certificate{{tt.cert}},
+			}
+		}
+
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		assert.Equals(t, tt.status, res.Code)
+		assert.Equals(t, tt.user, gotUser)
+	}
+}
@@ -0,0 +1,176 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+// BackendKind identifies the implementation serving Git's transport services.
+type BackendKind int
+
+const (
+	// GitBinary runs git-upload-pack and git-receive-pack as subprocesses.
+	// It is the default.
+	GitBinary BackendKind = iota
+	// GoGit serves upload-pack and receive-pack in-process using go-git,
+	// so the git binary is not needed to serve clones, fetches and pushes.
+	// Wire protocol v2 is not supported; clients fall back to v0.
+	GoGit
+)
+
+// Backend sets the implementation used to serve Git's transport services.
+func Backend(kind BackendKind) Option {
+	return func(h *handler) {
+		h.backend = kind
+	}
+}
+
+// runGoGit serves the Git service cmd describes using go-git instead of
+// running it, the same as runCommand would.
+func (h *handler) runGoGit(ctx context.Context, w io.Writer, r io.Reader, cmd *exec.Cmd) error {
+	dir := cmd.Dir
+	h.logger.Debug("Serving with go-git", Field{"dir", dir}, Field{"args", cmd.Args})
+
+	if namespaced(cmd.Env) {
+		return errors.New("go-git does not support Git namespaces")
+	}
+
+	ep, err := transport.NewEndpoint("/")
+	if err != nil {
+		return err
+	}
+
+	storage := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+	srv := server.NewServer(server.MapLoader{ep.String(): storage})
+
+	advertise := false
+	for _, arg := range cmd.Args[1:] {
+		if arg == "--advertise-refs" {
+			advertise = true
+		}
+	}
+
+	switch cmd.Args[0] {
+	case "git-upload-pack":
+		sess, err := srv.NewUploadPackSession(ep, nil)
+		if err != nil {
+			return err
+		}
+		defer sess.Close()
+
+		if advertise {
+			refs, err := sess.AdvertisedReferences()
+			if err != nil {
+				return err
+			}
+			return refs.Encode(w)
+		}
+		return goGitUploadPack(ctx, w, r, sess)
+
+	case "git-receive-pack":
+		sess, err := srv.NewReceivePackSession(ep, nil)
+		if err != nil {
+			return err
+		}
+		defer sess.Close()
+
+		if advertise {
+			refs, err := sess.AdvertisedReferences()
+			if err != nil {
+				return err
+			}
+			return refs.Encode(w)
+		}
+		return goGitReceivePack(ctx, w, r, sess)
+	}
+	return fmt.Errorf("unsupported service %s", cmd.Args[0])
+}
+
+// goGitUploadPack negotiates with the client and sends the packfile once it
+// is done sending what it has.
+func goGitUploadPack(ctx context.Context, w io.Writer, r io.Reader, sess transport.UploadPackSession) error {
+	req := packp.NewUploadPackRequest()
+	if err := req.UploadRequest.Decode(r); err != nil {
+		return err
+	}
+
+	done := false
+	for !done {
+		line, err := packetRead(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if line == nil {
+			break
+		}
+
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		switch {
+		case bytes.Equal(line, []byte("done")):
+			done = true
+		case bytes.HasPrefix(line, []byte("have ")):
+			id := line[len("have "):]
+			var have plumbing.Hash
+			if len(id) != hex.EncodedLen(len(have)) {
+				return fmt.Errorf("invalid have line %q", line)
+			}
+			if _, err := hex.Decode(have[:], id); err != nil {
+				return fmt.Errorf("invalid have line %q", line)
+			}
+			req.Haves = append(req.Haves, have)
+		}
+	}
+
+	// go-git does not acknowledge common commits, so the client is asked to
+	// keep sending what it has until it gives up negotiating.
+	if !done {
+		_, err := w.Write(packetWrite("NAK\n"))
+		return err
+	}
+
+	res, err := sess.UploadPack(ctx, req)
+	if err != nil {
+		return err
+	}
+	return res.Encode(w)
+}
+
+// goGitReceivePack applies the commands and packfile sent by the client.
+func goGitReceivePack(ctx context.Context, w io.Writer, r io.Reader, sess transport.ReceivePackSession) error {
+	req := packp.NewReferenceUpdateRequest()
+	if err := req.Decode(r); err != nil {
+		return err
+	}
+
+	status, err := sess.ReceivePack(ctx, req)
+	if status == nil {
+		return err
+	}
+
+	// Failed updates are reported to the client, the same as git does.
+	if req.Capabilities.Supports(capability.ReportStatus) {
+		return status.Encode(w)
+	}
+	return nil
+}
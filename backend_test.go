@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestGoGitBackend(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), Backend(GoGit)))
+	defer ts.Close()
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	url := ts.URL + "/test.git"
+	dir := filepath.Join(workspace, "test")
+	cloneAndCommit(t, url, dir, "go-git")
+	git(t, dir, "push", "origin", "master")
+
+	clone := filepath.Join(workspace, "clone")
+	git(t, workspace, "clone", url, clone)
+
+	content, err := ioutil.ReadFile(filepath.Join(clone, "README.md"))
+	assert.Ok(t, err)
+	assert.Equals(t, "go-git", string(content))
+
+	// Fetching on top of existing history negotiates what the client has.
+	err = ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("go-git again"), 0644)
+	assert.Ok(t, err)
+	git(t, dir, "commit", "-am", "second commit")
+	git(t, dir, "push", "origin", "master")
+	git(t, clone, "pull", "origin", "master")
+
+	content, err = ioutil.ReadFile(filepath.Join(clone, "README.md"))
+	assert.Ok(t, err)
+	assert.Equals(t, "go-git again", string(content))
+}
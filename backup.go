@@ -0,0 +1,454 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BackupFormat is the format of repository snapshots.
+type BackupFormat int
+
+const (
+	// BundleBackup snapshots the refs of repositories, and the objects they
+	// reach, as Git bundles. It is the default.
+	BundleBackup BackupFormat = iota
+	// TarBackup snapshots whole repository directories, including hooks and
+	// configuration, as gzipped tarballs.
+	TarBackup
+)
+
+// backupTimeFormat is the format of the time snapshots were taken at, in
+// their keys, so they sort in the order they were taken.
+const backupTimeFormat = "20060102T150405.000Z"
+
+var backupExtensions = map[BackupFormat]string{
+	BundleBackup: ".bundle",
+	TarBackup:    ".tar.gz",
+}
+
+// errNoBackup is returned when restoring a repository without snapshots.
+var errNoBackup = errors.New("no backup found")
+
+// BackupPolicy configures the scheduled backups of repositories.
+type BackupPolicy struct {
+	// Store is where snapshots are uploaded to, under keys such as
+	// "org/repo.git/20060102T150405.000Z.bundle".
+	Store BackupStore
+	// Interval is how often every repository is snapshotted. If zero,
+	// backups are not scheduled, though repositories can still be
+	// restored.
+	Interval time.Duration
+	Format   BackupFormat
+	// Keep is how many snapshots of each repository are kept. If zero,
+	// they are kept regardless of their number.
+	Keep int
+	// MaxAge is how long snapshots are kept for. If zero, they are kept
+	// regardless of their age. The latest snapshot of a repository is
+	// always kept.
+	MaxAge time.Duration
+}
+
+// Backups snapshots every repository on a schedule, uploading snapshots to
+// policy.Store and pruning those past the retention policy, so repositories
+// can be restored with RestoreBackup if the host is lost. Empty
+// repositories are skipped.
+func Backups(policy BackupPolicy) Option {
+	return func(h *handler) {
+		h.backups = &policy
+	}
+}
+
+// scheduleBackups snapshots every repository on the configured interval,
+// until the server shuts down.
+func (h *handler) scheduleBackups() {
+	ticker := time.NewTicker(h.backups.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.backupAll()
+		case <-h.maintenance.stop:
+			return
+		}
+	}
+}
+
+// backupAll snapshots every repository, one at a time.
+func (h *handler) backupAll() {
+	start := time.Now()
+	var count, failed int
+	err := h.walkRepos(func(name, dir string) error {
+		select {
+		case <-h.maintenance.stop:
+			return errShuttingDown
+		default:
+		}
+
+		count++
+		if err := h.backupRepo(context.Background(), name, dir); err != nil {
+			failed++
+		}
+		return nil
+	})
+
+	if err != nil && err != errShuttingDown {
+		h.logger.Error("Listing repositories for backup failed", Field{"error", err})
+	}
+	h.logger.Info("Repositories backed up", Field{"count", count}, Field{"failed", failed}, Field{"duration", time.Since(start)})
+}
+
+// backupRepo snapshots the repository name in dir and prunes its snapshots
+// past the retention policy.
+func (h *handler) backupRepo(ctx context.Context, name, dir string) error {
+	if !h.hasRefs(dir) {
+		return nil
+	}
+
+	start := time.Now()
+	f, err := ioutil.TempFile("", "gitd-backup")
+	if err != nil {
+		h.logger.Error("Backing up repository failed", Field{"repo", name}, Field{"error", err})
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer func() { f.Close() }()
+
+	format := h.backups.Format
+	if format == TarBackup {
+		err = writeTarball(f, dir)
+	} else {
+		cmd := h.gitCommand(dir, "bundle", "create", f.Name(), "--all")
+		if _, _, err = runAndLog(h.logger, cmd); err == nil {
+			// Git replaces the file rather than writing to it.
+			f.Close()
+			f, err = os.Open(f.Name())
+		}
+	}
+
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = f.Stat()
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	key := name + "/" + start.UTC().Format(backupTimeFormat) + backupExtensions[format]
+	if err == nil {
+		err = h.backups.Store.Put(ctx, key, f, fi.Size())
+	}
+	if err != nil {
+		h.logger.Error("Backing up repository failed", Field{"repo", name}, Field{"error", err})
+		return err
+	}
+
+	h.logger.Info("Repository backed up", Field{"repo", name}, Field{"key", key}, Field{"size", fi.Size()}, Field{"duration", time.Since(start)})
+	h.pruneBackups(ctx, name, start)
+	return nil
+}
+
+// hasRefs returns whether the repository in dir has any ref, as bundles
+// cannot be created otherwise.
+func (h *handler) hasRefs(dir string) bool {
+	cmd := h.gitCommand(dir, "for-each-ref", "--count=1")
+	out, err := cmd.Output()
+	return err == nil && len(out) > 0
+}
+
+// snapshot is a stored snapshot of a repository.
+type snapshot struct {
+	key    string
+	format BackupFormat
+	taken  time.Time
+}
+
+// snapshots returns the snapshots of the repository name in store, oldest
+// first.
+func snapshots(ctx context.Context, store BackupStore, name string) ([]snapshot, error) {
+	prefix := name + "/"
+	keys, err := store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var snaps []snapshot
+	for _, key := range keys {
+		base := strings.TrimPrefix(key, prefix)
+		for format, ext := range backupExtensions {
+			if !strings.HasSuffix(base, ext) {
+				continue
+			}
+			taken, err := time.Parse(backupTimeFormat, strings.TrimSuffix(base, ext))
+			if err == nil {
+				snaps = append(snaps, snapshot{key, format, taken})
+			}
+		}
+	}
+	return snaps, nil
+}
+
+// pruneBackups deletes the snapshots of the repository name past the
+// retention policy, as of now.
+func (h *handler) pruneBackups(ctx context.Context, name string, now time.Time) {
+	policy := h.backups
+	if policy.Keep <= 0 && policy.MaxAge <= 0 {
+		return
+	}
+
+	snaps, err := snapshots(ctx, policy.Store, name)
+	if err != nil {
+		h.logger.Error("Listing backups failed", Field{"repo", name}, Field{"error", err})
+		return
+	}
+	if len(snaps) == 0 {
+		return
+	}
+
+	// The latest snapshot is last, and always kept.
+	for i, s := range snaps[:len(snaps)-1] {
+		expired := policy.MaxAge > 0 && now.Sub(s.taken) > policy.MaxAge
+		excess := policy.Keep > 0 && len(snaps)-i > policy.Keep
+		if !expired && !excess {
+			continue
+		}
+		if err := policy.Store.Delete(ctx, s.key); err != nil {
+			h.logger.Error("Pruning backup failed", Field{"repo", name}, Field{"key", s.key}, Field{"error", err})
+			continue
+		}
+		h.logger.Debug("Backup pruned", Field{"repo", name}, Field{"key", s.key})
+	}
+}
+
+// RestoreBackup restores the repository name from the latest snapshot taken
+// at or before at, or from the latest one if at is zero, returning the key
+// of the snapshot. With a ref journal, the repository is restored from the
+// earliest snapshot taken at or after at, if any, and its refs brought to
+// their state at at by replaying the journal. The repository must not
+// exist. Backups must be configured.
+func (s *Server) RestoreBackup(ctx context.Context, name string, at time.Time) (string, error) {
+	h := s.h
+	if h.backups == nil {
+		return "", errors.New("backups are not configured")
+	}
+	if !validRepoName(name) {
+		return "", fmt.Errorf("invalid repository name %q", name)
+	}
+
+	dir, err := h.storage.Dir(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return "", fmt.Errorf("repository %s already exists", name)
+	}
+
+	snaps, err := snapshots(ctx, h.backups.Store, name)
+	if err != nil {
+		return "", err
+	}
+	snap := pickSnapshot(snaps, at, h.journal != nil)
+	if snap == nil {
+		return "", errNoBackup
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", err
+	}
+	// Repositories only show up once fully restored.
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir)+"-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := h.restoreSnapshot(ctx, *snap, tmp); err != nil {
+		return "", err
+	}
+	if h.journal != nil && !at.IsZero() {
+		n, err := h.replayJournal(name, tmp, snap.taken, at)
+		if err != nil {
+			return "", fmt.Errorf("replaying journal: %v", err)
+		}
+		h.logger.Info("Journal replayed", Field{"repo", name}, Field{"refs", n}, Field{"at", at})
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", err
+	}
+	h.invalidateRepo(dir)
+
+	h.logger.Info("Repository restored from backup", Field{"repo", name}, Field{"key", snap.key})
+	return snap.key, nil
+}
+
+// pickSnapshot returns the snapshot to restore the repository to its state
+// at at, or to the latest one if at is zero. Ref journals allow going back
+// from snapshots taken later, which have every object needed, as opposed
+// to earlier ones.
+func pickSnapshot(snaps []snapshot, at time.Time, journaled bool) *snapshot {
+	var snap *snapshot
+	for i := range snaps {
+		if at.IsZero() || !snaps[i].taken.After(at) {
+			snap = &snaps[i]
+		} else if journaled {
+			return &snaps[i]
+		}
+	}
+	return snap
+}
+
+// restoreSnapshot restores snap into the empty directory dir.
+func (h *handler) restoreSnapshot(ctx context.Context, snap snapshot, dir string) error {
+	r, err := h.backups.Store.Get(ctx, snap.key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if snap.format == TarBackup {
+		if err := extractTarball(r, dir); err != nil {
+			return err
+		}
+		return h.ownRepo(dir)
+	}
+
+	f, err := ioutil.TempFile("", "gitd-restore")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Cloning from the bundle points HEAD to the same branch it did.
+	cmd := h.gitCommand("", "clone", "--quiet", "--mirror", f.Name(), dir)
+	if _, _, err := runAndLog(h.logger, cmd); err != nil {
+		return err
+	}
+	if err := h.ownRepo(dir); err != nil {
+		return err
+	}
+	cmd = h.gitCommand(dir, "config", "--remove-section", "remote.origin")
+	if _, _, err := runAndLog(h.logger, cmd); err != nil {
+		return err
+	}
+	// Bundles do not keep the export marker, which the repository had.
+	return h.markExported(dir)
+}
+
+// writeTarball writes the directory dir to w as a gzipped tarball.
+func writeTarball(w io.Writer, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// extractTarball extracts the gzipped tarball read from r into dir,
+// rejecting entries outside of it.
+func extractTarball(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		p := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(p, dir+string(filepath.Separator)) {
+			return fmt.Errorf("invalid tarball entry %q", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, 0755)
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(p), 0755); err == nil {
+				err = writeFile(p, tr, os.FileMode(hdr.Mode).Perm())
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeFile writes what is read from r to the file p, giving it mode.
+func writeFile(p string, r io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,325 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupStore stores repository snapshots under slash-separated keys.
+type BackupStore interface {
+	// Put stores size bytes read from r under key.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get returns a reader for what is stored under key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the keys starting with prefix, sorted.
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// LocalBackupStore returns a BackupStore keeping snapshots in dir, such as
+// a mounted network volume.
+func LocalBackupStore(dir string) BackupStore {
+	return localBackupStore(dir)
+}
+
+type localBackupStore string
+
+func (s localBackupStore) path(key string) string {
+	return filepath.Join(string(s), filepath.FromSlash(key))
+}
+
+func (s localBackupStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// Snapshots only show up once complete.
+	f, err := ioutil.TempFile(filepath.Dir(p), ".backup")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (s localBackupStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+func (s localBackupStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(string(s), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() && p != string(s) && strings.HasPrefix(fi.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			return nil
+		}
+
+		key, err := filepath.Rel(string(s), p)
+		if err != nil {
+			return err
+		}
+		if key = filepath.ToSlash(key); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (s localBackupStore) Delete(ctx context.Context, key string) error {
+	return os.Remove(s.path(key))
+}
+
+// S3Config configures a BackupStore keeping snapshots in an S3 bucket. Google
+// Cloud Storage buckets can be used too, through its S3-compatible XML API,
+// with Endpoint set to https://storage.googleapis.com and HMAC keys.
+type S3Config struct {
+	// Endpoint is the URL of the service, such as
+	// https://s3.us-east-1.amazonaws.com. Buckets are addressed by path.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to the keys of snapshots, such as "gitd/".
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Transport sends requests to the service. If nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+// S3BackupStore returns a BackupStore keeping snapshots in an S3 bucket.
+func S3BackupStore(config S3Config) BackupStore {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	return &s3Store{config: config, client: &http.Client{Transport: config.Transport}}
+}
+
+// s3UnsignedPayload is the payload hash of requests whose body is not
+// signed, so snapshots are not read twice.
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+type s3Store struct {
+	config S3Config
+	client *http.Client
+}
+
+func (s *s3Store) url(key string, query url.Values) string {
+	u := strings.TrimSuffix(s.config.Endpoint, "/") + "/" + s3Escape(s.config.Bucket, false)
+	if key != "" {
+		u += "/" + s3Escape(s.config.Prefix+key, true)
+	}
+	if len(query) > 0 {
+		u += "?" + s3Query(query)
+	}
+	return u
+}
+
+// do sends a signed request to the service, returning an error unless it
+// responds with a 2xx status.
+func (s *s3Store) do(ctx context.Context, method, u string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.ContentLength = size
+	}
+	signS3(req, s.config.Region, s.config.AccessKey, s.config.SecretKey, s3UnsignedPayload, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, res.Status, strings.TrimSpace(string(msg)))
+	}
+	return res, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	res, err := s.do(ctx, "PUT", s.url(key, nil), r, size)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, "GET", s.url(key, nil), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// s3ListResult is the response of the service listing objects.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix + prefix}}
+	for {
+		res, err := s.do(ctx, "GET", s.url("", query), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, s.config.Prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, "DELETE", s.url(key, nil), nil, 0)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// signS3 signs req with AWS Signature Version 4, covering the headers set
+// so far and the host.
+func signS3(req *http.Request, region, accessKey, secretKey, payloadHash string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders string
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		s3Query(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes s the way AWS signatures expect, leaving slashes
+// alone if keepSlash is set.
+func s3Escape(s string, keepSlash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes query sorted by key, the way AWS signatures expect.
+func s3Query(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
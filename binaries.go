@@ -0,0 +1,94 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"os/exec"
+)
+
+// GitPath runs Git from path rather than looking it up in PATH, for
+// containers shipping their own Git. Unless given their own binaries with
+// UploadPackBinary or ReceivePackBinary, upload-pack and receive-pack are
+// run through it too.
+func GitPath(path string) Option {
+	return func(h *handler) {
+		h.gitPath = path
+	}
+}
+
+// UploadPackBinary runs path in place of git-upload-pack, such as a wrapper
+// restricting what clients can fetch. It is given the same arguments and
+// environment git-upload-pack would be.
+func UploadPackBinary(path string) Option {
+	return serviceBinary("git-upload-pack", path)
+}
+
+// ReceivePackBinary runs path in place of git-receive-pack, such as a
+// wrapper restricting what clients can push. It is given the same arguments
+// and environment git-receive-pack would be.
+func ReceivePackBinary(path string) Option {
+	return serviceBinary("git-receive-pack", path)
+}
+
+func serviceBinary(service, path string) Option {
+	return func(h *handler) {
+		if h.serviceBinaries == nil {
+			h.serviceBinaries = make(map[string]string)
+		}
+		h.serviceBinaries[service] = path
+	}
+}
+
+// git returns the Git binary to run.
+func (h *handler) git() string {
+	if h.gitPath != "" {
+		return h.gitPath
+	}
+	return "git"
+}
+
+// gitCommand returns the command running Git with args in dir, if not
+// empty, as the account owning it.
+func (h *handler) gitCommand(dir string, args ...string) *exec.Cmd {
+	return h.inRepo(exec.Command(h.git(), args...), dir)
+}
+
+// gitCommandContext is like gitCommand, killing Git once ctx is done.
+func (h *handler) gitCommandContext(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	return h.inRepo(exec.CommandContext(ctx, h.git(), args...), dir)
+}
+
+// serviceCommand returns the command running the Git service, such as
+// git-upload-pack, with args in dir, as the account owning it, killing it
+// once ctx is done. Its first
+// argument is the name of the service whatever binary runs it, which is how
+// Git itself tells which service to run when given a binary of its own.
+func (h *handler) serviceCommand(ctx context.Context, dir, service string, args ...string) *exec.Cmd {
+	path, ok := h.serviceBinaries[service]
+	if !ok && h.gitPath != "" {
+		path, ok = h.gitPath, true
+	}
+	if !ok {
+		return h.inRepo(exec.CommandContext(ctx, service, args...), dir)
+	}
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Args[0] = service
+	return h.inRepo(cmd, dir)
+}
+
+// inRepo runs cmd in dir, if not empty, as the account owning it, confined
+// as configured.
+func (h *handler) inRepo(cmd *exec.Cmd, dir string) *exec.Cmd {
+	if dir != "" {
+		cmd.Dir = dir
+		h.accountFor(dir).apply(cmd)
+		if h.confinement != nil {
+			h.confinement.wrap(cmd)
+		}
+	}
+	return cmd
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestBinaries(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "repo.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	git, err := exec.LookPath("git")
+	assert.Ok(t, err)
+
+	// The wrapper records how it is run before handing over to Git.
+	log := filepath.Join(workspace, "upload-pack.log")
+	wrapper := filepath.Join(workspace, "upload-pack")
+	script := "#!/bin/sh\necho \"$*\" >> " + log + "\nexec " + git + " upload-pack \"$@\"\n"
+	assert.Ok(t, ioutil.WriteFile(wrapper, []byte(script), 0755))
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		GitPath(git),
+		UploadPackBinary(wrapper),
+	))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "repo")
+	cloneAndCommit(t, ts.URL+"/repo.git", clone, "blah")
+	gitCmd := exec.Command("git", "push", "origin", "master")
+	gitCmd.Dir = clone
+	out, err := gitCmd.CombinedOutput()
+	assert.Cond(t, err == nil, "push through git failed: %s", out)
+
+	runs, err := ioutil.ReadFile(log)
+	assert.Ok(t, err)
+	assert.Cond(t, strings.Contains(string(runs), "--stateless-rpc --advertise-refs ."), "unexpected runs: %s", runs)
+
+	srv, err := NewServer(http.NotFoundHandler(), ReposPath(rpath), GitPath(filepath.Join(workspace, "missing")))
+	assert.Ok(t, err)
+	assert.Cond(t, srv.h.checkGit() != nil, "health check should fail without Git")
+}
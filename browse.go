@@ -0,0 +1,345 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPerPage is how many commits are listed per page by default.
+	defaultPerPage = 30
+	// maxPerPage is how many commits can be listed per page at most.
+	maxPerPage = 100
+)
+
+// BrowseAPI enables read-only JSON endpoints describing the contents of
+// repositories:
+//
+//	GET /api/repos/{name}/branches           lists branches
+//	GET /api/repos/{name}/tags               lists tags
+//	GET /api/repos/{name}/commits            lists commits, newest first
+//	GET /api/repos/{name}/tree/{ref}/{path}  lists the entries of a directory
+//
+// Commits are listed from the ref query parameter, HEAD by default,
+// optionally limited to those changing the path parameter, per_page at a
+// time, up to 100. The page parameter selects the page, and a Link header
+// points to the next one, if any. Refs hidden from fetches are neither
+// listed nor browsable. Requests go through the configured authenticator
+// and authorization callback using the Fetch operation.
+func BrowseAPI() Option {
+	return func(h *handler) {
+		h.browseAPI = true
+	}
+}
+
+// branchInfo describes a branch in browsing API responses.
+type branchInfo struct {
+	Name   string `json:"name"`
+	Commit string `json:"commit"`
+}
+
+// tagInfo describes a tag in browsing API responses.
+type tagInfo struct {
+	Name string `json:"name"`
+	// ID is the tag object of annotated tags, the commit otherwise.
+	ID     string `json:"id"`
+	Commit string `json:"commit"`
+}
+
+// personInfo describes the author or committer of a commit.
+type personInfo struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
+}
+
+// commitInfo describes a commit in browsing API responses.
+type commitInfo struct {
+	ID        string     `json:"id"`
+	Parents   []string   `json:"parents"`
+	Author    personInfo `json:"author"`
+	Committer personInfo `json:"committer"`
+	Message   string     `json:"message"`
+}
+
+// treeEntry describes an entry of a tree in browsing API responses.
+type treeEntry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Type is blob, tree or commit, the latter for submodules.
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+	ID   string `json:"id"`
+	// Size is only set for blobs.
+	Size int64 `json:"size,omitempty"`
+}
+
+// browseEndpoints are the endpoints of the browsing API, following the name
+// of repositories.
+var browseEndpoints = []string{"branches", "tags", "commits"}
+
+// parseBrowsePath splits p, relative to the admin API prefix, into the
+// name of a repository, a browsing API endpoint, and what follows it.
+func parseBrowsePath(p string) (name, endpoint, rest string, ok bool) {
+	for _, e := range browseEndpoints {
+		if strings.HasSuffix(p, "/"+e) {
+			return strings.TrimSuffix(p, "/"+e), e, "", true
+		}
+	}
+
+	if i := strings.Index(p, "/tree/"); i > 0 {
+		return p[:i], "tree", p[i+len("/tree/"):], true
+	}
+	return "", "", "", false
+}
+
+// serveBrowse serves the browsing API, returning false if req is not a
+// browsing API request.
+func (h *handler) serveBrowse(w http.ResponseWriter, req *http.Request) bool {
+	if !isAdminPath(req.URL.Path) || req.Method != "GET" {
+		return false
+	}
+
+	p := strings.Trim(strings.TrimPrefix(req.URL.Path, adminPrefix), "/")
+	name, endpoint, rest, ok := parseBrowsePath(p)
+	if !ok {
+		return false
+	}
+
+	req, ok = h.authenticate(w, req, name, Fetch)
+	if !ok || !h.authorizeRepo(w, req, name, Fetch) {
+		return true
+	}
+
+	repo, err := h.lookup(req.Context(), req.Host, "/"+name)
+	if err == nil && !h.exported(repo.dir) {
+		err = ErrRepoNotFound
+	}
+	if err != nil || namespaced(repo.env) {
+		if err != nil && err != ErrRepoNotFound && err != errInvalidRepoPath {
+			h.logger.Error("Resolving repository failed", Field{"repo", name}, Field{"error", err})
+		}
+		writeError(w, http.StatusNotFound, "repository not found")
+		return true
+	}
+
+	switch endpoint {
+	case "branches":
+		h.listBranches(w, req, repo)
+	case "tags":
+		h.listTags(w, req, repo)
+	case "commits":
+		h.listCommits(w, req, repo)
+	case "tree":
+		h.listTree(w, req, repo, rest)
+	}
+	return true
+}
+
+// browseGit runs a Git command in repo, returning its output. Failures are
+// logged and reported to the client, in which case ok is false.
+func (h *handler) browseGit(w http.ResponseWriter, req *http.Request, repo *repository, args ...string) (string, bool) {
+	cmd := h.gitCommandContext(req.Context(), repo.dir, args...)
+	cmd.Env = append(os.Environ(), repo.env...)
+	out, _, err := runAndLog(h.logger, cmd)
+	if err != nil {
+		h.logger.Error("Browsing repository failed", Field{"repo", repo.name}, Field{"command", args[0]}, Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to read repository")
+		return "", false
+	}
+	return out, true
+}
+
+// listBranches lists the branches of repo.
+func (h *handler) listBranches(w http.ResponseWriter, req *http.Request, repo *repository) {
+	out, ok := h.browseGit(w, req, repo, "for-each-ref", "--format=%(refname)%00%(objectname)", "refs/heads/")
+	if !ok {
+		return
+	}
+
+	hidden := h.fetchHiddenRefs(repo.name)
+	branches := []branchInfo{}
+	for _, line := range splitLines(out) {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 2 || refHidden(hidden, fields[0]) {
+			continue
+		}
+		branches = append(branches, branchInfo{Name: strings.TrimPrefix(fields[0], "refs/heads/"), Commit: fields[1]})
+	}
+	writeJSON(w, http.StatusOK, branches)
+}
+
+// listTags lists the tags of repo.
+func (h *handler) listTags(w http.ResponseWriter, req *http.Request, repo *repository) {
+	out, ok := h.browseGit(w, req, repo, "for-each-ref", "--format=%(refname)%00%(objectname)%00%(*objectname)", "refs/tags/")
+	if !ok {
+		return
+	}
+
+	hidden := h.fetchHiddenRefs(repo.name)
+	tags := []tagInfo{}
+	for _, line := range splitLines(out) {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 3 || refHidden(hidden, fields[0]) {
+			continue
+		}
+
+		// Only annotated tags have an object to peel.
+		tag := tagInfo{Name: strings.TrimPrefix(fields[0], "refs/tags/"), ID: fields[1], Commit: fields[2]}
+		if tag.Commit == "" {
+			tag.Commit = tag.ID
+		}
+		tags = append(tags, tag)
+	}
+	writeJSON(w, http.StatusOK, tags)
+}
+
+// commitFormat is the git log format of commits listed, fields being
+// separated by NUL bytes and commits by record separators.
+const commitFormat = "--format=%H%x00%P%x00%an%x00%ae%x00%aI%x00%cn%x00%ce%x00%cI%x00%B%x1e"
+
+// listCommits lists the commits of repo, a page at a time.
+func (h *handler) listCommits(w http.ResponseWriter, req *http.Request, repo *repository) {
+	query := req.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err := strconv.Atoi(query.Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	ref := query.Get("ref")
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if strings.HasPrefix(ref, "-") {
+		writeError(w, http.StatusBadRequest, "invalid ref")
+		return
+	}
+
+	if h.revHidden(req.Context(), repo, ref) {
+		writeError(w, http.StatusNotFound, "ref not found")
+		return
+	}
+	cmd := h.gitCommandContext(req.Context(), repo.dir, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	cmd.Env = append(os.Environ(), repo.env...)
+	if _, _, err := runAndLog(h.logger, cmd); err != nil {
+		writeError(w, http.StatusNotFound, "ref not found")
+		return
+	}
+
+	// One more commit than asked tells whether there is a next page.
+	args := []string{"log", commitFormat, "--skip=" + strconv.Itoa((page-1)*perPage), "-n", strconv.Itoa(perPage + 1), ref, "--"}
+	if p := query.Get("path"); p != "" {
+		args = append(args, p)
+	}
+	out, ok := h.browseGit(w, req, repo, args...)
+	if !ok {
+		return
+	}
+
+	commits := []commitInfo{}
+	for _, record := range strings.Split(out, "\x1e") {
+		fields := strings.Split(strings.TrimPrefix(record, "\n"), "\x00")
+		if len(fields) != 9 {
+			continue
+		}
+
+		commits = append(commits, commitInfo{
+			ID:        fields[0],
+			Parents:   strings.Fields(fields[1]),
+			Author:    parsePerson(fields[2:5]),
+			Committer: parsePerson(fields[5:8]),
+			Message:   strings.TrimRight(fields[8], "\n"),
+		})
+	}
+
+	if len(commits) > perPage {
+		commits = commits[:perPage]
+		next := url.Values{}
+		for k, v := range query {
+			next[k] = v
+		}
+		next.Set("page", strconv.Itoa(page+1))
+		next.Set("per_page", strconv.Itoa(perPage))
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, urlPrefix(req)+req.URL.Path, next.Encode()))
+	}
+	writeJSON(w, http.StatusOK, commits)
+}
+
+// parsePerson parses the name, email and ISO 8601 date of a commit
+// author or committer.
+func parsePerson(fields []string) personInfo {
+	date, _ := time.Parse(time.RFC3339, fields[2])
+	return personInfo{Name: fields[0], Email: fields[1], Date: date}
+}
+
+// listTree lists the entries of a tree of repo, rest being a ref followed by
+// the path of the tree.
+func (h *handler) listTree(w http.ResponseWriter, req *http.Request, repo *repository, rest string) {
+	if rest == "" || strings.ContainsAny(rest, "\x00\r\n") {
+		writeError(w, http.StatusNotFound, "tree not found")
+		return
+	}
+
+	dir, tree, err := h.findObject(req, repo, strings.TrimSuffix(rest, "/"))
+	if err != nil {
+		h.logger.Error("Looking up tree failed", Field{"repo", repo.name}, Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to read repository")
+		return
+	}
+	if tree == nil || tree.kind != "tree" {
+		writeError(w, http.StatusNotFound, "tree not found")
+		return
+	}
+
+	out, ok := h.browseGit(w, req, repo, "ls-tree", "-l", "-z", tree.id)
+	if !ok {
+		return
+	}
+
+	entries := []treeEntry{}
+	for _, line := range strings.Split(out, "\x00") {
+		// <mode> <type> <id> <size>\t<name>
+		i := strings.IndexByte(line, '\t')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(line[:i])
+		if len(fields) != 4 {
+			continue
+		}
+
+		entry := treeEntry{Name: line[i+1:], Mode: fields[0], Type: fields[1], ID: fields[2]}
+		entry.Path = entry.Name
+		if dir != "" {
+			entry.Path = dir + "/" + entry.Name
+		}
+		entry.Size, _ = strconv.ParseInt(fields[3], 10, 64)
+		entries = append(entries, entry)
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// splitLines splits the output of a Git command into lines.
+func splitLines(out string) []string {
+	out = strings.TrimSpace(out)
+	if out == "" {
+		return nil
+	}
+	return strings.Split(out, "\n")
+}
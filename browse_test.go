@@ -0,0 +1,113 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestBrowseAPI(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), BrowseAPI()))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	assert.Ok(t, os.MkdirAll(filepath.Join(clone, "docs"), 0755))
+	for i, name := range []string{"a.md", "b.md"} {
+		assert.Ok(t, ioutil.WriteFile(filepath.Join(clone, "docs", name), []byte(strings.Repeat("x", i+1)), 0644))
+		git(t, clone, "add", "docs")
+		git(t, clone, "commit", "-qm", "add "+name+"\n\nbody")
+	}
+	git(t, clone, "tag", "v1")
+	git(t, clone, "tag", "-am", "release", "v2")
+	git(t, clone, "push", "origin", "master", "master:feature/x", "--tags")
+	head := gitOutput(t, clone, "rev-parse", "HEAD")
+
+	get := func(p string, v interface{}) *http.Response {
+		res, err := http.Get(ts.URL + p)
+		assert.Ok(t, err)
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			assert.Ok(t, json.NewDecoder(res.Body).Decode(v))
+		}
+		return res
+	}
+
+	var branches []branchInfo
+	get("/api/repos/test.git/branches", &branches)
+	assert.Equals(t, []branchInfo{{"feature/x", head}, {"master", head}}, branches)
+
+	var tags []tagInfo
+	get("/api/repos/test.git/tags", &tags)
+	assert.Equals(t, 2, len(tags))
+	assert.Equals(t, tagInfo{Name: "v1", ID: head, Commit: head}, tags[0])
+	assert.Equals(t, head, tags[1].Commit)
+	assert.Cond(t, tags[1].ID != head, "annotated tags should have their own id")
+
+	var commits []commitInfo
+	res := get("/api/repos/test.git/commits?per_page=2", &commits)
+	assert.Equals(t, 2, len(commits))
+	assert.Equals(t, head, commits[0].ID)
+	assert.Equals(t, "add b.md\n\nbody", commits[0].Message)
+	assert.Equals(t, []string{commits[1].ID}, commits[0].Parents)
+	assert.Equals(t, "test@hooklift.io", commits[0].Author.Email)
+	assert.Cond(t, !commits[0].Committer.Date.IsZero(), "commit date should be set")
+	link := res.Header.Get("Link")
+	assert.Cond(t, strings.Contains(link, "page=2") && strings.Contains(link, `rel="next"`), "unexpected link: %s", link)
+
+	res = get("/api/repos/test.git/commits?per_page=2&page=2", &commits)
+	assert.Equals(t, 1, len(commits))
+	assert.Equals(t, "testing gitd", commits[0].Message)
+	assert.Equals(t, "", res.Header.Get("Link"))
+
+	get("/api/repos/test.git/commits?ref=feature/x&path=docs/a.md", &commits)
+	assert.Equals(t, 1, len(commits))
+	assert.Equals(t, "add a.md\n\nbody", commits[0].Message)
+
+	var entries []treeEntry
+	get("/api/repos/test.git/tree/feature/x", &entries)
+	assert.Equals(t, 2, len(entries))
+	assert.Equals(t, "README.md", entries[0].Name)
+	assert.Equals(t, int64(4), entries[0].Size)
+	assert.Equals(t, "docs", entries[1].Name)
+	assert.Equals(t, "tree", entries[1].Type)
+
+	get("/api/repos/test.git/tree/master/docs/", &entries)
+	assert.Equals(t, []string{"docs/a.md", "docs/b.md"}, []string{entries[0].Path, entries[1].Path})
+	assert.Equals(t, "blob", entries[1].Type)
+	assert.Equals(t, int64(2), entries[1].Size)
+
+	for _, p := range []string{
+		"/api/repos/test.git/tree/master/README.md",
+		"/api/repos/test.git/tree/missing",
+		"/api/repos/test.git/commits?ref=missing",
+		"/api/repos/missing.git/branches",
+	} {
+		res = get(p, nil)
+		assert.Equals(t, http.StatusNotFound, res.StatusCode)
+	}
+
+	// The admin API is not enabled.
+	res = get("/api/repos", nil)
+	assert.Equals(t, http.StatusNotFound, res.StatusCode)
+}
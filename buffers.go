@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import "sync"
+
+// defaultBufferSize is the size of the buffers used to copy data between
+// clients and Git processes, unless set otherwise.
+const defaultBufferSize = 32 * 1024
+
+// BufferSize sets the size of the buffers used to copy data between clients
+// and Git processes, 32 KiB by default. Larger buffers mean fewer, larger
+// writes on fast networks, at the cost of memory per operation. Buffers are
+// reused across operations.
+func BufferSize(n int) Option {
+	return func(h *handler) {
+		if n > 0 {
+			h.buffers.size = n
+		}
+	}
+}
+
+// bufferPool reuses copy buffers across operations, sparing the garbage
+// collector under load. Its zero value hands out buffers of the default size.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func (p *bufferPool) get() *[]byte {
+	if b, ok := p.pool.Get().(*[]byte); ok {
+		return b
+	}
+
+	size := p.size
+	if size == 0 {
+		size = defaultBufferSize
+	}
+	b := make([]byte, size)
+	return &b
+}
+
+func (p *bufferPool) put(b *[]byte) {
+	p.pool.Put(b)
+}
@@ -0,0 +1,32 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestBufferSize(t *testing.T) {
+	h := &handler{logger: stdLogger{}}
+	buf := h.buffers.get()
+	assert.Equals(t, defaultBufferSize, len(*buf))
+
+	h = &handler{logger: stdLogger{}}
+	BufferSize(1024)(h)
+	buf = h.buffers.get()
+	assert.Equals(t, 1024, len(*buf))
+	h.buffers.put(buf)
+
+	// Data larger than the buffers gets through whole.
+	input := strings.Repeat("0123456789", 1000)
+	var out bytes.Buffer
+	assert.Ok(t, h.runCommand(h.logger, &out, strings.NewReader(input), exec.Command("cat")))
+	assert.Equals(t, input, out.String())
+}
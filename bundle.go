@@ -0,0 +1,99 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// bundlePath matches bundle downloads after the repository path.
+const bundlePath = "/bundle"
+
+// Bundles serves bundles of repositories made by git bundle at
+// /{repo}/bundle, for offline transfers and backups, with the same access
+// control as fetches. Bundles have all refs but those hidden from fetches,
+// unless rev query parameters give the revisions to include, such as main,
+// v1.0..main or ^v1.0.
+func Bundles(enabled bool) Option {
+	return func(h *handler) {
+		h.bundles = enabled
+	}
+}
+
+// bundle streams a bundle of repo.
+func (h *handler) bundle(w http.ResponseWriter, req *http.Request, repo *repository) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method Not Allowed"))
+		return
+	}
+
+	// Bundles would otherwise have the refs of all namespaces.
+	if namespaced(repo.env) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return
+	}
+
+	revs := req.URL.Query()["rev"]
+	for _, rev := range revs {
+		if rev == "" || strings.HasPrefix(rev, "-") || strings.ContainsAny(rev, "\x00\r\n") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Bad Request"))
+			return
+		}
+		if h.revHidden(req.Context(), repo, rev) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Not Found"))
+			return
+		}
+	}
+	if len(revs) == 0 {
+		var err error
+		if revs, err = h.visibleRefs(req, repo); err != nil {
+			h.logger.Error("Listing refs failed", Field{"repo", repo.name}, Field{"error", err})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal Server Error"))
+			return
+		}
+	}
+
+	name := safeFileName(strings.TrimSuffix(path.Base(repo.name), ".git"))
+	headers := w.Header()
+	headers.Set("Content-Type", "application/x-git-bundle")
+	headers.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.bundle"`, name))
+	noCache(w)
+
+	cmd := h.gitCommandContext(req.Context(), repo.dir, append([]string{"bundle", "create", "-"}, revs...)...)
+	cmd.Env = append(os.Environ(), repo.env...)
+	h.execute(w, req, strings.NewReader(""), cmd, repo.name, nil)
+}
+
+// visibleRefs returns HEAD and the refs of repo that are not hidden from
+// fetches, which is what bundles of all refs have.
+func (h *handler) visibleRefs(req *http.Request, repo *repository) ([]string, error) {
+	cmd := h.gitCommandContext(req.Context(), repo.dir, "for-each-ref", "--format=%(refname)")
+	cmd.Env = append(os.Environ(), repo.env...)
+	out, _, err := runAndLog(h.logger, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	if !h.revHidden(req.Context(), repo, "HEAD") {
+		refs = append(refs, "HEAD")
+	}
+	hidden := h.fetchHiddenRefs(repo.name)
+	for _, ref := range splitLines(out) {
+		if !refHidden(hidden, ref) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
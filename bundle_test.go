@@ -0,0 +1,129 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestBundles(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+	initBareRepo(t, rpath, "private.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		Bundles(true),
+		AuthorizeRepo(func(user, repo string, op Operation) bool {
+			return repo != "private.git"
+		}),
+	))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "commit", "--allow-empty", "-qm", "second")
+	git(t, clone, "tag", "v1", "HEAD~1")
+	git(t, clone, "push", "origin", "master", "--tags")
+
+	download := func(query string) (int, string) {
+		res, err := http.Get(ts.URL + "/test.git/bundle" + query)
+		assert.Ok(t, err)
+		defer res.Body.Close()
+
+		file := filepath.Join(workspace, "test.bundle")
+		f, err := os.Create(file)
+		assert.Ok(t, err)
+		_, err = io.Copy(f, res.Body)
+		assert.Ok(t, err)
+		assert.Ok(t, f.Close())
+		return res.StatusCode, file
+	}
+
+	status, file := download("")
+	assert.Equals(t, http.StatusOK, status)
+	heads := gitOutput(t, workspace, "bundle", "list-heads", file)
+	assert.Cond(t, strings.Contains(heads, "refs/heads/master") && strings.Contains(heads, "refs/tags/v1"), "unexpected heads: %s", heads)
+
+	restored := filepath.Join(workspace, "restored")
+	git(t, workspace, "clone", "-q", file, restored)
+	assert.Equals(t, gitOutput(t, clone, "rev-parse", "HEAD"), gitOutput(t, restored, "rev-parse", "HEAD"))
+
+	// Incremental bundles require the commits they build on.
+	status, file = download("?rev=v1..master")
+	assert.Equals(t, http.StatusOK, status)
+	git(t, clone, "bundle", "verify", file)
+	git(t, restored, "bundle", "verify", file)
+	assert.Equals(t, gitOutput(t, clone, "rev-parse", "HEAD")+" refs/heads/master", gitOutput(t, workspace, "bundle", "list-heads", file))
+
+	status, _ = download("?rev=--output=x")
+	assert.Equals(t, http.StatusBadRequest, status)
+
+	res, err := http.Get(ts.URL + "/private.git/bundle")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestBundlesHideRefs(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		Bundles(true),
+		HideRefs(HiddenRefs{All: []string{"refs/internal/"}}),
+	))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "-q", "origin", "master")
+	git(t, filepath.Join(rpath, "test.git"), "update-ref", "refs/internal/secret", "refs/heads/master")
+
+	res, err := http.Get(ts.URL + "/test.git/bundle")
+	assert.Ok(t, err)
+	file := filepath.Join(workspace, "test.bundle")
+	f, err := os.Create(file)
+	assert.Ok(t, err)
+	_, err = io.Copy(f, res.Body)
+	res.Body.Close()
+	assert.Ok(t, err)
+	assert.Ok(t, f.Close())
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+
+	heads := gitOutput(t, workspace, "bundle", "list-heads", file)
+	assert.Cond(t, strings.Contains(heads, "refs/heads/master"), "master should be bundled: %s", heads)
+	assert.Cond(t, !strings.Contains(heads, "refs/internal/"), "hidden refs should not be bundled: %s", heads)
+
+	for _, rev := range []string{"refs/internal/secret", "internal/secret", "master..refs/internal/secret"} {
+		res, err = http.Get(ts.URL + "/test.git/bundle?rev=" + url.QueryEscape(rev))
+		assert.Ok(t, err)
+		res.Body.Close()
+		assert.Equals(t, http.StatusNotFound, res.StatusCode)
+	}
+}
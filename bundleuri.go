@@ -0,0 +1,143 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// bundleIDRe matches the bundle ids that can be advertised, which end up in
+// Git configuration keys.
+var bundleIDRe = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// BundleURI describes a bundle clients can bootstrap clones from, before
+// fetching what it is missing from the server.
+type BundleURI struct {
+	// ID identifies the bundle, using letters, digits and dashes.
+	ID string
+	// URI is where the bundle is downloaded from, such as a CDN or the
+	// bundle endpoint of a server with Bundles enabled.
+	URI string
+	// CreationToken orders bundles, letting clients only download those
+	// newer than the ones they already have. It is only advertised if all
+	// the bundles of a repository have one.
+	CreationToken uint64
+}
+
+// BundleURIs advertises the bundles list returns for repositories, given
+// their name, through the bundle-uri capability of Git wire protocol v2.
+// Clients configured to use them, with transfer.bundleURI, download the
+// bundles before fetching the rest from the server, which takes most of the
+// load of cloning large repositories off the server. Bundles are only
+// advertised over smart HTTP.
+func BundleURIs(list func(repo string) []BundleURI) Option {
+	return func(h *handler) {
+		h.bundleURIs = list
+	}
+}
+
+// bundleList returns the configuration lines of the bundle list of repo, as
+// sent in response to the bundle-uri command.
+func (h *handler) bundleList(repo string) []string {
+	var bundles []BundleURI
+	for _, b := range h.bundleURIs(repo) {
+		if !bundleIDRe.MatchString(b.ID) {
+			h.logger.Warn("Invalid bundle id", Field{"repo", repo}, Field{"id", b.ID})
+			continue
+		}
+		bundles = append(bundles, b)
+	}
+	if len(bundles) == 0 {
+		return nil
+	}
+
+	tokens := true
+	for _, b := range bundles {
+		tokens = tokens && b.CreationToken > 0
+	}
+
+	lines := []string{"bundle.version=1", "bundle.mode=all"}
+	if tokens {
+		lines = append(lines, "bundle.heuristic=creationToken")
+	}
+	for _, b := range bundles {
+		lines = append(lines, fmt.Sprintf("bundle.%s.uri=%s", b.ID, b.URI))
+		if tokens {
+			lines = append(lines, fmt.Sprintf("bundle.%s.creationToken=%d", b.ID, b.CreationToken))
+		}
+	}
+	return lines
+}
+
+// serveBundleURIs answers the bundle-uri command, if body, the request of a
+// protocol v2 client, is one. Otherwise, it returns body as it was.
+func (h *handler) serveBundleURIs(w http.ResponseWriter, repo *repository, body io.Reader) (io.Reader, bool) {
+	line, err := packetRead(body)
+	if err != nil || string(line) != "command=bundle-uri\n" {
+		consumed := packetFlush()
+		if line != nil {
+			consumed = packetWrite(string(line))
+		}
+		if err != nil {
+			consumed = nil
+		}
+		return io.MultiReader(bytes.NewReader(consumed), body), false
+	}
+
+	// The command has no arguments worth reading.
+	io.Copy(ioutil.Discard, body)
+
+	var resp bytes.Buffer
+	for _, line := range h.bundleList(repo.name) {
+		resp.Write(packetWrite(line + "\n"))
+	}
+	resp.Write(packetFlush())
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp.Bytes())
+	return nil, true
+}
+
+// capabilityWriter adds a capability to the protocol v2 capability
+// advertisement written through it, right before the flush packet ending
+// it.
+type capabilityWriter struct {
+	http.ResponseWriter
+	capability []byte
+	buf        []byte
+	done       bool
+}
+
+func (c *capabilityWriter) Write(p []byte) (int, error) {
+	if c.done {
+		return c.ResponseWriter.Write(p)
+	}
+
+	c.buf = append(c.buf, p...)
+	for off := 0; off+4 <= len(c.buf); {
+		n, err := strconv.ParseUint(string(c.buf[off:off+4]), 16, 16)
+		if err != nil || n == 0 {
+			// Not an advertisement, or the end of it.
+			out := c.buf
+			if err == nil {
+				out = append(append(c.buf[:off:off], c.capability...), c.buf[off:]...)
+			}
+			c.done = true
+			_, err := c.ResponseWriter.Write(out)
+			return len(p), err
+		}
+		if n < 4 {
+			n = 4
+		}
+		off += int(n)
+	}
+	return len(p), nil
+}
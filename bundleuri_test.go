@@ -0,0 +1,115 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+// readPackets reads pkt-lines from r until a flush packet.
+func readPackets(t *testing.T, r io.Reader) []string {
+	var lines []string
+	for {
+		line, err := packetRead(r)
+		assert.Ok(t, err)
+		if line == nil {
+			return lines
+		}
+		lines = append(lines, strings.TrimSuffix(string(line), "\n"))
+	}
+}
+
+func TestBundleURIs(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+	initBareRepo(t, rpath, "plain.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		BundleURIs(func(repo string) []BundleURI {
+			if repo != "test.git" {
+				return nil
+			}
+			return []BundleURI{
+				{ID: "base", URI: "https://cdn.example.com/base.bundle", CreationToken: 1},
+				{ID: "daily", URI: "https://cdn.example.com/daily.bundle", CreationToken: 2},
+			}
+		}),
+	))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "-q", "origin", "master")
+
+	advertise := func(repo string) []string {
+		req, err := http.NewRequest("GET", ts.URL+repo+"/info/refs?service=git-upload-pack", nil)
+		assert.Ok(t, err)
+		req.Header.Set("Git-Protocol", "version=2")
+		res, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		defer res.Body.Close()
+		assert.Equals(t, http.StatusOK, res.StatusCode)
+		return readPackets(t, res.Body)
+	}
+
+	caps := advertise("/test.git")
+	assert.Equals(t, "version 2", caps[0])
+	assert.Equals(t, "bundle-uri", caps[len(caps)-1])
+	assert.Cond(t, !strings.Contains(strings.Join(advertise("/plain.git"), "\n"), "bundle-uri"), "repositories without bundles should not advertise them")
+
+	command := func(body []byte) []string {
+		req, err := http.NewRequest("POST", ts.URL+"/test.git/git-upload-pack", bytes.NewReader(body))
+		assert.Ok(t, err)
+		req.Header.Set("Git-Protocol", "version=2")
+		req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+		res, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		defer res.Body.Close()
+		assert.Equals(t, http.StatusOK, res.StatusCode)
+		return readPackets(t, res.Body)
+	}
+
+	var body []byte
+	body = append(body, packetWrite("command=bundle-uri\n")...)
+	body = append(body, packetWrite("object-format=sha1\n")...)
+	body = append(body, "0001"...)
+	body = append(body, packetFlush()...)
+	assert.Equals(t, []string{
+		"bundle.version=1",
+		"bundle.mode=all",
+		"bundle.heuristic=creationToken",
+		"bundle.base.uri=https://cdn.example.com/base.bundle",
+		"bundle.base.creationToken=1",
+		"bundle.daily.uri=https://cdn.example.com/daily.bundle",
+		"bundle.daily.creationToken=2",
+	}, command(body))
+
+	// Other commands still reach Git.
+	body = append(packetWrite("command=ls-refs\n"), "0001"...)
+	body = append(body, packetFlush()...)
+	refs := command(body)
+	assert.Cond(t, strings.Contains(strings.Join(refs, "\n"), " refs/heads/master"), "unexpected refs: %v", refs)
+
+	// Clients not asking for bundles are not affected.
+	git(t, workspace, "-c", "protocol.version=2", "clone", "-q", ts.URL+"/test.git", filepath.Join(workspace, "v2"))
+	git(t, workspace, "-c", "protocol.version=0", "clone", "-q", ts.URL+"/test.git", filepath.Join(workspace, "v0"))
+}
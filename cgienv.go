@@ -0,0 +1,68 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Env adds the environment variables fn returns for each request, such as
+// "TENANT_ID=acme", to the Git processes serving it, for server-side hooks
+// to use. It is called with the repository requested, such as
+// "org/repo.git". Variables it returns override those gitd sets. Requests
+// over SSH and the Git protocol are described by a request too.
+func Env(fn func(req *http.Request, repo string) []string) Option {
+	return func(h *handler) {
+		h.env = fn
+	}
+}
+
+// requestEnv returns env along with the variables set for req to repo
+// through Env.
+func (h *handler) requestEnv(env []string, req *http.Request, repo *repository) []string {
+	if h.env == nil {
+		return env
+	}
+	return append(env, h.env(req, repo.name)...)
+}
+
+// cgiEnv returns env along with the environment git http-backend runs Git
+// processes with as a CGI program, so hooks written for it work unchanged.
+func cgiEnv(env []string, req *http.Request, repo *repository) []string {
+	user := remoteUser(req)
+	if strings.ContainsRune(user, 0) {
+		user = ""
+	}
+	addr := remoteIP(req.RemoteAddr)
+
+	env = append(env, "PATH_INFO="+req.URL.Path, "REMOTE_ADDR="+addr)
+	if user != "" {
+		env = append(env, "REMOTE_USER="+user)
+	}
+
+	// Repositories resolved elsewhere, or namespaced, have no project root.
+	suffix := string(filepath.Separator) + filepath.FromSlash(repo.name)
+	if strings.HasSuffix(repo.dir, suffix) {
+		env = append(env, "GIT_PROJECT_ROOT="+strings.TrimSuffix(repo.dir, suffix))
+	}
+
+	// The same as git http-backend, identities set for gitd itself win.
+	if user == "" {
+		user = "anonymous"
+	}
+	if addr == "" {
+		addr = "(none)"
+	}
+	if os.Getenv("GIT_COMMITTER_NAME") == "" {
+		env = append(env, "GIT_COMMITTER_NAME="+user)
+	}
+	if os.Getenv("GIT_COMMITTER_EMAIL") == "" {
+		env = append(env, "GIT_COMMITTER_EMAIL="+user+"@http."+addr)
+	}
+	return env
+}
@@ -0,0 +1,86 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestCGIEnv(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "org/test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	// A hook written for git http-backend.
+	out := filepath.Join(workspace, "env")
+	hook := "#!/bin/sh\necho \"$REMOTE_USER $REMOTE_ADDR $PATH_INFO $GIT_PROJECT_ROOT $GIT_COMMITTER_NAME $GIT_COMMITTER_EMAIL\" > " + out + "\n"
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(rpath, "org", "test.git", "hooks", "pre-receive"), []byte(hook), 0755))
+
+	validate := func(user, pass string) bool { return pass == "secret" }
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), BasicAuth("gitd", validate)))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	url := strings.Replace(ts.URL, "http://", "http://alice:secret@", 1) + "/org/test.git"
+	cloneAndCommit(t, url, clone, "cgi")
+	git(t, clone, "push", "-q", "origin", "master")
+
+	env, err := ioutil.ReadFile(out)
+	assert.Ok(t, err)
+	fields := strings.Fields(string(env))
+	assert.Equals(t, 6, len(fields))
+	assert.Equals(t, "alice", fields[0])
+	assert.Equals(t, "127.0.0.1", fields[1])
+	assert.Equals(t, "/org/test.git/git-receive-pack", fields[2])
+	assert.Equals(t, rpath, fields[3])
+	if os.Getenv("GIT_COMMITTER_NAME") == "" {
+		assert.Equals(t, "alice", fields[4])
+	}
+	if os.Getenv("GIT_COMMITTER_EMAIL") == "" {
+		assert.Equals(t, "alice@http.127.0.0.1", fields[5])
+	}
+}
+
+func TestEnv(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "org/test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	out := filepath.Join(workspace, "env")
+	hook := "#!/bin/sh\necho \"$TENANT_ID $FEATURE\" > " + out + "\n"
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(rpath, "org", "test.git", "hooks", "pre-receive"), []byte(hook), 0755))
+
+	env := func(req *http.Request, repo string) []string {
+		return []string{"TENANT_ID=" + strings.Split(repo, "/")[0], "FEATURE=" + req.Header.Get("X-Feature")}
+	}
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), Env(env)))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/org/test.git", clone, "env")
+	git(t, clone, "-c", "http.extraHeader=X-Feature: fast", "push", "-q", "origin", "master")
+
+	content, err := ioutil.ReadFile(out)
+	assert.Ok(t, err)
+	assert.Equals(t, "org fast\n", string(content))
+}
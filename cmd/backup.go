@@ -0,0 +1,88 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/c4milo/gitd"
+)
+
+// newBackupPolicy returns the backup policy configured, if backups are
+// stored anywhere.
+func newBackupPolicy(config Config) (*gitd.BackupPolicy, error) {
+	var policy gitd.BackupPolicy
+	switch {
+	case config.BackupS3Bucket != "":
+		policy.Store = gitd.S3BackupStore(gitd.S3Config{
+			Endpoint:  config.BackupS3Endpoint,
+			Region:    config.BackupS3Region,
+			Bucket:    config.BackupS3Bucket,
+			Prefix:    config.BackupS3Prefix,
+			AccessKey: config.BackupS3AccessKey,
+			SecretKey: config.BackupS3SecretKey,
+		})
+	case config.BackupDir != "":
+		policy.Store = gitd.LocalBackupStore(config.BackupDir)
+	default:
+		return nil, nil
+	}
+
+	switch config.BackupFormat {
+	case "", "bundle":
+	case "tar":
+		policy.Format = gitd.TarBackup
+	default:
+		return nil, fmt.Errorf("invalid backup format %q", config.BackupFormat)
+	}
+
+	var err error
+	if config.BackupInterval != "" {
+		if policy.Interval, err = time.ParseDuration(config.BackupInterval); err != nil {
+			return nil, err
+		}
+	}
+	if config.BackupMaxAge != "" {
+		if policy.MaxAge, err = time.ParseDuration(config.BackupMaxAge); err != nil {
+			return nil, err
+		}
+	}
+	policy.Keep = int(config.BackupKeep)
+	return &policy, nil
+}
+
+// restore restores a repository from its backups, as asked by
+// "restore <repo> [time]", where time is in RFC 3339 format and defaults to
+// the latest snapshot. With a ref journal, the repository is brought to its
+// state at time by replaying the journal against the closest snapshot.
+func restore(config Config, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: gitd [-f config] restore <repo> [time]")
+	}
+
+	var at time.Time
+	if len(args) == 2 {
+		var err error
+		if at, err = time.Parse(time.RFC3339, args[1]); err != nil {
+			return err
+		}
+	}
+
+	server, err := newServer(config)
+	if err != nil {
+		return err
+	}
+	defer server.Shutdown(context.Background())
+
+	key, err := server.RestoreBackup(context.Background(), args[0], at)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s from %s\n", args[0], key)
+	return nil
+}
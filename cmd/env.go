@@ -0,0 +1,52 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envPrefix prefixes the environment variables configuring the service.
+const envPrefix = "GITD_"
+
+// applyEnv overrides settings in config with the environment variables
+// named after their TOML keys, e.g. GITD_PORT for port or GITD_REPOS_PATH
+// for repos_path.
+func applyEnv(config *Config) error {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("toml")
+		name := envPrefix + strings.ToUpper(key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Uint:
+			n, err := strconv.ParseUint(value, 10, 0)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+			field.SetUint(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+			field.SetBool(b)
+		}
+	}
+	return nil
+}
@@ -5,19 +5,27 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/user"
+	"strconv"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/c4milo/gitd"
 	"github.com/c4milo/handlers/logger"
 	"github.com/hashicorp/logutils"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/tylerb/graceful.v1"
 )
 
@@ -27,14 +35,132 @@ var Version string
 // Name is injected in build time and defined in the Makefile
 var Name string
 
-// Config defines the configurable options for this service.
+// Config defines the configurable options for this service. Settings are
+// read from the config file, if any, and then from environment variables
+// named after their keys, such as GITD_PORT for port, which take
+// precedence.
 type Config struct {
-	Bind            string `toml:"bind"`
-	Port            uint   `toml:"port"`
-	ReposPath       string `toml:"repos_path"`
-	LogLevel        string `toml:"log_level"`
-	LogFilePath     string `toml:"log_file"`
-	ShutdownTimeout string `toml:"shutdown_timeout"`
+	Bind               string `toml:"bind"`
+	BindUnix           string `toml:"bind_unix"`
+	BindUnixMode       string `toml:"bind_unix_mode"`
+	Port               uint   `toml:"port"`
+	ReposPath          string `toml:"repos_path"`
+	LogLevel           string `toml:"log_level"`
+	LogFilePath        string `toml:"log_file"`
+	ShutdownTimeout    string `toml:"shutdown_timeout"`
+	UploadPackTimeout  string `toml:"upload_pack_timeout"`
+	ReceivePackTimeout string `toml:"receive_pack_timeout"`
+	BufferSize         uint   `toml:"buffer_size"`
+	TLSCert            string `toml:"tls_cert"`
+	TLSKey             string `toml:"tls_key"`
+	TLSClientCA        string `toml:"tls_client_ca"`
+	SSHAddr            string `toml:"ssh_addr"`
+	SSHHostKey         string `toml:"ssh_host_key"`
+	SSHAuthorizedKeys  string `toml:"ssh_authorized_keys"`
+	GitDaemonAddr      string `toml:"git_daemon_addr"`
+	HealthChecks       bool   `toml:"health_checks"`
+	Archives           bool   `toml:"archives"`
+	Bundles            bool   `toml:"bundles"`
+	RawFiles           bool   `toml:"raw_files"`
+	RawFileMaxSize     uint   `toml:"raw_file_max_size"`
+	AuditLog           string `toml:"audit_log"`
+	RepoQuota          uint   `toml:"repo_quota"`
+	RateLimitOps       uint   `toml:"rate_limit_ops"`
+	RateLimitBytes     uint   `toml:"rate_limit_bytes"`
+	ProxyURL           string `toml:"proxy_url"`
+	ProxyUsername      string `toml:"proxy_username"`
+	ProxyPassword      string `toml:"proxy_password"`
+	ProxyCacheTTL      string `toml:"proxy_cache_ttl"`
+	CacheURL           string `toml:"cache_url"`
+	CacheUsername      string `toml:"cache_username"`
+	CachePassword      string `toml:"cache_password"`
+	CacheTTL           string `toml:"cache_ttl"`
+	RedirectsFile      string `toml:"redirects_file"`
+	ReadOnly           bool   `toml:"read_only"`
+	ReadOnlyReason     string `toml:"read_only_reason"`
+	ExportOK           bool   `toml:"export_ok"`
+	ExportOKMarker     string `toml:"export_ok_marker"`
+	BackupInterval     string `toml:"backup_interval"`
+	BackupFormat       string `toml:"backup_format"`
+	BackupKeep         uint   `toml:"backup_keep"`
+	BackupMaxAge       string `toml:"backup_max_age"`
+	BackupDir          string `toml:"backup_dir"`
+	BackupS3Endpoint   string `toml:"backup_s3_endpoint"`
+	BackupS3Region     string `toml:"backup_s3_region"`
+	BackupS3Bucket     string `toml:"backup_s3_bucket"`
+	BackupS3Prefix     string `toml:"backup_s3_prefix"`
+	BackupS3AccessKey  string `toml:"backup_s3_access_key"`
+	BackupS3SecretKey  string `toml:"backup_s3_secret_key"`
+	JournalFile        string `toml:"journal_file"`
+	JournalURL         string `toml:"journal_url"`
+	AdminToken         string `toml:"admin_token"`
+	GitPath            string `toml:"git_path"`
+	RepoPattern        string `toml:"repo_pattern"`
+	MinGitVersion      string `toml:"min_git_version"`
+	UploadPackBinary   string `toml:"upload_pack_binary"`
+	ReceivePackBinary  string `toml:"receive_pack_binary"`
+	RunAs              string `toml:"run_as"`
+	ProcessCPUTime     string `toml:"process_cpu_time"`
+	ProcessMemory      uint   `toml:"process_memory"`
+	ProcessOpenFiles   uint   `toml:"process_open_files"`
+	ProcessCgroup      string `toml:"process_cgroup"`
+	Confine            bool   `toml:"confine"`
+	// Mirrors, replicas, redirects, additional repository roots and tenants
+	// are only read from the config file.
+	Mirrors   []MirrorConfig    `toml:"mirror"`
+	Replicas  []ReplicaConfig   `toml:"replica"`
+	Redirects map[string]string `toml:"redirects"`
+	// ReposPaths are searched for repositories after ReposPath.
+	ReposPaths []string `toml:"repos_paths"`
+	// HideRefs lists the prefixes of refs kept from clients.
+	HideRefs []string `toml:"hide_refs"`
+	// RepoRoots maps the first segments of repository names to the roots
+	// they live under, replacing ReposPath.
+	RepoRoots map[string]string `toml:"repo_roots"`
+	// Tenants isolate the repositories of customers sharing the server.
+	Tenants []TenantConfig `toml:"tenant"`
+	// ConfineDirs and ConfineReadOnlyDirs are what confined Git processes
+	// can also write to and read.
+	ConfineDirs         []string `toml:"confine_dirs"`
+	ConfineReadOnlyDirs []string `toml:"confine_read_only_dirs"`
+	// AllowIPs and DenyIPs are the CIDR blocks clients are served from and
+	// refused from.
+	AllowIPs []string `toml:"allow_ips"`
+	DenyIPs  []string `toml:"deny_ips"`
+	// TrustedProxies are the CIDR blocks of the proxies whose forwarded
+	// client addresses are trusted.
+	TrustedProxies []string `toml:"trusted_proxies"`
+}
+
+// TenantConfig configures a tenant, serving repositories under its name.
+type TenantConfig struct {
+	Name           string `toml:"name"`
+	Root           string `toml:"root"`
+	Quota          int64  `toml:"quota"`
+	OpsPerMinute   int    `toml:"ops_per_minute"`
+	BytesPerMinute int64  `toml:"bytes_per_minute"`
+	Realm          string `toml:"realm"`
+	RunAs          string `toml:"run_as"`
+}
+
+// MirrorConfig configures a repository mirrored from an upstream
+// repository.
+type MirrorConfig struct {
+	Repo     string `toml:"repo"`
+	URL      string `toml:"url"`
+	Interval string `toml:"interval"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	SSHKey   string `toml:"ssh_key"`
+}
+
+// ReplicaConfig configures a server repositories are replicated to after
+// pushes.
+type ReplicaConfig struct {
+	URL      string `toml:"url"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	SSHKey   string `toml:"ssh_key"`
 }
 
 // Default configuration
@@ -45,22 +171,27 @@ var config = Config{
 	ShutdownTimeout: "15s",
 }
 
+// Configuration used for settings missing from the config file.
+var defaults Config
+
 // Configuration file path
 var configFile string
 
 func init() {
-	reposPath, err := ioutil.TempDir(os.TempDir(), Name)
-	if err != nil {
-		log.Fatalf("%v\n", err)
-	}
-	config.ReposPath = reposPath
+	defaults = config
 
 	flag.StringVar(&configFile, "f", "", "config file path")
 	flag.Parse()
 
-	if _, err := toml.DecodeFile(configFile, &config); err != nil {
-		log.Printf("[ERROR] %v", err)
-		log.Print("[ERROR] Parsing config file, using default configuration.")
+	if configFile != "" {
+		if _, err := toml.DecodeFile(configFile, &config); err != nil {
+			log.Printf("[ERROR] %v", err)
+			log.Print("[ERROR] Parsing config file, using default configuration.")
+		}
+	}
+
+	if err := applyEnv(&config); err != nil {
+		log.Fatalf("[ERROR] %v", err)
 	}
 }
 
@@ -86,9 +217,85 @@ func main() {
 
 	log.SetOutput(filter)
 
-	mux := http.DefaultServeMux
-	rack := gitd.Handler(mux, gitd.ReposPath(config.ReposPath))
-	rack = logger.Handler(rack, logger.AppName(Name))
+	var err error
+	switch command := flag.Arg(0); command {
+	case "", "serve":
+		if isService() {
+			err = runService(config, filter)
+		} else {
+			serve(config, filter, nil)
+		}
+	case "service":
+		err = manageService(flag.Args()[1:])
+	case "repo":
+		err = repo(config, flag.Args()[1:])
+	case "restore":
+		err = restore(config, flag.Args()[1:])
+	case "version":
+		fmt.Printf("%s %s\n", Name, Version)
+	default:
+		err = fmt.Errorf("unknown command %q, usage: gitd [-f config] [serve|repo|restore|service|version]", command)
+	}
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+}
+
+// serve serves Git repositories until the server is shut down, by a signal
+// or once stop, if not nil, is closed, logging through filter.
+func serve(config Config, filter *logutils.LevelFilter, stop <-chan struct{}) {
+	server, err := newServer(config)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	servers := new(reloadable)
+	servers.swap(server)
+	go reloadOnSignal(servers, filter)
+
+	rack := logger.Handler(servers, logger.AppName(Name))
+
+	activated, err := activatedListeners()
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	// listen returns the listener systemd passed for the protocol, if any.
+	listen := func(protocol, address string) (net.Listener, error) {
+		if l, ok := activated[protocol]; ok {
+			return l, nil
+		}
+		return net.Listen("tcp", address)
+	}
+
+	if config.SSHAddr != "" || activated["ssh"] != nil {
+		sshConfig, err := newSSHConfig(config)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+
+		l, err := listen("ssh", config.SSHAddr)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+
+		log.Printf("[INFO] Serving Git repositories over SSH on %s", l.Addr())
+		go func() {
+			log.Fatalf("[ERROR] %v", server.ServeSSH(l, sshConfig))
+		}()
+	}
+
+	if config.GitDaemonAddr != "" || activated["git"] != nil {
+		l, err := listen("git", config.GitDaemonAddr)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+
+		log.Printf("[INFO] Serving Git repositories read-only over git:// on %s", l.Addr())
+		go func() {
+			log.Fatalf("[ERROR] %v", server.ServeGitDaemon(l))
+		}()
+	}
 
 	address := fmt.Sprintf("%s:%d", config.Bind, config.Port)
 	timeout, err := time.ParseDuration(config.ShutdownTimeout)
@@ -96,8 +303,460 @@ func main() {
 		log.Fatalf("[ERROR] %v", err)
 	}
 
-	log.Printf("[INFO] Listening on %s...", address)
-	log.Printf("[INFO] Serving Git repositories over HTTP from %s", config.ReposPath)
+	srv := &graceful.Server{
+		Timeout: timeout,
+		Server:  &http.Server{Addr: address, Handler: rack},
+	}
+
+	// Git processes are given as long as connections to finish, instead of
+	// being left behind.
+	stopped := make(chan struct{})
+	srv.ShutdownInitiated = func() {
+		go func() {
+			defer close(stopped)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := servers.Shutdown(ctx); err != nil {
+				log.Printf("[WARN] Git processes had to be stopped: %v", err)
+			}
+		}()
+	}
+
+	if stop != nil {
+		go func() {
+			<-stop
+			srv.Stop(timeout)
+		}()
+	}
+
+	var tlsConfig *tls.Config
+	if config.TLSCert != "" {
+		if tlsConfig, err = newTLSConfig(config); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+	}
+
+	l, ok := activated["http"]
+	if !ok && config.BindUnix != "" {
+		if l, err = listenUnix(config.BindUnix, config.BindUnixMode); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+	}
+
+	switch {
+	case l != nil && tlsConfig != nil:
+		log.Printf("[INFO] Listening on %s...", l.Addr())
+		log.Printf("[INFO] Serving Git repositories over HTTPS from %s", config.ReposPath)
+		srv.TLSConfig = tlsConfig
+		err = srv.Serve(tls.NewListener(l, tlsConfig))
+	case l != nil:
+		log.Printf("[INFO] Listening on %s...", l.Addr())
+		log.Printf("[INFO] Serving Git repositories over HTTP from %s", config.ReposPath)
+		err = srv.Serve(l)
+	case tlsConfig != nil:
+		log.Printf("[INFO] Listening on %s...", address)
+		log.Printf("[INFO] Serving Git repositories over HTTPS from %s", config.ReposPath)
+		err = srv.ListenAndServeTLSConfig(tlsConfig)
+	default:
+		log.Printf("[INFO] Listening on %s...", address)
+		log.Printf("[INFO] Serving Git repositories over HTTP from %s", config.ReposPath)
+		err = srv.ListenAndServe()
+	}
+
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	<-stopped
+}
+
+// listenUnix listens on the Unix socket at path, replacing any stale one,
+// and sets its permissions to mode, an octal string such as "0660".
+func listenUnix(path, mode string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("invalid bind_unix_mode %q: %v", mode, err)
+		}
+		if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// newServer returns a Git server configured after config.
+func newServer(config Config) (*gitd.Server, error) {
+	var opts []gitd.Option
+	if config.ReposPath != "" {
+		opts = append(opts, gitd.ReposPath(config.ReposPath, config.ReposPaths...))
+	}
+	if len(config.RepoRoots) > 0 {
+		opts = append(opts, gitd.RepoStorage(gitd.PrefixStorage(config.RepoRoots)))
+	}
+	if config.RepoPattern != "" {
+		opts = append(opts, gitd.RepoPattern(config.RepoPattern))
+	}
+	if config.TLSClientCA != "" {
+		// Client certificates identify who is fetching or pushing.
+		opts = append(opts, gitd.ClientCertAuth(nil))
+	}
+	if config.HealthChecks {
+		opts = append(opts, gitd.HealthChecks())
+	}
+	if config.AdminToken != "" {
+		opts = append(opts, gitd.AdminAPI(), gitd.AdminToken(config.AdminToken))
+	}
+	if config.Archives {
+		opts = append(opts, gitd.Archives(true))
+	}
+	if config.Bundles {
+		opts = append(opts, gitd.Bundles(true))
+	}
+	if config.RawFiles {
+		opts = append(opts, gitd.RawFiles(int64(config.RawFileMaxSize)))
+	}
+
+	if config.AuditLog != "" {
+		sink, err := openAuditLog(config.AuditLog)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, gitd.AuditLog(sink))
+	}
+
+	if config.RepoQuota > 0 {
+		quota := int64(config.RepoQuota)
+		opts = append(opts, gitd.RepoQuota(func(string) int64 { return quota }))
+	}
+
+	if config.RateLimitOps > 0 || config.RateLimitBytes > 0 {
+		opts = append(opts, gitd.RateLimit(int(config.RateLimitOps), int64(config.RateLimitBytes)))
+	}
+
+	if config.ProxyURL != "" {
+		upstream := gitd.Upstream{
+			URL:      config.ProxyURL,
+			Username: config.ProxyUsername,
+			Password: config.ProxyPassword,
+		}
+		if config.ProxyCacheTTL != "" {
+			d, err := time.ParseDuration(config.ProxyCacheTTL)
+			if err != nil {
+				return nil, err
+			}
+			upstream.CacheTTL = d
+		}
+		opts = append(opts, gitd.Proxy(upstream))
+	}
+
+	if config.CacheURL != "" {
+		upstream := gitd.Upstream{
+			URL:      config.CacheURL,
+			Username: config.CacheUsername,
+			Password: config.CachePassword,
+		}
+		if config.CacheTTL != "" {
+			d, err := time.ParseDuration(config.CacheTTL)
+			if err != nil {
+				return nil, err
+			}
+			upstream.CacheTTL = d
+		}
+		opts = append(opts, gitd.ReadThroughCache(upstream))
+	}
+
+	if len(config.Redirects) > 0 {
+		opts = append(opts, gitd.Redirects(config.Redirects))
+	}
+	if config.RedirectsFile != "" {
+		opts = append(opts, gitd.RedirectsFile(config.RedirectsFile))
+	}
+
+	if config.ReadOnly {
+		opts = append(opts, gitd.ReadOnly(config.ReadOnlyReason))
+	}
+	if config.ExportOK {
+		opts = append(opts, gitd.ExportOK(config.ExportOKMarker))
+	}
+	if len(config.HideRefs) > 0 {
+		opts = append(opts, gitd.HideRefs(gitd.HiddenRefs{All: config.HideRefs}))
+	}
+
+	policy, err := newBackupPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		opts = append(opts, gitd.Backups(*policy))
+	}
+	switch {
+	case config.JournalURL != "":
+		opts = append(opts, gitd.RefJournal(gitd.HTTPJournal(config.JournalURL, nil)))
+	case config.JournalFile != "":
+		opts = append(opts, gitd.RefJournal(gitd.FileJournal(config.JournalFile)))
+	}
+
+	if len(config.Mirrors) > 0 {
+		var mirrors []gitd.Mirror
+		for _, m := range config.Mirrors {
+			var interval time.Duration
+			if m.Interval != "" {
+				d, err := time.ParseDuration(m.Interval)
+				if err != nil {
+					return nil, fmt.Errorf("invalid interval of mirror %s: %v", m.Repo, err)
+				}
+				interval = d
+			}
+			mirrors = append(mirrors, gitd.Mirror{
+				Repo:     m.Repo,
+				URL:      m.URL,
+				Interval: interval,
+				Username: m.Username,
+				Password: m.Password,
+				SSHKey:   m.SSHKey,
+			})
+		}
+		opts = append(opts, gitd.Mirrors(mirrors...))
+	}
+
+	if len(config.Tenants) > 0 {
+		var tenants []gitd.Tenant
+		for _, t := range config.Tenants {
+			tenant := gitd.Tenant{
+				Name:           t.Name,
+				Root:           t.Root,
+				Quota:          t.Quota,
+				OpsPerMinute:   t.OpsPerMinute,
+				BytesPerMinute: t.BytesPerMinute,
+				Realm:          t.Realm,
+			}
+			if t.RunAs != "" {
+				var err error
+				if tenant.UID, tenant.GID, err = lookupAccount(t.RunAs); err != nil {
+					return nil, err
+				}
+			}
+			tenants = append(tenants, tenant)
+		}
+		opts = append(opts, gitd.Tenants(tenants...))
+	}
+
+	if len(config.Replicas) > 0 {
+		var replicas []gitd.Replica
+		for _, r := range config.Replicas {
+			replicas = append(replicas, gitd.Replica{
+				URL:      r.URL,
+				Username: r.Username,
+				Password: r.Password,
+				SSHKey:   r.SSHKey,
+			})
+		}
+		opts = append(opts, gitd.Replicas(replicas...))
+	}
+
+	if config.UploadPackTimeout != "" {
+		d, err := time.ParseDuration(config.UploadPackTimeout)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, gitd.UploadPackTimeout(d))
+	}
+
+	if config.ReceivePackTimeout != "" {
+		d, err := time.ParseDuration(config.ReceivePackTimeout)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, gitd.ReceivePackTimeout(d))
+	}
+
+	if config.BufferSize > 0 {
+		opts = append(opts, gitd.BufferSize(int(config.BufferSize)))
+	}
+	if config.GitPath != "" {
+		opts = append(opts, gitd.GitPath(config.GitPath))
+	}
+	if config.MinGitVersion != "" {
+		opts = append(opts, gitd.MinGitVersion(config.MinGitVersion))
+	}
+	if config.UploadPackBinary != "" {
+		opts = append(opts, gitd.UploadPackBinary(config.UploadPackBinary))
+	}
+	if config.ReceivePackBinary != "" {
+		opts = append(opts, gitd.ReceivePackBinary(config.ReceivePackBinary))
+	}
+	if config.RunAs != "" {
+		uid, gid, err := lookupAccount(config.RunAs)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, gitd.RunAs(uid, gid))
+	}
+
+	if config.ProcessCPUTime != "" || config.ProcessMemory > 0 || config.ProcessOpenFiles > 0 || config.ProcessCgroup != "" {
+		limits := gitd.ProcessLimits{
+			Memory:    int64(config.ProcessMemory),
+			OpenFiles: int(config.ProcessOpenFiles),
+			Cgroup:    config.ProcessCgroup,
+		}
+		if config.ProcessCPUTime != "" {
+			d, err := time.ParseDuration(config.ProcessCPUTime)
+			if err != nil {
+				return nil, err
+			}
+			limits.CPUTime = d
+		}
+		opts = append(opts, gitd.LimitProcesses(limits))
+	}
+
+	if config.Confine {
+		c := gitd.Confinement{Dirs: config.ConfineDirs, ReadOnlyDirs: config.ConfineReadOnlyDirs}
+		for _, root := range config.RepoRoots {
+			c.Dirs = append(c.Dirs, root)
+		}
+		opts = append(opts, gitd.Confine(c))
+	}
+
+	if len(config.AllowIPs) > 0 {
+		opts = append(opts, gitd.AllowIPs(config.AllowIPs...))
+	}
+	if len(config.DenyIPs) > 0 {
+		opts = append(opts, gitd.DenyIPs(config.DenyIPs...))
+	}
+	if len(config.TrustedProxies) > 0 {
+		opts = append(opts, gitd.TrustedProxies(config.TrustedProxies...))
+	}
+	server, err := gitd.NewServer(http.DefaultServeMux, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := server.Validate(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// lookupAccount returns the user and primary group of the user name, or
+// user ID.
+func lookupAccount(name string) (uint32, uint32, error) {
+	u, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		u, err = user.LookupId(name)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
 
-	graceful.Run(address, timeout, rack)
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(uid), uint32(gid), nil
+}
+
+// auditLogs are the audit logs opened, by path, so reloads keep appending
+// to them instead of opening them again.
+var auditLogs = make(map[string]gitd.AuditSink)
+
+// openAuditLog returns the audit log sink appending to the file at path.
+func openAuditLog(path string) (gitd.AuditSink, error) {
+	if sink, ok := auditLogs[path]; ok {
+		return sink, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	auditLogs[path] = gitd.JSONAuditSink(f)
+	return auditLogs[path], nil
+}
+
+// newTLSConfig returns the TLS configuration for serving HTTPS, including
+// HTTP/2. Clients are required to present a certificate signed by the
+// client CA, if one is configured.
+func newTLSConfig(config Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if config.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(config.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + config.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// newSSHConfig returns the configuration for serving Git over SSH. Clients
+// must use one of the authorized keys, and are identified by its comment.
+func newSSHConfig(config Config) (*ssh.ServerConfig, error) {
+	pemBytes, err := ioutil.ReadFile(config.SSHHostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKey, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	authorized, err := ioutil.ReadFile(config.SSHAuthorizedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	identities := make(map[string]string)
+	for len(authorized) > 0 {
+		key, comment, _, rest, err := ssh.ParseAuthorizedKey(authorized)
+		if err != nil {
+			break
+		}
+		identities[string(key.Marshal())] = comment
+		authorized = rest
+	}
+
+	sshConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			identity, ok := identities[string(key.Marshal())]
+			if !ok {
+				return nil, errors.New("unknown public key for " + conn.User())
+			}
+			return &ssh.Permissions{
+				Extensions: map[string]string{gitd.SSHIdentityExtension: identity},
+			}, nil
+		},
+	}
+	sshConfig.AddHostKey(hostKey)
+	return sshConfig, nil
 }
@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"github.com/c4milo/gitd"
+	"github.com/hashicorp/logutils"
+)
+
+// reloadable serves HTTP requests with the Git server built from the latest
+// configuration. Servers replaced by reloads keep serving the requests they
+// took, and are tracked so their Git processes are stopped on shutdown.
+type reloadable struct {
+	sync.Mutex
+	current *gitd.Server
+	servers []*gitd.Server
+}
+
+func (r *reloadable) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	current := r.current
+	r.Unlock()
+	current.ServeHTTP(w, req)
+}
+
+// swap makes server serve new requests.
+func (r *reloadable) swap(server *gitd.Server) {
+	r.Lock()
+	defer r.Unlock()
+	r.current = server
+	r.servers = append(r.servers, server)
+}
+
+// Shutdown shuts down all servers.
+func (r *reloadable) Shutdown(ctx context.Context) error {
+	r.Lock()
+	servers := r.servers
+	r.Unlock()
+
+	var err error
+	for _, server := range servers {
+		if e := server.Shutdown(ctx); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// reloadOnSignal re-reads the config file on SIGHUP, applying the new log
+// level and Git server settings to HTTP requests from then on, while
+// requests in flight complete as they started. Listeners, TLS, SSH and
+// git:// settings still require a restart.
+func reloadOnSignal(servers *reloadable, filter *logutils.LevelFilter) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	for range c {
+		newConfig := defaults
+		if configFile != "" {
+			if _, err := toml.DecodeFile(configFile, &newConfig); err != nil {
+				log.Printf("[ERROR] %v", err)
+				log.Print("[ERROR] Reloading config file, keeping current configuration.")
+				continue
+			}
+		}
+
+		if err := applyEnv(&newConfig); err != nil {
+			log.Printf("[ERROR] %v", err)
+			log.Print("[ERROR] Reloading config file, keeping current configuration.")
+			continue
+		}
+
+		server, err := newServer(newConfig)
+		if err != nil {
+			log.Printf("[ERROR] %v", err)
+			log.Print("[ERROR] Reloading config file, keeping current configuration.")
+			continue
+		}
+
+		filter.SetMinLevel(logutils.LogLevel(newConfig.LogLevel))
+		servers.swap(server)
+		log.Printf("[INFO] Configuration reloaded, serving Git repositories from %s", newConfig.ReposPath)
+	}
+}
@@ -0,0 +1,220 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/c4milo/gitd"
+)
+
+// repoUsage describes the repo command.
+const repoUsage = `usage: gitd [-f config] repo [-url url] <command> [args]
+
+Commands:
+  create [-branch branch] [-description text] <repo>
+  delete <repo>
+  list
+  gc <repo>
+
+With -url, repositories are managed through the admin API of the daemon
+serving them, authenticating with admin_token. Otherwise they are managed on
+disk, which is only safe for creating and listing them while a daemon
+serves them.`
+
+// repoManager manages repositories, on disk or through the admin API.
+type repoManager interface {
+	create(name string, opts gitd.RepoOptions) (string, error)
+	delete(name string) error
+	list() ([]string, error)
+	gc(name string) error
+}
+
+// repo manages repositories, as asked by "repo [-url url] <command> [args]".
+func repo(config Config, args []string) error {
+	flags := flag.NewFlagSet("repo", flag.ContinueOnError)
+	url := flags.String("url", "", "URL of the daemon serving the admin API")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		return errors.New(repoUsage)
+	}
+
+	var m repoManager
+	if *url != "" {
+		m = &adminClient{
+			url:    strings.TrimSuffix(*url, "/"),
+			token:  config.AdminToken,
+			client: &http.Client{Timeout: 10 * time.Minute},
+		}
+	} else {
+		server, err := newServer(config)
+		if err != nil {
+			return err
+		}
+		defer server.Shutdown(context.Background())
+		m = localRepos{server}
+	}
+
+	command, args := args[0], args[1:]
+	switch {
+	case command == "create":
+		flags := flag.NewFlagSet("create", flag.ContinueOnError)
+		branch := flags.String("branch", "", "default branch")
+		desc := flags.String("description", "", "description")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return errors.New(repoUsage)
+		}
+		name := flags.Arg(0)
+		head, err := m.create(name, gitd.RepoOptions{DefaultBranch: *branch, Description: *desc})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created %s with default branch %s\n", name, head)
+	case command == "delete" && len(args) == 1:
+		if err := m.delete(args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %s\n", args[0])
+	case command == "list" && len(args) == 0:
+		repos, err := m.list()
+		if err != nil {
+			return err
+		}
+		for _, name := range repos {
+			fmt.Println(name)
+		}
+	case command == "gc" && len(args) == 1:
+		if err := m.gc(args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Maintained %s\n", args[0])
+	default:
+		return errors.New(repoUsage)
+	}
+	return nil
+}
+
+// localRepos manages the repositories on disk.
+type localRepos struct {
+	server *gitd.Server
+}
+
+func (r localRepos) create(name string, opts gitd.RepoOptions) (string, error) {
+	return r.server.CreateRepo(context.Background(), name, opts)
+}
+
+func (r localRepos) delete(name string) error {
+	return r.server.DeleteRepo(context.Background(), name)
+}
+
+func (r localRepos) list() ([]string, error) {
+	return r.server.ListRepos(context.Background())
+}
+
+func (r localRepos) gc(name string) error {
+	return r.server.MaintainRepo(context.Background(), name)
+}
+
+// adminClient manages repositories through the admin API served at url.
+type adminClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// adminRepo is a repository in admin API requests and responses.
+type adminRepo struct {
+	Name          string `json:"name"`
+	DefaultBranch string `json:"default_branch,omitempty"`
+	Description   string `json:"description,omitempty"`
+}
+
+func (c *adminClient) create(name string, opts gitd.RepoOptions) (string, error) {
+	repo := adminRepo{Name: name, DefaultBranch: opts.DefaultBranch, Description: opts.Description}
+	if err := c.do("POST", "/api/repos", repo, &repo); err != nil {
+		return "", err
+	}
+	return repo.DefaultBranch, nil
+}
+
+func (c *adminClient) delete(name string) error {
+	return c.do("DELETE", "/api/repos/"+name, nil, nil)
+}
+
+func (c *adminClient) list() ([]string, error) {
+	var repos []adminRepo
+	if err := c.do("GET", "/api/repos?archived=true", nil, &repos); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		names = append(names, repo.Name)
+	}
+	return names, nil
+}
+
+func (c *adminClient) gc(name string) error {
+	return c.do("POST", "/api/repos/"+name+"/maintenance", nil, nil)
+}
+
+// do sends an admin API request with body, if not nil, as JSON, decoding
+// the response into out, if not nil.
+func (c *adminClient) do(method, path string, body, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.url+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		msg, _ := ioutil.ReadAll(res.Body)
+		if json.Unmarshal(msg, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s %s: %s", method, path, e.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, res.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+
+	"github.com/hashicorp/logutils"
+)
+
+// isService returns whether gitd is running as a Windows service, which it
+// never is elsewhere.
+func isService() bool {
+	return false
+}
+
+// runService is only supported on Windows.
+func runService(config Config, filter *logutils.LevelFilter) error {
+	return errors.New("Windows services are only supported on Windows")
+}
+
+// manageService is only supported on Windows.
+func manageService(args []string) error {
+	return errors.New("Windows services are only supported on Windows")
+}
@@ -0,0 +1,135 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/logutils"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name gitd is installed as a Windows service under.
+const serviceName = "gitd"
+
+// serviceUsage describes the service command.
+const serviceUsage = `usage: gitd [-f config] service <install|uninstall|start|stop>
+
+The service runs gitd with the config file given when installing it. Its
+working directory is the system directory, so paths in the config file,
+such as repos_path and log_file, had better be absolute.`
+
+// isService returns whether gitd is running as a Windows service.
+func isService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// runService serves Git repositories as a Windows service, until the
+// service control manager stops it.
+func runService(config Config, filter *logutils.LevelFilter) error {
+	return svc.Run(serviceName, &service{config: config, filter: filter})
+}
+
+// service serves Git repositories as asked by the service control manager.
+type service struct {
+	config Config
+	filter *logutils.LevelFilter
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		serve(s.config, s.filter, stop)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case <-stopped:
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(stop)
+				<-stopped
+				return false, 0
+			}
+		}
+	}
+}
+
+// manageService manages the Windows service running gitd, as asked by
+// "service <install|uninstall|start|stop>".
+func manageService(args []string) error {
+	if len(args) != 1 {
+		return errors.New(serviceUsage)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if args[0] == "install" {
+		return installService(m)
+	}
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	switch args[0] {
+	case "uninstall":
+		return s.Delete()
+	case "start":
+		return s.Start()
+	case "stop":
+		_, err := s.Control(svc.Stop)
+		return err
+	}
+	return errors.New(serviceUsage)
+}
+
+// installService installs the service running this binary with the config
+// file in use, starting it along with Windows.
+func installService(m *mgr.Mgr) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var args []string
+	if configFile != "" {
+		path, err := filepath.Abs(configFile)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-f", path)
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "gitd",
+		Description: "Serves Git repositories over HTTP, SSH and git://.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
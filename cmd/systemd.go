@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// activatedListeners returns the listeners passed through systemd socket
+// activation, by protocol. Sockets are told apart by the names set with
+// FileDescriptorName= in socket units: "ssh" and "git" sockets serve SSH and
+// git:// respectively, and any other one serves HTTP.
+func activatedListeners() (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make(map[string]net.Listener)
+	for i := 0; i < n; i++ {
+		name := "http"
+		if i < len(names) && (names[i] == "ssh" || names[i] == "git") {
+			name = names[i]
+		}
+
+		if _, ok := listeners[name]; ok {
+			return nil, fmt.Errorf("more than one %s socket passed by systemd", name)
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
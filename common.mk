@@ -7,7 +7,7 @@ test:
 	go test ./...
 
 build:
-	go build -o build/$(NAME) $(LDFLAGS) cmd/$(NAME).go
+	go build -o build/$(NAME) $(LDFLAGS) ./cmd
 
 install:
 	go install $(LDFLAGS)
@@ -19,6 +19,7 @@ compile:
 	-os="linux" \
 	-os="solaris" \
 	-os="freebsd" \
+	-os="windows" \
 	-output "build/$(NAME)_$(VERSION)_{{.OS}}_{{.Arch}}/$(NAME)" \
 	./...
 
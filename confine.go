@@ -0,0 +1,104 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// confineArg is the argument Git commands are run with in place of Git,
+// for the server binary to confine itself before running Git.
+const confineArg = "--gitd-confine="
+
+// Confinement configures what Git processes can reach besides the
+// repository roots.
+type Confinement struct {
+	// Dirs are directories Git can also write to, such as the roots of
+	// repositories stored elsewhere with RepoStorage.
+	Dirs []string
+	// ReadOnlyDirs are directories Git can also read, such as those holding
+	// the SSH keys of mirrors and replicas.
+	ReadOnlyDirs []string
+}
+
+// Confine keeps Git processes running on repositories, and so hooks, from
+// reaching files outside of the roots of ReposPath, Tenants and RepoPools,
+// and those in c, save for reading and running the system files Git needs,
+// so even a vulnerability in Git cannot expose others. Git processes are
+// run through the server binary, which confines itself with Landlock before
+// running Git, failing if it cannot. Confine requires Linux 5.13 or later,
+// and is ignored elsewhere.
+func Confine(c Confinement) Option {
+	return func(h *handler) {
+		h.confinement = &confinement{Confinement: c}
+	}
+}
+
+// confinement holds the state of a Confinement.
+type confinement struct {
+	Confinement
+	// self is the server binary, running Git once confined.
+	self string
+	// dirs and readOnly are the absolute directories Git can write to and
+	// read.
+	dirs, readOnly []string
+}
+
+// confinedCommand tells the server binary which Git binary to run once
+// confined, and what it can reach.
+type confinedCommand struct {
+	Path     string   `json:"path"`
+	Dirs     []string `json:"dirs"`
+	ReadOnly []string `json:"read_only"`
+}
+
+// init resolves the directories Git can reach, once h is configured.
+func (c *confinement) init(h *handler) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	c.self = self
+
+	dirs := append([]string{}, h.reposPaths...)
+	for _, t := range h.tenants {
+		dirs = append(dirs, t.Root)
+	}
+	if h.poolsRoot != "" {
+		dirs = append(dirs, h.poolsRoot)
+	}
+	dirs = append(dirs, c.Dirs...)
+
+	if c.dirs, err = absPaths(dirs); err != nil {
+		return err
+	}
+	c.readOnly, err = absPaths(c.ReadOnlyDirs)
+	return err
+}
+
+// wrap runs cmd through the server binary, confining Git before running it.
+// The first argument, naming the service, is kept.
+func (c *confinement) wrap(cmd *exec.Cmd) {
+	arg, _ := json.Marshal(confinedCommand{Path: cmd.Path, Dirs: c.dirs, ReadOnly: c.readOnly})
+	args := append([]string{cmd.Args[0], confineArg + string(arg)}, cmd.Args[1:]...)
+	cmd.Path = c.self
+	cmd.Args = args
+}
+
+// absPaths returns paths made absolute.
+func absPaths(paths []string) ([]string, error) {
+	abs := make([]string, 0, len(paths))
+	for _, p := range paths {
+		a, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		abs = append(abs, a)
+	}
+	return abs, nil
+}
@@ -0,0 +1,138 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// canConfine tells whether Git processes can be confined.
+const canConfine = true
+
+// systemFiles are the files and directories Git can read and run files from
+// when confined.
+var systemFiles = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/etc", "/dev/urandom"}
+
+// Landlock access rights, by the ABI version introducing them.
+const (
+	landlockFileRights = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_READ_FILE
+	landlockReadRights = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockRightsV1   = 1<<13 - 1
+)
+
+func init() {
+	// The server binary is being run in place of Git, to confine it.
+	if len(os.Args) > 1 && strings.HasPrefix(os.Args[1], confineArg) {
+		err := runConfined(os.Args)
+		fmt.Fprintf(os.Stderr, "gitd: confining Git failed: %v\n", err)
+		os.Exit(126)
+	}
+}
+
+// runConfined confines the process to what args, as built by wrap, allow,
+// and runs Git with the rest of them. It only returns if it fails.
+func runConfined(args []string) error {
+	var cc confinedCommand
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(args[1], confineArg)), &cc); err != nil {
+		return err
+	}
+
+	// Landlock restricts the calling thread, which must run Git.
+	runtime.LockOSThread()
+
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return fmt.Errorf("landlock not available: %v", errno)
+	}
+	handled := uint64(landlockRightsV1)
+	fileRights := uint64(landlockFileRights)
+	if abi >= 2 {
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		handled |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+		fileRights |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if abi >= 5 {
+		handled |= unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+		fileRights |= unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("creating landlock ruleset: %v", errno)
+	}
+	ruleset := int(fd)
+	defer unix.Close(ruleset)
+
+	// Git reads the global configuration of the user, if any.
+	readOnly := append(append([]string{}, systemFiles...), cc.ReadOnly...)
+	readOnly = append(readOnly, filepath.Dir(filepath.Dir(cc.Path)))
+	if home := os.Getenv("HOME"); home != "" {
+		readOnly = append(readOnly, filepath.Join(home, ".gitconfig"), filepath.Join(home, ".config", "git"))
+	}
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		readOnly = append(readOnly, filepath.Join(xdg, "git"))
+	}
+
+	for _, dir := range readOnly {
+		if err := landlockAllow(ruleset, dir, landlockReadRights, landlockReadRights&fileRights); err != nil {
+			return err
+		}
+	}
+	for _, dir := range append(cc.Dirs, "/dev/null") {
+		if err := landlockAllow(ruleset, dir, handled, fileRights); err != nil {
+			return err
+		}
+	}
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("setting no_new_privs: %v", err)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0); errno != 0 {
+		return fmt.Errorf("enforcing landlock ruleset: %v", errno)
+	}
+
+	argv := append([]string{args[0]}, args[2:]...)
+	return syscall.Exec(cc.Path, argv, os.Environ())
+}
+
+// landlockAllow allows access to path, if it exists, in ruleset: rights if
+// it is a directory, or fileRights if it is a file.
+func landlockAllow(ruleset int, path string, rights, fileRights uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err == unix.ENOENT || err == unix.ENOTDIR {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening %s: %v", path, err)
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("opening %s: %v", path, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		rights = fileRights
+	}
+
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: rights, Parent_fd: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("allowing %s: %v", path, errno)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestConfine(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "repo.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	secret := filepath.Join(workspace, "secret")
+	assert.Ok(t, ioutil.WriteFile(secret, []byte("s3cr3t"), 0644))
+
+	// Hooks only reach the repositories.
+	hook := "#!/bin/sh\ncat " + secret + " >&2 || echo denied >&2\n"
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(rpath, "repo.git", "hooks", "post-receive"), []byte(hook), 0755))
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		Confine(Confinement{}),
+	))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "repo")
+	cloneAndCommit(t, ts.URL+"/repo.git", clone, "blah")
+	cmd := exec.Command("git", "push", "origin", "master")
+	cmd.Dir = clone
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err == nil, "push failed: %s", out)
+	assert.Cond(t, strings.Contains(string(out), "remote: denied"), "unexpected output: %s", out)
+	assert.Cond(t, !strings.Contains(string(out), "s3cr3t"), "hook read outside of the repositories: %s", out)
+
+	git(t, workspace, "clone", ts.URL+"/repo.git", filepath.Join(workspace, "again"))
+}
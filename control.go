@@ -0,0 +1,131 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// Errors returned by the methods of Server managing repositories.
+var (
+	ErrInvalidRepoName      = errors.New("invalid repository name")
+	ErrInvalidDefaultBranch = errors.New("invalid default branch")
+	ErrInvalidDescription   = errors.New("invalid description")
+	ErrTemplateNotFound     = errors.New("template repository not found")
+	ErrRepoExists           = errors.New("repository already exists")
+	ErrRepoHasForks         = errors.New("repository has forks")
+	ErrRepoBusy             = errors.New("repository is busy")
+)
+
+// RepoOptions configures repositories created with CreateRepo.
+type RepoOptions struct {
+	// DefaultBranch is the branch HEAD points to, the one set with
+	// DefaultBranch if empty.
+	DefaultBranch string
+	Description   string
+	// Template is the name of a repository to copy hooks and configuration
+	// from.
+	Template string
+}
+
+// Ref is a ref of a repository and the object it points to.
+type Ref struct {
+	Name string
+	SHA  string
+}
+
+// CreateRepo creates the bare repository name, as the admin API does,
+// returning the branch its HEAD points to.
+func (s *Server) CreateRepo(ctx context.Context, name string, opts RepoOptions) (string, error) {
+	info := repoInfo{Name: name, DefaultBranch: opts.DefaultBranch, Description: opts.Description, Template: opts.Template}
+	dir, err := s.h.newRepo(ctx, info, contextUser(ctx))
+	if err != nil {
+		return "", err
+	}
+	return defaultBranch(dir), nil
+}
+
+// DeleteRepo deletes the repository name, or moves it to the trash, as the
+// admin API does. It returns ErrRepoBusy if the operations running on it do
+// not finish in time.
+func (s *Server) DeleteRepo(ctx context.Context, name string) error {
+	h := s.h
+	dir, err := h.repoDir(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	forked, err := h.hasForks(dir)
+	if err != nil {
+		return err
+	}
+	if forked {
+		return ErrRepoHasForks
+	}
+	return h.removeRepo(ctx, name, dir, contextUser(ctx))
+}
+
+// ListRefs returns the refs of the repository name, sorted by name.
+func (s *Server) ListRefs(ctx context.Context, name string) ([]Ref, error) {
+	h := s.h
+	dir, err := h.repoDir(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := h.gitCommandContext(ctx, dir, "for-each-ref", "--format=%(refname)%00%(objectname)")
+	out, _, err := runAndLog(h.logger, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []Ref{}
+	for _, line := range splitLines(out) {
+		if fields := strings.Split(line, "\x00"); len(fields) == 2 {
+			refs = append(refs, Ref{Name: fields[0], SHA: fields[1]})
+		}
+	}
+	return refs, nil
+}
+
+// ListRepos returns the names of the repositories, archived ones included.
+func (s *Server) ListRepos(ctx context.Context) ([]string, error) {
+	repos := []string{}
+	err := s.h.walkRepos(func(name, dir string) error {
+		repos = append(repos, name)
+		return ctx.Err()
+	})
+	return repos, err
+}
+
+// RepoSize returns the disk usage of the repository name, in bytes.
+func (s *Server) RepoSize(ctx context.Context, name string) (int64, error) {
+	dir, err := s.h.repoDir(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	return s.h.repoUsage(dir)
+}
+
+// MaintainRepo runs maintenance on the repository name, such as garbage
+// collection, returning once done. It returns ErrMaintenanceRunning if the
+// repository is already being maintained.
+func (s *Server) MaintainRepo(ctx context.Context, name string) error {
+	dir, err := s.h.repoDir(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	s.h.logger.Info("Repository maintenance requested", Field{"repo", name}, Field{"user", contextUser(ctx)})
+	return s.h.maintainRepo(name, dir)
+}
+
+// contextUser returns the identity ctx was authenticated as, if any.
+func contextUser(ctx context.Context) string {
+	identity, _ := IdentityFromContext(ctx)
+	return identity
+}
@@ -0,0 +1,77 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestServerRepos(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	srv, err := NewServer(http.NotFoundHandler(), ReposPath(rpath))
+	assert.Ok(t, err)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	ctx := context.Background()
+
+	branch, err := srv.CreateRepo(ctx, "org/test.git", RepoOptions{DefaultBranch: "main", Description: "testing"})
+	assert.Ok(t, err)
+	assert.Equals(t, "main", branch)
+	assert.Equals(t, "testing", description(filepath.Join(rpath, "org", "test.git")))
+
+	_, err = srv.CreateRepo(ctx, "org/test.git", RepoOptions{})
+	assert.Equals(t, ErrRepoExists, err)
+	_, err = srv.CreateRepo(ctx, "../evil.git", RepoOptions{})
+	assert.Equals(t, ErrInvalidRepoName, err)
+	_, err = srv.CreateRepo(ctx, "other.git", RepoOptions{Template: "missing.git"})
+	assert.Equals(t, ErrTemplateNotFound, err)
+
+	repos, err := srv.ListRepos(ctx)
+	assert.Ok(t, err)
+	assert.Equals(t, []string{"org/test.git"}, repos)
+
+	refs, err := srv.ListRefs(ctx, "org/test.git")
+	assert.Ok(t, err)
+	assert.Equals(t, []Ref{}, refs)
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/org/test.git", clone, "blah")
+	git(t, clone, "push", "origin", "HEAD:main")
+
+	refs, err = srv.ListRefs(ctx, "org/test.git")
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(refs))
+	assert.Equals(t, "refs/heads/main", refs[0].Name)
+	assert.Equals(t, 40, len(refs[0].SHA))
+
+	size, err := srv.RepoSize(ctx, "org/test.git")
+	assert.Ok(t, err)
+	assert.Cond(t, size > 0, "repository should take up disk space")
+
+	assert.Ok(t, srv.MaintainRepo(ctx, "org/test.git"))
+
+	assert.Ok(t, srv.DeleteRepo(ctx, "org/test.git"))
+	_, err = os.Stat(filepath.Join(rpath, "org", "test.git"))
+	assert.Cond(t, os.IsNotExist(err), "repository should have been deleted")
+
+	_, err = srv.RepoSize(ctx, "org/test.git")
+	assert.Equals(t, ErrRepoNotFound, err)
+	assert.Equals(t, ErrRepoNotFound, srv.DeleteRepo(ctx, "org/test.git"))
+}
@@ -0,0 +1,271 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: controlplane.proto
+
+package controlplane
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ControlPlane_CreateRepo_FullMethodName  = "/gitd.controlplane.v1.ControlPlane/CreateRepo"
+	ControlPlane_DeleteRepo_FullMethodName  = "/gitd.controlplane.v1.ControlPlane/DeleteRepo"
+	ControlPlane_ListRefs_FullMethodName    = "/gitd.controlplane.v1.ControlPlane/ListRefs"
+	ControlPlane_GetRepoSize_FullMethodName = "/gitd.controlplane.v1.ControlPlane/GetRepoSize"
+	ControlPlane_TriggerGC_FullMethodName   = "/gitd.controlplane.v1.ControlPlane/TriggerGC"
+)
+
+// ControlPlaneClient is the client API for ControlPlane service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ControlPlaneClient interface {
+	// CreateRepo creates a bare repository.
+	CreateRepo(ctx context.Context, in *CreateRepoRequest, opts ...grpc.CallOption) (*CreateRepoResponse, error)
+	// DeleteRepo deletes a repository, or moves it to the trash.
+	DeleteRepo(ctx context.Context, in *DeleteRepoRequest, opts ...grpc.CallOption) (*DeleteRepoResponse, error)
+	// ListRefs lists the refs of a repository.
+	ListRefs(ctx context.Context, in *ListRefsRequest, opts ...grpc.CallOption) (*ListRefsResponse, error)
+	// GetRepoSize returns the disk usage of a repository.
+	GetRepoSize(ctx context.Context, in *GetRepoSizeRequest, opts ...grpc.CallOption) (*GetRepoSizeResponse, error)
+	// TriggerGC runs maintenance on a repository, returning once done.
+	TriggerGC(ctx context.Context, in *TriggerGCRequest, opts ...grpc.CallOption) (*TriggerGCResponse, error)
+}
+
+type controlPlaneClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewControlPlaneClient(cc grpc.ClientConnInterface) ControlPlaneClient {
+	return &controlPlaneClient{cc}
+}
+
+func (c *controlPlaneClient) CreateRepo(ctx context.Context, in *CreateRepoRequest, opts ...grpc.CallOption) (*CreateRepoResponse, error) {
+	out := new(CreateRepoResponse)
+	err := c.cc.Invoke(ctx, ControlPlane_CreateRepo_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) DeleteRepo(ctx context.Context, in *DeleteRepoRequest, opts ...grpc.CallOption) (*DeleteRepoResponse, error) {
+	out := new(DeleteRepoResponse)
+	err := c.cc.Invoke(ctx, ControlPlane_DeleteRepo_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) ListRefs(ctx context.Context, in *ListRefsRequest, opts ...grpc.CallOption) (*ListRefsResponse, error) {
+	out := new(ListRefsResponse)
+	err := c.cc.Invoke(ctx, ControlPlane_ListRefs_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) GetRepoSize(ctx context.Context, in *GetRepoSizeRequest, opts ...grpc.CallOption) (*GetRepoSizeResponse, error) {
+	out := new(GetRepoSizeResponse)
+	err := c.cc.Invoke(ctx, ControlPlane_GetRepoSize_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlPlaneClient) TriggerGC(ctx context.Context, in *TriggerGCRequest, opts ...grpc.CallOption) (*TriggerGCResponse, error) {
+	out := new(TriggerGCResponse)
+	err := c.cc.Invoke(ctx, ControlPlane_TriggerGC_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ControlPlaneServer is the server API for ControlPlane service.
+// All implementations must embed UnimplementedControlPlaneServer
+// for forward compatibility
+type ControlPlaneServer interface {
+	// CreateRepo creates a bare repository.
+	CreateRepo(context.Context, *CreateRepoRequest) (*CreateRepoResponse, error)
+	// DeleteRepo deletes a repository, or moves it to the trash.
+	DeleteRepo(context.Context, *DeleteRepoRequest) (*DeleteRepoResponse, error)
+	// ListRefs lists the refs of a repository.
+	ListRefs(context.Context, *ListRefsRequest) (*ListRefsResponse, error)
+	// GetRepoSize returns the disk usage of a repository.
+	GetRepoSize(context.Context, *GetRepoSizeRequest) (*GetRepoSizeResponse, error)
+	// TriggerGC runs maintenance on a repository, returning once done.
+	TriggerGC(context.Context, *TriggerGCRequest) (*TriggerGCResponse, error)
+	mustEmbedUnimplementedControlPlaneServer()
+}
+
+// UnimplementedControlPlaneServer must be embedded to have forward compatible implementations.
+type UnimplementedControlPlaneServer struct {
+}
+
+func (UnimplementedControlPlaneServer) CreateRepo(context.Context, *CreateRepoRequest) (*CreateRepoResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateRepo not implemented")
+}
+func (UnimplementedControlPlaneServer) DeleteRepo(context.Context, *DeleteRepoRequest) (*DeleteRepoResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteRepo not implemented")
+}
+func (UnimplementedControlPlaneServer) ListRefs(context.Context, *ListRefsRequest) (*ListRefsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListRefs not implemented")
+}
+func (UnimplementedControlPlaneServer) GetRepoSize(context.Context, *GetRepoSizeRequest) (*GetRepoSizeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRepoSize not implemented")
+}
+func (UnimplementedControlPlaneServer) TriggerGC(context.Context, *TriggerGCRequest) (*TriggerGCResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TriggerGC not implemented")
+}
+func (UnimplementedControlPlaneServer) mustEmbedUnimplementedControlPlaneServer() {}
+
+// UnsafeControlPlaneServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ControlPlaneServer will
+// result in compilation errors.
+type UnsafeControlPlaneServer interface {
+	mustEmbedUnimplementedControlPlaneServer()
+}
+
+func RegisterControlPlaneServer(s grpc.ServiceRegistrar, srv ControlPlaneServer) {
+	s.RegisterService(&ControlPlane_ServiceDesc, srv)
+}
+
+func _ControlPlane_CreateRepo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateRepoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).CreateRepo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControlPlane_CreateRepo_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).CreateRepo(ctx, req.(*CreateRepoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_DeleteRepo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRepoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).DeleteRepo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControlPlane_DeleteRepo_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).DeleteRepo(ctx, req.(*DeleteRepoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_ListRefs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRefsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).ListRefs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControlPlane_ListRefs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).ListRefs(ctx, req.(*ListRefsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_GetRepoSize_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRepoSizeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).GetRepoSize(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControlPlane_GetRepoSize_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).GetRepoSize(ctx, req.(*GetRepoSizeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlPlane_TriggerGC_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TriggerGCRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlPlaneServer).TriggerGC(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControlPlane_TriggerGC_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlPlaneServer).TriggerGC(ctx, req.(*TriggerGCRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ControlPlane_ServiceDesc is the grpc.ServiceDesc for ControlPlane service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ControlPlane_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gitd.controlplane.v1.ControlPlane",
+	HandlerType: (*ControlPlaneServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateRepo",
+			Handler:    _ControlPlane_CreateRepo_Handler,
+		},
+		{
+			MethodName: "DeleteRepo",
+			Handler:    _ControlPlane_DeleteRepo_Handler,
+		},
+		{
+			MethodName: "ListRefs",
+			Handler:    _ControlPlane_ListRefs_Handler,
+		},
+		{
+			MethodName: "GetRepoSize",
+			Handler:    _ControlPlane_GetRepoSize_Handler,
+		},
+		{
+			MethodName: "TriggerGC",
+			Handler:    _ControlPlane_TriggerGC_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "controlplane.proto",
+}
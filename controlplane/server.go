@@ -0,0 +1,99 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package controlplane serves the repository management of a gitd server
+// over gRPC, alongside the Git transports serving its repositories, for
+// tooling managing them programmatically.
+package controlplane
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative controlplane.proto
+
+import (
+	"context"
+
+	"github.com/c4milo/gitd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Register registers the ControlPlane service managing the repositories of
+// srv with s. Like the admin API, the service lets its clients create and
+// delete any repository, so s is to authenticate them, such as with
+// interceptors or mutual TLS.
+func Register(s grpc.ServiceRegistrar, srv *gitd.Server) {
+	RegisterControlPlaneServer(s, &service{srv: srv})
+}
+
+// service implements ControlPlaneServer with the methods of gitd.Server.
+type service struct {
+	UnimplementedControlPlaneServer
+	srv *gitd.Server
+}
+
+func (s *service) CreateRepo(ctx context.Context, req *CreateRepoRequest) (*CreateRepoResponse, error) {
+	branch, err := s.srv.CreateRepo(ctx, req.Name, gitd.RepoOptions{
+		DefaultBranch: req.DefaultBranch,
+		Description:   req.Description,
+		Template:      req.Template,
+	})
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &CreateRepoResponse{DefaultBranch: branch}, nil
+}
+
+func (s *service) DeleteRepo(ctx context.Context, req *DeleteRepoRequest) (*DeleteRepoResponse, error) {
+	if err := s.srv.DeleteRepo(ctx, req.Name); err != nil {
+		return nil, statusError(err)
+	}
+	return &DeleteRepoResponse{}, nil
+}
+
+func (s *service) ListRefs(ctx context.Context, req *ListRefsRequest) (*ListRefsResponse, error) {
+	refs, err := s.srv.ListRefs(ctx, req.Name)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	res := &ListRefsResponse{}
+	for _, ref := range refs {
+		res.Refs = append(res.Refs, &Ref{Name: ref.Name, Sha: ref.SHA})
+	}
+	return res, nil
+}
+
+func (s *service) GetRepoSize(ctx context.Context, req *GetRepoSizeRequest) (*GetRepoSizeResponse, error) {
+	size, err := s.srv.RepoSize(ctx, req.Name)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &GetRepoSizeResponse{SizeBytes: size}, nil
+}
+
+func (s *service) TriggerGC(ctx context.Context, req *TriggerGCRequest) (*TriggerGCResponse, error) {
+	if err := s.srv.MaintainRepo(ctx, req.Name); err != nil {
+		return nil, statusError(err)
+	}
+	return &TriggerGCResponse{}, nil
+}
+
+// statusError converts err, returned by gitd.Server, to a gRPC status error.
+func statusError(err error) error {
+	switch err {
+	case gitd.ErrInvalidRepoName, gitd.ErrInvalidDefaultBranch, gitd.ErrInvalidDescription:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case gitd.ErrRepoNotFound, gitd.ErrTemplateNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case gitd.ErrRepoExists:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case gitd.ErrRepoHasForks:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case gitd.ErrMaintenanceRunning, gitd.ErrRepoBusy:
+		return status.Error(codes.Aborted, err.Error())
+	case context.Canceled, context.DeadlineExceeded:
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
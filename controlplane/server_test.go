@@ -0,0 +1,71 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package controlplane
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/c4milo/gitd"
+	"github.com/hooklift/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestControlPlane(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	srv, err := gitd.NewServer(http.NotFoundHandler(), gitd.ReposPath(rpath))
+	assert.Ok(t, err)
+
+	l := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	Register(s, srv)
+	go s.Serve(l)
+	defer s.Stop()
+
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		return l.Dial()
+	}
+	conn, err := grpc.Dial("bufnet", grpc.WithContextDialer(dial), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Ok(t, err)
+	defer conn.Close()
+	client := NewControlPlaneClient(conn)
+	ctx := context.Background()
+
+	created, err := client.CreateRepo(ctx, &CreateRepoRequest{Name: "test.git", DefaultBranch: "main"})
+	assert.Ok(t, err)
+	assert.Equals(t, "main", created.DefaultBranch)
+
+	_, err = client.CreateRepo(ctx, &CreateRepoRequest{Name: "test.git"})
+	assert.Equals(t, codes.AlreadyExists, status.Code(err))
+	_, err = client.CreateRepo(ctx, &CreateRepoRequest{Name: "../evil.git"})
+	assert.Equals(t, codes.InvalidArgument, status.Code(err))
+
+	refs, err := client.ListRefs(ctx, &ListRefsRequest{Name: "test.git"})
+	assert.Ok(t, err)
+	assert.Equals(t, 0, len(refs.Refs))
+
+	size, err := client.GetRepoSize(ctx, &GetRepoSizeRequest{Name: "test.git"})
+	assert.Ok(t, err)
+	assert.Cond(t, size.SizeBytes > 0, "repository should take up disk space")
+
+	_, err = client.TriggerGC(ctx, &TriggerGCRequest{Name: "test.git"})
+	assert.Ok(t, err)
+
+	_, err = client.DeleteRepo(ctx, &DeleteRepoRequest{Name: "test.git"})
+	assert.Ok(t, err)
+	_, err = client.DeleteRepo(ctx, &DeleteRepoRequest{Name: "test.git"})
+	assert.Equals(t, codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,116 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// daemonRequestTimeout bounds the time Git daemon clients have to send
+// their request once connected.
+const daemonRequestTimeout = 30 * time.Second
+
+// GitDaemonPush allows anonymous pushes through the Git daemon protocol.
+// Like git daemon, the protocol is read-only by default.
+func GitDaemonPush(enabled bool) Option {
+	return func(h *handler) {
+		h.daemonPush = enabled
+	}
+}
+
+// ServeGitDaemon accepts connections on l, usually bound to port 9418,
+// serving repositories through the Git daemon protocol for git:// URLs.
+// Clients are anonymous, so the authorization callback, if any, sees them
+// with an empty user name. It always returns a non-nil error, like
+// http.Serve.
+func (s *Server) ServeGitDaemon(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.h.serveDaemonConn(conn)
+	}
+}
+
+func (h *handler) serveDaemonConn(conn net.Conn) {
+	defer conn.Close()
+	if !h.ipFilter.allows(conn.RemoteAddr().String()) {
+		h.logger.Info("Client address denied", Field{"remote", conn.RemoteAddr()})
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(daemonRequestTimeout))
+	line, err := packetRead(conn)
+	if err != nil || line == nil {
+		h.logger.Debug("Reading Git daemon request failed", Field{"remote", conn.RemoteAddr()}, Field{"error", err})
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	s := &session{
+		transport:  "git",
+		remoteAddr: conn.RemoteAddr().String(),
+		rw:         conn,
+	}
+
+	service, name, ok := parseDaemonRequest(line, s)
+	if !ok {
+		h.logger.Info("Invalid Git daemon request", Field{"remote", s.remoteAddr}, Field{"request", string(line)})
+		s.fail("invalid request")
+		return
+	}
+
+	if service == "git-receive-pack" && !h.daemonPush {
+		s.fail("service not enabled: " + service)
+		return
+	}
+	h.serveSession(s, service, name)
+}
+
+// parseDaemonRequest parses the request Git daemon clients start with, such
+// as "git-upload-pack /org/repo.git\x00host=example.com\x00", returning the
+// service and repository name. The requested host and protocol are set in s.
+func parseDaemonRequest(line []byte, s *session) (service, name string, ok bool) {
+	parts := strings.Split(string(line), "\x00")
+
+	command := strings.TrimSuffix(parts[0], "\n")
+	i := strings.IndexByte(command, ' ')
+	if i < 0 {
+		return "", "", false
+	}
+
+	service, name = command[:i], command[i+1:]
+	switch service {
+	case "git-upload-pack", "git-receive-pack":
+	default:
+		return "", "", false
+	}
+
+	if !strings.HasPrefix(name, "/") || !validRepoName(name[1:]) {
+		return "", "", false
+	}
+
+	// Extra parameters, such as version=2, follow an empty one.
+	var extra bool
+	var params []string
+	for _, p := range parts[1:] {
+		switch {
+		case p == "":
+			extra = true
+		case extra:
+			params = append(params, p)
+		case strings.HasPrefix(p, "host="):
+			s.host = strings.TrimPrefix(p, "host=")
+		}
+	}
+
+	if protocol := strings.Join(params, ":"); gitProtocolRe.MatchString(protocol) {
+		s.protocol = protocol
+	}
+	return service, name[1:], true
+}
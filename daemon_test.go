@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestParseDaemonRequest(t *testing.T) {
+	tests := []struct {
+		line     string
+		service  string
+		name     string
+		host     string
+		protocol string
+		ok       bool
+	}{
+		{"git-upload-pack /app.git\x00host=example.com\x00", "git-upload-pack", "app.git", "example.com", "", true},
+		{"git-upload-pack /org/app.git\x00host=example.com:9418\x00\x00version=2\x00", "git-upload-pack", "org/app.git", "example.com:9418", "version=2", true},
+		{"git-receive-pack /app.git\n", "git-receive-pack", "app.git", "", "", true},
+		{"git-upload-pack app.git\x00", "", "", "", "", false},
+		{"git-upload-pack /../app.git\x00", "", "", "", "", false},
+		{"git-upload-archive /app.git\x00", "", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		s := new(session)
+		service, name, ok := parseDaemonRequest([]byte(tt.line), s)
+		assert.Equals(t, tt.ok, ok)
+		assert.Equals(t, tt.service, service)
+		assert.Equals(t, tt.name, name)
+		if ok {
+			assert.Equals(t, tt.host, s.host)
+			assert.Equals(t, tt.protocol, s.protocol)
+		}
+	}
+}
+
+func TestServeGitDaemon(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "app.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	dir := filepath.Join(workspace, "app")
+	cloneAndCommit(t, filepath.Join(rpath, "app.git"), dir, "over git://")
+	git(t, dir, "push", "origin", "master")
+
+	readOnly, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer readOnly.Close()
+	srv, err := NewServer(http.NotFoundHandler(), ReposPath(rpath))
+	assert.Ok(t, err)
+	go srv.ServeGitDaemon(readOnly)
+
+	writable, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer writable.Close()
+	srv, err = NewServer(http.NotFoundHandler(), ReposPath(rpath), GitDaemonPush(true))
+	assert.Ok(t, err)
+	go srv.ServeGitDaemon(writable)
+
+	url := "git://" + readOnly.Addr().String() + "/app.git"
+	git(t, workspace, "clone", url, "copy")
+	content, err := ioutil.ReadFile(filepath.Join(workspace, "copy", "README.md"))
+	assert.Ok(t, err)
+	assert.Equals(t, "over git://", string(content))
+
+	err = exec.Command("git", "-C", dir, "push", url, "master:other").Run()
+	assert.Cond(t, err != nil, "push should be refused by default")
+	err = exec.Command("git", "-C", dir, "fetch", "git://"+readOnly.Addr().String()+"/missing.git").Run()
+	assert.Cond(t, err != nil, "fetch from missing repository should fail")
+
+	git(t, dir, "push", "git://"+writable.Addr().String()+"/app.git", "master:other")
+	_, err = os.Stat(filepath.Join(rpath, "app.git", "refs", "heads", "other"))
+	assert.Ok(t, err)
+}
@@ -0,0 +1,162 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DumbHTTP enables Git's dumb HTTP protocol, serving the repository files
+// needed by old clients and plain HTTP mirroring tools.
+func DumbHTTP(enabled bool) Option {
+	return func(h *handler) {
+		h.dumbHTTP = enabled
+	}
+}
+
+// dumbFiles matches the repository files served by the dumb protocol after
+// the repository path, the same as git-http-backend does.
+var dumbFiles = []string{
+	"/HEAD",
+	"/objects/info/alternates",
+	"/objects/info/http-alternates",
+	"/objects/info/packs",
+	"/objects/[0-9a-f]{2}/[0-9a-f]{38}",
+	`/objects/pack/pack-[0-9a-f]{40}\.pack`,
+	`/objects/pack/pack-[0-9a-f]{40}\.idx`,
+}
+
+// dumbInfoRefs serves info/refs to dumb clients, refreshing it first.
+func (h *handler) dumbInfoRefs(w http.ResponseWriter, req *http.Request, repo *repository) {
+	if namespaced(repo.env) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return
+	}
+
+	cwd := repo.dir
+
+	cmd := h.gitCommandContext(req.Context(), cwd, "update-server-info")
+	cmd.Env = append(os.Environ(), repo.env...)
+	if _, _, err := runAndLog(h.logger, cmd); err != nil {
+		h.logger.Error("Updating server info failed", Field{"repo", repo.name}, Field{"error", err})
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return
+	}
+
+	noCache(w)
+	file := filepath.Join(cwd, "info", "refs")
+	hidden := h.fetchHiddenRefs(repo.name)
+	if len(hidden) == 0 {
+		serveRepoFile(w, req, file, "text/plain")
+		return
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		h.logger.Error("Reading info/refs failed", Field{"repo", repo.name}, Field{"error", err})
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return
+	}
+
+	// <id>\t<ref>, followed by <id>\t<ref>^{} for the objects tags peel to.
+	var refs bytes.Buffer
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), "\t", 2)
+		if len(fields) == 2 && refHidden(hidden, strings.TrimSuffix(fields[1], "^{}")) {
+			continue
+		}
+		refs.WriteString(line)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(refs.Bytes()))
+}
+
+// dumbFile serves a repository file requested by a dumb client.
+func (h *handler) dumbFile(w http.ResponseWriter, req *http.Request, repo *repository) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method Not Allowed"))
+		return
+	}
+
+	if namespaced(repo.env) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return
+	}
+
+	name := strings.TrimPrefix(req.URL.Path, "/"+repo.name+"/")
+	file := filepath.Join(repo.dir, filepath.FromSlash(name))
+
+	var contentType string
+	switch {
+	case strings.HasSuffix(name, ".pack"):
+		contentType = "application/x-git-packed-objects"
+		cacheForever(w)
+	case strings.HasSuffix(name, ".idx"):
+		contentType = "application/x-git-packed-objects-toc"
+		cacheForever(w)
+	case name == "objects/info/packs":
+		contentType = "text/plain; charset=utf-8"
+		noCache(w)
+	case strings.HasPrefix(name, "objects/info/") || name == "HEAD":
+		contentType = "text/plain"
+		noCache(w)
+	default:
+		contentType = "application/x-git-loose-object"
+		cacheForever(w)
+	}
+
+	serveRepoFile(w, req, file, contentType)
+}
+
+// serveRepoFile sends a file from a repository, supporting range requests.
+func serveRepoFile(w http.ResponseWriter, req *http.Request, file, contentType string) {
+	f, err := os.Open(file)
+	if err != nil {
+		w.Header().Del("Cache-Control")
+		w.Header().Del("Expires")
+		w.Header().Del("Pragma")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, req, "", fi.ModTime(), f)
+}
+
+func noCache(w http.ResponseWriter) {
+	headers := w.Header()
+	headers.Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	headers.Set("Pragma", "no-cache")
+	headers.Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
+
+func cacheForever(w http.ResponseWriter) {
+	now := time.Now()
+	headers := w.Header()
+	headers.Set("Date", now.UTC().Format(http.TimeFormat))
+	headers.Set("Expires", now.Add(365*24*time.Hour).UTC().Format(http.TimeFormat))
+	headers.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", 365*24*60*60))
+}
@@ -0,0 +1,51 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestDumbHTTP(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), DumbHTTP(true)))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "origin", "HEAD:refs/heads/master")
+
+	cmd := exec.Command("git", "clone", ts.URL+"/test.git", "dumb")
+	cmd.Dir = workspace
+	cmd.Env = append(os.Environ(), "GIT_SMART_HTTP=0")
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err == nil, "dumb clone failed: %v\n%s", err, out)
+
+	data, err := ioutil.ReadFile(filepath.Join(workspace, "dumb", "README.md"))
+	assert.Ok(t, err)
+	assert.Equals(t, "blah", string(data))
+
+	res, err := http.Get(ts.URL + "/test.git/HEAD")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, "text/plain", res.Header.Get("Content-Type"))
+	assert.Equals(t, "no-cache, max-age=0, must-revalidate", res.Header.Get("Cache-Control"))
+}
@@ -0,0 +1,170 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventsBuffer is the number of events subscribers can fall behind by before
+// missing events.
+const eventsBuffer = 256
+
+// Event is an operation of the server, whichever the transport, delivered
+// to applications embedding it through Events. It is one of FetchStarted,
+// FetchCompleted, PushReceived, RefUpdated and Error.
+type Event interface {
+	Info() EventInfo
+}
+
+// EventInfo describes what any event is about.
+type EventInfo struct {
+	Time      time.Time
+	Repo      string
+	Identity  string
+	RemoteIP  string
+	Transport string
+}
+
+// Info returns i, so events embedding it implement Event.
+func (i EventInfo) Info() EventInfo {
+	return i
+}
+
+// FetchStarted is emitted as git-upload-pack starts serving a fetch or
+// clone. Over smart HTTP, fetches may run it more than once.
+type FetchStarted struct {
+	EventInfo
+}
+
+// FetchCompleted is emitted once git-upload-pack served a fetch or clone.
+type FetchCompleted struct {
+	EventInfo
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// PushReceived is emitted once git-receive-pack finished a push, with the
+// ref updates it requested and, if Git reported it, its result.
+type PushReceived struct {
+	EventInfo
+	Refs   []RefUpdate
+	Result *PushResult
+}
+
+// RefUpdated is emitted for every ref updated by a push, after
+// PushReceived.
+type RefUpdated struct {
+	EventInfo
+	RefUpdate
+}
+
+// Error is emitted for fetches and pushes that failed, or were rejected.
+type Error struct {
+	EventInfo
+	Operation Operation
+	Err       error
+}
+
+// Events returns a channel delivering the events of the server from now
+// on, until Shutdown closes it. Events are dropped rather than holding Git
+// operations back when the channel is not read from fast enough.
+func (s *Server) Events() <-chan Event {
+	return s.h.events.subscribe()
+}
+
+// events delivers events to subscribers.
+type events struct {
+	sync.Mutex
+	subs   []chan Event
+	closed bool
+}
+
+func (e *events) subscribe() <-chan Event {
+	e.Lock()
+	defer e.Unlock()
+
+	ch := make(chan Event, eventsBuffer)
+	if e.closed {
+		close(ch)
+		return ch
+	}
+	e.subs = append(e.subs, ch)
+	return ch
+}
+
+// subscribed returns whether anyone listens to events.
+func (e *events) subscribed() bool {
+	e.Lock()
+	defer e.Unlock()
+	return len(e.subs) > 0
+}
+
+// emit delivers ev to the subscribers keeping up with events.
+func (e *events) emit(ev Event) {
+	e.Lock()
+	defer e.Unlock()
+
+	for _, ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// close closes the channels of subscribers.
+func (e *events) close() {
+	e.Lock()
+	defer e.Unlock()
+
+	for _, ch := range e.subs {
+		close(ch)
+	}
+	e.subs, e.closed = nil, true
+}
+
+// newEventInfo returns what an event about repo, requested by req, is about.
+func newEventInfo(req *http.Request, repo string) EventInfo {
+	return EventInfo{
+		Time:      time.Now().UTC(),
+		Repo:      repo,
+		Identity:  remoteUser(req),
+		RemoteIP:  remoteIP(req.RemoteAddr),
+		Transport: requestTransport(req),
+	}
+}
+
+// fetchDone emits the event for a fetch of repo, requested by req, which
+// sent and received the given bytes, and failed with err if not nil.
+func (h *handler) fetchDone(req *http.Request, repo string, sent, received int64, err error) {
+	if err != nil {
+		h.events.emit(Error{EventInfo: newEventInfo(req, repo), Operation: Fetch, Err: err})
+		return
+	}
+	h.events.emit(FetchCompleted{EventInfo: newEventInfo(req, repo), BytesSent: sent, BytesReceived: received})
+}
+
+// pushDone emits the events for a push to repo, requested by req, with the
+// updates it requested and the result Git reported, if any.
+func (h *handler) pushDone(req *http.Request, repo string, updates []RefUpdate, result *PushResult) {
+	info := newEventInfo(req, repo)
+	h.events.emit(PushReceived{EventInfo: info, Refs: updates, Result: result})
+
+	if result != nil {
+		updates = result.Accepted()
+	}
+	for _, u := range updates {
+		h.events.emit(RefUpdated{EventInfo: info, RefUpdate: u})
+	}
+}
+
+// pushFailed emits the event for a push to repo, requested by req, that
+// failed with err.
+func (h *handler) pushFailed(req *http.Request, repo string, err error) {
+	h.events.emit(Error{EventInfo: newEventInfo(req, repo), Operation: Push, Err: err})
+}
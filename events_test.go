@@ -0,0 +1,97 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestEvents(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	reject := PreReceive(func(r *http.Request, repo string, updates []RefUpdate) error {
+		for _, u := range updates {
+			if u.Name == "refs/heads/blocked" {
+				return errors.New("blocked")
+			}
+		}
+		return nil
+	})
+	srv, err := NewServer(http.NotFoundHandler(), ReposPath(rpath), reject)
+	assert.Ok(t, err)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	events := srv.Events()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "origin", "master")
+	git(t, filepath.Dir(clone), "clone", ts.URL+"/test.git", filepath.Join(workspace, "again"))
+
+	cmd := exec.Command("git", "push", "origin", "master:blocked")
+	cmd.Dir = clone
+	assert.Cond(t, cmd.Run() != nil, "push should have been rejected")
+
+	assert.Ok(t, srv.Shutdown(context.Background()))
+
+	var got []Event
+	for e := range events {
+		got = append(got, e)
+	}
+
+	var started, fetched, failed []Event
+	var pushes []PushReceived
+	var refs []RefUpdated
+	for _, e := range got {
+		switch e := e.(type) {
+		case FetchStarted:
+			started = append(started, e)
+		case FetchCompleted:
+			assert.Equals(t, "test.git", e.Repo)
+			assert.Equals(t, "http", e.Transport)
+			assert.Cond(t, e.BytesSent > 0, "fetch should have sent bytes")
+			fetched = append(fetched, e)
+		case PushReceived:
+			pushes = append(pushes, e)
+		case RefUpdated:
+			refs = append(refs, e)
+		case Error:
+			assert.Equals(t, Push, e.Operation)
+			assert.Equals(t, "blocked", e.Err.Error())
+			failed = append(failed, e)
+		}
+	}
+
+	// Smart HTTP fetches run git-upload-pack once per request.
+	assert.Cond(t, len(started) > 0 && len(started) == len(fetched), "unexpected fetches: %d started, %d completed", len(started), len(fetched))
+	assert.Equals(t, 1, len(failed))
+
+	assert.Equals(t, 1, len(pushes))
+	assert.Equals(t, "test.git", pushes[0].Repo)
+	assert.Cond(t, pushes[0].Result != nil && len(pushes[0].Result.Accepted()) == 1, "unexpected push result: %#v", pushes[0].Result)
+	assert.Equals(t, 1, len(refs))
+	assert.Equals(t, pushes[0].Refs[0], refs[0].RefUpdate)
+	assert.Equals(t, "refs/heads/master", refs[0].Name)
+
+	_, ok := <-srv.Events()
+	assert.Cond(t, !ok, "events should not be delivered after Shutdown")
+}
@@ -0,0 +1,51 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// defaultExportMarker is the file git daemon and git http-backend look for
+// in repositories when not exporting all of them.
+const defaultExportMarker = "git-daemon-export-ok"
+
+// ExportOK only serves repositories holding a marker file, named
+// git-daemon-export-ok if marker is empty, the same as git http-backend
+// without GIT_HTTP_EXPORT_ALL, so repositories dropped into the tree are not
+// exposed right away. Repositories gitd creates get the marker. The admin API
+// still manages every repository.
+func ExportOK(marker string) Option {
+	if marker == "" {
+		marker = defaultExportMarker
+	}
+	return func(h *handler) {
+		h.exportMarker = marker
+	}
+}
+
+// exported returns whether the repository in dir is served to clients.
+func (h *handler) exported(dir string) bool {
+	if !isBareRepo(dir) {
+		return false
+	}
+	if h.exportMarker == "" {
+		return true
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, h.exportMarker))
+	return err == nil && !fi.IsDir()
+}
+
+// markExported marks the repository in dir as served to clients, if
+// repositories need a marker for it.
+func (h *handler) markExported(dir string) error {
+	if h.exportMarker == "" {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(dir, h.exportMarker), nil, 0644)
+}
@@ -0,0 +1,55 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestExportOK(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "hidden.git")
+	initBareRepo(t, rpath, "public.git")
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(rpath, "public.git", "git-daemon-export-ok"), nil, 0644))
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AutoInitRepos(true), ExportOK("")))
+	defer ts.Close()
+
+	tests := []struct {
+		repo   string
+		status int
+	}{
+		{"hidden.git", http.StatusNotFound},
+		{"public.git", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		res, err := http.Get(ts.URL + "/" + tt.repo + "/info/refs?service=git-upload-pack")
+		assert.Ok(t, err)
+		res.Body.Close()
+		assert.Equals(t, tt.status, res.StatusCode)
+	}
+
+	// Repositories created on push are exported.
+	clone := filepath.Join(workspace, "new")
+	cloneAndCommit(t, ts.URL+"/public.git", clone, "new")
+	git(t, clone, "push", "-q", ts.URL+"/new.git", "master")
+	_, err = os.Stat(filepath.Join(rpath, "new.git", "git-daemon-export-ok"))
+	assert.Ok(t, err)
+	git(t, workspace, "clone", "-q", ts.URL+"/new.git", filepath.Join(workspace, "again"))
+}
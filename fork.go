@@ -0,0 +1,208 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// forkedFile marks repositories forks borrow objects from.
+const forkedFile = ".forked"
+
+// errFound stops walking repositories once the one looked for is found.
+var errFound = errors.New("found")
+
+// forkRequest is the body of requests forking repositories.
+type forkRequest struct {
+	Name string `json:"name"`
+}
+
+// forkRepo creates a bare repository with the branches and tags of another
+// one, borrowing its objects through objects/info/alternates rather than
+// copying them. Objects pushed to forks are stored in the forks themselves.
+// Repositories with forks can not be deleted nor moved, since forks would
+// lose the objects they borrow, unless they share them through a pool.
+func (h *handler) forkRepo(w http.ResponseWriter, req *http.Request, name string) {
+	var fork forkRequest
+	if err := json.NewDecoder(req.Body).Decode(&fork); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if !validRepoName(fork.Name) || fork.Name == name {
+		writeError(w, http.StatusBadRequest, "invalid repository name")
+		return
+	}
+
+	src, ok := h.locateRepo(w, req, name)
+	if !ok {
+		return
+	}
+	dst, err := h.storage.Dir(req.Context(), fork.Name)
+	if err == ErrRepoNotFound {
+		writeError(w, http.StatusBadRequest, "invalid repository name")
+		return
+	}
+	if err != nil {
+		h.logger.Error("Locating repository failed", Field{"repo", fork.Name}, Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to locate repository")
+		return
+	}
+	if _, err := os.Stat(dst); err == nil {
+		writeError(w, http.StatusConflict, "repository already exists")
+		return
+	}
+
+	// Forks only show up once fully set up.
+	tmp, err := h.initHiddenRepo(dst)
+	if err == nil {
+		err = h.setupFork(tmp, name, src)
+		if err == nil {
+			err = os.Rename(tmp, dst)
+		}
+		os.RemoveAll(tmp)
+	}
+	if err != nil {
+		h.logger.Error("Forking repository failed", Field{"repo", name}, Field{"fork", fork.Name}, Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to fork repository")
+		return
+	}
+	h.invalidateRepo(dst)
+
+	if err := h.redirects.remove(fork.Name); err != nil {
+		h.logger.Error("Saving redirects failed", Field{"repo", fork.Name}, Field{"error", err})
+	}
+
+	h.logger.Info("Repository forked", Field{"repo", name}, Field{"fork", fork.Name}, Field{"user", remoteUser(req)})
+	writeJSON(w, http.StatusCreated, repoInfo{Name: fork.Name, DefaultBranch: defaultBranch(dst)})
+}
+
+// setupFork makes the new repository in dir borrow the objects of the one
+// name in src, or of its pool, fetching its branches and tags, and pointing
+// HEAD to the same branch.
+func (h *handler) setupFork(dir, name, src string) error {
+	lender := src
+	if h.poolsRoot != "" {
+		pool, err := h.joinPool(name, src)
+		if err != nil {
+			return err
+		}
+		lender = pool
+	} else if err := h.lendObjects(src); err != nil {
+		return err
+	}
+
+	objects, err := filepath.Abs(filepath.Join(lender, "objects"))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "objects", "info", "alternates"), []byte(objects+"\n"), 0644); err != nil {
+		return err
+	}
+
+	// Every object is already available, so nothing is copied.
+	cmd := h.gitCommand(dir, "fetch", "--quiet", "--no-tags", src, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	if _, _, err := runAndLog(h.logger, cmd); err != nil {
+		return err
+	}
+	if branch := defaultBranch(src); branch != "" {
+		return h.setDefaultBranch(dir, branch)
+	}
+	return nil
+}
+
+// lendObjects keeps the objects of the repository in dir other repositories
+// borrow, even once no longer reachable from its refs.
+func (h *handler) lendObjects(dir string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, forkedFile), []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644); err != nil {
+		return err
+	}
+	cmd := h.gitCommand(dir, "config", "gc.pruneExpire", "never")
+	_, _, err := runAndLog(h.logger, cmd)
+	return err
+}
+
+// hasForks returns whether any repository borrows objects from the one in
+// dir.
+func (h *handler) hasForks(dir string) (bool, error) {
+	if _, err := os.Stat(filepath.Join(dir, forkedFile)); err != nil {
+		return false, nil
+	}
+	objects, err := filepath.Abs(filepath.Join(dir, "objects"))
+	if err != nil {
+		return false, err
+	}
+
+	err = h.walkRepos(func(name, fork string) error {
+		for _, alt := range alternates(fork) {
+			if filepath.Clean(alt) == objects {
+				return errFound
+			}
+		}
+		return nil
+	})
+	if err == errFound {
+		return true, nil
+	}
+	return false, err
+}
+
+// alternates returns the object directories the repository in dir borrows
+// objects from.
+func alternates(dir string) []string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "objects", "info", "alternates"))
+	if err != nil {
+		return nil
+	}
+
+	var dirs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			dirs = append(dirs, line)
+		}
+	}
+	return dirs
+}
+
+// checkNoForks writes an admin API error response if the repository name in
+// dir has forks, returning whether it has none.
+func (h *handler) checkNoForks(w http.ResponseWriter, name, dir string) bool {
+	forked, err := h.hasForks(dir)
+	if err != nil {
+		h.logger.Error("Looking up forks failed", Field{"repo", name}, Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to look up forks")
+		return false
+	}
+	if forked {
+		writeError(w, http.StatusConflict, "repository has forks")
+		return false
+	}
+	return true
+}
+
+// sharedRepackArgs adapts the args of git repack for the repository in dir:
+// forks leave the objects they borrow out of their packs, and repositories
+// with forks keep the objects no longer reachable from their refs, which
+// forks may still need.
+func sharedRepackArgs(dir string, args []string) []string {
+	if args[0] != "repack" {
+		return args
+	}
+	args = append([]string(nil), args...)
+	if len(alternates(dir)) > 0 {
+		args = append(args, "-l")
+	}
+	if _, err := os.Stat(filepath.Join(dir, forkedFile)); err == nil {
+		args = append(args, "--keep-unreachable")
+	}
+	return args
+}
@@ -0,0 +1,87 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestForkRepo(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "app.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AdminAPI()))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "app")
+	cloneAndCommit(t, ts.URL+"/app.git", clone, "blah")
+	git(t, clone, "push", "-q", "origin", "HEAD:refs/heads/master", "HEAD:refs/heads/feature")
+
+	admin := func(method, path, body string) (int, repoInfo) {
+		req, err := http.NewRequest(method, ts.URL+"/api/repos/"+path, strings.NewReader(body))
+		assert.Ok(t, err)
+		res, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		defer res.Body.Close()
+
+		var info repoInfo
+		json.NewDecoder(res.Body).Decode(&info)
+		return res.StatusCode, info
+	}
+
+	status, info := admin("POST", "app.git/fork", `{"name": "alice/app.git"}`)
+	assert.Equals(t, http.StatusCreated, status)
+	assert.Equals(t, "alice/app.git", info.Name)
+	assert.Equals(t, "master", info.DefaultBranch)
+
+	status, _ = admin("POST", "app.git/fork", `{"name": "alice/app.git"}`)
+	assert.Equals(t, http.StatusConflict, status)
+	status, _ = admin("POST", "missing.git/fork", `{"name": "bob/app.git"}`)
+	assert.Equals(t, http.StatusNotFound, status)
+
+	// Forks have the refs of their parent, but none of its objects.
+	parent, fork := filepath.Join(rpath, "app.git"), filepath.Join(rpath, "alice", "app.git")
+	assert.Equals(t, gitOutput(t, parent, "for-each-ref"), gitOutput(t, fork, "for-each-ref"))
+	counts := gitOutput(t, fork, "count-objects", "-v")
+	assert.Cond(t, strings.HasPrefix(counts, "count: 0\nsize: 0\nin-pack: 0\n"), "objects should be borrowed: %s", counts)
+	assert.Equals(t, "never", gitOutput(t, parent, "config", "gc.pruneExpire"))
+
+	forked := filepath.Join(workspace, "fork")
+	git(t, workspace, "clone", "-q", ts.URL+"/alice/app.git", forked)
+	git(t, forked, "config", "user.name", "Gitd tests")
+	git(t, forked, "config", "user.email", "test@hooklift.io")
+	git(t, forked, "commit", "-q", "--allow-empty", "-m", "fork only")
+	git(t, forked, "push", "-q", "origin", "master")
+	assert.Cond(t, gitOutput(t, parent, "rev-parse", "master") != gitOutput(t, fork, "rev-parse", "master"), "parent should not be updated")
+
+	assert.Equals(t, []string{"repack", "-a", "-d", "-l"}, sharedRepackArgs(fork, []string{"repack", "-a", "-d"}))
+	assert.Equals(t, []string{"repack", "-a", "-d", "--keep-unreachable"}, sharedRepackArgs(parent, []string{"repack", "-a", "-d"}))
+	assert.Equals(t, []string{"gc", "--auto"}, sharedRepackArgs(parent, []string{"gc", "--auto"}))
+
+	status, _ = admin("DELETE", "app.git", "")
+	assert.Equals(t, http.StatusConflict, status)
+	status, _ = admin("POST", "app.git/move", `{"name": "moved.git"}`)
+	assert.Equals(t, http.StatusConflict, status)
+
+	status, _ = admin("DELETE", "alice/app.git", "")
+	assert.Equals(t, http.StatusNoContent, status)
+	status, _ = admin("DELETE", "app.git", "")
+	assert.Equals(t, http.StatusNoContent, status)
+}
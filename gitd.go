@@ -9,132 +9,646 @@ package gitd
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"regexp"
-	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-func init() {
-	if !checkGitVersion(2, 2, 1) {
-		log.Fatalln("Git >= v2.2.1 is required")
-	}
-}
+// ErrNoReposPath is returned when configuring a server without telling it
+// where repositories live, with ReposPath, Tenants, RepoStorage, Resolver or
+// Proxy.
+var ErrNoReposPath = errors.New("no repositories path configured")
 
+// Option configures the handler.
 // http://commandcenter.blogspot.com/2014/01/self-referential-functions-and-design.html
-type option func(*handler)
+type Option func(*handler)
 
 // Internal handler
 type handler struct {
-	reposPath string
+	reposPaths      []string
+	storage         Storage
+	logger          Logger
+	authenticator   Authenticator
+	adminAuth       Authenticator
+	authorize       func(user, repo string, op Operation) bool
+	preReceive      []ReceiveHook
+	postReceive     []ReceiveHook
+	adminAPI        bool
+	autoInit        bool
+	exportMarker    string
+	tracer          Tracer
+	locks           repoLocks
+	env             func(req *http.Request, repo string) []string
+	buffers         bufferPool
+	templateDir     string
+	lfs             LFSStorage
+	lfsBatchRe      *regexp.Regexp
+	lfsObjectRe     *regexp.Regexp
+	dumbHTTP        bool
+	archives        bool
+	bundles         bool
+	rawFiles        bool
+	browseAPI       bool
+	mirrors         *mirrorSet
+	replicas        []*replicaQueue
+	proxy           *proxy
+	readThrough     *Upstream
+	activity        repoActivity
+	readOnly        readOnlyMode
+	backups         *BackupPolicy
+	journal         Journal
+	redirects       redirects
+	bundleURIs      func(repo string) []BundleURI
+	maxRawSize      int64
+	metrics         *metrics
+	metricsPath     string
+	opSlots         chan struct{}
+	queueTimeout    time.Duration
+	maxPushSize     int64
+	timeouts        map[string]time.Duration
+	backend         BackendKind
+	resolver        RepoResolver
+	namespacePrefix string
+	refsCache       *refsCache
+	packCache       *packCache
+	daemonPush      bool
+	procs           processes
+	messages        MessageFunc
+	healthChecks    bool
+	audit           AuditSink
+	refPolicy       *RefPolicy
+	pushCerts       *pushCertVerifier
+	commitSigs      SignatureVerifier
+	quotas          *quotas
+	rateLimiter     *rateLimiter
+	maintenance     *maintenance
+	optimizer       *optimizer
+	uploadConfig    func(repo string) UploadPackConfig
+	hiddenRefs      HiddenRefs
+	initialBranch   string
+	poolsRoot       string
+	trash           *trash
+	repoHiddenRefs  func(repo string) HiddenRefs
+	tenants         map[string]*tenant
+	gitPath         string
+	serviceBinaries map[string]string
+	runAs           *account
+	procLimits      *ProcessLimits
+	confinement     *confinement
+	minGitVersion   string
+	repoPattern     string
+	ipFilter        ipFilter
+	events          events
 }
 
-// ReposPath allows to set the root path where the Git bare repos live.
-func ReposPath(rpath string) option {
+// ReposPath allows to set the root path where the Git bare repos live,
+// unless stored elsewhere with RepoStorage. Given several paths,
+// repositories are looked up in each of them in order, and new ones are
+// created in the first, so repositories on a legacy volume can be served
+// along with new ones on another.
+func ReposPath(rpath string, more ...string) Option {
 	return func(l *handler) {
-		l.reposPath = rpath
+		l.reposPaths = append([]string{rpath}, more...)
+	}
+}
+
+// AutoInitRepos makes pushes to nonexistent repositories initialize them as
+// bare repositories on the fly, once the request is authenticated and
+// authorized.
+func AutoInitRepos(enabled bool) Option {
+	return func(h *handler) {
+		h.autoInit = enabled
 	}
 }
 
-// Handler configures the handler and returns an HTTP handler function.
-func Handler(h http.Handler, opts ...option) http.Handler {
-	reposPath, err := ioutil.TempDir(os.TempDir(), "gitd")
+// Server serves Git repositories. It is an http.Handler serving Git over
+// HTTP, and can serve other transports sharing the same configuration.
+type Server struct {
+	h    *handler
+	http http.Handler
+}
+
+// ServeHTTP serves Git over HTTP, passing any other requests through to the
+// handler Server was created with.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.http.ServeHTTP(w, req)
+}
+
+// Handler is like NewHandler but panics if the handler cannot be
+// configured.
+func Handler(h http.Handler, opts ...Option) http.Handler {
+	handler, err := NewHandler(h, opts...)
 	if err != nil {
-		log.Fatalf("%v\n", err)
+		panic(err)
 	}
+	return handler
+}
 
+// NewHandler configures the handler and returns an HTTP handler function.
+// The handler returned is a *Server.
+func NewHandler(h http.Handler, opts ...Option) (http.Handler, error) {
+	srv, err := NewServer(h, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+// NewServer configures a Git server. Requests it does not serve are passed
+// through to h. It fails with ErrNoReposPath unless told where repositories
+// live.
+func NewServer(h http.Handler, opts ...Option) (*Server, error) {
 	// Default configuration.
 	handler := &handler{
-		reposPath: reposPath,
+		logger:       stdLogger{},
+		queueTimeout: 10 * time.Second,
+		timeouts:     make(map[string]time.Duration),
+		maintenance:  newMaintenance(),
 	}
+	handler.resolver = storageResolver{handler}
 
 	// Sets users specified configurations, overriding default ones.
 	for _, opt := range opts {
 		opt(handler)
 	}
 
-	handlers := map[*regexp.Regexp]func(http.ResponseWriter, *http.Request, string, string){
-		regexp.MustCompile("(.*?)/git-upload-pack$"):  uploadPack,
-		regexp.MustCompile("(.*?)/git-receive-pack$"): receivePack,
-		regexp.MustCompile("(.*?)/info/refs$"):        infoRefs,
+	if handler.storage == nil && handler.tenants != nil {
+		handler.storage = tenantStorage(handler.tenants)
+	}
+	if handler.storage == nil {
+		switch {
+		case len(handler.reposPaths) > 0 && handler.reposPaths[0] != "":
+			handler.storage = RootsStorage(handler.reposPaths...)
+		case handler.proxy != nil || !usesStorage(handler.resolver):
+			handler.storage = noStorage{}
+		default:
+			return nil, ErrNoReposPath
+		}
+	}
+	if handler.confinement != nil {
+		if !canConfine {
+			handler.logger.Error("Confining Git is not supported on this system")
+			handler.confinement = nil
+		} else if err := handler.confinement.init(handler); err != nil {
+			return nil, fmt.Errorf("confining Git failed: %v", err)
+		}
+	}
+	if handler.quotas == nil && handler.hasTenantQuotas() {
+		handler.quotas = &quotas{limit: func(string) int64 { return 0 }, usage: make(map[string]quotaUsage)}
+	}
+
+	if err := handler.redirects.load(); err != nil {
+		handler.logger.Error("Loading redirects failed", Field{"file", handler.redirects.file}, Field{"error", err})
 	}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		for re, fn := range handlers {
-			if m := re.FindStringSubmatch(req.URL.Path); m != nil {
-				repoPath := m[1]
-				fn(w, req, handler.reposPath, repoPath)
-				return
-			}
+	if handler.maintenance.interval > 0 {
+		go handler.scheduleMaintenance()
+	}
+	if handler.backups != nil && handler.backups.Interval > 0 {
+		go handler.scheduleBackups()
+	}
+	if handler.trash != nil {
+		go handler.scheduleTrashPurge()
+	}
+	if handler.optimizer != nil {
+		handler.optimizer.start(handler)
+	}
+	if handler.mirrors != nil {
+		handler.mirrors.start(handler)
+	}
+	for _, q := range handler.replicas {
+		q.start(handler)
+	}
+
+	if err := handler.ipFilter.init(); err != nil {
+		return nil, err
+	}
+
+	routes, err := newRouter(handler.repoPattern)
+	if err != nil {
+		return nil, err
+	}
+	routes.add("/git-upload-pack", handler.uploadPack)
+	routes.add("/git-receive-pack", handler.receivePack)
+	routes.add("/info/refs", handler.infoRefs)
+
+	if handler.lfs != nil {
+		handler.lfsBatchRe = routes.compile(lfsBatchPath)
+		handler.lfsObjectRe = routes.compile(lfsObjectPath)
+	}
+
+	if handler.dumbHTTP {
+		for _, suffix := range dumbFiles {
+			routes.add(suffix, handler.dumbFile)
 		}
-		h.ServeHTTP(w, req)
+	}
+
+	if handler.archives {
+		routes.add(archivePath, handler.archive)
+	}
+
+	if handler.rawFiles {
+		routes.add(rawPath, handler.rawFile)
+	}
+
+	if handler.bundles {
+		routes.add(bundlePath, handler.bundle)
+	}
+
+	srv := &Server{h: handler}
+	srv.http = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req, allowed := handler.filterIPs(w, req)
+		if !allowed {
+			return
+		}
+
+		if handler.metrics != nil && req.URL.Path == handler.metricsPath {
+			handler.metrics.ServeHTTP(w, req)
+			return
+		}
+
+		if handler.healthChecks && handler.serveHealth(w, req) {
+			return
+		}
+
+		if handler.browseAPI && handler.serveBrowse(w, req) {
+			return
+		}
+
+		if handler.adminAPI && isAdminPath(req.URL.Path) {
+			handler.serveAdmin(w, req)
+			return
+		}
+
+		if handler.adminAPI && isServerAdminPath(req.URL.Path) {
+			handler.serveServerAdmin(w, req)
+			return
+		}
+
+		if handler.lfs != nil && handler.serveLFS(w, req) {
+			return
+		}
+
+		fn, repoPath, params := routes.match(req.URL.Path)
+		if fn == nil {
+			h.ServeHTTP(w, req)
+			return
+		}
+		req = req.WithContext(context.WithValue(req.Context(), paramsKey{}, params))
+
+		// Authorizers and upstream servers must see the repository the
+		// request is for, not a path that could traverse out of it.
+		if checkRepoPath(repoPath) == errInvalidRepoPath {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Bad Request"))
+			return
+		}
+
+		repo := strings.TrimPrefix(repoPath, "/")
+		op := operation(req)
+		if handler.tracer != nil {
+			tw, treq := handler.traceRequest(w, req, repo, op)
+			defer tw.end()
+			w, req = tw, treq
+		}
+
+		req, ok := handler.authenticate(w, req, repo, op)
+		if !ok || !handler.authorizeRepo(w, req, repo, op) {
+			return
+		}
+
+		if handler.redirect(w, req, repo) {
+			return
+		}
+
+		if handler.proxy != nil {
+			handler.serveProxy(w, req, repo)
+			return
+		}
+
+		if op == Fetch && handler.readThrough != nil && !handler.serveCached(w, req, repo) {
+			return
+		}
+
+		target, ok := handler.resolve(w, req, repoPath)
+		if !ok {
+			return
+		}
+
+		// Pushes to mirrors would be overwritten by their next sync.
+		if op == Push && (handler.readThrough != nil || handler.isMirror(target.name)) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Forbidden"))
+			return
+		}
+
+		if !handler.enterRepo(w, target.dir) {
+			return
+		}
+		defer handler.activity.leave(target.dir)
+
+		if op == Push && handler.autoInit && !handler.ensureRepo(w, target) {
+			return
+		}
+
+		// Git would otherwise run in a bogus directory, or in the
+		// nearest repository above it.
+		if !handler.exported(target.dir) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Not Found"))
+			return
+		}
+		fn(w, req, target)
 	})
+	return srv, nil
+}
+
+// enterRepo marks an operation as running on the repository in dir, until
+// h.activity.leave is called. It writes a 503 response and returns false if
+// operations on it are paused.
+func (h *handler) enterRepo(w http.ResponseWriter, dir string) bool {
+	if err := h.activity.enter(dir); err != nil {
+		retry := 5 * time.Second
+		if err == errMaintenanceMode {
+			retry = h.activity.retryAfterPause()
+		}
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(retry.Seconds())))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Service Unavailable"))
+		return false
+	}
+	return true
+}
+
+// invalidateRepo forgets the cached ref advertisements, packs and disk
+// usage of the repository in dir, once its contents changed or another
+// repository took its place.
+func (h *handler) invalidateRepo(dir string) {
+	if h.refsCache != nil {
+		h.refsCache.invalidate(dir)
+	}
+	if h.packCache != nil {
+		h.packCache.invalidate(dir)
+	}
+	if h.quotas != nil {
+		h.quotas.invalidate(dir)
+	}
+}
+
+// ensureRepo initializes repo if it does not exist yet. It writes an error
+// response and returns false if that is not possible.
+func (h *handler) ensureRepo(w http.ResponseWriter, repo *repository) bool {
+	if isBareRepo(repo.dir) {
+		return true
+	}
+
+	if !validRepoName(repo.name) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Bad Request"))
+		return false
+	}
+
+	if err := h.initRepo(repo.dir); err != nil {
+		h.logger.Error("Initializing repository failed", Field{"repo", repo.name}, Field{"error", err})
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal Server Error"))
+		return false
+	}
+	h.invalidateRepo(repo.dir)
+
+	h.logger.Info("Repository initialized on push", Field{"repo", repo.name})
+	return true
 }
 
 // uploadPack runs git-upload-pack in a safe manner.
-func uploadPack(w http.ResponseWriter, req *http.Request, reposPath, repoPath string) {
+func (h *handler) uploadPack(w http.ResponseWriter, req *http.Request, repo *repository) {
+	logger := h.requestLogger(req)
+
 	if req.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		w.Write([]byte("Method Not Allowed"))
 		return
 	}
 	process := "git-upload-pack"
-	cwd := filepath.Join(reposPath, repoPath)
+	cwd := repo.dir
 
-	headers := w.Header()
-	headers.Add("Content-Type", fmt.Sprintf("application/x-%s-result", process))
-	w.WriteHeader(http.StatusOK)
-
-	cmd := exec.Command(process, "--stateless-rpc", ".")
-	cmd.Dir = cwd
+	req, cancel := h.withTimeout(req, process)
+	defer cancel()
 
 	body, err := decompress(req)
 	if err != nil {
-		log.Printf("[ERROR] Error attempting to decompress request body: %+v", err)
+		logger.Error("Decompressing request body failed", Field{"error", err})
 		body = req.Body
 	}
+	defer req.Body.Close()
+
+	headers := w.Header()
+	headers.Add("Content-Type", fmt.Sprintf("application/x-%s-result", process))
+
+	if h.bundleURIs != nil && isProtocolV2(req) && h.backend != GoGit {
+		var served bool
+		if body, served = h.serveBundleURIs(w, repo, body); served {
+			return
+		}
+	}
+
+	out := &countingResponseWriter{ResponseWriter: w}
+	in := &countingReader{r: body}
+	relay := &sidebandRelay{ResponseWriter: out}
+	req = h.withMessages(req, messageWriter{relay}, repo.name, Fetch)
+
+	cmd := h.serviceCommand(req.Context(), cwd, process, "--stateless-rpc", ".")
+	cmd.Env = cgiEnv(append(gitProtocolEnv(req), repo.env...), req, repo)
+	cmd.Env = h.uploadPackEnv(h.requestEnv(cmd.Env, req, repo), repo.name)
+	cmd.Env = h.hideRefsEnv(cmd.Env, repo.name)
+
+	h.events.emit(FetchStarted{newEventInfo(req, repo.name)})
+	if h.packCache != nil {
+		err = h.cachedUploadPack(relay, req, in, cmd, repo)
+	} else {
+		err = h.execute(relay, req, in, cmd, repo.name, nil)
+	}
+	relay.Close()
+	h.fetchDone(req, repo.name, out.n, in.count(), err)
 
-	runCommand(w, body, cmd)
-	req.Body.Close()
+	if h.audit != nil {
+		e := newAuditEvent(req, repo.name, Fetch)
+		e.BytesSent, e.BytesReceived = out.n, in.count()
+		h.recordAudit(e, err)
+	}
 }
 
 // receivePack runs git-receive-pack in a safe manner.
-func receivePack(w http.ResponseWriter, req *http.Request, reposPath, repoPath string) {
+func (h *handler) receivePack(w http.ResponseWriter, req *http.Request, repo *repository) {
+	logger := h.requestLogger(req)
+
 	if req.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		w.Write([]byte("Method Not Allowed"))
 		return
 	}
 	process := "git-receive-pack"
-	cwd := filepath.Join(reposPath, repoPath)
+	cwd := repo.dir
+
+	req, cancel := h.withTimeout(req, process)
+	defer cancel()
+
+	body, err := decompress(req)
+	if err != nil {
+		logger.Error("Decompressing request body failed", Field{"error", err})
+		body = req.Body
+	}
+	defer req.Body.Close()
+
+	if h.maxPushSize > 0 {
+		if req.ContentLength > h.maxPushSize && body == req.Body {
+			logger.Info("Push rejected for being too large", Field{"repo", repo.name}, Field{"size", req.ContentLength})
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte("Request Entity Too Large"))
+			return
+		}
+		body = &maxSizeReader{r: body, n: h.maxPushSize}
+	}
+
+	blocked := h.pushBlocked(repo)
+	var cmds *commandList
+	if blocked != nil || h.readsCommands() {
+		cmds, body, err = readCommands(body)
+		if err != nil {
+			logger.Error("Reading push commands failed", Field{"repo", repo.name}, Field{"error", err})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Bad Request"))
+			return
+		}
+		req = withCommands(req, cmds)
+	}
 
 	headers := w.Header()
 	headers.Add("Content-Type", fmt.Sprintf("application/x-%s-result", process))
-	w.WriteHeader(http.StatusOK)
 
-	cmd := exec.Command(process, "--stateless-rpc", ".")
-	cmd.Dir = cwd
+	// Messages Git prints, such as those of repository hooks, are relayed
+	// to the client along with the ones of the server.
+	out := &countingResponseWriter{ResponseWriter: w}
+	in := &countingReader{r: body}
+	relay := &sidebandRelay{ResponseWriter: out}
+	req = h.withMessages(req, messageWriter{relay}, repo.name, Push)
 
-	body, err := decompress(req)
+	var audit *AuditEvent
+	if h.audit != nil {
+		audit = newAuditEvent(req, repo.name, Push)
+		audit.Refs = cmds.updates
+		defer func() {
+			audit.BytesSent, audit.BytesReceived = out.n, in.count()
+			h.recordAudit(audit, err)
+		}()
+	}
+	defer relay.Close()
+	defer func() {
+		if err != nil {
+			h.pushFailed(req, repo.name, err)
+		}
+	}()
+
+	reject := func(msg string) {
+		logger.Info(msg, Field{"repo", repo.name}, Field{"error", err})
+		io.Copy(ioutil.Discard, in)
+		w.WriteHeader(http.StatusOK)
+		cmds.reject(relay, err.Error())
+		if audit != nil {
+			audit.Result = AuditRejected
+		}
+	}
+
+	if blocked != nil {
+		err = blocked
+		reject("Push rejected by read-only repository")
+		return
+	}
+
+	if cmds != nil {
+		for _, hook := range h.preReceive {
+			if err = hook(req, repo.name, cmds.updates); err != nil {
+				reject("Push rejected by pre-receive hook")
+				return
+			}
+		}
+	}
+
+	if h.inspectsPacks() {
+		var cleanup func()
+		in.r, cleanup, err = h.inspectPack(repo.name, repo.dir, cmds)
+		defer cleanup()
+		if err != nil {
+			reject("Push rejected after inspecting its pack")
+			return
+		}
+	}
+
+	cmd := h.serviceCommand(req.Context(), cwd, process, "--stateless-rpc", ".")
+	cmd.Env = h.requestEnv(cgiEnv(append(gitProtocolEnv(req), repo.env...), req, repo), req, repo)
+	cmd.Stderr = messageWriter{relay}
+	cmd.Env = gitConfigEnv(cmd.Env, advertisePushOptions)
+	cmd.Env = h.hideRefsEnv(cmd.Env, repo.name)
+	if h.refPolicy != nil && h.refPolicy.fastForwardOnly(cmds.updates) {
+		cmd.Env = gitConfigEnv(cmd.Env, denyNonFastForwards)
+	}
+
+	// Concurrent pushes would race on packed-refs, and on what the journal
+	// records.
+	unlock, err := h.locks.lock(req.Context(), repo.dir)
 	if err != nil {
-		log.Printf("[ERROR] Error attempting to decompress request body: %+v", err)
-		body = req.Body
+		logger.Info("Push canceled waiting for the repository", Field{"repo", repo.name}, Field{"error", err})
+		status := http.StatusServiceUnavailable
+		if err == context.DeadlineExceeded {
+			status = http.StatusGatewayTimeout
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(http.StatusText(status)))
+		return
+	}
+	defer unlock()
+
+	var gitOut http.ResponseWriter = relay
+	report := new(reportParser)
+	if cmds != nil {
+		gitOut = &reportingResponseWriter{ResponseWriter: relay, report: report}
 	}
+	err = h.execute(gitOut, req, in, cmd, repo.name, nil)
 
-	runCommand(w, body, cmd)
-	req.Body.Close()
+	// Even failed pushes may have updated some refs.
+	h.invalidateRepo(repo.dir)
+
+	if err != nil {
+		return
+	}
+
+	h.optimizeAfterPush(repo.name, repo.dir)
+	h.dedupAfterPush(repo.name, repo.dir)
+	h.replicate(repo)
+	if cmds != nil {
+		h.recordRefs(req, repo, cmds.updates)
+		unlock()
+		result := report.result(cmds.updates)
+		logPushResult(logger, repo.name, result)
+		h.postReceiveHooks(logger, withPushResult(req, result), repo.name, cmds.updates, result)
+		h.pushDone(req, repo.name, cmds.updates, result)
+	}
 }
 
 // infoRefs returns Git object refs.
-func infoRefs(w http.ResponseWriter, req *http.Request, reposPath, repoPath string) {
+func (h *handler) infoRefs(w http.ResponseWriter, req *http.Request, repo *repository) {
+	logger := h.requestLogger(req)
+
 	if req.Method != "GET" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		w.Write([]byte("Method Not Allowed"))
@@ -142,7 +656,12 @@ func infoRefs(w http.ResponseWriter, req *http.Request, reposPath, repoPath stri
 	}
 
 	process := req.URL.Query().Get("service")
-	cwd := filepath.Join(reposPath, repoPath)
+	cwd := repo.dir
+
+	if process == "" && h.dumbHTTP {
+		h.dumbInfoRefs(w, req, repo)
+		return
+	}
 
 	if process != "git-receive-pack" && process != "git-upload-pack" {
 		w.WriteHeader(http.StatusBadRequest)
@@ -150,52 +669,403 @@ func infoRefs(w http.ResponseWriter, req *http.Request, reposPath, repoPath stri
 		return
 	}
 
+	// Advertisements are sent once complete, unless they are too large to
+	// hold back, and after compressing them, if they are.
+	sized := &sizedResponseWriter{ResponseWriter: w, max: maxSizedResponse}
+	defer sized.Close()
+	w = sized
+
+	req, cancel := h.withTimeout(req, process)
+	defer cancel()
+
+	body, err := decompress(req)
+	if err != nil {
+		logger.Error("Decompressing request body failed", Field{"error", err})
+		body = req.Body
+	}
+	defer req.Body.Close()
+
 	headers := w.Header()
 	headers.Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", process))
-	w.WriteHeader(http.StatusOK)
 
-	w.Write(packetWrite(fmt.Sprintf("# service=%s\n", process)))
-	w.Write(packetFlush())
+	if process == "git-receive-pack" {
+		if err := h.pushBlocked(repo); err != nil {
+			logger.Info("Push rejected", Field{"repo", repo.name}, Field{"error", err})
+			advertisePushBlocked(w, err)
+			return
+		}
+	}
+
+	// Advertisements of repositories with many refs compress well.
+	headers.Add("Vary", "Accept-Encoding")
+	if acceptsGzip(req) {
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		w = gw
+	}
 
-	cmd := exec.Command(process, "--stateless-rpc", "--advertise-refs", ".")
-	cmd.Dir = cwd
+	// Protocol v2 clients expect the capability advertisement right away.
+	// go-git only speaks v0, which always starts with the preamble.
+	var preamble []byte
+	if !isProtocolV2(req) || h.backend == GoGit {
+		preamble = append(packetWrite(fmt.Sprintf("# service=%s\n", process)), packetFlush()...)
+	}
 
-	body, err := decompress(req)
+	cmd := h.serviceCommand(req.Context(), cwd, process, "--stateless-rpc", "--advertise-refs", ".")
+	cmd.Env = h.requestEnv(cgiEnv(append(gitProtocolEnv(req), repo.env...), req, repo), req, repo)
+	cmd.Env = h.hideRefsEnv(cmd.Env, repo.name)
+	if process == "git-receive-pack" {
+		cmd.Env = gitConfigEnv(cmd.Env, advertisePushOptions)
+	} else {
+		cmd.Env = h.uploadPackEnv(cmd.Env, repo.name)
+		if h.bundleURIs != nil && preamble == nil && len(h.bundleList(repo.name)) > 0 {
+			w = &capabilityWriter{ResponseWriter: w, capability: packetWrite("bundle-uri\n")}
+		}
+	}
+
+	// Nonces for signed pushes must be fresh.
+	if process == "git-receive-pack" && h.pushCerts != nil {
+		cmd.Env = gitConfigEnv(cmd.Env, h.pushCerts.gitConfig())
+		h.execute(w, req, body, cmd, repo.name, preamble)
+		return
+	}
+
+	if h.refsCache != nil {
+		h.cachedAdvertisement(w, req, body, cmd, repo, preamble)
+		return
+	}
+	h.execute(w, req, body, cmd, repo.name, preamble)
+}
+
+// execute runs cmd, sending its output as response body. The response status
+// is only sent once the command produces output, prefixed by preamble, so
+// failing commands can still be reported as internal server errors.
+func (h *handler) execute(w http.ResponseWriter, req *http.Request, r io.Reader, cmd *exec.Cmd, repo string, preamble []byte) error {
+	logger := h.requestLogger(req)
+
+	if !h.limitRate(w, req, repo) {
+		return errRateLimited
+	}
+	if !h.acquireSlot(req.Context(), w) {
+		return errTooManyOps
+	}
+	defer h.releaseSlot()
+
+	start := time.Now()
+	rw := &deferredWriter{w: w, preamble: preamble}
+	body := &countingReader{r: r}
+
+	if h.metrics != nil {
+		h.metrics.started(cmd.Args[0])
+	}
+
+	ctx, span := h.startSpan(req.Context(), "exec "+cmd.Args[0], Field{"repo", repo}, Field{"user", remoteUser(req)})
+	in, out, endIO := h.traceIO(ctx, body, rw)
+
+	var err error
+	if h.backend == GoGit {
+		err = h.runGoGit(req.Context(), out, in, cmd)
+	} else {
+		err = h.runCommand(logger, out, in, cmd)
+	}
+
+	endIO()
 	if err != nil {
-		log.Printf("[ERROR] Error attempting to decompress request body: %+v", err)
-		body = req.Body
+		span.RecordError(err)
 	}
+	span.End()
 
-	runCommand(w, body, cmd)
-	req.Body.Close()
+	if h.metrics != nil {
+		h.metrics.finished(cmd.Args[0], h.tenantName(repo), repo, remoteUser(req), time.Since(start), rw.written, body.count(), err)
+	}
+	if limiter := h.limiterFor(repo); limiter != nil {
+		limiter.charge(requestRateKey(req), rw.written+body.count(), time.Now())
+	}
+
+	fields := []Field{
+		{"repo", repo},
+		{"service", cmd.Args[0]},
+		{"duration", time.Since(start)},
+		{"bytes", rw.written},
+	}
+
+	if err != nil {
+		logger.Error("Git command failed", append(fields, Field{"error", err})...)
+		if !rw.wroteHeader {
+			status := http.StatusInternalServerError
+			switch {
+			case err == errPushTooLarge:
+				status = http.StatusRequestEntityTooLarge
+			case err == errShuttingDown:
+				status = http.StatusServiceUnavailable
+			case req.Context().Err() == context.DeadlineExceeded:
+				status = http.StatusGatewayTimeout
+			}
+			// The client may still be sending its request, which must
+			// not be drained before replying. HTTP/2 streams are reset
+			// instead, keeping the connection.
+			if req.ProtoMajor == 1 {
+				w.Header().Set("Connection", "close")
+			}
+			text := http.StatusText(status)
+			w.Header().Del("Content-Type")
+			w.Header().Set("Content-Length", strconv.Itoa(len(text)))
+			w.WriteHeader(status)
+			w.Write([]byte(text))
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		return err
+	}
+
+	if !rw.wroteHeader {
+		rw.writeHeader()
+	}
+
+	logger.Info("Git command completed", fields...)
+	return nil
 }
 
-// runCommand executes a shell command and pipes its output to HTTP response writer.
-// DO NOT expose this function directly to end users as it will create a security breach.
-func runCommand(w io.Writer, r io.Reader, cmd *exec.Cmd) {
-	if cmd.Dir != "" {
-		cmd.Dir = sanitize(cmd.Dir)
+// deferredWriter delays sending the response status and headers until the
+// first write.
+type deferredWriter struct {
+	w           http.ResponseWriter
+	preamble    []byte
+	wroteHeader bool
+	written     int64
+}
+
+func (d *deferredWriter) writeHeader() error {
+	d.wroteHeader = true
+	d.w.WriteHeader(http.StatusOK)
+	if len(d.preamble) == 0 {
+		return nil
+	}
+	_, err := d.w.Write(d.preamble)
+	return err
+}
+
+func (d *deferredWriter) Write(p []byte) (int, error) {
+	if !d.wroteHeader {
+		if err := d.writeHeader(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := d.w.Write(p)
+	d.written += int64(n)
+	return n, err
+}
+
+// Flush sends what was written so far to the client.
+func (d *deferredWriter) Flush() {
+	if f, ok := d.w.(http.Flusher); ok && d.wroteHeader {
+		f.Flush()
 	}
+}
+
+// gitProtocolRe matches the values Git clients send in the Git-Protocol header,
+// such as "version=2".
+var gitProtocolRe = regexp.MustCompile(`^[a-zA-Z0-9=:._-]+$`)
+
+// gitProtocolEnv returns the environment for Git processes, passing the
+// client's Git-Protocol header through as GIT_PROTOCOL.
+func gitProtocolEnv(req *http.Request) []string {
+	env := os.Environ()
+	if p := req.Header.Get("Git-Protocol"); gitProtocolRe.MatchString(p) {
+		env = append(env, "GIT_PROTOCOL="+p)
+	}
+	return env
+}
 
-	log.Printf("[DEBUG] Running command from %s: %s %s ", cmd.Dir, cmd.Path, cmd.Args)
+// advertisePushOptions makes git-receive-pack accept push options, which
+// are passed to hooks.
+const advertisePushOptions = "receive.advertisepushoptions=true"
+
+// gitConfigEnv returns env setting the Git configuration param, such as
+// "receive.denynonfastforwards=true", along with any already set in env.
+func gitConfigEnv(env []string, param string) []string {
+	const key = "GIT_CONFIG_PARAMETERS="
+	quoted := "'" + strings.Replace(param, "'", `'\''`, -1) + "'"
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], key) {
+			env[i] += " " + quoted
+			return env
+		}
+	}
+	return append(env, key+quoted)
+}
+
+// isProtocolV2 returns whether the client requested Git wire protocol v2.
+func isProtocolV2(req *http.Request) bool {
+	for _, param := range strings.Split(req.Header.Get("Git-Protocol"), ":") {
+		if param == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// runCommand executes a shell command and pipes its output to HTTP response writer.
+// DO NOT expose this function directly to end users as it will create a security breach.
+func (h *handler) runCommand(logger Logger, w io.Writer, r io.Reader, cmd *exec.Cmd) error {
+	logger.Debug("Running command", Field{"dir", cmd.Dir}, Field{"path", cmd.Path}, Field{"args", cmd.Args})
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		log.Printf("[ERROR] %v", err)
+		return err
 	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Printf("[ERROR] %v", err)
+		return err
+	}
+
+	// Anything set as stderr by the caller gets a copy of it.
+	stderr := &stderrWriter{
+		logger: logger,
+		fields: []Field{{"service", cmd.Args[0]}, {"dir", cmd.Dir}},
+		w:      cmd.Stderr,
+	}
+	cmd.Stderr = stderr
+
+	if err := h.procs.start(cmd); err != nil {
+		return err
+	}
+	if h.procLimits != nil {
+		if err := h.procLimits.apply(cmd.Process); err != nil {
+			logger.Error("Limiting process failed", Field{"service", cmd.Args[0]}, Field{"error", err})
+			cmd.Process.Kill()
+			cmd.Wait()
+			h.procs.done(cmd)
+			stderr.Close()
+			return err
+		}
+	}
+
+	// Stdin is fed from its own goroutine, while output is streamed back,
+	// since Git may answer before reading all of its input, and so a
+	// stalled client cannot keep the command from being killed once its
+	// context is done. Failing to read the input kills the command rather
+	// than letting it act on a truncated one. Failing to write to the
+	// command means it exited already, which Wait reports. The input is
+	// done with before returning, unless the command is gone while the
+	// client stalls sending it, in which case reading it is given up.
+	input := &inputReader{r: r}
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		buf := h.buffers.get()
+		io.CopyBuffer(stdin, input, *buf)
+		h.buffers.put(buf)
+		if input.err() != nil {
+			cmd.Process.Kill()
+		}
+		stdin.Close()
+	}()
+
+	// Git must be able to write everything out to exit, even if the client
+	// is gone.
+	buf := h.buffers.get()
+	_, werr := streamOutput(w, stdout, *buf)
+	if werr != nil {
+		io.CopyBuffer(ioutil.Discard, stdout, *buf)
+	}
+	h.buffers.put(buf)
+
+	err = cmd.Wait()
+	h.procs.done(cmd)
+	stderr.Close()
+	if input.stop() {
+		<-copied
+	}
+
+	if rerr := input.err(); rerr == errPushTooLarge {
+		return rerr
+	} else if rerr != nil {
+		return fmt.Errorf("reading input failed: %v", rerr)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, stderr)
 	}
+	if werr != nil {
+		return fmt.Errorf("writing output failed: %v", werr)
+	}
+	return nil
+}
+
+// inputReader keeps the first error reading the input of a command, other
+// than io.EOF, telling it apart from errors writing to the command.
+type inputReader struct {
+	r       io.Reader
+	mu      sync.Mutex
+	rerr    error
+	reading bool
+	stopped bool
+}
+
+func (i *inputReader) Read(p []byte) (int, error) {
+	i.mu.Lock()
+	if i.stopped {
+		i.mu.Unlock()
+		return 0, io.EOF
+	}
+	i.reading = true
+	i.mu.Unlock()
 
-	if err := cmd.Start(); err != nil {
-		log.Printf("[ERROR] %v", err)
+	n, err := i.r.Read(p)
+	i.mu.Lock()
+	i.reading = false
+	if err != nil && err != io.EOF && i.rerr == nil {
+		i.rerr = err
 	}
+	i.mu.Unlock()
+	return n, err
+}
 
-	io.Copy(stdin, r)
-	io.Copy(w, stdout)
-	cmd.Wait()
+// stop keeps the input from being read any further, returning false if a
+// read is under way still, which may never end.
+func (i *inputReader) stop() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.stopped = true
+	return !i.reading
+}
+
+func (i *inputReader) err() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rerr
+}
+
+// streamOutput copies the output of a command to w as it is produced, through
+// buf. If w is an http.Flusher, it is flushed after every read, so clients
+// get acknowledgements and progress messages right away rather than once
+// response buffers fill up.
+func streamOutput(w io.Writer, stdout io.Reader, buf []byte) (int64, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return io.CopyBuffer(w, stdout, buf)
+	}
+
+	var written int64
+	for {
+		n, err := stdout.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
 }
 
 // packetWrite returns bytes of a git packet containing the given string
@@ -224,69 +1094,74 @@ func decompress(r *http.Request) (io.Reader, error) {
 	return gzip.NewReader(r.Body)
 }
 
-// sanitize Sanitizes name to avoid overwriting sensitive system files
-// or executing forbidden binaries
-func sanitize(name string) string {
-	// Gets rid of volume drive label in Windows
-	if len(name) > 1 && name[1] == ':' && runtime.GOOS == "windows" {
-		name = name[2:]
-	}
+// acceptsGzip returns whether the client accepts gzip-compressed responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != "gzip" && name != "x-gzip" {
+			continue
+		}
 
-	name = filepath.Clean(name)
-	name = filepath.ToSlash(name)
-	for strings.HasPrefix(name, "../") {
-		name = name[3:]
+		accepted := true
+		for _, p := range params[1:] {
+			p = strings.Replace(p, " ", "", -1)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(p[2:], 64)
+				accepted = err == nil && q > 0
+			}
+		}
+		return accepted
 	}
-	return name
+	return false
 }
 
-// checkGitVersion checks a given Git version and returns whether or not
-// the required version is installed in the system.
-func checkGitVersion(major, minor, patch int) bool {
-	git, err := exec.LookPath("git")
-	if err != nil {
-		log.Printf("[ERROR] %v", err)
-		return false
-	}
+// gzipResponseWriter compresses the body of successful responses, leaving
+// errors uncompressed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
 
-	cmd := exec.Command(git, "--version")
-	var stdout string
-	if stdout, _, err = runAndLog(cmd); err != nil {
-		log.Printf("[ERROR] %v", err)
-		return false
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if status == http.StatusOK {
+		g.Header().Set("Content-Encoding", "gzip")
+		g.Header().Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
 	}
+	g.ResponseWriter.WriteHeader(status)
+}
 
-	output := strings.Split(stdout, "\n")
-	if len(output) < 2 {
-		log.Printf("[DEBUG] git version output: %v", output)
-		return false
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.gz != nil {
+		return g.gz.Write(p)
 	}
+	return g.ResponseWriter.Write(p)
+}
 
-	parts := strings.Split(output[0], " ")
-	if len(parts) < 3 {
-		log.Printf("[DEBUG] git version parts: %v", parts)
-		return false
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
 	}
-
-	version := strings.Split(parts[2], ".")
-	major2, _ := strconv.Atoi(version[0])
-	minor2, _ := strconv.Atoi(version[1])
-	patch2, _ := strconv.Atoi(version[2])
-
-	if major2 < major && minor2 < minor && patch2 < patch {
-		log.Printf("[INFO] git version not supported: %d.%d.%d < %d.%d.%d", major2, minor2, patch2, major, minor, patch)
-		return false
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
+}
 
-	return true
+// Close flushes any compressed data not written yet.
+func (g *gzipResponseWriter) Close() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
 }
 
 // Borrowed from https://github.com/mitchellh/packer/blob/master/builder/vmware/common/driver.go
 // runAndLog executes Git commands and logs output.
-func runAndLog(cmd *exec.Cmd) (string, string, error) {
+func runAndLog(logger Logger, cmd *exec.Cmd) (string, string, error) {
 	var stdout, stderr bytes.Buffer
 
-	log.Printf("[GitD] Executing: %s %v", cmd.Path, cmd.Args[1:])
+	logger.Debug("Executing", Field{"path", cmd.Path}, Field{"args", cmd.Args[1:]})
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	err := cmd.Run()
@@ -303,8 +1178,7 @@ func runAndLog(cmd *exec.Cmd) (string, string, error) {
 		err = fmt.Errorf("[GitD] error: %s", message)
 	}
 
-	log.Printf("stdout: %s", stdoutString)
-	log.Printf("stderr: %s", stderrString)
+	logger.Debug("Executed", Field{"path", cmd.Path}, Field{"stdout", stdoutString}, Field{"stderr", stderrString})
 
 	// Replace these for Windows, we only want to deal with Unix
 	// style line endings.
@@ -5,14 +5,21 @@
 package gitd
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/c4milo/handlers/logger"
 	"github.com/hooklift/assert"
@@ -96,3 +103,215 @@ func TestGitD(t *testing.T) {
 	assert.Ok(t, err)
 	assert.Equals(t, data, []byte("blah"))
 }
+
+// initBareRepo creates a bare repository named name inside root.
+func initBareRepo(t *testing.T, root, name string) {
+	git(t, root, "--bare", "init", name)
+}
+
+// git runs a Git command from dir, failing the test if it does not succeed.
+func git(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+}
+
+// cloneAndCommit clones url into dir, configures a test identity and commits
+// a file with the given content, leaving it ready to be pushed.
+func cloneAndCommit(t *testing.T, url, dir, content string) {
+	git(t, filepath.Dir(dir), "clone", url, dir)
+	git(t, dir, "config", "--local", "user.name", "Gitd tests")
+	git(t, dir, "config", "--local", "user.email", "test@hooklift.io")
+
+	err := ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte(content), 0644)
+	assert.Ok(t, err)
+
+	git(t, dir, "add", "--all")
+	git(t, dir, "commit", "-m", "testing gitd")
+}
+
+func TestNewHandler(t *testing.T) {
+	_, err := NewHandler(http.NotFoundHandler())
+	assert.Equals(t, ErrNoReposPath, err)
+
+	h, err := NewHandler(http.NotFoundHandler(), ReposPath(os.TempDir()))
+	assert.Ok(t, err)
+	_, ok := h.(*Server)
+	assert.Cond(t, ok, "handler is not a *Server")
+}
+
+func TestAutoInitRepos(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AutoInitRepos(true)))
+	defer ts.Close()
+
+	git(t, workspace, "init", "new")
+	local := filepath.Join(workspace, "new")
+	git(t, local, "config", "--local", "user.name", "Gitd tests")
+	git(t, local, "config", "--local", "user.email", "test@hooklift.io")
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(local, "README.md"), []byte("blah"), 0644))
+	git(t, local, "add", "--all")
+	git(t, local, "commit", "-m", "testing gitd")
+	git(t, local, "push", ts.URL+"/org/new.git", "HEAD:refs/heads/master")
+
+	assert.Cond(t, isBareRepo(filepath.Join(rpath, "org", "new.git")), "repository should have been initialized")
+}
+
+func TestProtocolV2(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath)))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/test.git/info/refs?service=git-upload-pack", nil)
+	assert.Ok(t, err)
+	req.Header.Set("Git-Protocol", "version=2")
+	res, err := http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Ok(t, err)
+	assert.Cond(t, strings.HasPrefix(string(body), "000eversion 2\n"), "unexpected advertisement: %q", body)
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "origin", "HEAD:refs/heads/master")
+	git(t, workspace, "-c", "protocol.version=2", "clone", ts.URL+"/test.git", "test2")
+}
+
+func TestCompressedAdvertisement(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath)))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/test.git/info/refs?service=git-upload-pack", nil)
+	assert.Ok(t, err)
+	req.Header.Set("Accept-Encoding", "deflate, gzip")
+	res, err := http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	defer res.Body.Close()
+	assert.Equals(t, "gzip", res.Header.Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(res.Body)
+	assert.Ok(t, err)
+	body, err := ioutil.ReadAll(gz)
+	assert.Ok(t, err)
+	assert.Cond(t, strings.HasPrefix(string(body), "001e# service=git-upload-pack\n0000"), "unexpected advertisement: %q", body)
+
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, "", res.Header.Get("Content-Encoding"))
+}
+
+func TestRunCommandCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, "sleep", "30")
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	h := &handler{logger: stdLogger{}}
+	err := h.runCommand(h.logger, ioutil.Discard, strings.NewReader(""), cmd)
+	assert.Cond(t, err != nil, "canceled command should fail")
+	assert.Cond(t, time.Since(start) < 10*time.Second, "command was not killed on cancellation")
+}
+
+func TestRunCommandStreaming(t *testing.T) {
+	h := &handler{logger: stdLogger{}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cmd := exec.Command("sh", "-c", "echo first; sleep 3; echo second")
+		h.runCommand(h.logger, w, strings.NewReader(""), cmd)
+	}))
+	defer ts.Close()
+
+	start := time.Now()
+	res, err := http.Get(ts.URL)
+	assert.Ok(t, err)
+	defer res.Body.Close()
+
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	assert.Ok(t, err)
+	assert.Equals(t, "first\n", line)
+	assert.Cond(t, time.Since(start) < 2*time.Second, "output was not streamed")
+}
+
+func TestRunCommandPiping(t *testing.T) {
+	h := &handler{logger: stdLogger{}}
+
+	// Answering before reading the whole input does not deadlock.
+	input := strings.NewReader(strings.Repeat("have\n", 1<<20))
+	cmd := exec.Command("sh", "-c", "head -c 1048576 /dev/zero; cat")
+	var out bytes.Buffer
+	assert.Ok(t, h.runCommand(h.logger, &out, input, cmd))
+	assert.Equals(t, 1<<20+5<<20, out.Len())
+
+	// Truncated input is not acted upon.
+	r := io.MultiReader(strings.NewReader("partial"), errReader{io.ErrUnexpectedEOF})
+	cmd = exec.Command("sh", "-c", "cat > /dev/null; sleep 5")
+	start := time.Now()
+	err := h.runCommand(h.logger, ioutil.Discard, r, cmd)
+	assert.Cond(t, err != nil && strings.Contains(err.Error(), "unexpected EOF"), "unexpected error: %v", err)
+	assert.Cond(t, time.Since(start) < 5*time.Second, "command was not killed")
+}
+
+// errReader fails every read with err.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestErrorStatusCodes(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	// Not a Git repository, so it is not served.
+	assert.Ok(t, os.Mkdir(filepath.Join(rpath, "empty.git"), 0755))
+	// Looks like a repository, but git-upload-pack fails right away.
+	initBareRepo(t, rpath, "broken.git")
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(rpath, "broken.git", "HEAD"), []byte("garbage\n"), 0644))
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath)))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/missing.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusNotFound, res.StatusCode)
+
+	res, err = http.Get(ts.URL + "/empty.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusNotFound, res.StatusCode)
+
+	res, err = http.Get(ts.URL + "/broken.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusInternalServerError, res.StatusCode)
+}
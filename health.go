@@ -0,0 +1,109 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// HealthChecks serves health checks for orchestrators such as Kubernetes,
+// without authentication:
+//
+//	GET /healthz  liveness: Git can be run and the repositories path written
+//	GET /readyz   readiness: also, Git operations can be taken on, which is
+//	              not the case in maintenance mode
+//
+// Both respond with 200 if all checks pass, or 503 listing the failing ones.
+func HealthChecks() Option {
+	return func(h *handler) {
+		h.healthChecks = true
+	}
+}
+
+// healthCheck is a named check reporting a problem as an error.
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// serveHealth serves the health check endpoints, returning false for other
+// requests.
+func (h *handler) serveHealth(w http.ResponseWriter, req *http.Request) bool {
+	checks := []healthCheck{
+		{"git", h.checkGit},
+		{"repos-path", h.checkReposPath},
+	}
+
+	switch req.URL.Path {
+	case "/healthz":
+	case "/readyz":
+		checks = append(checks, healthCheck{"capacity", h.checkCapacity})
+	default:
+		return false
+	}
+
+	var failures []string
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			h.logger.Warn("Health check failed", Field{"check", c.name}, Field{"error", err})
+			failures = append(failures, fmt.Sprintf("%s: %v\n", c.name, err))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	noCache(w)
+	if len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, f := range failures {
+			w.Write([]byte(f))
+		}
+		return true
+	}
+	w.Write([]byte("ok\n"))
+	return true
+}
+
+// checkGit verifies that the Git binary can be run.
+func (h *handler) checkGit() error {
+	return h.gitCommand("", "--version").Run()
+}
+
+// checkReposPath verifies that repositories can be created.
+func (h *handler) checkReposPath() error {
+	for _, rpath := range h.reposPaths {
+		f, err := ioutil.TempFile(rpath, ".healthz")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCapacity verifies that Git operations are accepted without waiting.
+func (h *handler) checkCapacity() error {
+	h.procs.Lock()
+	closing := h.procs.closing
+	h.procs.Unlock()
+
+	if closing {
+		return errShuttingDown
+	}
+
+	if paused, _ := h.activity.status(); paused {
+		return errMaintenanceMode
+	}
+
+	if h.opSlots != nil && len(h.opSlots) >= cap(h.opSlots) {
+		return errTooManyOps
+	}
+	return nil
+}
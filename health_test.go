@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestHealthChecks(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	srv, err := NewServer(http.NotFoundHandler(), ReposPath(rpath), HealthChecks(), MaxConcurrentOps(1))
+	assert.Ok(t, err)
+
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get("/healthz")
+	assert.Equals(t, http.StatusOK, code)
+	assert.Equals(t, "ok\n", body)
+
+	code, _ = get("/readyz")
+	assert.Equals(t, http.StatusOK, code)
+
+	// Exhausted capacity only makes the server unready.
+	srv.h.opSlots <- struct{}{}
+	code, body = get("/readyz")
+	assert.Equals(t, http.StatusServiceUnavailable, code)
+	assert.Equals(t, "capacity: too many concurrent operations\n", body)
+	code, _ = get("/healthz")
+	assert.Equals(t, http.StatusOK, code)
+	<-srv.h.opSlots
+
+	assert.Ok(t, srv.Shutdown(context.Background()))
+	code, _ = get("/readyz")
+	assert.Equals(t, http.StatusServiceUnavailable, code)
+
+	os.RemoveAll(rpath)
+	code, body = get("/healthz")
+	assert.Equals(t, http.StatusServiceUnavailable, code)
+	assert.Cond(t, len(body) > 0, "failing check not reported")
+
+	// Without the option, requests are passed through.
+	plain, err := NewServer(http.NotFoundHandler(), ReposPath(rpath))
+	assert.Ok(t, err)
+	w := httptest.NewRecorder()
+	plain.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equals(t, http.StatusNotFound, w.Code)
+}
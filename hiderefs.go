@@ -0,0 +1,160 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// HiddenRefs lists refs kept from clients by prefix, such as refs/internal/
+// or refs/keep-around/, which may end in *, as in refs/internal/*. As with
+// the hideRefs settings of Git, a leading ! exposes refs an earlier prefix
+// hides, and a leading ^ matches refs by their full name, namespace
+// included. Hidden refs are not advertised, and pushes can not update them.
+type HiddenRefs struct {
+	// All hides refs from fetches and pushes, setting transfer.hideRefs.
+	All []string
+	// Fetch hides refs from fetches, setting uploadpack.hideRefs.
+	Fetch []string
+	// Push hides refs from pushes, setting receive.hideRefs.
+	Push []string
+}
+
+// gitConfig returns the Git configuration parameters applying r.
+func (r HiddenRefs) gitConfig() []string {
+	var params []string
+	for _, set := range []struct {
+		key  string
+		refs []string
+	}{
+		{"transfer.hiderefs", r.All},
+		{"uploadpack.hiderefs", r.Fetch},
+		{"receive.hiderefs", r.Push},
+	} {
+		for _, ref := range set.refs {
+			params = append(params, set.key+"="+strings.TrimSuffix(ref, "*"))
+		}
+	}
+	return params
+}
+
+// HideRefs keeps refs from the clients of every repository, over all
+// transports and the browsing API.
+func HideRefs(refs HiddenRefs) Option {
+	return func(h *handler) {
+		h.hiddenRefs.All = append(h.hiddenRefs.All, refs.All...)
+		h.hiddenRefs.Fetch = append(h.hiddenRefs.Fetch, refs.Fetch...)
+		h.hiddenRefs.Push = append(h.hiddenRefs.Push, refs.Push...)
+	}
+}
+
+// HideRepoRefs keeps the refs hide returns for repositories, given their
+// name, from their clients, after those hidden by HideRefs, which they can
+// expose again with a leading !.
+func HideRepoRefs(hide func(repo string) HiddenRefs) Option {
+	return func(h *handler) {
+		h.repoHiddenRefs = hide
+	}
+}
+
+// hideRefsEnv returns env hiding the refs of the repository name that are
+// to be kept from clients.
+func (h *handler) hideRefsEnv(env []string, name string) []string {
+	params := h.hiddenRefs.gitConfig()
+	if h.repoHiddenRefs != nil {
+		params = append(params, h.repoHiddenRefs(name).gitConfig()...)
+	}
+	for _, param := range params {
+		env = gitConfigEnv(env, param)
+	}
+	return env
+}
+
+// fetchHiddenRefs returns the prefixes of the refs of the repository name
+// hidden from fetches, in the order Git reads them.
+func (h *handler) fetchHiddenRefs(name string) []string {
+	refs := append(append([]string{}, h.hiddenRefs.All...), h.hiddenRefs.Fetch...)
+	if h.repoHiddenRefs != nil {
+		repo := h.repoHiddenRefs(name)
+		refs = append(append(refs, repo.All...), repo.Fetch...)
+	}
+	return refs
+}
+
+// refHidden reports whether hidden, as returned by fetchHiddenRefs, hides
+// ref, the same as Git does: the last prefix ref matches decides. Refs of
+// namespaced repositories are never matched, so a leading ^ is ignored.
+func refHidden(hidden []string, ref string) bool {
+	for i := len(hidden) - 1; i >= 0; i-- {
+		prefix := hidden[i]
+		exposed := strings.HasPrefix(prefix, "!")
+		prefix = strings.TrimPrefix(strings.TrimPrefix(prefix, "!"), "^")
+		prefix = strings.TrimRight(strings.TrimSuffix(prefix, "*"), "/")
+		if strings.HasPrefix(ref, prefix) && (len(ref) == len(prefix) || ref[len(prefix)] == '/') {
+			return !exposed
+		}
+	}
+	return false
+}
+
+// refRules are the rules Git expands short ref names with, as in
+// git rev-parse.
+var refRules = []string{"%s", "refs/%s", "refs/tags/%s", "refs/heads/%s", "refs/remotes/%s", "refs/remotes/%s/HEAD"}
+
+// revHidden reports whether rev, a revision of repo given by a client,
+// may refer to a ref hidden from fetches, at either end of a range, be it
+// by any of the names it expands to or by following symbolic refs, such as
+// HEAD. Revisions that can not be resolved, or that search the commits of
+// every ref, are reported as hidden.
+func (h *handler) revHidden(ctx context.Context, repo *repository, rev string) bool {
+	hidden := h.fetchHiddenRefs(repo.name)
+	if len(hidden) == 0 {
+		return false
+	}
+	if strings.Contains(rev, ":") {
+		return true
+	}
+
+	// Ref names can not have ^, ~ or @{, which select ancestors, objects
+	// or reflog entries, and ranges missing an end default to HEAD.
+	args := []string{"rev-parse", "--symbolic-full-name"}
+	for _, name := range strings.Split(strings.Replace(rev, "...", "..", -1), "..") {
+		name = strings.TrimPrefix(name, "^")
+		if i := strings.IndexAny(name, "^~"); i >= 0 {
+			name = name[:i]
+		}
+		if i := strings.Index(name, "@{"); i >= 0 {
+			name = name[:i]
+		}
+		if name == "" {
+			name = "HEAD"
+		}
+		if strings.HasPrefix(name, "-") {
+			return true
+		}
+		for _, rule := range refRules {
+			if refHidden(hidden, fmt.Sprintf(rule, name)) {
+				return true
+			}
+		}
+		args = append(args, name)
+	}
+
+	cmd := h.gitCommandContext(ctx, repo.dir, append(args, "--")...)
+	cmd.Env = append(os.Environ(), repo.env...)
+	out, _, err := runAndLog(h.logger, cmd)
+	if err != nil {
+		return true
+	}
+	for _, ref := range strings.Split(out, "\n") {
+		if refHidden(hidden, ref) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestHideRefs(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+	initBareRepo(t, rpath, "open.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		HideRefs(HiddenRefs{All: []string{"refs/internal/*"}}),
+		HideRepoRefs(func(repo string) HiddenRefs {
+			if repo == "open.git" {
+				return HiddenRefs{All: []string{"!refs/internal/"}}
+			}
+			return HiddenRefs{Fetch: []string{"refs/heads/secret"}}
+		}),
+	))
+	defer ts.Close()
+
+	// Refs hidden from fetches only can still be pushed to.
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "-q", "origin", "HEAD:refs/heads/master", "HEAD:refs/heads/secret")
+	git(t, clone, "push", "-q", ts.URL+"/open.git", "HEAD:refs/heads/master", "HEAD:refs/internal/open")
+
+	// Refs created behind the server's back, such as by a CI system.
+	git(t, filepath.Join(rpath, "test.git"), "update-ref", "refs/internal/ci", "refs/heads/master")
+
+	for _, version := range []string{"0", "2"} {
+		refs := gitOutput(t, clone, "-c", "protocol.version="+version, "ls-remote", "origin")
+		assert.Cond(t, strings.Contains(refs, "refs/heads/master"), "master should be advertised: %s", refs)
+		assert.Cond(t, !strings.Contains(refs, "refs/internal/"), "internal refs should be hidden: %s", refs)
+		assert.Cond(t, !strings.Contains(refs, "refs/heads/secret"), "secret should be hidden: %s", refs)
+	}
+
+	// Repositories can expose refs hidden from all of them.
+	refs := gitOutput(t, clone, "ls-remote", ts.URL+"/open.git")
+	assert.Cond(t, strings.Contains(refs, "refs/internal/open"), "internal refs should be exposed: %s", refs)
+
+	cmd := exec.Command("git", "push", "origin", "HEAD:refs/internal/mine")
+	cmd.Dir = clone
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "pushes to hidden refs should fail: %s", out)
+}
+
+func TestHideRefsBrowsing(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		BrowseAPI(),
+		DumbHTTP(true),
+		RawFiles(1<<20),
+		HideRefs(HiddenRefs{All: []string{"refs/internal/*"}, Fetch: []string{"refs/heads/secret", "refs/tags/secret"}}),
+	))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "-q", "origin", "HEAD:refs/heads/master", "HEAD:refs/heads/secret", "HEAD:refs/heads/secret-not")
+	git(t, clone, "commit", "-q", "--allow-empty", "-m", "internal")
+	git(t, filepath.Join(rpath, "test.git"), "fetch", "-q", clone, "HEAD:refs/internal/ci", "HEAD:refs/tags/secret", "HEAD:refs/tags/v1")
+
+	get := func(p string, v interface{}) int {
+		res, err := http.Get(ts.URL + p)
+		assert.Ok(t, err)
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusOK && v != nil {
+			assert.Ok(t, json.NewDecoder(res.Body).Decode(v))
+		}
+		return res.StatusCode
+	}
+
+	var branches []branchInfo
+	get("/api/repos/test.git/branches", &branches)
+	assert.Equals(t, 2, len(branches))
+	assert.Equals(t, []string{"master", "secret-not"}, []string{branches[0].Name, branches[1].Name})
+
+	var tags []tagInfo
+	get("/api/repos/test.git/tags", &tags)
+	assert.Equals(t, 1, len(tags))
+	assert.Equals(t, "v1", tags[0].Name)
+
+	var commits []commitInfo
+	assert.Equals(t, http.StatusOK, get("/api/repos/test.git/commits?ref=secret-not", &commits))
+	assert.Equals(t, http.StatusOK, get("/api/repos/test.git/commits?ref=v1~1", &commits))
+	for _, p := range []string{
+		"/api/repos/test.git/commits?ref=secret",
+		"/api/repos/test.git/commits?ref=refs/heads/secret",
+		"/api/repos/test.git/commits?ref=internal/ci",
+		"/api/repos/test.git/commits?ref=refs/internal/ci~1",
+		"/api/repos/test.git/commits?ref=master..refs/internal/ci",
+		"/api/repos/test.git/commits?ref=refs/internal/ci@{0}",
+		"/api/repos/test.git/commits?ref=:/internal",
+		"/api/repos/test.git/tree/secret",
+		"/api/repos/test.git/tree/refs/internal/ci",
+		"/test.git/raw/secret/README.md",
+		"/test.git/raw/refs/internal/ci/README.md",
+	} {
+		assert.Equals(t, http.StatusNotFound, get(p, nil))
+	}
+	assert.Equals(t, http.StatusOK, get("/test.git/raw/master/README.md", nil))
+
+	res, err := http.Get(ts.URL + "/test.git/info/refs")
+	assert.Ok(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	assert.Ok(t, err)
+	refs := string(body)
+	assert.Cond(t, strings.Contains(refs, "\trefs/heads/master\n"), "master should be listed: %s", refs)
+	assert.Cond(t, strings.Contains(refs, "\trefs/heads/secret-not\n"), "secret-not should be listed: %s", refs)
+	assert.Cond(t, strings.Contains(refs, "\trefs/tags/v1\n"), "v1 should be listed: %s", refs)
+	assert.Cond(t, !strings.Contains(refs, "/secret\n") && !strings.Contains(refs, "internal"), "hidden refs should not be listed: %s", refs)
+}
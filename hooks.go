@@ -0,0 +1,270 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// zeroSHA is used by Git as old SHA when creating refs and as new SHA when
+// deleting them.
+const zeroSHA = "0000000000000000000000000000000000000000"
+
+// RefUpdate describes a reference update requested by a push.
+type RefUpdate struct {
+	Name   string `json:"name"`
+	OldSHA string `json:"old_sha"`
+	NewSHA string `json:"new_sha"`
+}
+
+// Created returns whether the update creates a new ref.
+func (u RefUpdate) Created() bool {
+	return u.OldSHA == zeroSHA
+}
+
+// Deleted returns whether the update deletes the ref.
+func (u RefUpdate) Deleted() bool {
+	return u.NewSHA == zeroSHA
+}
+
+// ReceiveHook is a Go callback run around git-receive-pack. It gets the
+// push request, the repository and the ref updates sent by the client.
+type ReceiveHook func(r *http.Request, repo string, updates []RefUpdate) error
+
+// PreReceive registers a hook run before git-receive-pack is started.
+// Returning an error rejects the whole push and its message is reported
+// back to the client.
+func PreReceive(hook ReceiveHook) Option {
+	return func(h *handler) {
+		h.preReceive = append(h.preReceive, hook)
+	}
+}
+
+// readsCommands returns whether pushes are inspected before handing them
+// over to Git.
+func (h *handler) readsCommands() bool {
+	return len(h.preReceive) > 0 || len(h.postReceive) > 0 || h.audit != nil || h.journal != nil || h.inspectsPacks() || h.events.subscribed()
+}
+
+// PostReceive registers a hook run after git-receive-pack finishes
+// successfully, with the ref updates it applied. Errors returned by the hook
+// are only logged. PushReport returns what Git reported for every update.
+func PostReceive(hook ReceiveHook) Option {
+	return func(h *handler) {
+		h.postReceive = append(h.postReceive, hook)
+	}
+}
+
+// postReceiveHooks runs the post-receive hooks with the ref updates Git
+// applied, if it reported them, or else with all those requested.
+func (h *handler) postReceiveHooks(logger Logger, req *http.Request, repo string, updates []RefUpdate, result *PushResult) {
+	if result != nil {
+		updates = result.Accepted()
+		if len(updates) == 0 {
+			return
+		}
+	}
+	for _, hook := range h.postReceive {
+		if err := hook(req, repo, updates); err != nil {
+			logger.Error("Post-receive hook failed", Field{"repo", repo}, Field{"error", err})
+		}
+	}
+}
+
+// pushOptionsKey is the context key under which the push options sent by
+// the client are stored.
+type pushOptionsKey struct{}
+
+// PushOptions returns the push options sent along with r, a request passed
+// to a ReceiveHook, such as "ci.skip" for `git push -o ci.skip`.
+func PushOptions(r *http.Request) []string {
+	options, _ := r.Context().Value(pushOptionsKey{}).([]string)
+	return options
+}
+
+// withCommands returns req carrying the push options and certificate of
+// cmds.
+func withCommands(req *http.Request, cmds *commandList) *http.Request {
+	ctx := req.Context()
+	if len(cmds.options) > 0 {
+		ctx = context.WithValue(ctx, pushOptionsKey{}, cmds.options)
+	}
+	if cmds.cert != nil {
+		ctx = context.WithValue(ctx, pushCertKey{}, cmds.cert)
+	}
+	return req.WithContext(ctx)
+}
+
+// commandList holds the commands sent by a client at the beginning of
+// a git-receive-pack request.
+type commandList struct {
+	updates      []RefUpdate
+	capabilities []string
+	options      []string
+	cert         *PushCert
+	// raw holds the commands as sent, and rest reads what follows them.
+	raw  []byte
+	rest *bufio.Reader
+}
+
+// hasCapability returns whether the client requested the given capability.
+func (c *commandList) hasCapability(name string) bool {
+	for _, capability := range c.capabilities {
+		if capability == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readCommands reads the command list from a git-receive-pack request body.
+// It returns a reader yielding the full body again, so it can still be
+// handed over to Git.
+func readCommands(r io.Reader) (*commandList, io.Reader, error) {
+	var raw bytes.Buffer
+	br := bufio.NewReader(r)
+	tr := io.TeeReader(br, &raw)
+
+	cmds := new(commandList)
+	for {
+		line, err := packetRead(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Flush packet, the pack data follows.
+		if line == nil {
+			break
+		}
+
+		s := strings.TrimSuffix(string(line), "\n")
+		if strings.HasPrefix(s, "shallow ") {
+			continue
+		}
+
+		if i := strings.IndexByte(s, 0); i >= 0 {
+			cmds.capabilities = strings.Fields(s[i+1:])
+			s = s[:i]
+		}
+
+		// Signed pushes send their commands within a certificate.
+		if s == "push-cert" {
+			var updates []RefUpdate
+			cmds.cert, updates, err = readPushCert(tr)
+			if err != nil {
+				return nil, nil, err
+			}
+			cmds.updates = append(cmds.updates, updates...)
+			continue
+		}
+
+		fields := strings.Fields(s)
+		if len(fields) != 3 {
+			return nil, nil, fmt.Errorf("malformed command: %q", s)
+		}
+
+		cmds.updates = append(cmds.updates, RefUpdate{
+			OldSHA: fields[0],
+			NewSHA: fields[1],
+			Name:   fields[2],
+		})
+	}
+
+	// Push options follow the commands if the client sends any.
+	if cmds.hasCapability("push-options") {
+		for {
+			line, err := packetRead(tr)
+			if err != nil {
+				return nil, nil, err
+			}
+			if line == nil {
+				break
+			}
+			cmds.options = append(cmds.options, strings.TrimSuffix(string(line), "\n"))
+		}
+	}
+
+	cmds.raw, cmds.rest = raw.Bytes(), br
+	return cmds, io.MultiReader(bytes.NewReader(cmds.raw), br), nil
+}
+
+// reject reports back to the client that all ref updates were refused for the
+// given reason, following the report-status format and honoring sideband.
+func (c *commandList) reject(w io.Writer, reason string) {
+	if !c.hasCapability("report-status") && !c.hasCapability("report-status-v2") {
+		return
+	}
+
+	reason = strings.Replace(reason, "\n", " ", -1)
+
+	var report bytes.Buffer
+	report.Write(packetWrite("unpack ok\n"))
+	for _, u := range c.updates {
+		report.Write(packetWrite(fmt.Sprintf("ng %s %s\n", u.Name, reason)))
+	}
+	report.Write(packetFlush())
+
+	switch {
+	case c.hasCapability("side-band-64k"):
+		sidebandWrite(w, 2, []byte(reason+"\n"), 65515)
+		sidebandWrite(w, 1, report.Bytes(), 65515)
+		w.Write(packetFlush())
+	case c.hasCapability("side-band"):
+		sidebandWrite(w, 2, []byte(reason+"\n"), 995)
+		sidebandWrite(w, 1, report.Bytes(), 995)
+		w.Write(packetFlush())
+	default:
+		w.Write(report.Bytes())
+	}
+}
+
+// sidebandWrite writes data to the given sideband channel, splitting it in
+// packets carrying up to max bytes each.
+func sidebandWrite(w io.Writer, band byte, data []byte, max int) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > max {
+			n = max
+		}
+		w.Write(packetWrite(string(band) + string(data[:n])))
+		data = data[n:]
+	}
+}
+
+// packetRead reads a git packet and returns its payload, or nil if it is
+// a flush packet.
+func packetRead(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.ParseUint(string(size[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid packet length %q", size)
+	}
+
+	if n == 0 {
+		return nil, nil
+	}
+
+	if n < 4 {
+		return nil, errors.New("invalid packet length")
+	}
+
+	line := make([]byte, n-4)
+	if _, err := io.ReadFull(r, line); err != nil {
+		return nil, err
+	}
+	return line, nil
+}
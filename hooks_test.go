@@ -0,0 +1,100 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestReceiveHooks(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	protect := func(r *http.Request, repo string, updates []RefUpdate) error {
+		for _, u := range updates {
+			if u.Name == "refs/heads/protected" {
+				return errors.New("protected branch")
+			}
+		}
+		return nil
+	}
+
+	var received []RefUpdate
+	notify := func(r *http.Request, repo string, updates []RefUpdate) error {
+		received = updates
+		return nil
+	}
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), PreReceive(protect), PostReceive(notify)))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+
+	cmd := exec.Command("git", "push", "origin", "HEAD:refs/heads/protected")
+	cmd.Dir = clone
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "push to protected branch should fail")
+	assert.Cond(t, strings.Contains(string(out), "protected branch"), "unexpected output: %s", out)
+	assert.Equals(t, 0, len(received))
+
+	git(t, clone, "push", "origin", "HEAD:refs/heads/master")
+	assert.Equals(t, 1, len(received))
+	assert.Equals(t, "refs/heads/master", received[0].Name)
+	assert.Cond(t, received[0].Created(), "ref should have been created")
+}
+
+func TestPushOptions(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	var before, after []string
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		PreReceive(func(r *http.Request, repo string, updates []RefUpdate) error {
+			before = PushOptions(r)
+			return nil
+		}),
+		PostReceive(func(r *http.Request, repo string, updates []RefUpdate) error {
+			after = PushOptions(r)
+			return nil
+		}),
+	))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+
+	git(t, clone, "push", "-o", "ci.skip", "-o", "reviewer=alice", "origin", "master")
+	assert.Equals(t, []string{"ci.skip", "reviewer=alice"}, before)
+	assert.Equals(t, before, after)
+
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(clone, "README.md"), []byte("bye"), 0644))
+	git(t, clone, "commit", "-qam", "bye")
+	git(t, clone, "push", "origin", "master")
+	assert.Equals(t, 0, len(before))
+}
@@ -0,0 +1,169 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AllowIPs only serves clients whose addresses are within the given CIDR
+// blocks or IP addresses, such as "10.0.0.0/8" or "192.0.2.7", over every
+// transport. Other clients get a 403 response, or have their connections
+// closed. Behind load balancers, the addresses checked are those of the
+// clients, as forwarded by TrustedProxies.
+func AllowIPs(cidrs ...string) Option {
+	return func(h *handler) {
+		h.ipFilter.allowed = append(h.ipFilter.allowed, cidrs...)
+	}
+}
+
+// DenyIPs refuses to serve clients whose addresses are within the given CIDR
+// blocks or IP addresses, even if allowed by AllowIPs.
+func DenyIPs(cidrs ...string) Option {
+	return func(h *handler) {
+		h.ipFilter.denied = append(h.ipFilter.denied, cidrs...)
+	}
+}
+
+// TrustedProxies trusts the X-Forwarded-For and X-Real-IP headers of HTTP
+// requests made from the given CIDR blocks or IP addresses, such as those
+// of load balancers, to tell the address of the client. Rate limits, audit
+// logs, events, hooks and IP filters then see it in place of the address of
+// the proxy. Headers sent by other clients are ignored, since they can be
+// forged.
+func TrustedProxies(cidrs ...string) Option {
+	return func(h *handler) {
+		h.ipFilter.proxies = append(h.ipFilter.proxies, cidrs...)
+	}
+}
+
+// ipFilter holds the IP addresses clients are served from, and those of
+// trusted proxies.
+type ipFilter struct {
+	allowed, denied, proxies []string
+	allow, deny, trusted     []*net.IPNet
+}
+
+// init parses the addresses of f.
+func (f *ipFilter) init() error {
+	var err error
+	if f.allow, err = parseCIDRs(f.allowed); err != nil {
+		return err
+	}
+	if f.deny, err = parseCIDRs(f.denied); err != nil {
+		return err
+	}
+	f.trusted, err = parseCIDRs(f.proxies)
+	return err
+}
+
+// allows tells whether the client at remoteAddr can be served.
+func (f *ipFilter) allows(remoteAddr string) bool {
+	if f.allow == nil && f.deny == nil {
+		return true
+	}
+
+	ip := net.ParseIP(remoteIP(remoteAddr))
+	if ip == nil || containsIP(f.deny, ip) {
+		return false
+	}
+	return f.allow == nil || containsIP(f.allow, ip)
+}
+
+// clientAddr returns the address of the client making req. Requests from
+// trusted proxies are for the nearest address in X-Forwarded-For not
+// belonging to a trusted proxy, or for X-Real-IP.
+func (f *ipFilter) clientAddr(req *http.Request) string {
+	ip := net.ParseIP(remoteIP(req.RemoteAddr))
+	if ip == nil || !containsIP(f.trusted, ip) {
+		return req.RemoteAddr
+	}
+
+	// Each proxy appends the address it got the request from.
+	var hops []string
+	for _, header := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		if real := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); real != nil {
+			return real.String()
+		}
+		return req.RemoteAddr
+	}
+
+	client := req.RemoteAddr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		client = hop.String()
+		if !containsIP(f.trusted, hop) {
+			break
+		}
+	}
+	return client
+}
+
+// filterIPs returns req with the address of its client, as forwarded by
+// trusted proxies. It writes a 403 response and returns false if the client
+// is not allowed.
+func (h *handler) filterIPs(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	if h.ipFilter.trusted != nil {
+		if addr := h.ipFilter.clientAddr(req); addr != req.RemoteAddr {
+			r := *req
+			r.RemoteAddr = addr
+			req = &r
+		}
+	}
+
+	if !h.ipFilter.allows(req.RemoteAddr) {
+		h.logger.Info("Client address denied", Field{"remote", req.RemoteAddr}, Field{"path", req.URL.Path})
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Forbidden"))
+		return req, false
+	}
+	return req, true
+}
+
+// parseCIDRs parses CIDR blocks or IP addresses, the latter standing for
+// themselves alone.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR block %q", cidr)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP tells whether ip is within any of nets.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
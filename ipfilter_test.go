@@ -0,0 +1,114 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestClientAddr(t *testing.T) {
+	f := &ipFilter{proxies: []string{"10.0.0.0/8", "2001:db8::1"}}
+	assert.Ok(t, f.init())
+
+	tests := []struct {
+		remoteAddr string
+		headers    map[string]string
+		client     string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1:1234"},
+		// Untrusted clients cannot forge their address.
+		{"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "192.0.2.1:1234"},
+		{"10.0.0.1:1234", nil, "10.0.0.1:1234"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"[2001:db8::1]:1234", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.9, 10.0.0.2"}, "203.0.113.9"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "bogus, 10.0.0.2"}, "10.0.0.2"},
+		{"10.0.0.1:1234", map[string]string{"X-Real-IP": "203.0.113.9"}, "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		assert.Equals(t, tt.client, f.clientAddr(req))
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	f := &ipFilter{allowed: []string{"10.0.0.0/8", "192.0.2.7"}, denied: []string{"10.1.0.0/16"}}
+	assert.Ok(t, f.init())
+
+	tests := []struct {
+		remoteAddr string
+		allowed    bool
+	}{
+		{"10.0.0.1:1234", true},
+		{"10.1.0.1:1234", false},
+		{"192.0.2.7:1234", true},
+		{"192.0.2.8:1234", false},
+		{"[2001:db8::1]:1234", false},
+		{"bogus", false},
+	}
+	for _, tt := range tests {
+		assert.Equals(t, tt.allowed, f.allows(tt.remoteAddr))
+	}
+
+	f = &ipFilter{}
+	assert.Ok(t, f.init())
+	assert.Cond(t, f.allows("bogus"), "clients should be allowed without filters")
+
+	for _, cidr := range []string{"10.0.0.0/33", "10.0.0", ""} {
+		f = &ipFilter{denied: []string{cidr}}
+		assert.Cond(t, f.init() != nil, "%q should be rejected", cidr)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.RemoteAddr))
+	})
+
+	get := func(ts *httptest.Server, forwardedFor string) (int, string) {
+		req, err := http.NewRequest("GET", ts.URL+"/", nil)
+		assert.Ok(t, err)
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		assert.Ok(t, err)
+		return res.StatusCode, string(body)
+	}
+
+	ts := httptest.NewServer(Handler(echo,
+		ReposPath("."),
+		TrustedProxies("127.0.0.1"),
+		AllowIPs("203.0.113.0/24"),
+		DenyIPs("203.0.113.66"),
+	))
+	defer ts.Close()
+
+	status, body := get(ts, "203.0.113.9")
+	assert.Equals(t, http.StatusOK, status)
+	assert.Equals(t, "203.0.113.9", body)
+
+	status, _ = get(ts, "203.0.113.66")
+	assert.Equals(t, http.StatusForbidden, status)
+
+	status, _ = get(ts, "")
+	assert.Equals(t, http.StatusForbidden, status)
+
+	_, err := NewServer(echo, ReposPath("."), AllowIPs("bogus"))
+	assert.Cond(t, err != nil, "invalid addresses should be rejected")
+}
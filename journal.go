@@ -0,0 +1,276 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JournalEntry records a ref update applied by a push.
+type JournalEntry struct {
+	Time     time.Time `json:"time"`
+	Repo     string    `json:"repo"`
+	Ref      string    `json:"ref"`
+	OldSHA   string    `json:"old_sha"`
+	NewSHA   string    `json:"new_sha"`
+	Identity string    `json:"identity,omitempty"`
+}
+
+// Journal keeps the ref updates applied by pushes, so repositories can be
+// reconstructed to a point in time. Journals are called synchronously as
+// pushes finish, by concurrent pushes.
+type Journal interface {
+	Record(entries []JournalEntry) error
+	// Entries returns the entries recorded for repo, oldest first.
+	Entries(repo string) ([]JournalEntry, error)
+}
+
+// RefJournal records every ref update applied by pushes, whichever the
+// transport, in journal. Along with backups, it allows RestoreBackup to
+// reconstruct repositories to any point in time, by replaying the journal
+// against the closest snapshot. Pushes to namespaced repositories are not
+// recorded.
+func RefJournal(journal Journal) Option {
+	return func(h *handler) {
+		h.journal = journal
+	}
+}
+
+// FileJournal returns a Journal appending entries to the file at path as
+// JSON, one per line.
+func FileJournal(path string) Journal {
+	return &fileJournal{path: path}
+}
+
+type fileJournal struct {
+	sync.Mutex
+	path string
+}
+
+func (j *fileJournal) Record(entries []JournalEntry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (j *fileJournal) Entries(repo string) ([]JournalEntry, error) {
+	j.Lock()
+	defer j.Unlock()
+
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		if e.Repo == repo {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// HTTPJournal returns a Journal kept by a remote endpoint at url. Entries
+// are recorded by POSTing them as a JSON array, and read back from a GET
+// request with the repository in the repo query parameter, to which the
+// endpoint responds with a JSON array, oldest first.
+func HTTPJournal(url string, client *http.Client) Journal {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpJournal{url: url, client: client}
+}
+
+type httpJournal struct {
+	url    string
+	client *http.Client
+}
+
+func (j *httpJournal) Record(entries []JournalEntry) error {
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	res, err := j.client.Post(j.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("journal responded with %s", res.Status)
+	}
+	return nil
+}
+
+func (j *httpJournal) Entries(repo string) ([]JournalEntry, error) {
+	u := j.url
+	if strings.Contains(u, "?") {
+		u += "&"
+	} else {
+		u += "?"
+	}
+
+	res, err := j.client.Get(u + "repo=" + url.QueryEscape(repo))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("journal responded with %s", res.Status)
+	}
+
+	var entries []JournalEntry
+	err = json.NewDecoder(res.Body).Decode(&entries)
+	return entries, err
+}
+
+// recordRefs records in the journal the updates a push to repo applied.
+// Updates Git rejected are left out, which is why refs are looked up
+// rather than taken from the push.
+func (h *handler) recordRefs(req *http.Request, repo *repository, updates []RefUpdate) {
+	if h.journal == nil || len(updates) == 0 || namespaced(repo.env) {
+		return
+	}
+
+	now := time.Now().UTC()
+	cmd := h.gitCommand(repo.dir, "for-each-ref", "--format=%(refname) %(objectname)")
+	out, _, err := runAndLog(h.logger, cmd)
+	if err != nil {
+		h.logger.Error("Recording ref updates failed", Field{"repo", repo.name}, Field{"error", err})
+		return
+	}
+
+	refs := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if parts := strings.Fields(line); len(parts) == 2 {
+			refs[parts[0]] = parts[1]
+		}
+	}
+
+	var entries []JournalEntry
+	for _, u := range updates {
+		sha, ok := refs[u.Name]
+		if !ok {
+			sha = zeroSHA
+		}
+		if sha == u.OldSHA {
+			continue
+		}
+		entries = append(entries, JournalEntry{
+			Time:     now,
+			Repo:     repo.name,
+			Ref:      u.Name,
+			OldSHA:   u.OldSHA,
+			NewSHA:   sha,
+			Identity: remoteUser(req),
+		})
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+	if err := h.journal.Record(entries); err != nil {
+		h.logger.Error("Recording ref updates failed", Field{"repo", repo.name}, Field{"error", err})
+	}
+}
+
+// replayJournal brings the refs of the repository name in dir, restored
+// from a snapshot taken at taken, to their state at at, applying the
+// journal entries recorded in between, or reverting them if at is earlier.
+func (h *handler) replayJournal(name, dir string, taken, at time.Time) (int, error) {
+	entries, err := h.journal.Entries(name)
+	if err != nil {
+		return 0, err
+	}
+
+	// Refs are only updated once, to where the last entry leaves them.
+	var refs []string
+	target := make(map[string]string)
+	apply := func(ref, sha string) {
+		if _, ok := target[ref]; !ok {
+			refs = append(refs, ref)
+		}
+		target[ref] = sha
+	}
+
+	if at.After(taken) {
+		for _, e := range entries {
+			if e.Time.After(taken) && !e.Time.After(at) {
+				apply(e.Ref, e.NewSHA)
+			}
+		}
+	} else {
+		for i := len(entries) - 1; i >= 0; i-- {
+			e := entries[i]
+			if e.Time.After(at) && !e.Time.After(taken) {
+				apply(e.Ref, e.OldSHA)
+			}
+		}
+	}
+
+	if len(refs) == 0 {
+		return 0, nil
+	}
+
+	var commands bytes.Buffer
+	for _, ref := range refs {
+		if sha := target[ref]; sha == zeroSHA {
+			fmt.Fprintf(&commands, "delete %s\n", ref)
+		} else {
+			fmt.Fprintf(&commands, "update %s %s\n", ref, sha)
+		}
+	}
+
+	// Every command is applied, or none is.
+	cmd := h.gitCommand(dir, "update-ref", "--stdin")
+	cmd.Stdin = &commands
+	if _, _, err := runAndLog(h.logger, cmd); err != nil {
+		return 0, err
+	}
+	return len(refs), nil
+}
@@ -0,0 +1,130 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRefJournal(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	backups, err := ioutil.TempDir(os.TempDir(), "gitd-backups")
+	assert.Ok(t, err)
+	defer os.RemoveAll(backups)
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	journal := FileJournal(filepath.Join(backups, "journal"))
+	var h *handler
+	capture := func(x *handler) { h = x }
+	server, err := NewServer(http.NotFoundHandler(), ReposPath(rpath), Backups(BackupPolicy{Store: LocalBackupStore(backups)}), RefJournal(journal), capture)
+	assert.Ok(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	run := func(dir string, args ...string) error {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		return cmd.Run()
+	}
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "-q", "origin", "master")
+	first := gitOutput(t, clone, "rev-parse", "HEAD")
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	git(t, clone, "commit", "--allow-empty", "-qm", "second")
+	git(t, clone, "push", "-q", "origin", "master", "master:topic")
+	second := gitOutput(t, clone, "rev-parse", "HEAD")
+
+	// Rejected updates are not recorded.
+	git(t, clone, "reset", "-q", "--hard", "HEAD^")
+	git(t, clone, "commit", "--allow-empty", "-qm", "diverged")
+	git(t, clone, "push", "-q", "-f", "origin", "master")
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(rpath, "test.git", "hooks", "pre-receive"), []byte("#!/bin/sh\nexit 1\n"), 0755))
+	git(t, clone, "commit", "--allow-empty", "-qm", "rejected")
+	assert.Cond(t, run(clone, "push", "-q", "origin", "master") != nil, "push should be rejected")
+	assert.Ok(t, os.Remove(filepath.Join(rpath, "test.git", "hooks", "pre-receive")))
+	diverged := gitOutput(t, clone, "rev-parse", "HEAD^")
+
+	entries, err := journal.Entries("test.git")
+	assert.Ok(t, err)
+	assert.Equals(t, 4, len(entries))
+	assert.Equals(t, JournalEntry{Time: entries[0].Time, Repo: "test.git", Ref: "refs/heads/master", OldSHA: zeroSHA, NewSHA: first}, entries[0])
+	assert.Equals(t, "refs/heads/topic", entries[2].Ref)
+	assert.Equals(t, second, entries[1].NewSHA)
+	assert.Equals(t, diverged, entries[3].NewSHA)
+
+	time.Sleep(10 * time.Millisecond)
+	dir := filepath.Join(rpath, "test.git")
+	assert.Ok(t, h.backupRepo(context.Background(), "test.git", dir))
+
+	// Restoring to a point in time before the snapshot reverts later
+	// updates, deleting refs created since.
+	assert.Ok(t, os.RemoveAll(dir))
+	_, err = server.RestoreBackup(context.Background(), "test.git", between)
+	assert.Ok(t, err)
+	assert.Equals(t, first, gitOutput(t, dir, "rev-parse", "refs/heads/master"))
+	assert.Cond(t, run(dir, "rev-parse", "--verify", "-q", "refs/heads/topic") != nil, "topic should not exist yet")
+
+	assert.Ok(t, os.RemoveAll(dir))
+	_, err = server.RestoreBackup(context.Background(), "test.git", time.Time{})
+	assert.Ok(t, err)
+	assert.Equals(t, diverged, gitOutput(t, dir, "rev-parse", "refs/heads/master"))
+	assert.Equals(t, second, gitOutput(t, dir, "rev-parse", "refs/heads/topic"))
+}
+
+func TestHTTPJournal(t *testing.T) {
+	var mu sync.Mutex
+	var recorded []JournalEntry
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if req.Method == "POST" {
+			var entries []JournalEntry
+			assert.Ok(t, json.NewDecoder(req.Body).Decode(&entries))
+			recorded = append(recorded, entries...)
+			return
+		}
+
+		entries := []JournalEntry{}
+		for _, e := range recorded {
+			if e.Repo == req.URL.Query().Get("repo") {
+				entries = append(entries, e)
+			}
+		}
+		json.NewEncoder(w).Encode(entries)
+	}))
+	defer ts.Close()
+
+	journal := HTTPJournal(ts.URL, nil)
+	assert.Ok(t, journal.Record([]JournalEntry{{Repo: "org/a.git", Ref: "refs/heads/master"}, {Repo: "b.git"}}))
+
+	entries, err := journal.Entries("org/a.git")
+	assert.Ok(t, err)
+	assert.Equals(t, []JournalEntry{{Repo: "org/a.git", Ref: "refs/heads/master"}}, entries)
+}
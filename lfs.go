@@ -0,0 +1,478 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// lfsContentType is the media type used by the Git LFS API.
+const lfsContentType = "application/vnd.git-lfs+json"
+
+// LFSStorage stores Git LFS objects. Objects are identified by the SHA-256
+// of their content and scoped to the repository they were pushed to.
+type LFSStorage interface {
+	// Size returns the size of the object, or an error satisfying
+	// os.IsNotExist if it is not stored.
+	Size(repo, oid string) (int64, error)
+	// Open returns a reader for the object content.
+	Open(repo, oid string) (io.ReadCloser, error)
+	// Put stores the object, reading r until EOF. Implementations must
+	// not keep the object if reading r fails.
+	Put(repo, oid string, r io.Reader) error
+}
+
+// LFS enables the Git LFS API, storing objects in the given storage. If
+// storage is nil, objects are stored inside each bare repository under
+// lfs/objects, the same as git-lfs does locally. Repositories are served at
+// the paths set by RepoPattern, and uploads go through the same checks as
+// pushes, such as MaxPushSize and RepoQuota.
+func LFS(storage LFSStorage) Option {
+	return func(h *handler) {
+		h.lfs = storage
+		if h.lfs == nil {
+			h.lfs = &localLFSStorage{dir: "lfs/objects", inRepo: true}
+		}
+	}
+}
+
+// LocalLFSStorage returns an LFSStorage keeping objects in dir.
+func LocalLFSStorage(dir string) LFSStorage {
+	return &localLFSStorage{root: dir, dir: "objects"}
+}
+
+// localLFSStorage stores objects in root/<repo>/<dir>/aa/bb/<oid>. If inRepo
+// is set, objects are stored inside repositories instead, and the storage is
+// scoped to the directory each request is resolved to through repoDir.
+type localLFSStorage struct {
+	root    string
+	dir     string
+	inRepo  bool
+	repoDir string
+}
+
+func (s *localLFSStorage) path(repo, oid string) string {
+	dir := filepath.Join(s.root, filepath.FromSlash(repo))
+	if s.inRepo {
+		dir = s.repoDir
+	}
+	return filepath.Join(dir, filepath.FromSlash(s.dir), oid[0:2], oid[2:4], oid)
+}
+
+func (s *localLFSStorage) Size(repo, oid string) (int64, error) {
+	fi, err := os.Stat(s.path(repo, oid))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (s *localLFSStorage) Open(repo, oid string) (io.ReadCloser, error) {
+	return os.Open(s.path(repo, oid))
+}
+
+func (s *localLFSStorage) Put(repo, oid string, r io.Reader) error {
+	p := s.path(repo, oid)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(p), "incoming")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// lfsStorage returns the storage holding the LFS objects of repo.
+func (h *handler) lfsStorage(repo *repository) LFSStorage {
+	if s, ok := h.lfs.(*localLFSStorage); ok && s.inRepo {
+		return &localLFSStorage{dir: s.dir, inRepo: true, repoDir: repo.dir}
+	}
+	return h.lfs
+}
+
+// lfsBatchPath and lfsObjectPath match the LFS API after the repository
+// path, the latter capturing the oid of objects last.
+const (
+	lfsBatchPath  = "/info/lfs/objects/batch"
+	lfsObjectPath = "/info/lfs/objects/([0-9a-f]{64})"
+)
+
+var lfsOIDRe = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// errLFSChecksum is returned when uploaded content does not match its oid.
+var errLFSChecksum = errors.New("object content does not match its oid")
+
+type lfsObject struct {
+	OID           string               `json:"oid"`
+	Size          int64                `json:"size"`
+	Authenticated bool                 `json:"authenticated,omitempty"`
+	Actions       map[string]lfsAction `json:"actions,omitempty"`
+	Error         *lfsError            `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []lfsObject `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string      `json:"transfer"`
+	Objects  []lfsObject `json:"objects"`
+}
+
+// serveLFS dispatches Git LFS requests. It returns false if the request
+// path does not belong to the LFS API.
+func (h *handler) serveLFS(w http.ResponseWriter, req *http.Request) bool {
+	if m := h.lfsBatchRe.FindStringSubmatch(req.URL.Path); m != nil {
+		req = req.WithContext(context.WithValue(req.Context(), paramsKey{}, matchParams(h.lfsBatchRe, m)))
+		h.lfsBatch(w, req, strings.TrimPrefix(m[1], "/"))
+		return true
+	}
+
+	if m := h.lfsObjectRe.FindStringSubmatch(req.URL.Path); m != nil {
+		req = req.WithContext(context.WithValue(req.Context(), paramsKey{}, matchParams(h.lfsObjectRe, m)))
+		h.lfsTransfer(w, req, strings.TrimPrefix(m[1], "/"), m[len(m)-1])
+		return true
+	}
+	return false
+}
+
+// lfsResolve authenticates and authorizes an LFS request for op on repo,
+// resolving the repository it is for. Requests go through the same checks
+// as Git ones, those of pushes included for Push, but for quotas and size
+// limits, which depend on the objects uploaded. It writes an error response
+// and returns a nil repository if the request can not go on. Otherwise, the
+// operation runs on the repository until h.activity.leave is called.
+func (h *handler) lfsResolve(w http.ResponseWriter, req *http.Request, repo string, op Operation) (*http.Request, *repository) {
+	if checkRepoPath("/"+repo) == errInvalidRepoPath {
+		writeLFSError(w, http.StatusBadRequest, "invalid repository path")
+		return req, nil
+	}
+
+	req, ok := h.authenticate(w, req, repo, op)
+	if !ok || !h.authorizeRepo(w, req, repo, op) {
+		return req, nil
+	}
+
+	target, ok := h.resolve(w, req, "/"+repo)
+	if !ok {
+		return req, nil
+	}
+
+	// Objects pushed to mirrors would never be referenced.
+	if op == Push && (h.readThrough != nil || h.isMirror(target.name)) {
+		writeLFSError(w, http.StatusForbidden, "repository is a mirror")
+		return req, nil
+	}
+
+	if !h.enterRepo(w, target.dir) {
+		return req, nil
+	}
+
+	if !h.exported(target.dir) {
+		h.activity.leave(target.dir)
+		writeLFSError(w, http.StatusNotFound, "repository not found")
+		return req, nil
+	}
+
+	if op == Push {
+		if err := h.pushBlocked(target); err != nil {
+			h.activity.leave(target.dir)
+			writeLFSError(w, http.StatusForbidden, err.Error())
+			return req, nil
+		}
+	}
+
+	if !h.limitRate(w, req, target.name) {
+		h.activity.leave(target.dir)
+		return req, nil
+	}
+	return req, target
+}
+
+// lfsRoom returns how many bytes objects uploaded to repo can take up, zero
+// meaning no limit. It writes an error response and returns false if repo
+// is out of room.
+func (h *handler) lfsRoom(w http.ResponseWriter, req *http.Request, repo *repository) (int64, bool) {
+	room, limit, used, err := h.pushRoom(repo.name, repo.dir)
+	switch {
+	case err != nil && limit > 0 && used >= limit:
+		writeLFSError(w, http.StatusInsufficientStorage, err.Error())
+		return 0, false
+	case err != nil:
+		h.requestLogger(req).Error("Checking repository quota failed", Field{"repo", repo.name}, Field{"error", err})
+		writeLFSError(w, http.StatusInternalServerError, "storage error")
+		return 0, false
+	}
+	return room, true
+}
+
+// lfsBatch implements the Git LFS batch API using the basic transfer adapter.
+func (h *handler) lfsBatch(w http.ResponseWriter, req *http.Request, repo string) {
+	if req.Method != "POST" {
+		writeLFSError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var batch lfsBatchRequest
+	if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+		writeLFSError(w, http.StatusUnprocessableEntity, "invalid batch request")
+		return
+	}
+
+	var op Operation
+	switch batch.Operation {
+	case "download":
+		op = Fetch
+	case "upload":
+		op = Push
+	default:
+		writeLFSError(w, http.StatusUnprocessableEntity, "unknown operation")
+		return
+	}
+
+	req, target := h.lfsResolve(w, req, repo, op)
+	if target == nil {
+		return
+	}
+	defer h.activity.leave(target.dir)
+	logger := h.requestLogger(req)
+	storage := h.lfsStorage(target)
+
+	var room int64
+	if op == Push {
+		var ok bool
+		if room, ok = h.lfsRoom(w, req, target); !ok {
+			return
+		}
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	base := fmt.Sprintf("%s://%s%s/%s/info/lfs/objects/", scheme, req.Host, urlPrefix(req), repo)
+
+	var header map[string]string
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		header = map[string]string{"Authorization": auth}
+	}
+
+	res := lfsBatchResponse{Transfer: "basic", Objects: []lfsObject{}}
+	for _, obj := range batch.Objects {
+		out := lfsObject{OID: obj.OID, Size: obj.Size}
+		if !lfsOIDRe.MatchString(obj.OID) {
+			out.Error = &lfsError{Code: http.StatusUnprocessableEntity, Message: "invalid oid"}
+			res.Objects = append(res.Objects, out)
+			continue
+		}
+
+		size, err := storage.Size(repo, obj.OID)
+		exists := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			logger.Error("Looking up LFS object failed", Field{"repo", repo}, Field{"oid", obj.OID}, Field{"error", err})
+			out.Error = &lfsError{Code: http.StatusInternalServerError, Message: "storage error"}
+			res.Objects = append(res.Objects, out)
+			continue
+		}
+
+		action := lfsAction{Href: base + obj.OID, Header: header}
+		switch {
+		case op == Fetch && !exists:
+			out.Error = &lfsError{Code: http.StatusNotFound, Message: "object not found"}
+		case op == Fetch:
+			out.Size = size
+			out.Authenticated = true
+			out.Actions = map[string]lfsAction{"download": action}
+		case op == Push && exists:
+		case h.maxPushSize > 0 && obj.Size > h.maxPushSize:
+			out.Error = &lfsError{Code: http.StatusRequestEntityTooLarge, Message: errPushTooLarge.Error()}
+		case room > 0 && obj.Size > room:
+			out.Error = &lfsError{Code: http.StatusInsufficientStorage, Message: errQuotaExceeded.Error()}
+		default:
+			if room > 0 {
+				room -= obj.Size
+			}
+			out.Authenticated = true
+			out.Actions = map[string]lfsAction{"upload": action}
+		}
+		res.Objects = append(res.Objects, out)
+	}
+
+	w.Header().Set("Content-Type", lfsContentType)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// lfsTransfer uploads or downloads a single LFS object.
+func (h *handler) lfsTransfer(w http.ResponseWriter, req *http.Request, repo, oid string) {
+	var op Operation
+	switch req.Method {
+	case "GET":
+		op = Fetch
+	case "PUT":
+		op = Push
+	default:
+		writeLFSError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	req, target := h.lfsResolve(w, req, repo, op)
+	if target == nil {
+		return
+	}
+	defer h.activity.leave(target.dir)
+
+	if op == Push {
+		h.lfsUpload(w, req, target, oid)
+		return
+	}
+	logger := h.requestLogger(req)
+	storage := h.lfsStorage(target)
+
+	size, err := storage.Size(repo, oid)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeLFSError(w, http.StatusNotFound, "object not found")
+			return
+		}
+		logger.Error("Looking up LFS object failed", Field{"repo", repo}, Field{"oid", oid}, Field{"error", err})
+		writeLFSError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	f, err := storage.Open(repo, oid)
+	if err != nil {
+		logger.Error("Opening LFS object failed", Field{"repo", repo}, Field{"oid", oid}, Field{"error", err})
+		writeLFSError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+	w.WriteHeader(http.StatusOK)
+	n, _ := io.Copy(w, f)
+	if limiter := h.limiterFor(target.name); limiter != nil {
+		limiter.charge(requestRateKey(req), n, time.Now())
+	}
+}
+
+// lfsUpload stores the LFS object oid uploaded to repo, as long as it fits
+// in MaxPushSize and the quotas of repo.
+func (h *handler) lfsUpload(w http.ResponseWriter, req *http.Request, repo *repository, oid string) {
+	logger := h.requestLogger(req)
+	defer req.Body.Close()
+
+	room, ok := h.lfsRoom(w, req, repo)
+	if !ok {
+		return
+	}
+
+	if h.maxPushSize > 0 && req.ContentLength > h.maxPushSize {
+		logger.Info("LFS upload rejected for being too large", Field{"repo", repo.name}, Field{"size", req.ContentLength})
+		writeLFSError(w, http.StatusRequestEntityTooLarge, errPushTooLarge.Error())
+		return
+	}
+	if room > 0 && req.ContentLength > room {
+		writeLFSError(w, http.StatusInsufficientStorage, errQuotaExceeded.Error())
+		return
+	}
+
+	// Objects are cut short at whichever limit is the lowest.
+	body := &countingReader{r: req.Body}
+	var r io.Reader = body
+	max := h.maxPushSize
+	if room > 0 && (max == 0 || room < max) {
+		max = room
+	}
+	if max > 0 {
+		r = &maxSizeReader{r: r, n: max}
+	}
+
+	err := h.lfsStorage(repo).Put(repo.name, oid, &lfsVerifier{r: r, oid: oid, hash: sha256.New()})
+	if err == errPushTooLarge && max != h.maxPushSize {
+		err = errQuotaExceeded
+	}
+	if limiter := h.limiterFor(repo.name); limiter != nil {
+		limiter.charge(requestRateKey(req), body.count(), time.Now())
+	}
+	if h.quotas != nil {
+		h.quotas.invalidate(repo.dir)
+	}
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+	case errLFSChecksum:
+		writeLFSError(w, http.StatusUnprocessableEntity, err.Error())
+	case errPushTooLarge:
+		writeLFSError(w, http.StatusRequestEntityTooLarge, err.Error())
+	case errQuotaExceeded:
+		writeLFSError(w, http.StatusInsufficientStorage, err.Error())
+	default:
+		logger.Error("Storing LFS object failed", Field{"repo", repo.name}, Field{"oid", oid}, Field{"error", err})
+		writeLFSError(w, http.StatusInternalServerError, "unable to store object")
+	}
+}
+
+// lfsVerifier hashes content as it is read, failing with errLFSChecksum
+// instead of returning io.EOF if it does not match the expected oid.
+type lfsVerifier struct {
+	r    io.Reader
+	oid  string
+	hash hash.Hash
+}
+
+func (v *lfsVerifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && !strings.EqualFold(hex.EncodeToString(v.hash.Sum(nil)), v.oid) {
+		return n, errLFSChecksum
+	}
+	return n, err
+}
+
+func writeLFSError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", lfsContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
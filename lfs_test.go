@@ -0,0 +1,167 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func lfsBatch(t *testing.T, url, operation, oid string, size int) lfsObject {
+	body := fmt.Sprintf(`{"operation": %q, "transfers": ["basic"], "objects": [{"oid": %q, "size": %d}]}`, operation, oid, size)
+	res, err := http.Post(url, lfsContentType, bytes.NewBufferString(body))
+	assert.Ok(t, err)
+	defer res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+
+	var batch lfsBatchResponse
+	assert.Ok(t, json.NewDecoder(res.Body).Decode(&batch))
+	assert.Equals(t, 1, len(batch.Objects))
+	return batch.Objects[0]
+}
+
+func TestLFS(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), LFS(nil), ReposPath(rpath)))
+	defer ts.Close()
+
+	content := []byte("large binary content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	batchURL := ts.URL + "/test.git/info/lfs/objects/batch"
+
+	obj := lfsBatch(t, batchURL, "download", oid, len(content))
+	assert.Equals(t, http.StatusNotFound, obj.Error.Code)
+
+	obj = lfsBatch(t, batchURL, "upload", oid, len(content))
+	upload, ok := obj.Actions["upload"]
+	assert.Cond(t, ok, "missing upload action")
+
+	req, err := http.NewRequest("PUT", upload.Href, bytes.NewBufferString("tampered content"))
+	assert.Ok(t, err)
+	res, err := http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+	req, err = http.NewRequest("PUT", upload.Href, bytes.NewReader(content))
+	assert.Ok(t, err)
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+
+	_, err = os.Stat(filepath.Join(rpath, "test.git", "lfs", "objects", oid[0:2], oid[2:4], oid))
+	assert.Ok(t, err)
+
+	obj = lfsBatch(t, batchURL, "upload", oid, len(content))
+	assert.Equals(t, 0, len(obj.Actions))
+
+	obj = lfsBatch(t, batchURL, "download", oid, len(content))
+	download, ok := obj.Actions["download"]
+	assert.Cond(t, ok, "missing download action")
+
+	res, err = http.Get(download.Href)
+	assert.Ok(t, err)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Ok(t, err)
+	assert.Equals(t, content, data)
+}
+
+func TestLFSPushChecks(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "acme/test.git")
+	initBareRepo(t, rpath, "acme/full.git")
+	initBareRepo(t, rpath, "acme/old.git")
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(rpath, "acme", "old.git", archivedFile), nil, 0644))
+
+	srv, err := NewServer(http.NotFoundHandler(),
+		LFS(nil),
+		ReposPath(rpath),
+		RepoPattern("/{org}/{repo}.git"),
+		MaxPushSize(16),
+		RepoQuota(func(repo string) int64 {
+			if repo == "acme/full.git" {
+				return 1
+			}
+			return 0
+		}),
+	)
+	assert.Ok(t, err)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	batch := func(repo string, size int) (int, lfsObject) {
+		body := fmt.Sprintf(`{"operation": "upload", "objects": [{"oid": "%064d", "size": %d}]}`, 0, size)
+		res, err := http.Post(ts.URL+repo+"/info/lfs/objects/batch", lfsContentType, bytes.NewBufferString(body))
+		assert.Ok(t, err)
+		defer res.Body.Close()
+
+		var batch lfsBatchResponse
+		if res.StatusCode == http.StatusOK {
+			assert.Ok(t, json.NewDecoder(res.Body).Decode(&batch))
+			assert.Equals(t, 1, len(batch.Objects))
+			return res.StatusCode, batch.Objects[0]
+		}
+		return res.StatusCode, lfsObject{}
+	}
+	put := func(repo string, content []byte) int {
+		sum := sha256.Sum256(content)
+		url := ts.URL + repo + "/info/lfs/objects/" + hex.EncodeToString(sum[:])
+		req, err := http.NewRequest("PUT", url, bytes.NewReader(content))
+		assert.Ok(t, err)
+		res, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// LFS is served at the paths set by RepoPattern only.
+	status, obj := batch("/acme/test.git", 8)
+	assert.Equals(t, http.StatusOK, status)
+	assert.Cond(t, obj.Actions["upload"].Href != "", "missing upload action")
+	status, _ = batch("/test.git", 8)
+	assert.Equals(t, http.StatusNotFound, status)
+	assert.Equals(t, http.StatusOK, put("/acme/test.git", []byte("small")))
+
+	status, obj = batch("/acme/test.git", 32)
+	assert.Equals(t, http.StatusOK, status)
+	assert.Equals(t, http.StatusRequestEntityTooLarge, obj.Error.Code)
+	assert.Equals(t, http.StatusRequestEntityTooLarge, put("/acme/test.git", []byte("too large to be pushed")))
+
+	status, _ = batch("/acme/full.git", 8)
+	assert.Equals(t, http.StatusInsufficientStorage, status)
+	assert.Equals(t, http.StatusInsufficientStorage, put("/acme/full.git", []byte("small")))
+
+	status, _ = batch("/acme/old.git", 8)
+	assert.Equals(t, http.StatusForbidden, status)
+	assert.Equals(t, http.StatusForbidden, put("/acme/old.git", []byte("small")))
+
+	// Uploads wait for maintenance to end, the same as pushes.
+	srv.h.activity.pause(time.Minute)
+	defer srv.h.activity.resume()
+	status, _ = batch("/acme/test.git", 8)
+	assert.Equals(t, http.StatusServiceUnavailable, status)
+	assert.Equals(t, http.StatusServiceUnavailable, put("/acme/test.git", []byte("small")))
+}
@@ -0,0 +1,144 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// errTooManyOps is returned when a Git process slot could not be acquired.
+var errTooManyOps = errors.New("too many concurrent operations")
+
+// errPushTooLarge is returned when a push exceeds the configured maximum size.
+var errPushTooLarge = errors.New("push exceeds maximum size")
+
+// MaxConcurrentOps caps the number of Git processes running at the same time.
+// Requests beyond that are queued until a slot frees up or the queue timeout
+// expires, in which case they get a 503 with a Retry-After header.
+func MaxConcurrentOps(n int) Option {
+	return func(h *handler) {
+		h.opSlots = make(chan struct{}, n)
+	}
+}
+
+// QueueTimeout sets how long requests wait for a slot when MaxConcurrentOps
+// is reached. It defaults to 10 seconds. Zero rejects them right away.
+func QueueTimeout(d time.Duration) Option {
+	return func(h *handler) {
+		h.queueTimeout = d
+	}
+}
+
+// waitSlot waits for a slot to run a Git operation, for up to the queue
+// timeout. It returns false if none became available.
+func (h *handler) waitSlot(ctx context.Context) bool {
+	if h.opSlots == nil {
+		return true
+	}
+
+	select {
+	case h.opSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(h.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case h.opSlots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+
+	h.logger.Warn("Too many concurrent Git operations", Field{"limit", cap(h.opSlots)})
+	return false
+}
+
+// acquireSlot waits for a free Git process slot. It writes a 503 response and
+// returns false if none became available in time.
+func (h *handler) acquireSlot(ctx context.Context, w http.ResponseWriter) bool {
+	if h.waitSlot(ctx) {
+		return true
+	}
+
+	retry := h.queueTimeout
+	if retry < time.Second {
+		retry = time.Second
+	}
+	w.Header().Del("Content-Type")
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(retry.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("Service Unavailable"))
+	return false
+}
+
+// releaseSlot frees a slot taken by acquireSlot.
+func (h *handler) releaseSlot() {
+	if h.opSlots != nil {
+		<-h.opSlots
+	}
+}
+
+// MaxPushSize limits the size, in bytes, of the data clients can push in a
+// single request. Pushes exceeding it are aborted and get a 413 response.
+func MaxPushSize(bytes int64) Option {
+	return func(h *handler) {
+		h.maxPushSize = bytes
+	}
+}
+
+// maxSizeReader fails with errPushTooLarge once more than n bytes are read.
+type maxSizeReader struct {
+	r io.Reader
+	n int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.n < 0 {
+		return 0, errPushTooLarge
+	}
+
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return n, errPushTooLarge
+	}
+	return n, err
+}
+
+// UploadPackTimeout sets the maximum time git-upload-pack is allowed to run,
+// killing it once exceeded.
+func UploadPackTimeout(d time.Duration) Option {
+	return func(h *handler) {
+		h.timeouts["git-upload-pack"] = d
+	}
+}
+
+// ReceivePackTimeout sets the maximum time git-receive-pack is allowed to run,
+// killing it once exceeded.
+func ReceivePackTimeout(d time.Duration) Option {
+	return func(h *handler) {
+		h.timeouts["git-receive-pack"] = d
+	}
+}
+
+// withTimeout returns req with a context expiring after the timeout
+// configured for process, if any.
+func (h *handler) withTimeout(req *http.Request, process string) (*http.Request, context.CancelFunc) {
+	d := h.timeouts[process]
+	if d <= 0 {
+		return req, func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), d)
+	return req.WithContext(ctx), cancel
+}
@@ -0,0 +1,97 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestMaxConcurrentOps(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	var h *handler
+	capture := func(x *handler) { h = x }
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), MaxConcurrentOps(1), QueueTimeout(0), capture))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+
+	// Takes the only slot available, as a long running clone would.
+	h.opSlots <- struct{}{}
+
+	res, err = http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equals(t, "1", res.Header.Get("Retry-After"))
+
+	<-h.opSlots
+	res, err = http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+}
+
+func TestMaxPushSize(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), MaxPushSize(64)))
+	defer ts.Close()
+
+	url := ts.URL + "/test.git/git-receive-pack"
+	contentType := "application/x-git-receive-pack-request"
+	pack := strings.Repeat("0", 128)
+
+	res, err := http.Post(url, contentType, strings.NewReader(pack))
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+
+	// Without a Content-Length, the limit is enforced while streaming.
+	res, err = http.Post(url, contentType, ioutil.NopCloser(strings.NewReader(pack)))
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+}
+
+func TestUploadPackTimeout(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), UploadPackTimeout(100*time.Millisecond)))
+	defer ts.Close()
+
+	// A client that never finishes sending its request keeps
+	// git-upload-pack waiting for input.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	start := time.Now()
+	res, err := http.Post(ts.URL+"/test.git/git-upload-pack", "application/x-git-upload-pack-request", pr)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusGatewayTimeout, res.StatusCode)
+	assert.Cond(t, time.Since(start) < 10*time.Second, "git-upload-pack was not killed")
+}
@@ -0,0 +1,68 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"sync"
+)
+
+// repoLocks serializes the operations conflicting on repositories: pushes,
+// which race on packed-refs, and maintenance or mirror syncs, which repack
+// repositories or update their refs too. Fetches take no lock.
+type repoLocks struct {
+	sync.Mutex
+	locks map[string]*repoLock
+}
+
+// repoLock is the lock of a repository, held by whoever sent to ch, and
+// kept around while anyone holds it or waits for it.
+type repoLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// lock waits until the repository in dir is not locked, or until ctx is
+// done, and locks it. The function returned unlocks it, and may be called
+// more than once.
+func (l *repoLocks) lock(ctx context.Context, dir string) (func(), error) {
+	l.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*repoLock)
+	}
+	rl := l.locks[dir]
+	if rl == nil {
+		rl = &repoLock{ch: make(chan struct{}, 1)}
+		l.locks[dir] = rl
+	}
+	rl.refs++
+	l.Unlock()
+
+	select {
+	case rl.ch <- struct{}{}:
+	case <-ctx.Done():
+		l.release(dir, rl)
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-rl.ch
+			l.release(dir, rl)
+		})
+	}, nil
+}
+
+// release drops a reference to the lock of the repository in dir.
+func (l *repoLocks) release(dir string, rl *repoLock) {
+	l.Lock()
+	defer l.Unlock()
+
+	rl.refs--
+	if rl.refs == 0 {
+		delete(l.locks, dir)
+	}
+}
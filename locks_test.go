@@ -0,0 +1,64 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRepoLocks(t *testing.T) {
+	var locks repoLocks
+
+	unlock, err := locks.lock(context.Background(), "/a.git")
+	assert.Ok(t, err)
+
+	// Other repositories are not held back.
+	other, err := locks.lock(context.Background(), "/b.git")
+	assert.Ok(t, err)
+	other()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = locks.lock(ctx, "/a.git")
+	assert.Equals(t, context.DeadlineExceeded, err)
+
+	// Holders run one at a time.
+	var mu sync.Mutex
+	var running, max int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := locks.lock(context.Background(), "/a.git")
+			assert.Ok(t, err)
+			mu.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			unlock()
+		}()
+	}
+
+	unlock()
+	unlock()
+	wg.Wait()
+	assert.Equals(t, 1, max)
+
+	locks.Lock()
+	assert.Equals(t, 0, len(locks.locks))
+	locks.Unlock()
+}
@@ -0,0 +1,73 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Field is a key/value pair attached to log entries, such as the repository,
+// Git service, duration or bytes transferred by an operation.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger is the interface gitd logs through. It can be implemented on top of
+// any structured logging library.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// WithLogger sets the logger used by the handler. By default, entries are
+// written through the standard library's log package, prefixed by their
+// level, e.g. "[INFO]", so they can be filtered by level.
+func WithLogger(l Logger) Option {
+	return func(h *handler) {
+		h.logger = l
+	}
+}
+
+// stdLogger implements Logger on top of the standard library's log package.
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, fields ...Field) { stdLog("DEBUG", msg, fields) }
+func (stdLogger) Info(msg string, fields ...Field)  { stdLog("INFO", msg, fields) }
+func (stdLogger) Warn(msg string, fields ...Field)  { stdLog("WARN", msg, fields) }
+func (stdLogger) Error(msg string, fields ...Field) { stdLog("ERROR", msg, fields) }
+
+func stdLog(level, msg string, fields []Field) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[%s] %s", level, msg)
+	for _, f := range fields {
+		value := fmt.Sprintf("%v", f.Value)
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&buf, " %s=%s", f.Key, value)
+	}
+	log.Print(buf.String())
+}
+
+// fieldLogger adds fields to every entry logged through it.
+type fieldLogger struct {
+	Logger
+	fields []Field
+}
+
+func (l fieldLogger) Debug(msg string, fields ...Field) { l.Logger.Debug(msg, l.with(fields)...) }
+func (l fieldLogger) Info(msg string, fields ...Field)  { l.Logger.Info(msg, l.with(fields)...) }
+func (l fieldLogger) Warn(msg string, fields ...Field)  { l.Logger.Warn(msg, l.with(fields)...) }
+func (l fieldLogger) Error(msg string, fields ...Field) { l.Logger.Error(msg, l.with(fields)...) }
+
+func (l fieldLogger) with(fields []Field) []Field {
+	return append(fields[:len(fields):len(fields)], l.fields...)
+}
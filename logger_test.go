@@ -0,0 +1,119 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+type logEntry struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+// recordingLogger keeps log entries in memory so tests can inspect them.
+type recordingLogger struct {
+	sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) record(level, msg string, fields []Field) {
+	l.Lock()
+	defer l.Unlock()
+	e := logEntry{level: level, msg: msg, fields: make(map[string]interface{})}
+	for _, f := range fields {
+		e.fields[f.Key] = f.Value
+	}
+	l.entries = append(l.entries, e)
+}
+
+func (l *recordingLogger) find(msg string) (logEntry, bool) {
+	l.Lock()
+	defer l.Unlock()
+	for _, e := range l.entries {
+		if e.msg == msg {
+			return e, true
+		}
+	}
+	return logEntry{}, false
+}
+
+func (l *recordingLogger) count(msg string) int {
+	l.Lock()
+	defer l.Unlock()
+	n := 0
+	for _, e := range l.entries {
+		if e.msg == msg {
+			n++
+		}
+	}
+	return n
+}
+
+func (l *recordingLogger) Debug(msg string, fields ...Field) { l.record("DEBUG", msg, fields) }
+func (l *recordingLogger) Info(msg string, fields ...Field)  { l.record("INFO", msg, fields) }
+func (l *recordingLogger) Warn(msg string, fields ...Field)  { l.record("WARN", msg, fields) }
+func (l *recordingLogger) Error(msg string, fields ...Field) { l.record("ERROR", msg, fields) }
+
+func TestWithLogger(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	logger := new(recordingLogger)
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), WithLogger(logger)))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	_, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Ok(t, err)
+
+	e, ok := logger.find("Git command completed")
+	assert.Cond(t, ok, "missing completion entry")
+	assert.Equals(t, "INFO", e.level)
+	assert.Equals(t, "test.git", e.fields["repo"])
+	assert.Equals(t, "git-upload-pack", e.fields["service"])
+	assert.Cond(t, e.fields["bytes"].(int64) > 0, "bytes should be logged")
+}
+
+func TestRequestLoggerIdentity(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	logger := new(recordingLogger)
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		WithLogger(logger),
+		BasicAuth("git", func(user, pass string) bool { return pass == "secret" }),
+	))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/test.git/info/refs?service=git-upload-pack", nil)
+	assert.Ok(t, err)
+	req.SetBasicAuth("alice", "secret")
+	res, err := http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	_, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Ok(t, err)
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+
+	e, ok := logger.find("Git command completed")
+	assert.Cond(t, ok, "missing completion entry")
+	assert.Equals(t, "alice", e.fields["user"])
+}
@@ -0,0 +1,172 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrMaintenanceRunning is returned when maintenance is requested for a
+// repository already being maintained.
+var ErrMaintenanceRunning = errors.New("maintenance already running")
+
+// maintenanceTasks are the Git commands maintaining repositories. git gc
+// --auto only repacks and prunes once enough loose objects or packs have
+// accumulated, while commit graphs speed up history walks.
+var maintenanceTasks = [][]string{
+	{"gc", "--auto", "--quiet"},
+	{"commit-graph", "write", "--reachable"},
+}
+
+// Maintenance runs maintenance on every repository under the repositories
+// root each interval, up to concurrency repositories at a time, in the
+// background until Shutdown. Repositories can also be maintained on demand
+// through the admin API.
+func Maintenance(interval time.Duration, concurrency int) Option {
+	return func(h *handler) {
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		h.maintenance.interval = interval
+		h.maintenance.concurrency = concurrency
+	}
+}
+
+// maintenance tracks the maintenance of repositories.
+type maintenance struct {
+	sync.Mutex
+	interval    time.Duration
+	concurrency int
+	running     map[string]bool
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+func newMaintenance() *maintenance {
+	return &maintenance{
+		concurrency: 1,
+		running:     make(map[string]bool),
+		stop:        make(chan struct{}),
+	}
+}
+
+// begin marks the repository in dir as being maintained, returning false if
+// it already was.
+func (m *maintenance) begin(dir string) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.running[dir] {
+		return false
+	}
+	m.running[dir] = true
+	return true
+}
+
+func (m *maintenance) end(dir string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.running, dir)
+}
+
+// close stops scheduled maintenance and repository optimization.
+func (m *maintenance) close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+// scheduleMaintenance maintains all repositories each interval, until
+// maintenance is closed.
+func (h *handler) scheduleMaintenance() {
+	m := h.maintenance
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.maintainAll()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// maintainAll maintains all repositories, concurrently up to the configured
+// limit.
+func (h *handler) maintainAll() {
+	m := h.maintenance
+	start := time.Now()
+	slots := make(chan struct{}, m.concurrency)
+	var wg sync.WaitGroup
+
+	var count int
+	err := h.walkRepos(func(name, dir string) error {
+		select {
+		case slots <- struct{}{}:
+		case <-m.stop:
+			return errShuttingDown
+		}
+
+		count++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			h.maintainRepo(name, dir)
+		}()
+		return nil
+	})
+	wg.Wait()
+
+	if err != nil && err != errShuttingDown {
+		h.logger.Error("Listing repositories for maintenance failed", Field{"error", err})
+		return
+	}
+	h.logger.Info("Maintenance completed", Field{"repos", count}, Field{"duration", time.Since(start)})
+}
+
+// maintainRepo runs the maintenance tasks on the repository name in dir.
+func (h *handler) maintainRepo(name, dir string) error {
+	return h.runMaintenance(name, dir, maintenanceTasks)
+}
+
+// runMaintenance runs tasks on the repository name in dir, unless it is
+// already being maintained.
+func (h *handler) runMaintenance(name, dir string, tasks [][]string) error {
+	m := h.maintenance
+	if !m.begin(dir) {
+		return ErrMaintenanceRunning
+	}
+	defer m.end(dir)
+
+	// Repacking while pushes update refs could lose them.
+	unlock, err := h.locks.lock(context.Background(), dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	start := time.Now()
+	for _, args := range tasks {
+		cmd := h.gitCommand(dir, sharedRepackArgs(dir, args)...)
+		if err := h.runCommand(h.logger, ioutil.Discard, strings.NewReader(""), cmd); err != nil {
+			h.logger.Error("Repository maintenance failed", Field{"repo", name}, Field{"task", args[0]}, Field{"error", err})
+			return err
+		}
+	}
+
+	// Packing objects changes the size of repositories.
+	if h.quotas != nil {
+		h.quotas.invalidate(dir)
+	}
+
+	h.logger.Debug("Repository maintained", Field{"repo", name}, Field{"duration", time.Since(start)})
+	return nil
+}
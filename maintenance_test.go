@@ -0,0 +1,96 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// commitGraph returns whether the repository in dir has a commit graph.
+func commitGraph(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "objects", "info", "commit-graph"))
+	return err == nil
+}
+
+func TestMaintenanceAdminAPI(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	var h *handler
+	capture := func(x *handler) { h = x }
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AdminAPI(), capture))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "origin", "master")
+
+	dir := filepath.Join(rpath, "test.git")
+	assert.Cond(t, !commitGraph(dir), "repository should not have a commit graph yet")
+
+	res, err := http.Post(ts.URL+"/api/repos/test.git/maintenance", "application/json", nil)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusNoContent, res.StatusCode)
+	assert.Cond(t, commitGraph(dir), "maintenance should have written a commit graph")
+
+	// Maintenance does not run twice at the same time on a repository.
+	assert.Cond(t, h.maintenance.begin(dir), "repository should not be maintained")
+	res, err = http.Post(ts.URL+"/api/repos/test.git/maintenance", "application/json", nil)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusConflict, res.StatusCode)
+	h.maintenance.end(dir)
+
+	res, err = http.Post(ts.URL+"/api/repos/missing.git/maintenance", "application/json", nil)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestScheduledMaintenance(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	repos := []string{"one.git", "org/two.git"}
+	for _, name := range repos {
+		initBareRepo(t, rpath, name)
+		clone := filepath.Join(workspace, filepath.Base(name))
+		cloneAndCommit(t, filepath.Join(rpath, name), clone, "blah")
+		git(t, clone, "push", "origin", "master")
+	}
+
+	srv, err := NewServer(http.NotFoundHandler(), ReposPath(rpath), Maintenance(10*time.Millisecond, 2))
+	assert.Ok(t, err)
+	defer srv.Shutdown(context.Background())
+
+	deadline := time.Now().Add(10 * time.Second)
+	for _, name := range repos {
+		for !commitGraph(filepath.Join(rpath, name)) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Cond(t, commitGraph(filepath.Join(rpath, name)), "%s should have been maintained", name)
+	}
+}
@@ -0,0 +1,87 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// defaultMaintenanceRetry is how long clients are asked to wait before
+// retrying operations rejected in maintenance mode, unless told otherwise.
+const defaultMaintenanceRetry = time.Minute
+
+// errMaintenanceMode is returned when an operation is not started because
+// the server is in maintenance mode.
+var errMaintenanceMode = errors.New("server is under maintenance")
+
+// pause keeps operations from starting on every repository, asking clients
+// to retry after retryAfter. Running operations are left to finish.
+func (a *repoActivity) pause(retryAfter time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+	a.paused = true
+	a.retryAfter = retryAfter
+}
+
+func (a *repoActivity) resume() {
+	a.Lock()
+	defer a.Unlock()
+	a.paused = false
+}
+
+func (a *repoActivity) retryAfterPause() time.Duration {
+	a.Lock()
+	defer a.Unlock()
+	return a.retryAfter
+}
+
+// status returns whether operations are paused and how many are running.
+func (a *repoActivity) status() (paused bool, running int) {
+	a.Lock()
+	defer a.Unlock()
+
+	for _, n := range a.running {
+		running += n
+	}
+	return a.paused, running
+}
+
+// maintenanceRequest is the body of requests putting the server in
+// maintenance mode.
+type maintenanceRequest struct {
+	// RetryAfter is how long clients are asked to wait before retrying, in
+	// seconds.
+	RetryAfter int `json:"retry_after"`
+}
+
+// setMaintenance puts the server in maintenance mode, or back in service.
+// Progress draining operations is reported by the server status.
+func (h *handler) setMaintenance(w http.ResponseWriter, req *http.Request, enabled bool) {
+	if !enabled {
+		h.activity.resume()
+		h.logger.Info("Server back in service", Field{"user", remoteUser(req)})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var m maintenanceRequest
+	if err := json.NewDecoder(req.Body).Decode(&m); (err != nil && err != io.EOF) || m.RetryAfter < 0 {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	retry := defaultMaintenanceRetry
+	if m.RetryAfter > 0 {
+		retry = time.Duration(m.RetryAfter) * time.Second
+	}
+
+	h.activity.pause(retry)
+	h.logger.Info("Server in maintenance mode", Field{"retry_after", retry}, Field{"user", remoteUser(req)})
+	w.WriteHeader(http.StatusNoContent)
+}
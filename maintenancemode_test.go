@@ -0,0 +1,77 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	var h *handler
+	capture := func(x *handler) { h = x }
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AdminAPI(), HealthChecks(), capture))
+	defer ts.Close()
+
+	post := func(p, body string) int {
+		res, err := http.Post(ts.URL+p, "application/json", strings.NewReader(body))
+		assert.Ok(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	get := func(p string) *http.Response {
+		res, err := http.Get(ts.URL + p)
+		assert.Ok(t, err)
+		res.Body.Close()
+		return res
+	}
+	status := func() serverStatus {
+		res, err := http.Get(ts.URL + "/api/server")
+		assert.Ok(t, err)
+		defer res.Body.Close()
+		var s serverStatus
+		assert.Ok(t, json.NewDecoder(res.Body).Decode(&s))
+		return s
+	}
+
+	// An operation still running when maintenance starts.
+	dir := filepath.Join(rpath, "test.git")
+	assert.Ok(t, h.activity.enter(dir))
+
+	assert.Equals(t, http.StatusNoContent, post("/api/server/maintenance", `{"retry_after": 120}`))
+	assert.Equals(t, serverStatus{Maintenance: true, Running: 1}, status())
+
+	res := get("/test.git/info/refs?service=git-upload-pack")
+	assert.Equals(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equals(t, "120", res.Header.Get("Retry-After"))
+	assert.Equals(t, http.StatusServiceUnavailable, get("/readyz").StatusCode)
+
+	h.activity.leave(dir)
+	assert.Equals(t, serverStatus{Maintenance: true, Drained: true}, status())
+
+	assert.Equals(t, http.StatusNoContent, post("/api/server/resume", ""))
+	assert.Equals(t, serverStatus{}, status())
+	assert.Equals(t, http.StatusOK, get("/test.git/info/refs?service=git-upload-pack").StatusCode)
+	assert.Equals(t, http.StatusOK, get("/readyz").StatusCode)
+
+	// Clients are asked to retry after a minute by default.
+	assert.Equals(t, http.StatusNoContent, post("/api/server/maintenance", ""))
+	assert.Equals(t, "60", get("/test.git/info/refs?service=git-upload-pack").Header.Get("Retry-After"))
+
+	assert.Equals(t, http.StatusBadRequest, post("/api/server/maintenance", `{"retry_after": -1}`))
+}
@@ -0,0 +1,52 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// MessageFunc returns the messages to show users about to fetch from or push
+// to repo.
+type MessageFunc func(r *http.Request, repo string, op Operation) []string
+
+// RemoteMessages shows users the messages fn returns, such as a welcome
+// banner or a deprecation notice, in their terminal while they fetch or
+// push, the same as messages printed by Git itself: prefixed with
+// "remote:". Hooks can show messages as well, through Message.
+func RemoteMessages(fn MessageFunc) Option {
+	return func(h *handler) {
+		h.messages = fn
+	}
+}
+
+// messagesKey is the context key under which the writer relaying messages
+// to the client is stored.
+type messagesKey struct{}
+
+// Message shows msg to the user making r, which must be a request passed
+// to a hook or other callback while gitd serves a fetch or push. Messages
+// can only be shown to clients able to receive progress messages; they
+// are dropped otherwise.
+func Message(r *http.Request, msg string) {
+	if w, ok := r.Context().Value(messagesKey{}).(io.Writer); ok {
+		w.Write([]byte(strings.TrimRight(msg, "\n") + "\n"))
+	}
+}
+
+// withMessages returns req carrying w to relay messages to the client, and
+// shows the messages configured for repo and op.
+func (h *handler) withMessages(req *http.Request, w io.Writer, repo string, op Operation) *http.Request {
+	req = req.WithContext(context.WithValue(req.Context(), messagesKey{}, w))
+	if h.messages != nil {
+		for _, msg := range h.messages(req, repo, op) {
+			Message(req, msg)
+		}
+	}
+	return req
+}
@@ -0,0 +1,61 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRemoteMessages(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		RemoteMessages(func(r *http.Request, repo string, op Operation) []string {
+			return []string{"Welcome to " + repo + ", about to " + op.String()}
+		}),
+		PostReceive(func(r *http.Request, repo string, updates []RefUpdate) error {
+			Message(r, "Pushed "+updates[0].Name+"\n")
+			return nil
+		}),
+	))
+	defer ts.Close()
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	dir := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", dir, "hello")
+
+	cmd := exec.Command("git", "push", "origin", "master")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	assert.Ok(t, err)
+	assert.Cond(t, strings.Contains(string(out), "remote: Welcome to test.git, about to push"), "welcome message missing:\n%s", out)
+	assert.Cond(t, strings.Contains(string(out), "remote: Pushed refs/heads/master"), "post-receive message missing:\n%s", out)
+
+	cmd = exec.Command("git", "clone", ts.URL+"/test.git", "copy")
+	cmd.Dir = workspace
+	out, err = cmd.CombinedOutput()
+	assert.Ok(t, err)
+	assert.Cond(t, strings.Contains(string(out), "remote: Welcome to test.git, about to fetch"), "welcome message missing:\n%s", out)
+
+	content, err := ioutil.ReadFile(filepath.Join(workspace, "copy", "README.md"))
+	assert.Ok(t, err)
+	assert.Equals(t, "hello", string(content))
+}
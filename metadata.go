@@ -0,0 +1,143 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultDescription is the description git init gives repositories.
+const defaultDescription = "Unnamed repository; edit this file 'description' to name the repository."
+
+// templateConfigSkipped are the configuration sections not copied from
+// template repositories, as they describe the repositories themselves.
+var templateConfigSkipped = []string{"core.", "extensions.", "remote.", "branch."}
+
+// DefaultBranch sets the branch HEAD points to in repositories gitd creates,
+// such as "main", unless told otherwise through the admin API. By default,
+// it is the one git init picks.
+func DefaultBranch(branch string) Option {
+	return func(h *handler) {
+		h.initialBranch = branch
+	}
+}
+
+// validBranchName returns whether branch is a valid branch name.
+func (h *handler) validBranchName(branch string) bool {
+	if branch == "" || strings.HasPrefix(branch, "-") {
+		return false
+	}
+	_, _, err := runAndLog(h.logger, h.gitCommand("", "check-ref-format", "refs/heads/"+branch))
+	return err == nil
+}
+
+// setDefaultBranch points the HEAD of the repository in dir to branch.
+func (h *handler) setDefaultBranch(dir, branch string) error {
+	cmd := h.gitCommand(dir, "symbolic-ref", "HEAD", "refs/heads/"+branch)
+	_, _, err := runAndLog(h.logger, cmd)
+	return err
+}
+
+// defaultBranch returns the branch HEAD points to in the repository in dir.
+func defaultBranch(dir string) string {
+	head, err := ioutil.ReadFile(filepath.Join(dir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.TrimSpace(string(head)), "ref: refs/heads/")
+}
+
+// setDescription sets the description of the repository in dir, stored in
+// its description file as gitweb and other tools expect.
+func setDescription(dir, description string) error {
+	return ioutil.WriteFile(filepath.Join(dir, "description"), []byte(description+"\n"), 0644)
+}
+
+// description returns the description of the repository in dir, if it was
+// given one.
+func description(dir string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "description"))
+	if err != nil {
+		return ""
+	}
+	d := strings.TrimSpace(string(data))
+	if d == defaultDescription {
+		return ""
+	}
+	return d
+}
+
+// copyTemplate copies the hooks and configuration of the repository in src
+// to the one in dst. Sample hooks and the settings describing src itself,
+// such as its remotes, are not copied.
+func (h *handler) copyTemplate(src, dst string) error {
+	hooks, err := ioutil.ReadDir(filepath.Join(src, "hooks"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, fi := range hooks {
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), ".sample") {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, "hooks", fi.Name()), filepath.Join(dst, "hooks", fi.Name()), fi.Mode()); err != nil {
+			return err
+		}
+	}
+
+	out, _, err := runAndLog(h.logger, h.gitCommand("", "config", "--file", filepath.Join(src, "config"), "--list", "-z"))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range strings.Split(out, "\x00") {
+		parts := strings.SplitN(entry, "\n", 2)
+		if parts[0] == "" || skipTemplateConfig(parts[0]) {
+			continue
+		}
+
+		// Settings without a value are true.
+		value := "true"
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		cmd := h.gitCommand(dst, "config", "--file", filepath.Join(dst, "config"), "--add", parts[0], value)
+		if _, _, err := runAndLog(h.logger, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func skipTemplateConfig(key string) bool {
+	for _, prefix := range templateConfigSkipped {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyFile copies the file src to dst, giving it mode.
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
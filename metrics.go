@@ -0,0 +1,258 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics enables instrumentation of Git operations and serves the collected
+// metrics at path using the Prometheus text exposition format.
+func Metrics(path string) Option {
+	return func(h *handler) {
+		h.metrics = newMetrics()
+		h.metricsPath = path
+	}
+}
+
+// durationBuckets are the upper bounds, in seconds, of the operation
+// duration histogram.
+var durationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// opLabels identifies the series of an operation metric.
+type opLabels struct {
+	service string
+	tenant  string
+	repo    string
+	user    string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metrics holds the instrumentation data of a handler.
+type metrics struct {
+	sync.Mutex
+	operations    map[opLabels]map[string]uint64
+	durations     map[opLabels]*histogram
+	bytesSent     map[opLabels]uint64
+	bytesReceived map[opLabels]uint64
+	active        map[string]int64
+	// replications counts replication outcomes by their formatted labels.
+	replications map[string]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		operations:    make(map[opLabels]map[string]uint64),
+		durations:     make(map[opLabels]*histogram),
+		bytesSent:     make(map[opLabels]uint64),
+		bytesReceived: make(map[opLabels]uint64),
+		active:        make(map[string]int64),
+		replications:  make(map[string]uint64),
+	}
+}
+
+// started records that a Git process started running for service.
+func (m *metrics) started(service string) {
+	m.Lock()
+	m.active[service]++
+	m.Unlock()
+}
+
+// finished records the outcome of a Git operation.
+func (m *metrics) finished(service, tenant, repo, user string, d time.Duration, sent, received int64, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.active[service]--
+
+	l := opLabels{service: service, tenant: tenant, repo: repo, user: user}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	if m.operations[l] == nil {
+		m.operations[l] = make(map[string]uint64)
+	}
+	m.operations[l][result]++
+
+	hist := m.durations[l]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[l] = hist
+	}
+
+	seconds := d.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += seconds
+	hist.count++
+
+	m.bytesSent[l] += uint64(sent)
+	m.bytesReceived[l] += uint64(received)
+}
+
+// replicated records the outcome of an attempt to replicate repo to replica.
+func (m *metrics) replicated(repo, replica, result string) {
+	m.Lock()
+	defer m.Unlock()
+
+	l := fmt.Sprintf("replica=\"%s\",repo=\"%s\",result=\"%s\"", escapeLabel(replica), escapeLabel(repo), escapeLabel(result))
+	m.replications[l]++
+}
+
+// ServeHTTP writes metrics in the Prometheus text exposition format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// write writes metrics in the Prometheus text exposition format.
+func (m *metrics) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	labels := make([]opLabels, 0, len(m.durations))
+	for l := range m.durations {
+		labels = append(labels, l)
+	}
+	sort.Sort(byLabels(labels))
+
+	fmt.Fprintln(w, "# HELP gitd_operations_total Git operations handled, by result.")
+	fmt.Fprintln(w, "# TYPE gitd_operations_total counter")
+	for _, l := range labels {
+		results := make([]string, 0, len(m.operations[l]))
+		for r := range m.operations[l] {
+			results = append(results, r)
+		}
+		sort.Strings(results)
+
+		for _, r := range results {
+			fmt.Fprintf(w, "gitd_operations_total{%s,result=\"%s\"} %d\n", l, r, m.operations[l][r])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP gitd_operation_duration_seconds Duration of Git operations.")
+	fmt.Fprintln(w, "# TYPE gitd_operation_duration_seconds histogram")
+	for _, l := range labels {
+		hist := m.durations[l]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "gitd_operation_duration_seconds_bucket{%s,le=\"%g\"} %d\n", l, bound, hist.counts[i])
+		}
+		fmt.Fprintf(w, "gitd_operation_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, hist.count)
+		fmt.Fprintf(w, "gitd_operation_duration_seconds_sum{%s} %g\n", l, hist.sum)
+		fmt.Fprintf(w, "gitd_operation_duration_seconds_count{%s} %d\n", l, hist.count)
+	}
+
+	fmt.Fprintln(w, "# HELP gitd_sent_bytes_total Bytes sent to clients by Git operations.")
+	fmt.Fprintln(w, "# TYPE gitd_sent_bytes_total counter")
+	for _, l := range labels {
+		fmt.Fprintf(w, "gitd_sent_bytes_total{%s} %d\n", l, m.bytesSent[l])
+	}
+
+	fmt.Fprintln(w, "# HELP gitd_received_bytes_total Bytes received from clients by Git operations.")
+	fmt.Fprintln(w, "# TYPE gitd_received_bytes_total counter")
+	for _, l := range labels {
+		fmt.Fprintf(w, "gitd_received_bytes_total{%s} %d\n", l, m.bytesReceived[l])
+	}
+
+	services := make([]string, 0, len(m.active))
+	for s := range m.active {
+		services = append(services, s)
+	}
+	sort.Strings(services)
+
+	fmt.Fprintln(w, "# HELP gitd_active_processes Git processes currently running.")
+	fmt.Fprintln(w, "# TYPE gitd_active_processes gauge")
+	for _, s := range services {
+		fmt.Fprintf(w, "gitd_active_processes{service=\"%s\"} %d\n", escapeLabel(s), m.active[s])
+	}
+
+	replications := make([]string, 0, len(m.replications))
+	for l := range m.replications {
+		replications = append(replications, l)
+	}
+	sort.Strings(replications)
+
+	fmt.Fprintln(w, "# HELP gitd_replications_total Attempts to replicate repositories, by result.")
+	fmt.Fprintln(w, "# TYPE gitd_replications_total counter")
+	for _, l := range replications {
+		fmt.Fprintf(w, "gitd_replications_total{%s} %d\n", l, m.replications[l])
+	}
+}
+
+func (l opLabels) String() string {
+	// Only servers with tenants label operations with them.
+	if l.tenant != "" {
+		return fmt.Sprintf("repo=\"%s\",service=\"%s\",tenant=\"%s\",user=\"%s\"", escapeLabel(l.repo), escapeLabel(l.service), escapeLabel(l.tenant), escapeLabel(l.user))
+	}
+	return fmt.Sprintf("repo=\"%s\",service=\"%s\",user=\"%s\"", escapeLabel(l.repo), escapeLabel(l.service), escapeLabel(l.user))
+}
+
+// escapeLabel escapes a label value as required by the exposition format.
+func escapeLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	return strings.Replace(v, `"`, `\"`, -1)
+}
+
+type byLabels []opLabels
+
+func (b byLabels) Len() int      { return len(b) }
+func (b byLabels) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byLabels) Less(i, j int) bool {
+	if b[i].repo != b[j].repo {
+		return b[i].repo < b[j].repo
+	}
+	if b[i].service != b[j].service {
+		return b[i].service < b[j].service
+	}
+	return b[i].user < b[j].user
+}
+
+// countingReader counts the bytes read through it. Reads given up on by
+// runCommand may still be under way, so n is accessed atomically.
+type countingReader struct {
+	n int64
+	r io.Reader
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// count returns the bytes read so far.
+func (c *countingReader) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,48 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), Metrics("/metrics")))
+	defer ts.Close()
+
+	// Responses are streamed, so operations are only over once read.
+	res, err := http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	_, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Ok(t, err)
+
+	res, err = http.Get(ts.URL + "/metrics")
+	assert.Ok(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Ok(t, err)
+
+	for _, line := range []string{
+		`gitd_operations_total{repo="test.git",service="git-upload-pack",user="",result="success"} 1`,
+		`gitd_operation_duration_seconds_count{repo="test.git",service="git-upload-pack",user=""} 1`,
+		`gitd_received_bytes_total{repo="test.git",service="git-upload-pack",user=""} 0`,
+		`gitd_active_processes{service="git-upload-pack"} 0`,
+	} {
+		assert.Cond(t, strings.Contains(string(body), line+"\n"), "missing %q in:\n%s", line, body)
+	}
+}
@@ -0,0 +1,262 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errNotMirror is returned when syncing a repository that is not a
+	// mirror.
+	errNotMirror = errors.New("repository is not a mirror")
+	// errSyncRunning is returned when syncing a mirror already being synced.
+	errSyncRunning = errors.New("mirror sync already running")
+)
+
+// mirrorRefspecs are the refs fetched from upstream repositories. Other
+// refs, such as the pull request refs of GitHub, are left out.
+var mirrorRefspecs = []string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"}
+
+// Mirror describes a repository kept in sync with an upstream repository.
+type Mirror struct {
+	// Repo is the name of the local repository, such as github.com/foo/bar.git.
+	Repo string
+	// URL is the upstream repository, such as https://github.com/foo/bar.git.
+	URL string
+	// Interval is how often the mirror is synced. Mirrors without one are
+	// only synced on startup and through the admin API.
+	Interval time.Duration
+	// Username and Password authenticate fetches from HTTP(S) upstreams.
+	Username string
+	Password string
+	// SSHKey is the path of the private key authenticating fetches from SSH
+	// upstreams.
+	SSHKey string
+}
+
+// Mirrors keeps repositories in sync with upstream repositories, creating
+// them if needed, so gitd can serve as a cache of repositories hosted
+// elsewhere. Mirrors are synced on startup, then each of their intervals,
+// in the background until Shutdown, and on demand through the admin API.
+// Branches and tags deleted upstream are deleted from mirrors, and pushes
+// to mirrors are rejected.
+func Mirrors(mirrors ...Mirror) Option {
+	return func(h *handler) {
+		if h.mirrors == nil {
+			h.mirrors = newMirrorSet()
+		}
+		for _, m := range mirrors {
+			h.mirrors.byRepo[m.Repo] = m
+			h.mirrors.scheduled = append(h.mirrors.scheduled, m)
+		}
+	}
+}
+
+// mirrorSet tracks mirrors and their syncs.
+type mirrorSet struct {
+	sync.Mutex
+	byRepo map[string]Mirror
+	// scheduled are the mirrors configured with Mirrors.
+	scheduled []Mirror
+	// syncing has the channels closed once running syncs finish.
+	syncing map[string]chan struct{}
+	synced  map[string]time.Time
+}
+
+func newMirrorSet() *mirrorSet {
+	return &mirrorSet{
+		byRepo:  make(map[string]Mirror),
+		syncing: make(map[string]chan struct{}),
+		synced:  make(map[string]time.Time),
+	}
+}
+
+// get returns the mirror of repo, if it is one.
+func (s *mirrorSet) get(repo string) (Mirror, bool) {
+	s.Lock()
+	defer s.Unlock()
+	m, ok := s.byRepo[repo]
+	return m, ok
+}
+
+// isMirror returns whether repo is a mirror.
+func (h *handler) isMirror(repo string) bool {
+	if h.mirrors == nil {
+		return false
+	}
+	_, ok := h.mirrors.get(repo)
+	return ok
+}
+
+// add adds m, unless its repository already is a mirror.
+func (s *mirrorSet) add(m Mirror) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.byRepo[m.Repo]; !ok {
+		s.byRepo[m.Repo] = m
+	}
+}
+
+func (s *mirrorSet) remove(repo string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.byRepo, repo)
+	delete(s.synced, repo)
+}
+
+// begin marks repo as being synced, returning false if it already was.
+func (s *mirrorSet) begin(repo string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.syncing[repo] != nil {
+		return false
+	}
+	s.syncing[repo] = make(chan struct{})
+	return true
+}
+
+// end marks the sync of repo as finished, recording when it succeeded.
+func (s *mirrorSet) end(repo string, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if ok {
+		s.synced[repo] = time.Now()
+	}
+	close(s.syncing[repo])
+	delete(s.syncing, repo)
+}
+
+// wait waits for the running sync of repo, if any, to finish.
+func (s *mirrorSet) wait(repo string) {
+	s.Lock()
+	done := s.syncing[repo]
+	s.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// lastSync returns when repo was last synced successfully, if it was.
+func (s *mirrorSet) lastSync(repo string) time.Time {
+	s.Lock()
+	defer s.Unlock()
+	return s.synced[repo]
+}
+
+// start syncs the mirrors configured, then each on its schedule, until
+// maintenance is closed.
+func (s *mirrorSet) start(h *handler) {
+	for _, m := range s.scheduled {
+		go func(m Mirror) {
+			h.syncMirror(m.Repo)
+			if m.Interval <= 0 {
+				return
+			}
+
+			ticker := time.NewTicker(m.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					h.syncMirror(m.Repo)
+				case <-h.maintenance.stop:
+					return
+				}
+			}
+		}(m)
+	}
+}
+
+// syncMirror fetches the refs of the mirror repo from its upstream,
+// creating the repository if it does not exist yet. New repositories only
+// show up once their first sync succeeds.
+func (h *handler) syncMirror(repo string) (err error) {
+	m, ok := h.mirrors.get(repo)
+	if !ok {
+		return errNotMirror
+	}
+	if !validRepoName(m.Repo) {
+		h.logger.Error("Invalid mirror repository name", Field{"repo", m.Repo})
+		return fmt.Errorf("invalid repository name %q", m.Repo)
+	}
+	if !h.mirrors.begin(m.Repo) {
+		return errSyncRunning
+	}
+	defer func() { h.mirrors.end(m.Repo, err == nil) }()
+
+	start := time.Now()
+	dir, err := h.storage.Dir(context.Background(), m.Repo)
+	if err != nil {
+		h.logger.Error("Locating mirror failed", Field{"repo", m.Repo}, Field{"error", err})
+		return err
+	}
+
+	// Syncs update refs, the same as pushes.
+	unlock, err := h.locks.lock(context.Background(), dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	target := dir
+	if !isBareRepo(dir) {
+		if target, err = h.initHiddenRepo(dir); err != nil {
+			h.logger.Error("Creating mirror failed", Field{"repo", m.Repo}, Field{"error", err})
+			return err
+		}
+		defer os.RemoveAll(target)
+	}
+
+	cmds := [][]string{
+		{"config", "remote.upstream.url", m.URL},
+		append([]string{"fetch", "--prune", "--quiet", "upstream"}, mirrorRefspecs...),
+	}
+	for _, args := range cmds {
+		cmd := h.gitCommand(target, args...)
+		cmd.Env = remoteEnv(m.Username, m.Password, m.SSHKey)
+		if err := h.runCommand(h.logger, ioutil.Discard, strings.NewReader(""), cmd); err != nil {
+			h.logger.Error("Syncing mirror failed", Field{"repo", m.Repo}, Field{"error", err})
+			return err
+		}
+	}
+
+	if target != dir {
+		if err := os.Rename(target, dir); err != nil {
+			h.logger.Error("Creating mirror failed", Field{"repo", m.Repo}, Field{"error", err})
+			return err
+		}
+	}
+
+	h.invalidateRepo(dir)
+
+	h.logger.Debug("Mirror synced", Field{"repo", m.Repo}, Field{"duration", time.Since(start)})
+	return nil
+}
+
+// remoteEnv returns the environment of Git commands fetching from or pushing
+// to remote repositories with the given credentials, if any.
+func remoteEnv(username, password, sshKey string) []string {
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if username != "" || password != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		env = gitConfigEnv(env, "http.extraHeader=Authorization: Basic "+auth)
+	}
+	if sshKey != "" {
+		env = append(env, "GIT_SSH_COMMAND=ssh -i '"+strings.Replace(sshKey, "'", `'\''`, -1)+"' -o IdentitiesOnly=yes -o BatchMode=yes")
+	}
+	return env
+}
@@ -0,0 +1,90 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestMirrors(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	initBareRepo(t, workspace, "upstream.git")
+	upstream := filepath.Join(workspace, "upstream")
+	cloneAndCommit(t, filepath.Join(workspace, "upstream.git"), upstream, "blah")
+	git(t, upstream, "push", "-q", "origin", "master", "master:feature")
+
+	srv, err := NewServer(http.NotFoundHandler(),
+		ReposPath(rpath),
+		AdminAPI(),
+		Mirrors(Mirror{Repo: "github.com/foo/bar.git", URL: filepath.Join(workspace, "upstream.git")}),
+	)
+	assert.Ok(t, err)
+	defer srv.Shutdown(context.Background())
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	syncNow := func(repo string) int {
+		for {
+			res, err := http.Post(ts.URL+"/api/repos/"+repo+"/sync", "application/json", nil)
+			assert.Ok(t, err)
+			res.Body.Close()
+
+			// The sync on startup may still be running.
+			if res.StatusCode != http.StatusConflict {
+				return res.StatusCode
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	assert.Equals(t, http.StatusNoContent, syncNow("github.com/foo/bar.git"))
+	clone := filepath.Join(workspace, "clone")
+	git(t, workspace, "clone", "-q", ts.URL+"/github.com/foo/bar.git", clone)
+	assert.Equals(t, gitOutput(t, upstream, "rev-parse", "HEAD"), gitOutput(t, clone, "rev-parse", "HEAD"))
+
+	// Syncs follow new commits and deleted branches.
+	git(t, upstream, "commit", "--allow-empty", "-qm", "second")
+	git(t, upstream, "push", "-q", "origin", "master", ":feature")
+	assert.Equals(t, http.StatusNoContent, syncNow("github.com/foo/bar.git"))
+	refs := gitOutput(t, clone, "ls-remote", "origin")
+	assert.Cond(t, strings.Contains(refs, gitOutput(t, upstream, "rev-parse", "HEAD")+"\trefs/heads/master"), "unexpected refs: %s", refs)
+	assert.Cond(t, !strings.Contains(refs, "refs/heads/feature"), "deleted branches should be pruned: %s", refs)
+
+	// Mirrors are read-only.
+	git(t, clone, "config", "--local", "user.name", "Gitd tests")
+	git(t, clone, "config", "--local", "user.email", "test@hooklift.io")
+	git(t, clone, "commit", "--allow-empty", "-qm", "local")
+	cmd := exec.Command("git", "push", "origin", "master")
+	cmd.Dir = clone
+	assert.Cond(t, cmd.Run() != nil, "pushes to mirrors should be rejected")
+
+	initBareRepo(t, rpath, "test.git")
+	assert.Equals(t, http.StatusNotFound, syncNow("test.git"))
+}
+
+func TestRemoteEnv(t *testing.T) {
+	env := strings.Join(remoteEnv("user", "pass", "/keys/it's"), "\n")
+	assert.Cond(t, strings.Contains(env, "http.extraHeader=Authorization: Basic dXNlcjpwYXNz"), "missing credentials: %s", env)
+	assert.Cond(t, strings.Contains(env, `GIT_SSH_COMMAND=ssh -i '/keys/it'\''s'`), "missing SSH key: %s", env)
+	assert.Cond(t, strings.Contains(env, "GIT_TERMINAL_PROMPT=0"), "prompts should be disabled: %s", env)
+}
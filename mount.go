@@ -0,0 +1,69 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Mount serves Git repositories from mux under prefix, such as "/git", so
+// they live alongside the other routes of an application rather than
+// taking over the whole URL space. Repositories are then cloned from URLs
+// such as https://example.com/git/org/repo.git. The server returned can be
+// validated, shut down and serve other transports.
+func Mount(mux *http.ServeMux, prefix string, opts ...Option) (*Server, error) {
+	srv, err := NewServer(http.NotFoundHandler(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	mux.Handle(strings.TrimSuffix(cleanPrefix(prefix), "/")+"/", srv.Handler(prefix))
+	return srv, nil
+}
+
+// Handler returns an HTTP handler serving Git under prefix, for routers
+// other than http.ServeMux, as in r.Mount("/git", srv.Handler("/git")) with
+// chi or r.PathPrefix("/git/").Handler(srv.Handler("/git")) with
+// gorilla/mux. Requests outside of prefix get a 404 response, and the URLs
+// sent to clients, such as those of redirects and LFS objects, keep it.
+func (s *Server) Handler(prefix string) http.Handler {
+	prefix = cleanPrefix(prefix)
+	if prefix == "/" {
+		return s
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rest := strings.TrimPrefix(req.URL.Path, prefix)
+		if len(rest) == len(req.URL.Path) || !strings.HasPrefix(rest, "/") {
+			http.NotFound(w, req)
+			return
+		}
+
+		req = req.WithContext(context.WithValue(req.Context(), prefixKey{}, prefix))
+		u := *req.URL
+		u.Path = rest
+		u.RawPath = ""
+		req.URL = &u
+		s.ServeHTTP(w, req)
+	})
+}
+
+// prefixKey is the context key under which the prefix Git is served under
+// is stored.
+type prefixKey struct{}
+
+// urlPrefix returns the prefix req was served under, without a trailing
+// slash.
+func urlPrefix(req *http.Request) string {
+	prefix, _ := req.Context().Value(prefixKey{}).(string)
+	return prefix
+}
+
+// cleanPrefix returns prefix with a leading slash and no trailing one,
+// unless it is the root.
+func cleanPrefix(prefix string) string {
+	return "/" + strings.Trim(prefix, "/")
+}
@@ -0,0 +1,102 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestMount(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "repo.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("app"))
+	})
+	_, err = Mount(mux, "/git/", ReposPath(rpath))
+	assert.Ok(t, err)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "repo")
+	cloneAndCommit(t, ts.URL+"/git/repo.git", clone, "blah")
+	git(t, clone, "push", "origin", "master")
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/git/repo.git/info/refs?service=git-upload-pack", http.StatusOK, ""},
+		{"/git/missing", http.StatusNotFound, "404 page not found\n"},
+		{"/repo.git/info/refs?service=git-upload-pack", http.StatusOK, "app"},
+		{"/github/repo.git/info/refs?service=git-upload-pack", http.StatusOK, "app"},
+	}
+	for _, tt := range tests {
+		res, err := http.Get(ts.URL + tt.path)
+		assert.Ok(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Ok(t, err)
+		assert.Equals(t, tt.status, res.StatusCode)
+		if tt.body != "" {
+			assert.Equals(t, tt.body, string(body))
+		}
+	}
+}
+
+func TestServerHandler(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "repo.git")
+
+	srv, err := NewServer(http.NotFoundHandler(),
+		ReposPath(rpath),
+		Redirects(map[string]string{"old.git": "repo.git"}),
+	)
+	assert.Ok(t, err)
+	ts := httptest.NewServer(srv.Handler("git"))
+	defer ts.Close()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/git/repo.git/info/refs?service=git-upload-pack", http.StatusOK},
+		{"/gitx/repo.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"/repo.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		res, err := http.Get(ts.URL + tt.path)
+		assert.Ok(t, err)
+		res.Body.Close()
+		assert.Equals(t, tt.status, res.StatusCode)
+	}
+
+	// Redirects stay under the prefix.
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := noRedirects.Get(ts.URL + "/git/old.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusMovedPermanently, res.StatusCode)
+	assert.Equals(t, "/git/repo.git/info/refs?service=git-upload-pack", res.Header.Get("Location"))
+}
@@ -0,0 +1,191 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// drainTimeout is how long moving or deleting a repository waits for the
+// operations running on it to finish.
+var drainTimeout = 30 * time.Second
+
+// errRepoDraining is returned when an operation is not started because its
+// repository is being moved.
+var errRepoDraining = errors.New("repository is being moved")
+
+// repoActivity tracks the operations running on repositories, so they can
+// be drained before moving them, or before maintenance of the server.
+type repoActivity struct {
+	sync.Mutex
+	running map[string]int
+	// draining has the channels closed once the operations running on
+	// repositories being drained finish.
+	draining map[string]chan struct{}
+	// paused keeps operations from starting on every repository, asking
+	// clients to retry after retryAfter.
+	paused     bool
+	retryAfter time.Duration
+}
+
+// enter records an operation starting on the repository in dir, returning
+// an error if the repository is being drained or the server is in
+// maintenance mode.
+func (a *repoActivity) enter(dir string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.paused {
+		return errMaintenanceMode
+	}
+	if a.draining[dir] != nil {
+		return errRepoDraining
+	}
+	if a.running == nil {
+		a.running = make(map[string]int)
+	}
+	a.running[dir]++
+	return nil
+}
+
+// leave records an operation on the repository in dir finishing.
+func (a *repoActivity) leave(dir string) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.running[dir]--
+	if a.running[dir] > 0 {
+		return
+	}
+	delete(a.running, dir)
+	if idle := a.draining[dir]; idle != nil {
+		select {
+		case <-idle:
+		default:
+			close(idle)
+		}
+	}
+}
+
+// drain keeps new operations from starting on the repository in dir,
+// returning a channel closed once running ones finish. Operations are
+// allowed again by undrain.
+func (a *repoActivity) drain(dir string) <-chan struct{} {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.draining == nil {
+		a.draining = make(map[string]chan struct{})
+	}
+	idle := make(chan struct{})
+	a.draining[dir] = idle
+	if a.running[dir] == 0 {
+		close(idle)
+	}
+	return idle
+}
+
+func (a *repoActivity) undrain(dir string) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.draining, dir)
+}
+
+// waitIdle waits for idle, as returned by drain, to be closed, for up to
+// drainTimeout. It returns ErrRepoBusy if it is not, or the error of ctx if
+// it is done first.
+func waitIdle(ctx context.Context, idle <-chan struct{}) error {
+	timer := time.NewTimer(drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return nil
+	case <-timer.C:
+		return ErrRepoBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// moveRequest is the body of requests moving repositories.
+type moveRequest struct {
+	Name string `json:"name"`
+	// Redirect leaves a redirect from the old name to the new one.
+	Redirect bool `json:"redirect"`
+}
+
+// moveRepo renames a bare repository, once the operations running on it
+// finish. Operations starting meanwhile are rejected.
+func (h *handler) moveRepo(w http.ResponseWriter, req *http.Request, name string) {
+	var move moveRequest
+	if err := json.NewDecoder(req.Body).Decode(&move); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if !validRepoName(move.Name) || move.Name == name {
+		writeError(w, http.StatusBadRequest, "invalid repository name")
+		return
+	}
+
+	src, ok := h.locateRepo(w, req, name)
+	if !ok || !h.checkNoForks(w, name, src) {
+		return
+	}
+	dst, err := h.storage.Dir(req.Context(), move.Name)
+	if err != nil {
+		h.logger.Error("Locating repository failed", Field{"repo", move.Name}, Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to locate repository")
+		return
+	}
+	// Repositories cannot be moved into themselves.
+	if strings.HasPrefix(dst, src+string(filepath.Separator)) {
+		writeError(w, http.StatusBadRequest, "invalid repository name")
+		return
+	}
+	if _, err := os.Stat(dst); err == nil {
+		writeError(w, http.StatusConflict, "repository already exists")
+		return
+	}
+
+	idle := h.activity.drain(src)
+	defer h.activity.undrain(src)
+
+	switch err := waitIdle(req.Context(), idle); {
+	case err == ErrRepoBusy:
+		writeError(w, http.StatusConflict, "repository is busy, try again later")
+		return
+	case err != nil:
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err == nil {
+		err = os.Rename(src, dst)
+	}
+	if err != nil {
+		h.logger.Error("Moving repository failed", Field{"repo", name}, Field{"to", move.Name}, Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to move repository")
+		return
+	}
+
+	h.invalidateRepo(src)
+	if move.Redirect {
+		if err := h.redirects.add(name, move.Name); err != nil {
+			h.logger.Error("Saving redirects failed", Field{"repo", name}, Field{"error", err})
+		}
+	}
+
+	h.logger.Info("Repository moved", Field{"repo", name}, Field{"to", move.Name}, Field{"user", remoteUser(req)})
+	writeJSON(w, http.StatusOK, repoInfo{Name: move.Name})
+}
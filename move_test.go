@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestMoveRepo(t *testing.T) {
+	defer func(d time.Duration) { drainTimeout = d }(drainTimeout)
+	drainTimeout = 50 * time.Millisecond
+
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+	initBareRepo(t, rpath, "other.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	var h *handler
+	capture := func(x *handler) { h = x }
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AdminAPI(), capture))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "-q", "origin", "master")
+
+	move := func(name, body string) int {
+		res, err := http.Post(ts.URL+"/api/repos/"+name+"/move", "application/json", strings.NewReader(body))
+		assert.Ok(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(p string) *http.Response {
+		res, err := noRedirects.Get(ts.URL + p)
+		assert.Ok(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	// Repositories are not moved while in use.
+	dir := filepath.Join(rpath, "test.git")
+	assert.Ok(t, h.activity.enter(dir))
+	assert.Equals(t, http.StatusConflict, move("test.git", `{"name": "org/renamed.git", "redirect": true}`))
+	idle := h.activity.drain(dir)
+	assert.Equals(t, http.StatusServiceUnavailable, get("/test.git/info/refs?service=git-upload-pack").StatusCode)
+	h.activity.leave(dir)
+	<-idle
+	h.activity.undrain(dir)
+
+	assert.Equals(t, http.StatusOK, move("test.git", `{"name": "org/renamed.git", "redirect": true}`))
+	assert.Cond(t, isBareRepo(filepath.Join(rpath, "org", "renamed.git")), "repository should have been moved")
+
+	res := get("/test.git/info/refs?service=git-upload-pack")
+	assert.Equals(t, http.StatusMovedPermanently, res.StatusCode)
+	assert.Equals(t, "/org/renamed.git/info/refs?service=git-upload-pack", res.Header.Get("Location"))
+
+	// Clients follow redirects.
+	git(t, workspace, "clone", "-q", ts.URL+"/test.git", filepath.Join(workspace, "redirected"))
+	assert.Equals(t, gitOutput(t, clone, "rev-parse", "HEAD"), gitOutput(t, filepath.Join(workspace, "redirected"), "rev-parse", "HEAD"))
+
+	// Redirects do not chain.
+	assert.Equals(t, http.StatusOK, move("org/renamed.git", `{"name": "final.git", "redirect": true}`))
+	assert.Equals(t, "/final.git/info/refs?service=git-upload-pack", get("/test.git/info/refs?service=git-upload-pack").Header.Get("Location"))
+
+	assert.Equals(t, http.StatusOK, move("other.git", `{"name": "moved.git"}`))
+	assert.Equals(t, http.StatusNotFound, get("/other.git/info/refs?service=git-upload-pack").StatusCode)
+
+	assert.Equals(t, http.StatusConflict, move("final.git", `{"name": "moved.git"}`))
+	assert.Equals(t, http.StatusNotFound, move("missing.git", `{"name": "new.git"}`))
+	assert.Equals(t, http.StatusBadRequest, move("final.git", `{"name": "../escaped.git"}`))
+	assert.Equals(t, http.StatusBadRequest, move("final.git", `{"name": "final.git/nested.git"}`))
+}
@@ -0,0 +1,86 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !windows
+// +build !windows
+
+package gitd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// validNamePart returns whether part of a repository name names a file of
+// its own, which any part does outside of Windows.
+func validNamePart(part string) bool {
+	return true
+}
+
+// sameCase returns whether dir names the directory it resolves to, realDir
+// under realRoot, in the same case. Case-insensitive file systems, such as
+// the default ones of macOS, would otherwise reach the same repository under
+// names Authorize callbacks do not know about. Each existing part of the
+// path is probed with its case swapped, and looked up among the names of its
+// directory if that reaches the same file.
+func sameCase(root, dir, realRoot, realDir string) bool {
+	rel, err := filepath.Rel(realRoot, realDir)
+	if err != nil {
+		return false
+	}
+	if rel == "." {
+		return true
+	}
+
+	parent := realRoot
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		p := filepath.Join(parent, name)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			// Missing directories are created in the case given.
+			return true
+		}
+
+		if swapped := swapCase(name); swapped != name {
+			sfi, err := os.Lstat(filepath.Join(parent, swapped))
+			if err == nil && os.SameFile(fi, sfi) && !hasName(parent, name) {
+				return false
+			}
+		}
+		parent = p
+	}
+	return true
+}
+
+// hasName returns whether dir holds an entry named exactly name.
+func hasName(dir, name string) bool {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return false
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// swapCase returns s with the case of its letters swapped.
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, s)
+}
@@ -0,0 +1,61 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !windows
+// +build !windows
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestSameCase(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, filepath.Join("org", "secret.git"))
+
+	assert.Equals(t, "sECRET.GIT", swapCase("Secret.git"))
+	assert.Cond(t, sameCase(rpath, rpath, rpath, rpath), "roots are named in their own case")
+
+	dir := filepath.Join(rpath, "org", "secret.git")
+	assert.Cond(t, sameCase(rpath, dir, rpath, dir), "%s is named in its own case", dir)
+	missing := filepath.Join(rpath, "org", "New.git")
+	assert.Cond(t, sameCase(rpath, missing, rpath, missing), "%s does not exist yet", missing)
+
+	// Only case-insensitive file systems reach secret.git as Secret.git.
+	variant := filepath.Join(rpath, "Org", "Secret.git")
+	_, err = os.Stat(variant)
+	assert.Equals(t, err != nil, sameCase(rpath, variant, rpath, variant))
+}
+
+func TestCaseVariantRepoPaths(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "secret.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AuthorizeRepo(func(user, repo string, op Operation) bool {
+		return repo != "secret.git"
+	})))
+	defer ts.Close()
+
+	for path, status := range map[string]int{
+		"/secret.git/info/refs?service=git-upload-pack": http.StatusForbidden,
+		"/SECRET.git/info/refs?service=git-upload-pack": http.StatusNotFound,
+	} {
+		res, err := http.Get(ts.URL + path)
+		assert.Ok(t, err)
+		res.Body.Close()
+		assert.Equals(t, status, res.StatusCode)
+	}
+}
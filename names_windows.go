@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// reservedNames are the device names Windows reserves in every directory,
+// with or without an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM0": true, "COM1": true, "COM2": true, "COM3": true, "COM4": true,
+	"COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"COM¹": true, "COM²": true, "COM³": true,
+	"LPT0": true, "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true,
+	"LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+	"LPT¹": true, "LPT²": true, "LPT³": true,
+}
+
+// validNamePart returns whether part of a repository name names a file of
+// its own on Windows: not a device, without the trailing dots and spaces
+// Windows drops, and without the characters it does not allow, such as the
+// colon naming alternate data streams or drives.
+func validNamePart(part string) bool {
+	if strings.HasSuffix(part, ".") || strings.HasSuffix(part, " ") {
+		return false
+	}
+	if strings.ContainsAny(part, `<>:"|?*`) {
+		return false
+	}
+	for _, r := range part {
+		if r < ' ' {
+			return false
+		}
+	}
+
+	base := part
+	if i := strings.Index(base, "."); i >= 0 {
+		base = base[:i]
+	}
+	return !reservedNames[strings.ToUpper(strings.TrimRight(base, " "))]
+}
+
+// sameCase returns whether dir, under root, names the directory it resolves
+// to, realDir under realRoot, in the same case. Windows file systems ignore
+// case, so names differing in case only would otherwise reach the same
+// repository under names Authorize callbacks do not know about. Symbolic
+// links are not compared.
+func sameCase(root, dir, realRoot, realDir string) bool {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return false
+	}
+	realRel, err := filepath.Rel(realRoot, realDir)
+	if err != nil {
+		return false
+	}
+	return rel == realRel || !strings.EqualFold(rel, realRel)
+}
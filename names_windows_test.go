@@ -0,0 +1,71 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestWindowsRepoNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"org/app.git", true},
+		{"org/console.git", true},
+		{"org/con", false},
+		{"org/CON.git", false},
+		{"nul.git/app.git", false},
+		{"org/com1.git", false},
+		{"org/lpt9", false},
+		{"org/conin$", false},
+		{"org/app.git.", false},
+		{"org/app.git ", false},
+		{"org/app.git:stream", false},
+		{"C:/app.git", false},
+		{`org\app.git`, false},
+		{"org/a|b.git", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equals(t, tt.valid, validRepoName(tt.name))
+	}
+}
+
+func TestWindowsRepoPaths(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "secret.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AuthorizeRepo(func(user, repo string, op Operation) bool {
+		return repo != "secret.git"
+	})))
+	defer ts.Close()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/secret.git/info/refs?service=git-upload-pack", http.StatusForbidden},
+		// Names differing in case only do not reach the same repository.
+		{"/SECRET.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"/secret.git./info/refs?service=git-upload-pack", http.StatusBadRequest},
+		{"/secret.git::$DATA/info/refs?service=git-upload-pack", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		res, err := http.Get(ts.URL + tt.path)
+		assert.Ok(t, err)
+		res.Body.Close()
+		assert.Equals(t, tt.status, res.StatusCode)
+	}
+}
@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"regexp"
+	"strings"
+)
+
+// namespaceRe matches the namespace names accepted in URLs.
+var namespaceRe = regexp.MustCompile(`^[a-zA-Z0-9_-][a-zA-Z0-9._-]*$`)
+
+// Namespaces serves namespaced views of repositories under prefix. Requests
+// for {prefix}/{namespace}/{repo} are served from {repo} with GIT_NAMESPACE
+// set to {namespace}, so forks can share a single object store while keeping
+// their refs apart. For example, with Namespaces("/fork"), /fork/bob/app.git
+// is app.git as seen by bob.
+//
+// Dumb HTTP clients are refused namespaced repositories, since raw repository
+// files would expose the refs of every namespace.
+func Namespaces(prefix string) Option {
+	return func(h *handler) {
+		h.namespacePrefix = "/" + strings.Trim(prefix, "/") + "/"
+	}
+}
+
+// splitNamespace extracts the namespace from urlPath, returning the path of
+// the repository holding it. It returns ok set to false if urlPath is under
+// the namespaces prefix but does not include a valid namespace.
+func (h *handler) splitNamespace(urlPath string) (namespace, repoPath string, ok bool) {
+	if h.namespacePrefix == "" || !strings.HasPrefix(urlPath, h.namespacePrefix) {
+		return "", urlPath, true
+	}
+
+	rest := strings.TrimPrefix(urlPath, h.namespacePrefix)
+	i := strings.Index(rest, "/")
+	if i < 0 || !namespaceRe.MatchString(rest[:i]) {
+		return "", "", false
+	}
+	return rest[:i], rest[i:], true
+}
+
+// namespaced returns whether env sets GIT_NAMESPACE.
+func namespaced(env []string) bool {
+	for _, v := range env {
+		if strings.HasPrefix(v, "GIT_NAMESPACE=") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestNamespaces(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "app.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), Namespaces("/fork"), DumbHTTP(true)))
+	defer ts.Close()
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	// Pushes to the upstream and a fork land in the same repository, with
+	// the fork's refs kept apart.
+	upstream := filepath.Join(workspace, "upstream")
+	cloneAndCommit(t, ts.URL+"/app.git", upstream, "upstream")
+	git(t, upstream, "push", "origin", "master")
+
+	fork := filepath.Join(workspace, "fork")
+	cloneAndCommit(t, ts.URL+"/fork/bob/app.git", fork, "fork")
+	git(t, fork, "push", "origin", "master")
+
+	_, err = os.Stat(filepath.Join(rpath, "app.git", "refs", "namespaces", "bob", "refs", "heads", "master"))
+	assert.Ok(t, err)
+
+	clone := filepath.Join(workspace, "clone")
+	git(t, workspace, "clone", ts.URL+"/fork/bob/app.git", clone)
+	content, err := ioutil.ReadFile(filepath.Join(clone, "README.md"))
+	assert.Ok(t, err)
+	assert.Equals(t, "fork", string(content))
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/fork/../app.git/info/refs?service=git-upload-pack", http.StatusBadRequest},
+		{"/fork/.bob/app.git/info/refs?service=git-upload-pack", http.StatusBadRequest},
+		{"/fork/bob/app.git/info/refs", http.StatusNotFound},
+		{"/fork/bob/app.git/HEAD", http.StatusNotFound},
+		{"/app.git/info/refs", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		res, err := http.Get(ts.URL + tt.path)
+		assert.Ok(t, err)
+		res.Body.Close()
+		assert.Equals(t, tt.status, res.StatusCode)
+	}
+}
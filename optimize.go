@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"sync"
+)
+
+// optimizeQueueSize is how many repositories can wait to be optimized.
+const optimizeQueueSize = 1024
+
+// optimizeTasks are the Git commands optimizing repositories for fetches.
+// Bitmaps require all objects in a single pack, so repositories are fully
+// repacked.
+var optimizeTasks = [][]string{
+	{"repack", "-a", "-d", "-q", "--write-bitmap-index"},
+	{"commit-graph", "write", "--reachable"},
+}
+
+// OptimizeAfterPush regenerates the pack bitmaps and commit graph of
+// repositories after successful pushes, in the background, with up to
+// workers repositories optimized at a time. This makes subsequent clones and
+// fetches much faster, at the cost of repacking repositories. Pushes made
+// while a repository waits to be optimized are optimized at once.
+func OptimizeAfterPush(workers int) Option {
+	return func(h *handler) {
+		if workers < 1 {
+			workers = 1
+		}
+		h.optimizer = &optimizer{
+			workers: workers,
+			queued:  make(map[string]bool),
+			jobs:    make(chan optimizeJob, optimizeQueueSize),
+		}
+	}
+}
+
+type optimizeJob struct {
+	name string
+	dir  string
+}
+
+// optimizer optimizes repositories from a pool of workers.
+type optimizer struct {
+	sync.Mutex
+	workers int
+	queued  map[string]bool
+	jobs    chan optimizeJob
+}
+
+// start starts the workers, which stop along with scheduled maintenance.
+func (o *optimizer) start(h *handler) {
+	for i := 0; i < o.workers; i++ {
+		go func() {
+			for {
+				select {
+				case job := <-o.jobs:
+					o.Lock()
+					delete(o.queued, job.dir)
+					o.Unlock()
+					h.optimizeRepo(job.name, job.dir)
+				case <-h.maintenance.stop:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// enqueue queues the repository name in dir for optimization, unless it
+// already is.
+func (o *optimizer) enqueue(name, dir string) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.queued[dir] {
+		return true
+	}
+
+	select {
+	case o.jobs <- optimizeJob{name: name, dir: dir}:
+		o.queued[dir] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// optimizeAfterPush queues the repository name in dir for optimization, if
+// enabled.
+func (h *handler) optimizeAfterPush(name, dir string) {
+	if h.optimizer == nil {
+		return
+	}
+	if !h.optimizer.enqueue(name, dir) {
+		h.logger.Warn("Too many repositories waiting to be optimized", Field{"repo", name})
+	}
+}
+
+// optimizeRepo runs the optimization tasks on the repository name in dir.
+func (h *handler) optimizeRepo(name, dir string) {
+	err := h.runMaintenance(name, dir, optimizeTasks)
+	if err == ErrMaintenanceRunning {
+		h.logger.Debug("Repository optimization skipped, maintenance running", Field{"repo", name})
+	}
+}
@@ -0,0 +1,62 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestOptimizeAfterPush(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	srv, err := NewServer(http.NotFoundHandler(), ReposPath(rpath), OptimizeAfterPush(2))
+	assert.Ok(t, err)
+	defer srv.Shutdown(context.Background())
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "origin", "master")
+
+	dir := filepath.Join(rpath, "test.git")
+	bitmaps := func() []string {
+		matches, err := filepath.Glob(filepath.Join(dir, "objects", "pack", "*.bitmap"))
+		assert.Ok(t, err)
+		return matches
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for (len(bitmaps()) == 0 || !commitGraph(dir)) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equals(t, 1, len(bitmaps()))
+	assert.Cond(t, commitGraph(dir), "push should have written a commit graph")
+}
+
+func TestOptimizerQueue(t *testing.T) {
+	o := &optimizer{workers: 1, queued: make(map[string]bool), jobs: make(chan optimizeJob, 1)}
+
+	assert.Cond(t, o.enqueue("one.git", "/repos/one.git"), "repository should be queued")
+	assert.Cond(t, o.enqueue("one.git", "/repos/one.git"), "queued repository should be accepted again")
+	assert.Equals(t, 1, len(o.jobs))
+	assert.Cond(t, !o.enqueue("two.git", "/repos/two.git"), "full queue should refuse repositories")
+}
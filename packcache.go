@@ -0,0 +1,169 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"os/exec"
+	"sync"
+)
+
+// maxCachedRequest bounds the size of upload-pack requests considered for
+// caching. Full clone requests only carry wants, so they are small.
+const maxCachedRequest = 1 << 20
+
+// PackCache caches, in up to maxBytes of memory, the upload-pack responses to
+// full clones: requests without haves, shallow or filter lines. Repeated
+// clones of the same commits, as CI fleets do, are then served without
+// recomputing packs. The least recently used responses are evicted first,
+// responses larger than maxBytes are never cached, and the responses of a
+// repository are dropped when it is pushed to.
+func PackCache(maxBytes int64) Option {
+	return func(h *handler) {
+		h.packCache = &packCache{
+			max:         maxBytes,
+			lru:         list.New(),
+			entries:     make(map[string]*list.Element),
+			generations: make(map[string]uint64),
+		}
+	}
+}
+
+type packCacheEntry struct {
+	key  string
+	dir  string
+	data []byte
+}
+
+// packCache is a size-bounded LRU cache of upload-pack responses, keyed by
+// repository, Git environment and request.
+type packCache struct {
+	sync.Mutex
+	max         int64
+	size        int64
+	lru         *list.List
+	entries     map[string]*list.Element
+	generations map[string]uint64
+}
+
+func (c *packCache) get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el := c.entries[key]
+	if el == nil {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*packCacheEntry).data, true
+}
+
+func (c *packCache) generation(dir string) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.generations[dir]
+}
+
+// put caches data unless the repository in dir was invalidated since gen.
+func (c *packCache) put(key, dir string, gen uint64, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.generations[dir] != gen || int64(len(data)) > c.max {
+		return
+	}
+
+	if el := c.entries[key]; el != nil {
+		c.remove(el)
+	}
+
+	for c.size+int64(len(data)) > c.max {
+		c.remove(c.lru.Back())
+	}
+
+	c.entries[key] = c.lru.PushFront(&packCacheEntry{key: key, dir: dir, data: data})
+	c.size += int64(len(data))
+}
+
+// invalidate drops the responses of the repository in dir.
+func (c *packCache) invalidate(dir string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.generations[dir]++
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*packCacheEntry).dir == dir {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+func (c *packCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*packCacheEntry)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.data))
+}
+
+// readFullClone reads the upload-pack request in r as long as it looks like
+// a full clone. It returns the request read so far, whether it is a full
+// clone, and a reader yielding the whole request.
+func readFullClone(r io.Reader) ([]byte, bool, io.Reader) {
+	var buf bytes.Buffer
+	tee := io.TeeReader(io.LimitReader(r, maxCachedRequest), &buf)
+	rest := func() io.Reader {
+		return io.MultiReader(bytes.NewReader(buf.Bytes()), r)
+	}
+
+	wants := 0
+	for {
+		line, err := packetRead(tee)
+		if err != nil {
+			return nil, false, rest()
+		}
+		if line == nil {
+			break
+		}
+		if !bytes.HasPrefix(line, []byte("want ")) {
+			return nil, false, rest()
+		}
+		wants++
+	}
+
+	line, err := packetRead(tee)
+	if err != nil || wants == 0 || string(line) != "done\n" {
+		return nil, false, rest()
+	}
+	return buf.Bytes(), true, rest()
+}
+
+// cachedUploadPack serves full clones from the pack cache, running cmd and
+// caching its output on misses. Other requests are served as usual.
+func (h *handler) cachedUploadPack(w http.ResponseWriter, req *http.Request, r io.Reader, cmd *exec.Cmd, repo *repository) error {
+	request, cacheable, r := readFullClone(r)
+	if !cacheable {
+		return h.execute(w, req, r, cmd, repo.name, nil)
+	}
+
+	key := refsCacheKey(cmd) + "\x00" + string(request)
+	if data, ok := h.packCache.get(key); ok {
+		h.logger.Debug("Serving cached pack", Field{"repo", repo.name}, Field{"bytes", len(data)})
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write(data)
+		return err
+	}
+
+	gen := h.packCache.generation(repo.dir)
+	cw := &captureWriter{ResponseWriter: w, max: int(h.packCache.max)}
+	err := h.execute(cw, req, r, cmd, repo.name, nil)
+	if err == nil && !cw.overflow {
+		h.packCache.put(key, repo.dir, gen, cw.buf.Bytes())
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestPackCache(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	log := &recordingLogger{}
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), PackCache(10<<20), WithLogger(log)))
+	defer ts.Close()
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	url := ts.URL + "/test.git"
+	dir := filepath.Join(workspace, "test")
+	cloneAndCommit(t, url, dir, "first")
+	git(t, dir, "push", "origin", "master")
+
+	clone := func(name, content string) {
+		git(t, workspace, "-c", "protocol.version=0", "clone", url, name)
+		data, err := ioutil.ReadFile(filepath.Join(workspace, name, "README.md"))
+		assert.Ok(t, err)
+		assert.Equals(t, content, string(data))
+	}
+
+	clone("clone1", "first")
+	clone("clone2", "first")
+	assert.Equals(t, 1, log.count("Serving cached pack"))
+
+	// Pushes drop the cached responses of the repository.
+	err = ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("second"), 0644)
+	assert.Ok(t, err)
+	git(t, dir, "commit", "-am", "second commit")
+	git(t, dir, "push", "origin", "master")
+
+	clone("clone3", "second")
+	assert.Equals(t, 1, log.count("Serving cached pack"))
+}
+
+func TestPackCacheEviction(t *testing.T) {
+	h := &handler{}
+	PackCache(10)(h)
+	c := h.packCache
+
+	c.put("a", "/repo", 0, []byte("12345"))
+	c.put("b", "/repo", 0, []byte("12345"))
+	_, ok := c.get("a")
+	assert.Cond(t, ok, "a should be cached")
+
+	// b is the least recently used entry.
+	c.put("c", "/repo", 0, []byte("123"))
+	_, ok = c.get("b")
+	assert.Cond(t, !ok, "b should have been evicted")
+	_, ok = c.get("a")
+	assert.Cond(t, ok, "a should still be cached")
+
+	c.put("d", "/repo", 0, []byte("12345678901"))
+	_, ok = c.get("d")
+	assert.Cond(t, !ok, "entries larger than the cache should not be cached")
+}
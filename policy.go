@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// denyNonFastForwards makes git-receive-pack refuse non-fast-forward
+// updates.
+const denyNonFastForwards = "receive.denynonfastforwards=true"
+
+// RefPolicy declares the ref updates pushes are allowed to make. Patterns
+// are matched against full ref names, such as refs/heads/main, using the
+// syntax of path.Match.
+type RefPolicy struct {
+	// Protected refs can be neither deleted nor force-pushed.
+	Protected []string
+	// FastForwardOnly refs can not be force-pushed, but can be deleted.
+	FastForwardOnly []string
+	// DenyTagDeletion rejects pushes deleting tags.
+	DenyTagDeletion bool
+	// RefName, if set, must match the names of the refs pushes create.
+	RefName *regexp.Regexp
+}
+
+// EnforceRefPolicy rejects pushes making ref updates the policy does not
+// allow, without having to write hooks. Force pushes are refused by Git
+// once it received the pushed objects; pushes updating any
+// FastForwardOnly or Protected refs can not force-push other refs either,
+// nor can any push over SSH if the policy has such refs.
+func EnforceRefPolicy(p RefPolicy) Option {
+	return func(h *handler) {
+		h.refPolicy = &p
+		PreReceive(p.check)(h)
+	}
+}
+
+// check implements ReceiveHook, rejecting pushes with updates the policy
+// does not allow.
+func (p *RefPolicy) check(r *http.Request, repo string, updates []RefUpdate) error {
+	for _, u := range updates {
+		switch {
+		case u.Deleted() && matchRef(p.Protected, u.Name):
+			return fmt.Errorf("%s is protected and can not be deleted", u.Name)
+		case u.Deleted() && p.DenyTagDeletion && strings.HasPrefix(u.Name, "refs/tags/"):
+			return fmt.Errorf("tags can not be deleted: %s", u.Name)
+		case u.Created() && p.RefName != nil && !p.RefName.MatchString(u.Name):
+			return fmt.Errorf("%s does not match the ref name pattern %s", u.Name, p.RefName)
+		}
+	}
+	return nil
+}
+
+// fastForwardOnly returns whether any of updates is limited to
+// fast-forwards, or whether the policy limits any refs if updates is nil.
+func (p *RefPolicy) fastForwardOnly(updates []RefUpdate) bool {
+	if updates == nil {
+		return len(p.Protected) > 0 || len(p.FastForwardOnly) > 0
+	}
+
+	for _, u := range updates {
+		if matchRef(p.Protected, u.Name) || matchRef(p.FastForwardOnly, u.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRef returns whether name matches any of patterns.
+func matchRef(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRefPolicyCheck(t *testing.T) {
+	p := &RefPolicy{
+		Protected:       []string{"refs/heads/main", "refs/heads/release/*"},
+		DenyTagDeletion: true,
+		RefName:         regexp.MustCompile(`^refs/(heads|tags)/[a-z0-9./-]+$`),
+	}
+	sha := "1111111111111111111111111111111111111111"
+
+	tests := []struct {
+		update  RefUpdate
+		allowed bool
+	}{
+		{RefUpdate{"refs/heads/main", sha, zeroSHA}, false},
+		{RefUpdate{"refs/heads/release/1.0", sha, zeroSHA}, false},
+		{RefUpdate{"refs/heads/feature", sha, zeroSHA}, true},
+		{RefUpdate{"refs/tags/v1.0", sha, zeroSHA}, false},
+		{RefUpdate{"refs/heads/Feature", zeroSHA, sha}, false},
+		{RefUpdate{"refs/heads/feature", zeroSHA, sha}, true},
+		{RefUpdate{"refs/heads/main", sha, sha}, true},
+	}
+
+	for _, tt := range tests {
+		err := p.check(nil, "test.git", []RefUpdate{tt.update})
+		assert.Cond(t, (err == nil) == tt.allowed, "%+v: unexpected result %v", tt.update, err)
+	}
+
+	assert.Cond(t, p.fastForwardOnly([]RefUpdate{{Name: "refs/heads/release/2.0"}}), "release branches are protected")
+	assert.Cond(t, !p.fastForwardOnly([]RefUpdate{{Name: "refs/heads/feature"}}), "feature branches are not protected")
+}
+
+func TestEnforceRefPolicy(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		EnforceRefPolicy(RefPolicy{Protected: []string{"refs/heads/master"}}),
+	))
+	defer ts.Close()
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	dir := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", dir, "hello")
+	git(t, dir, "push", "origin", "master", "master:feature")
+
+	// Rewriting history can not be pushed to master, but can to feature.
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("bye"), 0644))
+	git(t, dir, "commit", "-q", "--amend", "-am", "rewritten")
+
+	cmd := exec.Command("git", "push", "--force", "origin", "master")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "force push to master should fail:\n%s", out)
+
+	git(t, dir, "push", "--force", "origin", "master:feature")
+
+	cmd = exec.Command("git", "push", "origin", ":master")
+	cmd.Dir = dir
+	out, err = cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "deleting master should fail:\n%s", out)
+
+	git(t, dir, "push", "origin", ":feature")
+}
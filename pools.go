@@ -0,0 +1,215 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ObjectPools deduplicates the objects of related repositories, such as
+// forks, into pool repositories kept under root, apart from the
+// repositories. The first fork of a repository made through the admin API
+// creates a pool, which the repository and its forks then borrow objects
+// from, so repositories with forks can be deleted. After pushes to pool
+// members, the objects they got are fetched into their pool and dropped from
+// them, in the background. The admin API reports the disk space pools save.
+// Pools keep every object they ever got, and are never deleted.
+func ObjectPools(root string) Option {
+	return func(h *handler) {
+		h.poolsRoot = root
+	}
+}
+
+// poolOf returns the directory of the object pool the repository in dir
+// belongs to, if any.
+func (h *handler) poolOf(dir string) string {
+	if h.poolsRoot == "" {
+		return ""
+	}
+	root, err := filepath.Abs(h.poolsRoot)
+	if err != nil {
+		return ""
+	}
+
+	for _, objects := range alternates(dir) {
+		pool := filepath.Dir(filepath.Clean(objects))
+		if pool != root && within(root, pool) {
+			return pool
+		}
+	}
+	return ""
+}
+
+// poolID identifies the repository in dir within pools, whichever its name.
+func poolID(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	sum := sha256.Sum256([]byte(dir))
+	return hex.EncodeToString(sum[:10])
+}
+
+// joinPool makes the repository in dir a member of an object pool, creating
+// one for it if it is not a member yet, and returns the pool.
+func (h *handler) joinPool(name, dir string) (string, error) {
+	if pool := h.poolOf(dir); pool != "" {
+		return pool, nil
+	}
+
+	pool, err := filepath.Abs(filepath.Join(h.poolsRoot, poolID(dir)+".git"))
+	if err != nil {
+		return "", err
+	}
+	if !isBareRepo(pool) {
+		if err := h.createPool(pool); err != nil {
+			return "", err
+		}
+	}
+
+	if err := h.fetchIntoPool(pool, dir); err != nil {
+		return "", err
+	}
+
+	// Git looks objects up in every alternate listed.
+	f, err := os.OpenFile(filepath.Join(dir, "objects", "info", "alternates"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(filepath.Join(pool, "objects") + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	h.logger.Info("Repository joined object pool", Field{"repo", name}, Field{"pool", filepath.Base(pool)})
+	return pool, h.repackMember(dir)
+}
+
+// createPool creates an empty object pool in dir.
+func (h *handler) createPool(dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if _, _, err := runAndLog(h.logger, h.gitCommand("", "init", "--quiet", "--bare", tmp)); err != nil {
+		return err
+	}
+	if err := h.ownRepo(tmp); err != nil {
+		return err
+	}
+	if err := h.lendObjects(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+// fetchIntoPool fetches the refs of the member in dir into pool, under a
+// namespace of its own, along with the objects they point to.
+func (h *handler) fetchIntoPool(pool, dir string) error {
+	unlock, err := h.locks.lock(context.Background(), pool)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	refspec := "+refs/*:refs/members/" + poolID(dir) + "/*"
+	cmd := h.gitCommand(pool, "fetch", "--quiet", "--no-tags", "--prune", dir, refspec)
+	if _, _, err := runAndLog(h.logger, cmd); err != nil {
+		return err
+	}
+
+	// Members drop the objects they hold once packed in the pool, and gc
+	// eventually consolidates the packs.
+	for _, args := range [][]string{{"repack", "-d", "-q"}, {"gc", "--auto", "--quiet"}} {
+		cmd = h.gitCommand(pool, args...)
+		if _, _, err := runAndLog(h.logger, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repackMember drops the objects the member in dir finds in its pool.
+func (h *handler) repackMember(dir string) error {
+	unlock, err := h.locks.lock(context.Background(), dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cmd := h.gitCommand(dir, sharedRepackArgs(dir, []string{"repack", "-a", "-d", "-q"})...)
+	_, _, err = runAndLog(h.logger, cmd)
+	return err
+}
+
+// dedupAfterPush moves the objects a push brought to the repository name in
+// dir into its pool, in the background, if it belongs to one.
+func (h *handler) dedupAfterPush(name, dir string) {
+	if h.poolOf(dir) == "" {
+		return
+	}
+	go h.dedupRepo(name, dir)
+}
+
+// dedupRepo moves the objects of the repository name in dir its pool lacks
+// into the pool, unless the repository is being maintained.
+func (h *handler) dedupRepo(name, dir string) error {
+	pool := h.poolOf(dir)
+	if pool == "" {
+		return nil
+	}
+	if !h.maintenance.begin(dir) {
+		return ErrMaintenanceRunning
+	}
+	defer h.maintenance.end(dir)
+
+	err := h.fetchIntoPool(pool, dir)
+	if err == nil {
+		err = h.repackMember(dir)
+	}
+	if err != nil {
+		h.logger.Error("Deduplicating repository failed", Field{"repo", name}, Field{"pool", filepath.Base(pool)}, Field{"error", err})
+		return err
+	}
+
+	if h.quotas != nil {
+		h.quotas.invalidate(dir)
+	}
+	h.logger.Debug("Repository deduplicated", Field{"repo", name}, Field{"pool", filepath.Base(pool)})
+	return nil
+}
+
+// poolSavings returns the disk space the object pool in pool saves its
+// members, that is, its size for every member but one.
+func (h *handler) poolSavings(pool string) (int64, error) {
+	size, err := diskUsage(pool)
+	if err != nil {
+		return 0, err
+	}
+
+	var members int64
+	err = h.walkRepos(func(name, dir string) error {
+		if h.poolOf(dir) == pool {
+			members++
+		}
+		return nil
+	})
+	if err != nil || members < 2 {
+		return 0, err
+	}
+	return size * (members - 1), nil
+}
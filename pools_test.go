@@ -0,0 +1,110 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestObjectPools(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "app.git")
+
+	pools, err := ioutil.TempDir(os.TempDir(), "gitd-pools")
+	assert.Ok(t, err)
+	defer os.RemoveAll(pools)
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AdminAPI(), ObjectPools(pools)))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "app")
+	cloneAndCommit(t, ts.URL+"/app.git", clone, "blah")
+	git(t, clone, "push", "-q", "origin", "master")
+
+	res, err := http.Post(ts.URL+"/api/repos/app.git/fork", "application/json", strings.NewReader(`{"name": "alice/app.git"}`))
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusCreated, res.StatusCode)
+
+	// The parent and its fork both borrow their objects from the pool.
+	parent, fork := filepath.Join(rpath, "app.git"), filepath.Join(rpath, "alice", "app.git")
+	h := &handler{poolsRoot: pools}
+	pool := h.poolOf(parent)
+	assert.Cond(t, pool != "", "parent should belong to a pool")
+	assert.Equals(t, pool, h.poolOf(fork))
+	head := gitOutput(t, clone, "rev-parse", "HEAD")
+	assert.Equals(t, "commit", gitOutput(t, pool, "cat-file", "-t", head))
+	assert.Cond(t, !hasLocalObject(parent, head), "parent objects should have moved to the pool")
+
+	// Pushed objects move to the pool too.
+	git(t, clone, "commit", "-q", "--allow-empty", "-m", "fork only")
+	git(t, clone, "push", "-q", ts.URL+"/alice/app.git", "HEAD:master")
+	head = gitOutput(t, clone, "rev-parse", "HEAD")
+	for i := 0; i < 100 && hasLocalObject(fork, head); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Cond(t, !hasLocalObject(fork, head), "pushed objects should have moved to the pool")
+	assert.Equals(t, "commit", gitOutput(t, pool, "cat-file", "-t", head))
+
+	res, err = http.Get(ts.URL + "/api/repos/alice/app.git")
+	assert.Ok(t, err)
+	var info repoInfo
+	assert.Ok(t, json.NewDecoder(res.Body).Decode(&info))
+	res.Body.Close()
+	assert.Equals(t, filepath.Base(pool), info.Pool)
+	assert.Cond(t, info.PoolSavings > 0, "pool should save disk space")
+
+	// Forks do not depend on parents sharing a pool with them.
+	req, err := http.NewRequest("DELETE", ts.URL+"/api/repos/app.git", nil)
+	assert.Ok(t, err)
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusNoContent, res.StatusCode)
+
+	git(t, workspace, "clone", "-q", ts.URL+"/alice/app.git", filepath.Join(workspace, "fork"))
+	assert.Equals(t, head, gitOutput(t, filepath.Join(workspace, "fork"), "rev-parse", "HEAD"))
+}
+
+// hasLocalObject returns whether the repository in dir holds the object id
+// itself, rather than borrowing it.
+func hasLocalObject(dir, id string) bool {
+	if _, err := os.Stat(filepath.Join(dir, "objects", id[:2], id[2:])); err == nil {
+		return true
+	}
+
+	indexes, _ := filepath.Glob(filepath.Join(dir, "objects", "pack", "*.idx"))
+	for _, idx := range indexes {
+		f, err := os.Open(idx)
+		if err != nil {
+			continue
+		}
+		cmd := exec.Command("git", "show-index")
+		cmd.Stdin = f
+		out, _ := cmd.Output()
+		f.Close()
+		if strings.Contains(string(out), " "+id+" ") {
+			return true
+		}
+	}
+	return false
+}
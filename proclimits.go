@@ -0,0 +1,36 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"time"
+)
+
+// ProcessLimits bounds the resources Git processes can use, zero meaning no
+// limit.
+type ProcessLimits struct {
+	// CPUTime is the CPU time each process can use before being killed.
+	CPUTime time.Duration
+	// Memory is the address space each process can map, in bytes.
+	Memory int64
+	// OpenFiles is the number of files each process can have open.
+	OpenFiles int
+	// Cgroup is the directory of a cgroup processes are moved into, such as
+	// /sys/fs/cgroup/gitd.slice/git.scope, for the limits configured on it
+	// to apply to all of them together. It must exist and use cgroup v2.
+	Cgroup string
+}
+
+// LimitProcesses applies l to the Git processes serving fetches and pushes,
+// indexing pushed packs, and maintaining, mirroring and replicating
+// repositories, along with the processes they run, so a pathological pack
+// cannot take down the host. Processes that cannot be limited are killed.
+// Limits only apply on Linux, and not to the GoGit backend serving
+// in-process.
+func LimitProcesses(l ProcessLimits) Option {
+	return func(h *handler) {
+		h.procLimits = &l
+	}
+}
@@ -0,0 +1,50 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// apply limits the process p, which has just started, along with the
+// processes it runs from then on.
+func (l *ProcessLimits) apply(p *os.Process) error {
+	if l.Cgroup != "" {
+		procs := filepath.Join(l.Cgroup, "cgroup.procs")
+		if err := ioutil.WriteFile(procs, []byte(strconv.Itoa(p.Pid)), 0644); err != nil {
+			return err
+		}
+	}
+
+	if l.CPUTime > 0 {
+		// CPU time is limited in whole seconds.
+		secs := uint64((l.CPUTime + time.Second - 1) / time.Second)
+		if err := prlimit(p.Pid, unix.RLIMIT_CPU, secs); err != nil {
+			return err
+		}
+	}
+	if l.Memory > 0 {
+		if err := prlimit(p.Pid, unix.RLIMIT_AS, uint64(l.Memory)); err != nil {
+			return err
+		}
+	}
+	if l.OpenFiles > 0 {
+		if err := prlimit(p.Pid, unix.RLIMIT_NOFILE, uint64(l.OpenFiles)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prlimit sets both the soft and hard limit of resource of the process pid.
+func prlimit(pid, resource int, max uint64) error {
+	return unix.Prlimit(pid, resource, &unix.Rlimit{Cur: max, Max: max}, nil)
+}
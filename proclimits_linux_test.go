@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestProcessLimits(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	assert.Ok(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	l := &ProcessLimits{CPUTime: 1500 * time.Millisecond, Memory: 1 << 30, OpenFiles: 64}
+	assert.Ok(t, l.apply(cmd.Process))
+
+	limits, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(cmd.Process.Pid), "limits"))
+	assert.Ok(t, err)
+	for _, want := range []string{
+		`Max cpu time\s+2\s+2\s`,
+		`Max address space\s+1073741824\s+1073741824\s`,
+		`Max open files\s+64\s+64\s`,
+	} {
+		assert.Cond(t, regexp.MustCompile(want).Match(limits), "%s not found in limits: %s", want, limits)
+	}
+
+	// Processes cannot be moved to missing cgroups.
+	l = &ProcessLimits{Cgroup: "/nonexistent"}
+	assert.Cond(t, l.apply(cmd.Process) != nil, "moving to a missing cgroup should fail")
+}
+
+func TestLimitProcesses(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "repo.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		LimitProcesses(ProcessLimits{CPUTime: time.Minute, OpenFiles: 1024}),
+	))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "repo")
+	cloneAndCommit(t, ts.URL+"/repo.git", clone, "blah")
+	git(t, clone, "push", "origin", "master")
+
+	// Git fails to serve clients past its limits.
+	ts = httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		LimitProcesses(ProcessLimits{Cgroup: "/nonexistent"}),
+	))
+	defer ts.Close()
+
+	cmd := exec.Command("git", "clone", ts.URL+"/repo.git", filepath.Join(workspace, "failed"))
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "clone should fail: %s", out)
+}
@@ -0,0 +1,17 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux
+// +build !linux
+
+package gitd
+
+import (
+	"os"
+)
+
+// apply does nothing, as processes are only limited on Linux.
+func (l *ProcessLimits) apply(p *os.Process) error {
+	return nil
+}
@@ -0,0 +1,266 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxiedRequestHeaders are the request headers passed on to upstream
+// servers. Credentials of clients are not.
+var proxiedRequestHeaders = []string{"Accept", "Accept-Encoding", "Content-Encoding", "Content-Type", "Git-Protocol", "User-Agent"}
+
+// proxiedResponseHeaders are the response headers passed on to clients.
+var proxiedResponseHeaders = []string{"Cache-Control", "Content-Encoding", "Content-Type", "Expires", "Pragma", "Vary"}
+
+// Upstream describes a Smart HTTP server Git requests are proxied to.
+type Upstream struct {
+	// URL is the base URL of the server, such as https://gitlab.internal,
+	// to which the paths of requests are appended.
+	URL string
+	// Username and Password authenticate requests to the server.
+	Username string
+	Password string
+	// CacheTTL, if set, is how long the ref advertisements of fetches are
+	// cached, sparing the server from most of the requests of busy clients,
+	// such as CI fleets, at the cost of serving refs up to CacheTTL old.
+	CacheTTL time.Duration
+	// Transport makes requests to the server, http.DefaultTransport by
+	// default.
+	Transport http.RoundTripper
+}
+
+// Proxy proxies fetches and pushes to an upstream Smart HTTP server instead
+// of serving repositories from disk. Requests still go through the
+// configured authentication, authorization, rate and concurrency limits,
+// logging, metrics and audit log, so gitd can gate access to servers that
+// are not otherwise exposed. Only Git over HTTP is proxied; receive hooks,
+// push policies and the features serving repositories from disk do not
+// apply.
+func Proxy(upstream Upstream) Option {
+	return func(h *handler) {
+		if upstream.Transport == nil {
+			upstream.Transport = http.DefaultTransport
+		}
+		h.proxy = &proxy{
+			Upstream: upstream,
+			cache:    make(map[string]*proxiedResponse),
+		}
+	}
+}
+
+// proxiedResponse is a response of an upstream server.
+type proxiedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// proxy holds the upstream server and the advertisements cached from it.
+type proxy struct {
+	Upstream
+	sync.Mutex
+	cache map[string]*proxiedResponse
+}
+
+// cached returns the response cached for key, if still fresh.
+func (p *proxy) cached(key string) (*proxiedResponse, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	res, ok := p.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(res.expires) {
+		delete(p.cache, key)
+		return nil, false
+	}
+	return res, true
+}
+
+func (p *proxy) store(key string, res *proxiedResponse) {
+	p.Lock()
+	defer p.Unlock()
+
+	// Expired advertisements are dropped now and then, so repositories no
+	// longer fetched do not stay around.
+	now := time.Now()
+	for k, r := range p.cache {
+		if now.After(r.expires) {
+			delete(p.cache, k)
+		}
+	}
+	res.expires = now.Add(p.CacheTTL)
+	p.cache[key] = res
+}
+
+// proxyService returns the Git service of req, if it can be proxied.
+func proxyService(req *http.Request) (string, bool) {
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/info/refs"):
+		service := req.URL.Query().Get("service")
+		return service, service == "git-upload-pack" || service == "git-receive-pack"
+	case strings.HasSuffix(req.URL.Path, "/git-upload-pack"):
+		return "git-upload-pack", req.Method == "POST"
+	case strings.HasSuffix(req.URL.Path, "/git-receive-pack"):
+		return "git-receive-pack", req.Method == "POST"
+	}
+	return "", false
+}
+
+// serveProxy proxies req, an authorized Git request for repo, to the
+// upstream server.
+func (h *handler) serveProxy(w http.ResponseWriter, req *http.Request, repo string) {
+	logger := h.requestLogger(req)
+	p := h.proxy
+
+	service, ok := proxyService(req)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return
+	}
+
+	// Upstream paths are made of the repository name, already validated,
+	// and the service, as only those are proxied.
+	upstreamPath := "/" + repo + "/" + service
+	if req.Method == "GET" {
+		upstreamPath = "/" + repo + "/info/refs"
+	}
+
+	// Only fetch advertisements are cached, as pushes must see current refs.
+	var key string
+	if p.CacheTTL > 0 && req.Method == "GET" && service == "git-upload-pack" {
+		key = strings.Join([]string{upstreamPath, req.Header.Get("Git-Protocol"), req.Header.Get("Accept-Encoding")}, "\x00")
+		if res, ok := p.cached(key); ok {
+			writeProxied(w, res.status, res.header, bytes.NewReader(res.body))
+			return
+		}
+	}
+
+	if !h.limitRate(w, req, repo) {
+		return
+	}
+	if !h.acquireSlot(req.Context(), w) {
+		return
+	}
+	defer h.releaseSlot()
+
+	req, cancel := h.withTimeout(req, service)
+	defer cancel()
+
+	body := &countingReader{r: req.Body}
+	out, err := http.NewRequest(req.Method, strings.TrimSuffix(p.URL, "/")+upstreamPath, body)
+	if err != nil {
+		logger.Error("Creating upstream request failed", Field{"error", err})
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+	out = out.WithContext(req.Context())
+	out.URL.RawQuery = req.URL.RawQuery
+	out.ContentLength = req.ContentLength
+	for _, k := range proxiedRequestHeaders {
+		if v := req.Header.Get(k); v != "" {
+			out.Header.Set(k, v)
+		}
+	}
+	if p.Username != "" || p.Password != "" {
+		out.SetBasicAuth(p.Username, p.Password)
+	}
+
+	start := time.Now()
+	if h.metrics != nil {
+		h.metrics.started(service)
+	}
+
+	var sent int64
+	res, err := p.Transport.RoundTrip(out)
+	if err == nil {
+		defer res.Body.Close()
+
+		// Clients would be asked for credentials gitd does not pass on.
+		if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusProxyAuthRequired {
+			logger.Error("Upstream server rejected gitd credentials", Field{"repo", repo}, Field{"status", res.StatusCode})
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("Bad Gateway"))
+		} else if key != "" && res.StatusCode == http.StatusOK {
+			var buf bytes.Buffer
+			if _, err = io.Copy(&buf, res.Body); err == nil {
+				p.store(key, &proxiedResponse{status: res.StatusCode, header: res.Header, body: buf.Bytes()})
+				sent, err = writeProxied(w, res.StatusCode, res.Header, &buf)
+			}
+		} else {
+			sent, err = writeProxied(w, res.StatusCode, res.Header, res.Body)
+		}
+	} else {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("Bad Gateway"))
+	}
+
+	if h.metrics != nil {
+		h.metrics.finished(service, h.tenantName(repo), repo, remoteUser(req), time.Since(start), sent, body.count(), err)
+	}
+	if limiter := h.limiterFor(repo); limiter != nil {
+		limiter.charge(requestRateKey(req), sent+body.count(), time.Now())
+	}
+	if req.Method == "POST" && h.audit != nil {
+		e := newAuditEvent(req, repo, operation(req))
+		e.BytesSent, e.BytesReceived = sent, body.count()
+		h.recordAudit(e, err)
+	}
+
+	fields := []Field{
+		{"repo", repo},
+		{"service", service},
+		{"duration", time.Since(start)},
+		{"bytes", sent},
+	}
+	if err != nil {
+		logger.Error("Proxying request failed", append(fields, Field{"error", err})...)
+		return
+	}
+	logger.Debug("Request proxied", append(fields, Field{"status", res.StatusCode})...)
+}
+
+// writeProxied writes an upstream response, flushing as it goes so
+// progress reaches clients right away. It returns the bytes written.
+func writeProxied(w http.ResponseWriter, status int, header http.Header, body io.Reader) (int64, error) {
+	for _, k := range proxiedResponseHeaders {
+		if v := header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+	w.WriteHeader(status)
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
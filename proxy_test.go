@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestProxy(t *testing.T) {
+	upstreamPath, err := ioutil.TempDir(os.TempDir(), "gitd-upstream")
+	assert.Ok(t, err)
+	defer os.RemoveAll(upstreamPath)
+	initBareRepo(t, upstreamPath, "test.git")
+	initBareRepo(t, upstreamPath, "private.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	var advertisements int32
+	gitlab := Handler(http.NotFoundHandler(),
+		ReposPath(upstreamPath),
+		BasicAuth("gitlab", func(user, pass string) bool {
+			return user == "proxy" && pass == "secret"
+		}),
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("service") == "git-upload-pack" {
+			atomic.AddInt32(&advertisements, 1)
+		}
+		gitlab.ServeHTTP(w, req)
+	}))
+	defer upstream.Close()
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		Proxy(Upstream{URL: upstream.URL, Username: "proxy", Password: "secret", CacheTTL: time.Minute}),
+		AuthorizeRepo(func(user, repo string, op Operation) bool {
+			return repo != "private.git"
+		}),
+	))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "-q", "origin", "master")
+	assert.Equals(t, gitOutput(t, clone, "rev-parse", "HEAD"), gitOutput(t, filepath.Join(upstreamPath, "test.git"), "rev-parse", "master"))
+
+	// Protocol v2 advertisements only have capabilities and are cached.
+	git(t, clone, "-c", "protocol.version=2", "ls-remote", "origin")
+	git(t, clone, "-c", "protocol.version=2", "fetch", "-q", "origin")
+	assert.Equals(t, int32(1), atomic.LoadInt32(&advertisements))
+
+	get := func(server, path string) int {
+		res, err := http.Get(server + path)
+		assert.Ok(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equals(t, http.StatusForbidden, get(ts.URL, "/private.git/info/refs?service=git-upload-pack"))
+	assert.Equals(t, http.StatusNotFound, get(ts.URL, "/test.git/HEAD"))
+
+	// Paths traversing out of authorized repositories never reach upstream.
+	advertised := atomic.LoadInt32(&advertisements)
+	assert.Equals(t, http.StatusBadRequest, get(ts.URL, "/test.git/../private.git/info/refs?service=git-upload-pack"))
+	assert.Equals(t, advertised, atomic.LoadInt32(&advertisements))
+
+	// Upstreams rejecting gitd credentials are reported as such.
+	bad := httptest.NewServer(Handler(http.NotFoundHandler(), Proxy(Upstream{URL: upstream.URL, Username: "proxy"})))
+	defer bad.Close()
+	assert.Equals(t, http.StatusBadGateway, get(bad.URL, "/test.git/info/refs?service=git-upload-pack"))
+}
@@ -0,0 +1,262 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PushResult is the outcome of a push, as git-receive-pack reports it to
+// the client.
+type PushResult struct {
+	// UnpackError is why the pack sent could not be unpacked, if it could
+	// not, in which case no ref was updated.
+	UnpackError string `json:"unpack_error,omitempty"`
+	// Refs holds the outcome of every ref update requested.
+	Refs []RefResult `json:"refs"`
+}
+
+// RefResult is the outcome of a ref update requested by a push.
+type RefResult struct {
+	RefUpdate
+	OK bool `json:"ok"`
+	// Reason is why Git rejected the update, such as "non-fast-forward".
+	Reason string `json:"reason,omitempty"`
+}
+
+// Accepted returns the ref updates Git applied.
+func (r *PushResult) Accepted() []RefUpdate {
+	var updates []RefUpdate
+	for _, ref := range r.Refs {
+		if ref.OK {
+			updates = append(updates, ref.RefUpdate)
+		}
+	}
+	return updates
+}
+
+// Rejected returns the ref updates Git refused to apply.
+func (r *PushResult) Rejected() []RefResult {
+	var refs []RefResult
+	for _, ref := range r.Refs {
+		if !ref.OK {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// pushResultKey is the context key under which the result of a push is
+// stored.
+type pushResultKey struct{}
+
+// PushReport returns the result of r, a request passed to a post-receive
+// ReceiveHook, if the client asked Git to report it, as clients do unless
+// they are very old.
+func PushReport(r *http.Request) (*PushResult, bool) {
+	result, ok := r.Context().Value(pushResultKey{}).(*PushResult)
+	return result, ok
+}
+
+// withPushResult returns req carrying result, if there is any.
+func withPushResult(req *http.Request, result *PushResult) *http.Request {
+	if result == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), pushResultKey{}, result))
+}
+
+// reportParser reads the report-status of git-receive-pack out of its
+// output as it is written to the client. The report may be multiplexed
+// into sideband packets, and, in sessions, follows the ref advertisement.
+type reportParser struct {
+	// skip is the number of flush-terminated sections, such as the ref
+	// advertisement, preceding the report.
+	skip     int
+	sniffed  bool
+	sideband bool
+	buf      []byte
+	report   []byte
+	lines    []string
+	done     bool
+	failed   bool
+}
+
+// errMalformedPacket is returned by splitPacket for data that is not made
+// of packets.
+var errMalformedPacket = errors.New("malformed packet")
+
+// splitPacket returns the payload of the packet buf starts with, nil for
+// flush packets, and its size, which is 0 if buf does not hold it whole.
+func splitPacket(buf []byte) ([]byte, int, error) {
+	if len(buf) < 4 {
+		return nil, 0, nil
+	}
+	n, err := strconv.ParseUint(string(buf[:4]), 16, 16)
+	if err != nil || n > 0 && n < 4 {
+		return nil, 0, errMalformedPacket
+	}
+	if n == 0 {
+		return nil, 4, nil
+	}
+	if len(buf) < int(n) {
+		return nil, 0, nil
+	}
+	return buf[4:n], int(n), nil
+}
+
+func (p *reportParser) Write(b []byte) (int, error) {
+	if p.done {
+		return len(b), nil
+	}
+
+	p.buf = append(p.buf, b...)
+	for !p.done {
+		pkt, n, err := splitPacket(p.buf)
+		if err != nil {
+			p.fail()
+			break
+		}
+		if n == 0 {
+			break
+		}
+		p.buf = p.buf[n:]
+
+		if p.skip > 0 {
+			if pkt == nil {
+				p.skip--
+			}
+			continue
+		}
+
+		// Reports start with an unpack status, sideband packets with their
+		// band.
+		if !p.sniffed && pkt != nil {
+			p.sniffed = true
+			p.sideband = pkt[0] >= 1 && pkt[0] <= 3
+		}
+
+		switch {
+		case !p.sideband:
+			p.line(pkt)
+		case pkt == nil:
+			p.done = true
+		case pkt[0] == 1:
+			p.demux(pkt[1:])
+		}
+	}
+
+	if p.done {
+		p.buf, p.report = nil, nil
+	}
+	return len(b), nil
+}
+
+// demux parses the report carried by sideband packets.
+func (p *reportParser) demux(b []byte) {
+	p.report = append(p.report, b...)
+	for !p.done {
+		pkt, n, err := splitPacket(p.report)
+		if err != nil {
+			p.fail()
+			return
+		}
+		if n == 0 {
+			return
+		}
+		p.report = p.report[n:]
+		p.line(pkt)
+	}
+}
+
+// line records a line of the report, which ends with a flush packet.
+func (p *reportParser) line(pkt []byte) {
+	if pkt == nil {
+		p.done = true
+		return
+	}
+	p.lines = append(p.lines, strings.TrimSuffix(string(pkt), "\n"))
+}
+
+func (p *reportParser) fail() {
+	p.done, p.failed = true, true
+}
+
+// result returns the result reported for updates, or nil if Git did not
+// report it in full.
+func (p *reportParser) result(updates []RefUpdate) *PushResult {
+	if !p.done || p.failed || len(p.lines) == 0 || !strings.HasPrefix(p.lines[0], "unpack ") {
+		return nil
+	}
+
+	requested := make(map[string]RefUpdate, len(updates))
+	for _, u := range updates {
+		requested[u.Name] = u
+	}
+
+	result := new(PushResult)
+	if status := strings.TrimPrefix(p.lines[0], "unpack "); status != "ok" {
+		result.UnpackError = status
+	}
+
+	for _, line := range p.lines[1:] {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 2 {
+			return nil
+		}
+
+		ref := RefResult{RefUpdate: requested[fields[1]]}
+		ref.Name = fields[1]
+		switch fields[0] {
+		case "ok":
+			ref.OK = true
+		case "ng":
+			if len(fields) == 3 {
+				ref.Reason = fields[2]
+			}
+		default:
+			// Such as the options report-status-v2 reports refs with.
+			continue
+		}
+		result.Refs = append(result.Refs, ref)
+	}
+	return result
+}
+
+// reportingResponseWriter parses the report of git-receive-pack out of the
+// output it passes through.
+type reportingResponseWriter struct {
+	http.ResponseWriter
+	report *reportParser
+}
+
+func (w *reportingResponseWriter) Write(p []byte) (int, error) {
+	w.report.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush flushes the underlying writer, if it supports it.
+func (w *reportingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logPushResult logs the ref updates Git rejected.
+func logPushResult(logger Logger, repo string, result *PushResult) {
+	if result == nil {
+		return
+	}
+	if result.UnpackError != "" {
+		logger.Info("Unpacking push failed", Field{"repo", repo}, Field{"error", result.UnpackError})
+	}
+	for _, ref := range result.Rejected() {
+		logger.Info("Ref update rejected", Field{"repo", repo}, Field{"ref", ref.Name}, Field{"reason", ref.Reason})
+	}
+}
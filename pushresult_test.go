@@ -0,0 +1,128 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestReportParser(t *testing.T) {
+	updates := []RefUpdate{
+		{Name: "refs/heads/master", OldSHA: zeroSHA, NewSHA: "1111111111111111111111111111111111111111"},
+		{Name: "refs/heads/blocked", OldSHA: zeroSHA, NewSHA: "2222222222222222222222222222222222222222"},
+	}
+
+	var report bytes.Buffer
+	report.Write(packetWrite("unpack ok\n"))
+	report.Write(packetWrite("ok refs/heads/master\n"))
+	report.Write(packetWrite("option forced-update\n"))
+	report.Write(packetWrite("ng refs/heads/blocked hook declined\n"))
+	report.Write(packetFlush())
+
+	var muxed bytes.Buffer
+	sidebandWrite(&muxed, 2, []byte("progress\n"), 995)
+	sidebandWrite(&muxed, 1, report.Bytes()[:10], 995)
+	sidebandWrite(&muxed, 1, report.Bytes()[10:], 995)
+	muxed.Write(packetFlush())
+
+	var advertised bytes.Buffer
+	advertised.Write(packetWrite(zeroSHA + " capabilities^{}\x00report-status\n"))
+	advertised.Write(packetFlush())
+	advertised.Write(report.Bytes())
+
+	tests := []struct {
+		name   string
+		parser *reportParser
+		output []byte
+	}{
+		{"plain", new(reportParser), report.Bytes()},
+		{"sideband", new(reportParser), muxed.Bytes()},
+		{"session", &reportParser{skip: 1}, advertised.Bytes()},
+	}
+
+	for _, tt := range tests {
+		// Output is written in pieces of any size.
+		for _, b := range tt.output {
+			tt.parser.Write([]byte{b})
+		}
+
+		result := tt.parser.result(updates)
+		assert.Cond(t, result != nil, "%s: report should have been parsed", tt.name)
+		assert.Equals(t, "", result.UnpackError)
+		assert.Equals(t, []RefUpdate{updates[0]}, result.Accepted())
+		assert.Equals(t, []RefResult{{RefUpdate: updates[1], Reason: "hook declined"}}, result.Rejected())
+	}
+
+	partial := new(reportParser)
+	partial.Write(report.Bytes()[:20])
+	assert.Cond(t, partial.result(updates) == nil, "incomplete reports should not be parsed")
+
+	pack := new(reportParser)
+	pack.Write([]byte("PACK\x00\x00\x00\x02"))
+	pack.Write(report.Bytes())
+	assert.Cond(t, pack.result(updates) == nil, "output other than packets should not be parsed")
+}
+
+func TestPushReport(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	// Git itself declines updates of the blocked branch.
+	hook := filepath.Join(rpath, "test.git", "hooks", "update")
+	assert.Ok(t, ioutil.WriteFile(hook, []byte("#!/bin/sh\ntest \"$1\" != refs/heads/blocked\n"), 0755))
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	var received []RefUpdate
+	var result *PushResult
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		PostReceive(func(r *http.Request, repo string, updates []RefUpdate) error {
+			received = updates
+			result, _ = PushReport(r)
+			return nil
+		}),
+	))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+
+	cmd := exec.Command("git", "push", "origin", "HEAD:refs/heads/master", "HEAD:refs/heads/blocked")
+	cmd.Dir = clone
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "push to the blocked branch should fail: %s", out)
+
+	assert.Equals(t, 1, len(received))
+	assert.Equals(t, "refs/heads/master", received[0].Name)
+	assert.Cond(t, result != nil, "push result should have been reported")
+	assert.Equals(t, 2, len(result.Refs))
+	rejected := result.Rejected()
+	assert.Equals(t, 1, len(rejected))
+	assert.Equals(t, "refs/heads/blocked", rejected[0].Name)
+	assert.Equals(t, "hook declined", rejected[0].Reason)
+	assert.Equals(t, gitOutput(t, clone, "rev-parse", "HEAD"), rejected[0].NewSHA)
+
+	// Nothing is run for pushes Git rejected entirely.
+	received = nil
+	cmd = exec.Command("git", "push", "origin", "HEAD:refs/heads/blocked")
+	cmd.Dir = clone
+	_, err = cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "push to the blocked branch should fail")
+	assert.Equals(t, 0, len(received))
+}
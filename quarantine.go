@@ -0,0 +1,237 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// inspectsPacks returns whether the packs of pushes are set aside and
+// inspected before handing them over to Git.
+func (h *handler) inspectsPacks() bool {
+	return h.quotas != nil || h.commitSigs != nil
+}
+
+// inspectPack sets aside the pack following cmds in a push to the repository
+// name in dir, making sure it fits in the repository quota and brings signed
+// commits, as configured. It returns a reader yielding the push again for
+// Git, and a function discarding the pack once Git is done with it.
+func (h *handler) inspectPack(name, dir string, cmds *commandList) (io.Reader, func(), error) {
+	body := io.MultiReader(bytes.NewReader(cmds.raw), cmds.rest)
+	var wants []string
+	for _, u := range cmds.updates {
+		if !u.Deleted() {
+			wants = append(wants, u.NewSHA)
+		}
+	}
+
+	// Clients only send packs for pushes updating or creating refs.
+	if len(wants) == 0 {
+		return body, func() {}, nil
+	}
+
+	max, limit, used, err := h.pushRoom(name, dir)
+	if err != nil {
+		return body, func() {}, err
+	}
+
+	q, err := h.newQuarantine(dir)
+	if err != nil {
+		return body, func() {}, err
+	}
+
+	// Whatever was read of the pack is handed over to Git regardless.
+	err = q.receive(cmds, max)
+	body = io.MultiReader(bytes.NewReader(cmds.raw), q.reader(), cmds.rest)
+	switch {
+	case err == errQuotaExceeded:
+		return body, q.remove, quotaError(limit, used)
+	case err != nil:
+		return body, q.remove, err
+	}
+
+	if h.commitSigs != nil {
+		err = h.verifySignatures(q, wants)
+	}
+	return body, q.remove, err
+}
+
+// quarantine holds a pack set aside from a push in a temporary object
+// directory of the repository, which Git can look into without the
+// repository seeing its objects.
+type quarantine struct {
+	h       *handler
+	repo    string
+	objects string
+	path    string
+	pack    *os.File
+	size    int64
+}
+
+func (h *handler) newQuarantine(repo string) (*quarantine, error) {
+	objects, err := filepath.Abs(filepath.Join(repo, "objects"))
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := ioutil.TempDir(objects, "gitd-quarantine-")
+	if err != nil {
+		return nil, err
+	}
+
+	pack, err := os.Create(filepath.Join(path, "incoming.pack"))
+	if err != nil {
+		os.RemoveAll(path)
+		return nil, err
+	}
+	return &quarantine{h: h, repo: repo, objects: objects, path: path, pack: pack}, nil
+}
+
+// receive copies the pack following cmds, failing with errQuotaExceeded
+// once it is larger than max bytes, if positive.
+func (q *quarantine) receive(cmds *commandList, max int64) error {
+	hashSize := 20
+	if cmds.hasCapability("object-format=sha256") {
+		hashSize = 32
+	}
+
+	cw := &countingWriter{w: q.pack}
+	var w io.Writer = cw
+	if max > 0 {
+		w = &quotaWriter{w: cw, n: max}
+	}
+	bw := bufio.NewWriter(w)
+
+	err := copyPack(cmds.rest, bw, hashSize)
+	if e := bw.Flush(); err == nil {
+		err = e
+	}
+	q.size = cw.n
+	return err
+}
+
+// reader returns a reader yielding the pack.
+func (q *quarantine) reader() io.Reader {
+	return io.NewSectionReader(q.pack, 0, q.size)
+}
+
+// env returns the environment for Git commands to see the objects of the
+// pack once indexed.
+func (q *quarantine) env() []string {
+	return append(os.Environ(),
+		"GIT_OBJECT_DIRECTORY="+q.path,
+		"GIT_ALTERNATE_OBJECT_DIRECTORIES="+q.objects,
+	)
+}
+
+// index indexes the pack, for Git commands to see its objects.
+func (q *quarantine) index() error {
+	if err := os.Mkdir(filepath.Join(q.path, "pack"), 0755); err != nil {
+		return err
+	}
+	if err := q.h.ownRepo(q.path); err != nil {
+		return err
+	}
+
+	cmd := q.h.gitCommand(q.repo, "index-pack", "--stdin", "--fix-thin")
+	cmd.Env = q.env()
+	if err := q.h.runCommand(q.h.logger, ioutil.Discard, q.reader(), cmd); err != nil {
+		return fmt.Errorf("indexing pack: %v", err)
+	}
+	return nil
+}
+
+// remove discards the quarantine.
+func (q *quarantine) remove() {
+	q.pack.Close()
+	os.RemoveAll(q.path)
+}
+
+// copyPack copies the pack r starts with to w, without reading any further,
+// so that packs can be set aside from clients still waiting for a response.
+func copyPack(r *bufio.Reader, w io.Writer, hashSize int) error {
+	tr := &teeByteReader{r: r, w: w}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(tr, header); err != nil {
+		return err
+	}
+	if string(header[:4]) != "PACK" {
+		return errors.New("malformed pack")
+	}
+
+	for n := binary.BigEndian.Uint32(header[8:]); n > 0; n-- {
+		// The object type and size, followed by the base of deltas.
+		c, err := tr.ReadByte()
+		if err != nil {
+			return err
+		}
+		kind := (c >> 4) & 7
+		for c&0x80 != 0 {
+			if c, err = tr.ReadByte(); err != nil {
+				return err
+			}
+		}
+
+		switch kind {
+		case 6: // OFS_DELTA
+			for c = 0x80; c&0x80 != 0; {
+				if c, err = tr.ReadByte(); err != nil {
+					return err
+				}
+			}
+		case 7: // REF_DELTA
+			if _, err := io.ReadFull(tr, make([]byte, hashSize)); err != nil {
+				return err
+			}
+		}
+
+		// Data is compressed, and the decompressor stops right at its end
+		// when it can read byte by byte.
+		zr, err := zlib.NewReader(tr)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, zr); err != nil {
+			return err
+		}
+		zr.Close()
+	}
+
+	_, err := io.ReadFull(tr, make([]byte, hashSize))
+	return err
+}
+
+// teeByteReader writes to w what is read from r.
+type teeByteReader struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+func (t *teeByteReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if _, werr := t.w.Write(p[:n]); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+func (t *teeByteReader) ReadByte() (byte, error) {
+	c, err := t.r.ReadByte()
+	if err != nil {
+		return c, err
+	}
+	_, err = t.w.Write([]byte{c})
+	return c, err
+}
@@ -0,0 +1,50 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestCopyPack(t *testing.T) {
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	dir := filepath.Join(workspace, "repo")
+	git(t, workspace, "init", "-q", "repo")
+	git(t, dir, "config", "user.name", "Gitd tests")
+	git(t, dir, "config", "user.email", "test@hooklift.io")
+	for _, content := range []string{"one", "two", "three"} {
+		assert.Ok(t, ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte(strings.Repeat(content, 100)), 0644))
+		git(t, dir, "add", "README.md")
+		git(t, dir, "commit", "-qm", content)
+	}
+
+	cmd := exec.Command("git", "pack-objects", "--stdout", "--revs", "--delta-base-offset")
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader("HEAD\n")
+	pack, err := cmd.Output()
+	assert.Ok(t, err)
+
+	var out bytes.Buffer
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(pack), strings.NewReader("trailing")))
+	assert.Ok(t, copyPack(r, &out, 20))
+	assert.Equals(t, pack, out.Bytes())
+
+	rest, err := ioutil.ReadAll(r)
+	assert.Ok(t, err)
+	assert.Equals(t, "trailing", string(rest))
+}
@@ -0,0 +1,183 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// quotaUsageTTL is how long the disk usage of repositories is cached, so
+// that changes made outside of pushes, such as garbage collection, are
+// eventually taken into account.
+const quotaUsageTTL = 5 * time.Minute
+
+// errQuotaExceeded is returned when a push does not fit in the quota of its
+// repository.
+var errQuotaExceeded = errors.New("repository quota exceeded")
+
+// RepoQuota limits the disk space each repository can take up to the bytes
+// limit returns for it, zero meaning no limit. Pushes that would exceed it
+// are rejected. The usage of repositories is shown by the admin API.
+func RepoQuota(limit func(repo string) int64) Option {
+	return func(h *handler) {
+		h.quotas = &quotas{limit: limit, usage: make(map[string]quotaUsage)}
+	}
+}
+
+type quotaUsage struct {
+	size    int64
+	expires time.Time
+}
+
+// quotas tracks the disk usage of repositories.
+type quotas struct {
+	sync.Mutex
+	limit func(repo string) int64
+	usage map[string]quotaUsage
+}
+
+// check returns the quota of the repository name in dir and its usage, or
+// quotaError if it is already exhausted.
+func (q *quotas) check(name, dir string) (limit, used int64, err error) {
+	limit = q.limit(name)
+	if limit <= 0 {
+		return 0, 0, nil
+	}
+
+	if used, err = q.used(dir); err != nil {
+		return limit, used, err
+	}
+	if used >= limit {
+		return limit, used, quotaError(limit, used)
+	}
+	return limit, used, nil
+}
+
+// used returns the disk usage of the repository in dir.
+func (q *quotas) used(dir string) (int64, error) {
+	q.Lock()
+	u, ok := q.usage[dir]
+	q.Unlock()
+	if ok && time.Now().Before(u.expires) {
+		return u.size, nil
+	}
+
+	size, err := diskUsage(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	q.Lock()
+	q.usage[dir] = quotaUsage{size: size, expires: time.Now().Add(quotaUsageTTL)}
+	q.Unlock()
+	return size, nil
+}
+
+// invalidate drops the usage of the repository in dir, once it changed,
+// along with that of the tenant roots holding it.
+func (q *quotas) invalidate(dir string) {
+	q.Lock()
+	defer q.Unlock()
+	for d := range q.usage {
+		if within(d, dir) {
+			delete(q.usage, d)
+		}
+	}
+}
+
+// pushRoom returns how many bytes a push to the repository name in dir can
+// take up, zero meaning no limit, along with the quota limiting it and its
+// usage, or quotaError if there is no room left.
+func (h *handler) pushRoom(name, dir string) (max, limit, used int64, err error) {
+	if h.quotas == nil {
+		return 0, 0, 0, nil
+	}
+	if limit, used, err = h.quotas.check(name, dir); err != nil {
+		return 0, limit, used, err
+	}
+	if limit > 0 {
+		max = limit - used
+	}
+
+	// Pushes fit in whichever quota has the least room left.
+	tlimit, tused, err := h.checkTenantQuota(name)
+	if err != nil {
+		return 0, tlimit, tused, err
+	}
+	if tlimit > 0 && (max == 0 || tlimit-tused < max) {
+		limit, used, max = tlimit, tused, tlimit-tused
+	}
+	return max, limit, used, nil
+}
+
+// repoUsage returns the disk usage of the repository in dir.
+func (h *handler) repoUsage(dir string) (int64, error) {
+	if h.quotas != nil {
+		return h.quotas.used(dir)
+	}
+	return diskUsage(dir)
+}
+
+// diskUsage returns the size of the files in dir.
+func diskUsage(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Git may remove temporary files at any time.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// quotaError describes a repository quota being exceeded to users.
+func quotaError(limit, used int64) error {
+	return fmt.Errorf("%v: push does not fit in the %s left of %s", errQuotaExceeded, formatBytes(limit-used), formatBytes(limit))
+}
+
+// formatBytes formats n bytes using binary units, such as "1.5 MiB".
+func formatBytes(n int64) string {
+	if n < 0 {
+		n = 0
+	}
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value, unit := float64(n)/1024, 0
+	for value >= 1024 && unit < 4 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[unit])
+}
+
+// quotaWriter fails with errQuotaExceeded once more than n bytes are written.
+type quotaWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > q.n {
+		q.n = -1
+		return 0, errQuotaExceeded
+	}
+	q.n -= int64(len(p))
+	return q.w.Write(p)
+}
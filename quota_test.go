@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRepoQuota(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	empty, err := diskUsage(filepath.Join(rpath, "test.git"))
+	assert.Ok(t, err)
+	limit := empty + 32*1024
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		AdminAPI(),
+		RepoQuota(func(repo string) int64 {
+			if repo == "test.git" {
+				return limit
+			}
+			return 0
+		}),
+	))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "origin", "master")
+
+	// Random data does not compress, so the pack is larger than the quota.
+	data := make([]byte, 64*1024)
+	_, err = rand.Read(data)
+	assert.Ok(t, err)
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(clone, "blob"), data, 0644))
+	git(t, clone, "add", "blob")
+	git(t, clone, "commit", "-qm", "large")
+
+	cmd := exec.Command("git", "push", "origin", "master")
+	cmd.Dir = clone
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "push exceeding the quota should fail")
+	assert.Cond(t, strings.Contains(string(out), "repository quota exceeded"), "unexpected output: %s", out)
+
+	matches, err := filepath.Glob(filepath.Join(rpath, "test.git", "objects", "gitd-quarantine-*"))
+	assert.Ok(t, err)
+	assert.Equals(t, 0, len(matches))
+
+	res, err := http.Get(ts.URL + "/api/repos/test.git")
+	assert.Ok(t, err)
+	var info repoInfo
+	assert.Ok(t, json.NewDecoder(res.Body).Decode(&info))
+	res.Body.Close()
+	assert.Equals(t, "test.git", info.Name)
+	assert.Equals(t, limit, info.Quota)
+	assert.Cond(t, info.Size > empty && info.Size < limit, "unexpected usage: %d", info.Size)
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equals(t, "512 B", formatBytes(512))
+	assert.Equals(t, "1.5 KiB", formatBytes(1536))
+	assert.Equals(t, "2.0 GiB", formatBytes(2<<30))
+}
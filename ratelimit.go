@@ -0,0 +1,203 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errRateLimited is returned when a client exceeded its rate limit.
+var errRateLimited = errors.New("rate limit exceeded")
+
+// RateLimit caps how many Git operations each client can run per minute,
+// and how many bytes it can transfer per minute, zero meaning no limit.
+// Authenticated clients are limited by identity, anonymous ones by IP
+// address. Clients over their limit get a 429 with a Retry-After header
+// before any Git process starts.
+//
+// Operations are counted as Git processes run: over smart HTTP, fetches and
+// pushes run at least two, one of which advertises refs. Bytes are counted
+// once operations end, so a single large transfer can exceed the limit,
+// delaying the next operations of the client accordingly.
+func RateLimit(opsPerMinute int, bytesPerMinute int64) Option {
+	return func(h *handler) {
+		h.rateLimiter = &rateLimiter{
+			ops:     float64(opsPerMinute),
+			bytes:   float64(bytesPerMinute),
+			clients: make(map[string]*rateBuckets),
+		}
+	}
+}
+
+// tokenBucket holds tokens refilling at a rate of its capacity per minute.
+// Its level can go negative, once more was taken than available.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated since the bucket was last refilled.
+func (b *tokenBucket) refill(capacity float64, now time.Time) {
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Minutes()*capacity)
+	b.last = now
+}
+
+// wait returns how long it takes for the bucket to hold n tokens.
+func (b *tokenBucket) wait(capacity, n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / capacity * float64(time.Minute))
+}
+
+// rateBuckets holds the token buckets of a client.
+type rateBuckets struct {
+	ops   tokenBucket
+	bytes tokenBucket
+}
+
+// rateLimiter limits the rate of Git operations clients run.
+type rateLimiter struct {
+	sync.Mutex
+	ops       float64
+	bytes     float64
+	clients   map[string]*rateBuckets
+	lastSweep time.Time
+}
+
+// allow takes a token for an operation of the client key, returning how
+// long it has to wait if it exceeded its limit.
+func (l *rateLimiter) allow(key string, now time.Time) (time.Duration, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.sweep(now)
+	b := l.buckets(key, now)
+
+	var wait time.Duration
+	if l.ops > 0 {
+		wait = b.ops.wait(l.ops, 1)
+	}
+	// Bytes are only known afterwards, so clients can run operations for
+	// as long as they have not gone over.
+	if l.bytes > 0 {
+		if w := b.bytes.wait(l.bytes, 0); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return wait, false
+	}
+
+	b.ops.tokens--
+	return 0, true
+}
+
+// charge takes n bytes transferred by the client key from its bucket.
+func (l *rateLimiter) charge(key string, n int64, now time.Time) {
+	if l.bytes <= 0 {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.buckets(key, now).bytes.tokens -= float64(n)
+}
+
+// buckets returns the buckets of the client key, refilled as of now.
+func (l *rateLimiter) buckets(key string, now time.Time) *rateBuckets {
+	b, ok := l.clients[key]
+	if !ok {
+		b = &rateBuckets{
+			ops:   tokenBucket{tokens: l.ops, last: now},
+			bytes: tokenBucket{tokens: l.bytes, last: now},
+		}
+		l.clients[key] = b
+	}
+	b.ops.refill(l.ops, now)
+	b.bytes.refill(l.bytes, now)
+	return b
+}
+
+// sweep forgets clients whose buckets are full again, at most once a
+// minute, so that they do not accumulate.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.clients {
+		b.ops.refill(l.ops, now)
+		b.bytes.refill(l.bytes, now)
+		if b.ops.tokens >= l.ops && b.bytes.tokens >= l.bytes {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// rateKey returns the key clients are rate limited by: their identity, or
+// their IP address if anonymous.
+func rateKey(identity, remoteAddr string) string {
+	if identity != "" {
+		return "user:" + identity
+	}
+	return "ip:" + remoteIP(remoteAddr)
+}
+
+// requestRateKey returns the key the client making req is rate limited by.
+// Only identities verified by an authenticator count, since clients could
+// otherwise send a different user name with every request to dodge limits.
+func requestRateKey(req *http.Request) string {
+	identity, _ := IdentityFromContext(req.Context())
+	return rateKey(identity, req.RemoteAddr)
+}
+
+// remoteIP returns the IP address of the client at remoteAddr.
+func remoteIP(remoteAddr string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return ip
+}
+
+// limitRate takes a token for an operation of the client making req on
+// repo. It writes a 429 response and returns false if the client is over its
+// limit.
+func (h *handler) limitRate(w http.ResponseWriter, req *http.Request, repo string) bool {
+	limiter := h.limiterFor(repo)
+	if limiter == nil {
+		return true
+	}
+
+	key := requestRateKey(req)
+	wait, ok := limiter.allow(key, time.Now())
+	if ok {
+		return true
+	}
+
+	h.requestLogger(req).Warn("Rate limit exceeded", Field{"client", key}, Field{"retry", wait})
+	w.Header().Del("Content-Type")
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter(wait)))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("Too Many Requests"))
+	return false
+}
+
+// retryAfter returns the seconds to wait for d to elapse, at least one.
+func retryAfter(d time.Duration) int {
+	s := int(math.Ceil(d.Seconds()))
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), RateLimit(2, 0)))
+	defer ts.Close()
+
+	for i := 0; i < 2; i++ {
+		res, err := http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+		assert.Ok(t, err)
+		res.Body.Close()
+		assert.Equals(t, http.StatusOK, res.StatusCode)
+	}
+
+	res, err := http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equals(t, "30", res.Header.Get("Retry-After"))
+}
+
+func TestRateLimitUnverifiedUsers(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), RateLimit(2, 0)))
+	defer ts.Close()
+
+	// Without an authenticator, user names are not verified, so clients
+	// rotating them are still limited by their address.
+	var statuses []int
+	for _, user := range []string{"alice", "bob", "carol"} {
+		req, err := http.NewRequest("GET", ts.URL+"/test.git/info/refs?service=git-upload-pack", nil)
+		assert.Ok(t, err)
+		req.SetBasicAuth(user, "secret")
+		res, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		res.Body.Close()
+		statuses = append(statuses, res.StatusCode)
+	}
+	assert.Equals(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, statuses)
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{ops: 60, bytes: 1000, clients: make(map[string]*rateBuckets)}
+	now := time.Now()
+
+	_, ok := l.allow("ip:10.0.0.1", now)
+	assert.Cond(t, ok, "first operation should be allowed")
+
+	// Going over the bytes limit holds further operations back, for as
+	// long as it takes to refill what was exceeded.
+	l.charge("ip:10.0.0.1", 1500, now)
+	wait, ok := l.allow("ip:10.0.0.1", now)
+	assert.Cond(t, !ok, "operation over the bytes limit should be denied")
+	assert.Equals(t, 30*time.Second, wait)
+
+	_, ok = l.allow("ip:10.0.0.2", now)
+	assert.Cond(t, ok, "other clients should not be limited")
+
+	_, ok = l.allow("ip:10.0.0.1", now.Add(30*time.Second))
+	assert.Cond(t, ok, "operation should be allowed once refilled")
+
+	// Clients back to full buckets are forgotten.
+	l.sweep(now.Add(10 * time.Minute))
+	assert.Equals(t, 0, len(l.clients))
+
+	assert.Equals(t, "user:alice", rateKey("alice", "10.0.0.1:1234"))
+	assert.Equals(t, "ip:10.0.0.1", rateKey("", "10.0.0.1:1234"))
+}
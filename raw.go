@@ -0,0 +1,142 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// rawPath matches raw file downloads after the repository path, capturing
+// the ref followed by the file path.
+const rawPath = `/raw/(?P<path>.+/.+)`
+
+// RawFiles serves the contents of files at /{repo}/raw/{ref}/{path}, so that
+// single files, such as configuration, can be fetched without cloning. Files
+// larger than maxSize bytes are refused, unless it is zero. Responses have the
+// blob id as ETag.
+func RawFiles(maxSize int64) Option {
+	return func(h *handler) {
+		h.rawFiles = true
+		h.maxRawSize = maxSize
+	}
+}
+
+// objectInfo describes a Git object, as reported by git cat-file
+// --batch-check.
+type objectInfo struct {
+	id   string
+	kind string
+	size int64
+}
+
+// rawFile serves the contents of a file of repo.
+func (h *handler) rawFile(w http.ResponseWriter, req *http.Request, repo *repository) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method Not Allowed"))
+		return
+	}
+
+	rest := PathParams(req.Context())["path"]
+	if namespaced(repo.env) || strings.ContainsAny(rest, "\x00\r\n") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return
+	}
+
+	file, blob, err := h.findObject(req, repo, rest)
+	if err != nil {
+		h.logger.Error("Looking up file failed", Field{"repo", repo.name}, Field{"error", err})
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal Server Error"))
+		return
+	}
+	if blob == nil || blob.kind != "blob" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return
+	}
+
+	if h.maxRawSize > 0 && blob.size > h.maxRawSize {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("File exceeds the maximum size"))
+		return
+	}
+
+	etag := `"` + blob.id + `"`
+	headers := w.Header()
+	headers.Set("ETag", etag)
+	noCache(w)
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Files are not meant to be rendered by browsers, which must not
+	// guess a different content type either.
+	if contentType := mime.TypeByExtension(path.Ext(file)); contentType != "" {
+		headers.Set("Content-Type", contentType)
+	}
+	headers.Set("X-Content-Type-Options", "nosniff")
+	headers.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	headers.Set("Content-Length", strconv.FormatInt(blob.size, 10))
+	if req.Method == "HEAD" || blob.size == 0 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// The content type of other files is sniffed by net/http.
+	cmd := h.gitCommandContext(req.Context(), repo.dir, "cat-file", "blob", blob.id)
+	cmd.Env = append(os.Environ(), repo.env...)
+	h.execute(w, req, strings.NewReader(""), cmd, repo.name, nil)
+}
+
+// findObject finds the object rest, a ref followed by a path, refers to,
+// returning its path. Refs can have slashes, so rest is split at each of
+// them until an object is found, shortest refs first, the root tree of rest
+// as a whole coming last. Objects of hidden refs are not found.
+func (h *handler) findObject(req *http.Request, repo *repository, rest string) (string, *objectInfo, error) {
+	parts := strings.Split(rest, "/")
+	var names []string
+	for i := 1; i <= len(parts); i++ {
+		names = append(names, strings.Join(parts[:i], "/")+":"+strings.Join(parts[i:], "/"))
+	}
+
+	cmd := h.gitCommandContext(req.Context(), repo.dir, "cat-file", "--batch-check")
+	cmd.Env = append(os.Environ(), repo.env...)
+	cmd.Stdin = strings.NewReader(strings.Join(names, "\n") + "\n")
+	out, _, err := runAndLog(h.logger, cmd)
+	if err != nil {
+		return "", nil, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	for i, line := range lines {
+		// <id> <type> <size>, or <name> missing, where names can have
+		// spaces.
+		fields := strings.Fields(line)
+		if len(fields) != 3 || i >= len(names) || strings.HasSuffix(line, " missing") || strings.HasSuffix(line, " ambiguous") {
+			continue
+		}
+
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("unexpected cat-file output: %q", line)
+		}
+		sep := strings.Index(names[i], ":")
+		if h.revHidden(req.Context(), repo, names[i][:sep]) {
+			return "", nil, nil
+		}
+		file := names[i][sep+1:]
+		return file, &objectInfo{id: fields[0], kind: fields[1], size: size}, nil
+	}
+	return "", nil, nil
+}
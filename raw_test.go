@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRawFiles(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), RawFiles(1024)))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	assert.Ok(t, os.MkdirAll(filepath.Join(clone, "conf"), 0755))
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(clone, "conf", "app.json"), []byte(`{"debug": true}`), 0644))
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(clone, "conf", "big file"), []byte(strings.Repeat("x", 2048)), 0644))
+	git(t, clone, "add", "conf")
+	git(t, clone, "commit", "-qm", "conf")
+	git(t, clone, "push", "origin", "master", "master:feature/x")
+
+	get := func(p string) (*http.Response, string) {
+		res, err := http.Get(ts.URL + p)
+		assert.Ok(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Ok(t, err)
+		return res, string(body)
+	}
+
+	res, body := get("/test.git/raw/feature/x/conf/app.json")
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+	assert.Equals(t, `{"debug": true}`, body)
+	assert.Equals(t, "application/json", res.Header.Get("Content-Type"))
+	assert.Equals(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+
+	res, body = get("/test.git/raw/master/README.md")
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+	assert.Equals(t, "blah", body)
+	assert.Cond(t, strings.HasPrefix(res.Header.Get("Content-Type"), "text/"), "unexpected content type: %s", res.Header.Get("Content-Type"))
+
+	req, err := http.NewRequest("GET", ts.URL+"/test.git/raw/master/README.md", nil)
+	assert.Ok(t, err)
+	req.Header.Set("If-None-Match", res.Header.Get("ETag"))
+	res, err = http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusNotModified, res.StatusCode)
+
+	res, _ = get("/test.git/raw/master/conf/big%20file")
+	assert.Equals(t, http.StatusForbidden, res.StatusCode)
+
+	for _, p := range []string{"/test.git/raw/master/missing", "/test.git/raw/master/conf", "/test.git/raw/missing/README.md"} {
+		res, _ = get(p)
+		assert.Equals(t, http.StatusNotFound, res.StatusCode)
+	}
+}
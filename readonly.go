@@ -0,0 +1,134 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// readOnlyFile marks repositories as read-only. It holds the reason given
+// to clients, if any.
+const readOnlyFile = ".readonly"
+
+// ReadOnly rejects pushes to every repository while still serving fetches,
+// telling clients reason, if given, as during migrations or maintenance
+// windows. Read-only mode can also be switched through the admin API.
+func ReadOnly(reason string) Option {
+	return func(h *handler) {
+		h.readOnly.set(true, reason)
+	}
+}
+
+// readOnlyMode is the server-wide read-only switch.
+type readOnlyMode struct {
+	sync.RWMutex
+	enabled bool
+	reason  string
+}
+
+func (m *readOnlyMode) set(enabled bool, reason string) {
+	m.Lock()
+	defer m.Unlock()
+	m.enabled = enabled
+	m.reason = reason
+}
+
+func (m *readOnlyMode) get() (bool, string) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.enabled, m.reason
+}
+
+// readOnly returns whether the repository in dir is read-only, along with
+// the reason, if any.
+func readOnly(dir string) (bool, string) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, readOnlyFile))
+	if err != nil {
+		return false, ""
+	}
+	return true, strings.TrimSpace(string(data))
+}
+
+// readOnlyError describes why pushes are rejected to clients.
+func readOnlyError(what, reason string) error {
+	if reason == "" {
+		return fmt.Errorf("%s is read-only", what)
+	}
+	return fmt.Errorf("%s is read-only: %s", what, reason)
+}
+
+// readOnlyRequest is the body of requests making repositories, or the
+// server, read-only.
+type readOnlyRequest struct {
+	Reason string `json:"reason"`
+}
+
+// decodeReadOnly reads the optional body of requests making repositories,
+// or the server, read-only.
+func decodeReadOnly(w http.ResponseWriter, req *http.Request) (readOnlyRequest, bool) {
+	var ro readOnlyRequest
+	if err := json.NewDecoder(req.Body).Decode(&ro); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return ro, false
+	}
+	if strings.ContainsAny(ro.Reason, "\r\n") {
+		writeError(w, http.StatusBadRequest, "invalid reason")
+		return ro, false
+	}
+	return ro, true
+}
+
+// setRepoReadOnly makes a bare repository read-only, or writable again.
+func (h *handler) setRepoReadOnly(w http.ResponseWriter, req *http.Request, name string, enabled bool) {
+	dir, ok := h.locateRepo(w, req, name)
+	if !ok {
+		return
+	}
+
+	var ro readOnlyRequest
+	if enabled {
+		if ro, ok = decodeReadOnly(w, req); !ok {
+			return
+		}
+	}
+
+	var err error
+	if enabled {
+		err = ioutil.WriteFile(filepath.Join(dir, readOnlyFile), []byte(ro.Reason+"\n"), 0644)
+	} else if err = os.Remove(filepath.Join(dir, readOnlyFile)); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		h.logger.Error("Switching repository read-only mode failed", Field{"repo", name}, Field{"read_only", enabled}, Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to switch read-only mode")
+		return
+	}
+
+	h.logger.Info("Repository read-only mode switched", Field{"repo", name}, Field{"read_only", enabled}, Field{"user", remoteUser(req)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setServerReadOnly switches the server-wide read-only mode.
+func (h *handler) setServerReadOnly(w http.ResponseWriter, req *http.Request, enabled bool) {
+	var ro readOnlyRequest
+	if enabled {
+		var ok bool
+		if ro, ok = decodeReadOnly(w, req); !ok {
+			return
+		}
+	}
+
+	h.readOnly.set(enabled, ro.Reason)
+	h.logger.Info("Server read-only mode switched", Field{"read_only", enabled}, Field{"user", remoteUser(req)})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,102 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestReadOnly(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AdminAPI(), ReadOnly("migrating")))
+	defer ts.Close()
+
+	post := func(p, body string) int {
+		res, err := http.Post(ts.URL+p, "application/json", strings.NewReader(body))
+		assert.Ok(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	push := func(clone string) (string, error) {
+		cmd := exec.Command("git", "push", "origin", "master")
+		cmd.Dir = clone
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	status := func() (bool, string) {
+		res, err := http.Get(ts.URL + "/api/server")
+		assert.Ok(t, err)
+		defer res.Body.Close()
+		var s serverStatus
+		assert.Ok(t, json.NewDecoder(res.Body).Decode(&s))
+		return s.ReadOnly, s.ReadOnlyReason
+	}
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	out, err := push(clone)
+	assert.Cond(t, err != nil, "pushes to read-only servers should fail")
+	assert.Cond(t, strings.Contains(out, "server is read-only: migrating"), "unexpected push output: %s", out)
+	readOnly, reason := status()
+	assert.Cond(t, readOnly, "server should be described as read-only")
+	assert.Equals(t, "migrating", reason)
+
+	assert.Equals(t, http.StatusNoContent, post("/api/server/writable", ""))
+	readOnly, _ = status()
+	assert.Cond(t, !readOnly, "server should no longer be read-only")
+	git(t, clone, "push", "-q", "origin", "master")
+
+	// Repositories are made read-only one by one.
+	assert.Equals(t, http.StatusNoContent, post("/api/repos/test.git/readonly", `{"reason": "moving to new storage"}`))
+	data, err := ioutil.ReadFile(filepath.Join(rpath, "test.git", readOnlyFile))
+	assert.Ok(t, err)
+	assert.Equals(t, "moving to new storage\n", string(data))
+
+	res, err := http.Get(ts.URL + "/api/repos/test.git")
+	assert.Ok(t, err)
+	var info repoInfo
+	assert.Ok(t, json.NewDecoder(res.Body).Decode(&info))
+	res.Body.Close()
+	assert.Cond(t, info.ReadOnly, "repository should be described as read-only")
+
+	// Read-only repositories can still be fetched.
+	git(t, workspace, "clone", "-q", ts.URL+"/test.git", filepath.Join(workspace, "fetched"))
+	git(t, clone, "commit", "--allow-empty", "-qm", "second")
+	out, err = push(clone)
+	assert.Cond(t, err != nil, "pushes to read-only repositories should fail")
+	assert.Cond(t, strings.Contains(out, "repository test.git is read-only: moving to new storage"), "unexpected push output: %s", out)
+
+	assert.Equals(t, http.StatusNoContent, post("/api/repos/test.git/writable", ""))
+	git(t, clone, "push", "-q", "origin", "master")
+
+	// Creating the file by hand works just as well.
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(rpath, "test.git", readOnlyFile), nil, 0644))
+	git(t, clone, "commit", "--allow-empty", "-qm", "third")
+	out, err = push(clone)
+	assert.Cond(t, err != nil, "pushes to read-only repositories should fail")
+	assert.Cond(t, strings.Contains(out, "repository test.git is read-only"), "unexpected push output: %s", out)
+
+	assert.Equals(t, http.StatusBadRequest, post("/api/server/readonly", "{"))
+	assert.Equals(t, http.StatusNotFound, post("/api/repos/missing.git/readonly", ""))
+	assert.Equals(t, http.StatusNotFound, post("/api/server/unknown", ""))
+}
@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ReadThroughCache serves repositories as mirrors of those of upstream with
+// the same names, cloning them on their first fetch. Afterwards, ref
+// advertisements older than upstream.CacheTTL sync repositories with
+// upstream before being served, keeping them fresh, while the rest of
+// fetches are served from disk. Like other mirrors, cached repositories are
+// read-only and can be synced on demand through the admin API. Every
+// repository under the repositories root is considered a cached one.
+// Upstream servers are fetched from by Git itself, so upstream.Transport is
+// not used.
+func ReadThroughCache(upstream Upstream) Option {
+	return func(h *handler) {
+		if h.mirrors == nil {
+			h.mirrors = newMirrorSet()
+		}
+		h.readThrough = &upstream
+	}
+}
+
+// serveCached makes sure the cached repository name is ready to be fetched
+// by req, writing a 404 response and returning false if it cannot be
+// cloned from upstream.
+func (h *handler) serveCached(w http.ResponseWriter, req *http.Request, name string) bool {
+	if !h.cacheRepo(name, strings.HasSuffix(req.URL.Path, "/info/refs")) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return false
+	}
+	return true
+}
+
+// cacheRepo makes sure the cached repository name is ready to be fetched,
+// cloning it from upstream if needed, returning false if it cannot be.
+// Stale repositories are synced if refresh is set.
+func (h *handler) cacheRepo(name string, refresh bool) bool {
+	if !validRepoName(name) {
+		return false
+	}
+
+	u := h.readThrough
+	h.mirrors.add(Mirror{
+		Repo:     name,
+		URL:      strings.TrimSuffix(u.URL, "/") + "/" + name,
+		Username: u.Username,
+		Password: u.Password,
+	})
+
+	dir, err := h.storage.Dir(context.Background(), name)
+	if err != nil {
+		h.logger.Error("Locating cached repository failed", Field{"repo", name}, Field{"error", err})
+		return false
+	}
+	cached := isBareRepo(dir)
+	if cached && (!refresh || time.Since(h.mirrors.lastSync(name)) < u.CacheTTL) {
+		return true
+	}
+
+	switch err := h.syncMirror(name); {
+	case err == errSyncRunning && !cached:
+		// Another fetch is cloning the repository.
+		h.mirrors.wait(name)
+	case err != nil && cached:
+		h.logger.Warn("Serving stale cached repository", Field{"repo", name}, Field{"error", err})
+	}
+
+	if !isBareRepo(dir) {
+		// Repositories missing upstream are not kept around as mirrors.
+		h.mirrors.remove(name)
+		return false
+	}
+	return true
+}
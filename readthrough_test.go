@@ -0,0 +1,77 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestReadThroughCache(t *testing.T) {
+	upstreamPath, err := ioutil.TempDir(os.TempDir(), "gitd-upstream")
+	assert.Ok(t, err)
+	defer os.RemoveAll(upstreamPath)
+	initBareRepo(t, upstreamPath, "org/test.git")
+
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	upstream := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(upstreamPath),
+		BasicAuth("github", func(user, pass string) bool {
+			return user == "cache" && pass == "secret"
+		}),
+	))
+	defer upstream.Close()
+
+	source := filepath.Join(workspace, "source")
+	cloneAndCommit(t, filepath.Join(upstreamPath, "org/test.git"), source, "blah")
+	git(t, source, "push", "-q", "origin", "master")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		ReadThroughCache(Upstream{URL: upstream.URL, Username: "cache", Password: "secret"}),
+	))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "clone")
+	git(t, workspace, "clone", "-q", ts.URL+"/org/test.git", clone)
+	assert.Equals(t, gitOutput(t, source, "rev-parse", "HEAD"), gitOutput(t, clone, "rev-parse", "HEAD"))
+	assert.Cond(t, isBareRepo(filepath.Join(rpath, "org/test.git")), "repository should be cached")
+
+	// Stale repositories are refreshed.
+	git(t, source, "commit", "--allow-empty", "-qm", "second")
+	git(t, source, "push", "-q", "origin", "master")
+	git(t, clone, "pull", "-q")
+	assert.Equals(t, gitOutput(t, source, "rev-parse", "HEAD"), gitOutput(t, clone, "rev-parse", "HEAD"))
+
+	// Cached repositories are read-only.
+	git(t, clone, "config", "--local", "user.name", "Gitd tests")
+	git(t, clone, "config", "--local", "user.email", "test@hooklift.io")
+	git(t, clone, "commit", "--allow-empty", "-qm", "local")
+	cmd := exec.Command("git", "push", "origin", "master")
+	cmd.Dir = clone
+	assert.Cond(t, cmd.Run() != nil, "pushes to cached repositories should be rejected")
+
+	// Repositories missing upstream are not left behind.
+	cmd = exec.Command("git", "clone", "-q", ts.URL+"/org/missing.git", filepath.Join(workspace, "missing"))
+	assert.Cond(t, cmd.Run() != nil, "cloning a repository missing upstream should fail")
+	entries, err := ioutil.ReadDir(filepath.Join(rpath, "org"))
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(entries))
+	assert.Equals(t, "test.git", entries[0].Name())
+}
@@ -0,0 +1,158 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Redirects answers requests for the repositories named as keys of table
+// with 301 responses pointing to the repositories named as their values,
+// which Git clients follow, as if they had been moved. SSH and git://
+// clients are served the new repositories directly.
+func Redirects(table map[string]string) Option {
+	return func(h *handler) {
+		for from, to := range table {
+			h.redirects.add(from, to)
+		}
+	}
+}
+
+// RedirectsFile keeps the redirects left by repositories moved through the
+// admin API in file, as a JSON object mapping old names to new ones, so they
+// survive restarts. Redirects in file are loaded on startup.
+func RedirectsFile(file string) Option {
+	return func(h *handler) {
+		h.redirects.file = file
+	}
+}
+
+// redirects maps the old names of moved repositories to their new ones.
+type redirects struct {
+	sync.Mutex
+	to map[string]string
+	// file is where redirects are saved, if anywhere.
+	file string
+}
+
+// load adds the redirects saved in the redirects file, if any.
+func (r *redirects) load() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(r.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved map[string]string
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	for from, to := range saved {
+		r.set(from, to)
+	}
+	return nil
+}
+
+// save writes the redirects to the redirects file, if any, replacing it
+// atomically.
+func (r *redirects) save() error {
+	if r.file == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(r.to, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(r.file), "."+filepath.Base(r.file)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), r.file)
+}
+
+// add redirects the repository from to the repository to, saving the
+// redirects.
+func (r *redirects) add(from, to string) error {
+	r.Lock()
+	defer r.Unlock()
+	r.set(from, to)
+	return r.save()
+}
+
+// set redirects the repository from to the repository to, updating the
+// redirects to from so they do not chain.
+func (r *redirects) set(from, to string) {
+	if r.to == nil {
+		r.to = make(map[string]string)
+	}
+	for old, target := range r.to {
+		if target == from {
+			r.to[old] = to
+		}
+	}
+	delete(r.to, to)
+	r.to[from] = to
+}
+
+// remove removes the redirect of the repository name, if any, saving the
+// redirects.
+func (r *redirects) remove(name string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.to[name]; !ok {
+		return nil
+	}
+	delete(r.to, name)
+	return r.save()
+}
+
+// lookup returns where the repository name was moved to, if it was.
+func (r *redirects) lookup(name string) (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+	to, ok := r.to[name]
+	return to, ok
+}
+
+// redirect sends a 301 response to the new location of the repository repo,
+// if it was moved, returning whether it did.
+func (h *handler) redirect(w http.ResponseWriter, req *http.Request, repo string) bool {
+	to, ok := h.redirects.lookup(repo)
+	if !ok {
+		return false
+	}
+
+	u := *req.URL
+	u.Path = urlPrefix(req) + "/" + to + strings.TrimPrefix(req.URL.Path, "/"+repo)
+	http.Redirect(w, req, u.String(), http.StatusMovedPermanently)
+	return true
+}
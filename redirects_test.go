@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRedirects(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+	initBareRepo(t, rpath, "new/configured.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+	file := filepath.Join(workspace, "redirects.json")
+
+	newServer := func() *httptest.Server {
+		return httptest.NewServer(Handler(http.NotFoundHandler(),
+			ReposPath(rpath),
+			AdminAPI(),
+			Redirects(map[string]string{"old/configured.git": "new/configured.git"}),
+			RedirectsFile(file),
+		))
+	}
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	location := func(ts *httptest.Server, p string) string {
+		res, err := noRedirects.Get(ts.URL + p)
+		assert.Ok(t, err)
+		res.Body.Close()
+		if res.StatusCode != http.StatusMovedPermanently {
+			return ""
+		}
+		return res.Header.Get("Location")
+	}
+
+	ts := newServer()
+	assert.Equals(t, "/new/configured.git/info/refs?service=git-upload-pack", location(ts, "/old/configured.git/info/refs?service=git-upload-pack"))
+
+	res, err := http.Post(ts.URL+"/api/repos/test.git/move", "application/json", strings.NewReader(`{"name": "moved.git", "redirect": true}`))
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+	ts.Close()
+
+	// Redirects left by moves survive restarts.
+	ts = newServer()
+	defer ts.Close()
+	assert.Equals(t, "/moved.git/git-upload-pack", location(ts, "/test.git/git-upload-pack"))
+	data, err := ioutil.ReadFile(file)
+	assert.Ok(t, err)
+	assert.Cond(t, strings.Contains(string(data), `"test.git": "moved.git"`), "unexpected redirects file: %s", data)
+
+	// Creating a repository with an old name drops its redirect.
+	res, err = http.Post(ts.URL+"/api/repos", "application/json", strings.NewReader(`{"name": "test.git"}`))
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusCreated, res.StatusCode)
+	assert.Equals(t, "", location(ts, "/test.git/info/refs?service=git-upload-pack"))
+}
@@ -0,0 +1,171 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RefsCache caches ref advertisements in memory for up to ttl, sparing a Git
+// process for every info/refs request. Entries are invalidated as soon as a
+// push through the handler completes or packed-refs changes; refs updated by
+// other means are picked up once entries expire.
+func RefsCache(ttl time.Duration) Option {
+	return func(h *handler) {
+		h.refsCache = &refsCache{
+			ttl:         ttl,
+			entries:     make(map[string]*refsCacheEntry),
+			generations: make(map[string]uint64),
+		}
+	}
+}
+
+type refsCacheEntry struct {
+	dir     string
+	data    []byte
+	packed  string
+	expires time.Time
+}
+
+// refsCache holds ref advertisements by service, repository and Git
+// environment, which carries the protocol version and namespace.
+type refsCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]*refsCacheEntry
+	// generations counts the invalidations of each repository, so that
+	// advertisements generated while a push was completing are not cached.
+	generations map[string]uint64
+}
+
+// refsCacheKey returns the cache key of the advertisement cmd produces.
+func refsCacheKey(cmd *exec.Cmd) string {
+	key := []string{cmd.Args[0], cmd.Dir}
+	for _, v := range cmd.Env {
+		if strings.HasPrefix(v, "GIT_") {
+			key = append(key, v)
+		}
+	}
+	return strings.Join(key, "\x00")
+}
+
+// packedRefsState identifies the current contents of the packed-refs file of
+// the repository in dir.
+func packedRefsState(dir string) string {
+	fi, err := os.Stat(filepath.Join(dir, "packed-refs"))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+func (c *refsCache) get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e := c.entries[key]
+	if e == nil {
+		return nil, false
+	}
+
+	if time.Now().After(e.expires) || packedRefsState(e.dir) != e.packed {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.data, true
+}
+
+func (c *refsCache) generation(dir string) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.generations[dir]
+}
+
+// put caches data unless the repository in dir was invalidated since gen.
+func (c *refsCache) put(key, dir string, gen uint64, packed string, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.generations[dir] != gen {
+		return
+	}
+
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = &refsCacheEntry{
+		dir:     dir,
+		data:    data,
+		packed:  packed,
+		expires: now.Add(c.ttl),
+	}
+}
+
+// invalidate drops the advertisements of the repository in dir.
+func (c *refsCache) invalidate(dir string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.generations[dir]++
+	for k, e := range c.entries {
+		if e.dir == dir {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// cachedAdvertisement serves the advertisement cmd produces from the refs
+// cache, running cmd and caching its output on misses.
+func (h *handler) cachedAdvertisement(w http.ResponseWriter, req *http.Request, r io.Reader, cmd *exec.Cmd, repo *repository, preamble []byte) {
+	key := refsCacheKey(cmd)
+	if data, ok := h.refsCache.get(key); ok {
+		h.logger.Debug("Serving cached advertisement", Field{"repo", repo.name}, Field{"service", cmd.Args[0]})
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	}
+
+	gen := h.refsCache.generation(repo.dir)
+	packed := packedRefsState(repo.dir)
+
+	cw := &captureWriter{ResponseWriter: w}
+	if err := h.execute(cw, req, r, cmd, repo.name, preamble); err == nil {
+		h.refsCache.put(key, repo.dir, gen, packed, cw.buf.Bytes())
+	}
+}
+
+// captureWriter keeps a copy of the response body written through it. If max
+// is positive, it gives up copying bodies larger than max bytes.
+type captureWriter struct {
+	http.ResponseWriter
+	buf      bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	switch {
+	case c.overflow:
+	case c.max > 0 && c.buf.Len()+len(p) > c.max:
+		c.overflow = true
+		c.buf = bytes.Buffer{}
+	default:
+		c.buf.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
@@ -0,0 +1,105 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRefsCache(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	log := &recordingLogger{}
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), RefsCache(time.Minute), WithLogger(log)))
+	defer ts.Close()
+
+	advertise := func() string {
+		res, err := http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+		assert.Ok(t, err)
+		defer res.Body.Close()
+		assert.Equals(t, http.StatusOK, res.StatusCode)
+
+		body, err := ioutil.ReadAll(res.Body)
+		assert.Ok(t, err)
+		return string(body)
+	}
+
+	empty := advertise()
+	assert.Equals(t, empty, advertise())
+	assert.Equals(t, 1, log.count("Serving cached advertisement"))
+
+	// Pushes invalidate the cached advertisement.
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	dir := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", dir, "cached")
+	git(t, dir, "push", "origin", "master")
+
+	refs := advertise()
+	assert.Cond(t, strings.Contains(refs, "refs/heads/master"), "stale advertisement: %q", refs)
+	assert.Equals(t, refs, advertise())
+}
+
+func TestRefsCacheRecreatedRepos(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), RefsCache(time.Minute), AdminAPI()))
+	defer ts.Close()
+
+	advertise := func() string {
+		res, err := http.Get(ts.URL + "/test.git/info/refs?service=git-upload-pack")
+		assert.Ok(t, err)
+		defer res.Body.Close()
+		assert.Equals(t, http.StatusOK, res.StatusCode)
+
+		body, err := ioutil.ReadAll(res.Body)
+		assert.Ok(t, err)
+		return string(body)
+	}
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	dir := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", dir, "deleted")
+	git(t, dir, "push", "origin", "master")
+	refs := advertise()
+	assert.Cond(t, strings.Contains(refs, "refs/heads/master"), "stale advertisement: %q", refs)
+
+	// Repositories created in place of deleted ones do not inherit their
+	// cached advertisements.
+	req, err := http.NewRequest("DELETE", ts.URL+"/api/repos/test.git", nil)
+	assert.Ok(t, err)
+	res, err := http.DefaultClient.Do(req)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusNoContent, res.StatusCode)
+
+	res, err = http.Post(ts.URL+"/api/repos", "application/json", strings.NewReader(`{"name": "test.git"}`))
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusCreated, res.StatusCode)
+
+	refs = advertise()
+	assert.Cond(t, !strings.Contains(refs, "refs/heads/master"), "stale advertisement: %q", refs)
+}
@@ -0,0 +1,166 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// replicationQueueSize is how many repositories can wait to be
+	// replicated to each replica.
+	replicationQueueSize = 1024
+	// replicationAttempts is how many times replicating a repository is
+	// attempted before giving up until its next push.
+	replicationAttempts = 5
+)
+
+// replicationBackoff is how long the first retry of a failed replication
+// waits, doubling for every attempt.
+var replicationBackoff = time.Second
+
+// replicationRefspecs are the refs pushed to replicas.
+var replicationRefspecs = []string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"}
+
+// Replica describes a server repositories are replicated to.
+type Replica struct {
+	// URL is the base URL of the replica, such as
+	// https://standby.example.com, to which the names of repositories are
+	// appended.
+	URL string
+	// Username and Password authenticate pushes to HTTP(S) replicas.
+	Username string
+	Password string
+	// SSHKey is the path of the private key authenticating pushes to SSH
+	// replicas.
+	SSHKey string
+}
+
+// Replicas replicates repositories to the given replicas after successful
+// pushes, in the background, so standby servers stay in sync. Branches and
+// tags are force pushed, deleting those deleted locally, and failed
+// replications are retried a few times with exponential backoff. Replicas
+// must create missing repositories on push, as gitd does with AutoInitRepos.
+// Repositories in Git namespaces are not replicated.
+func Replicas(replicas ...Replica) Option {
+	return func(h *handler) {
+		h.replicas = nil
+		for _, r := range replicas {
+			h.replicas = append(h.replicas, &replicaQueue{
+				Replica: r,
+				queued:  make(map[string]bool),
+				jobs:    make(chan replicationJob, replicationQueueSize),
+			})
+		}
+	}
+}
+
+type replicationJob struct {
+	name string
+	dir  string
+}
+
+// replicaQueue holds the repositories waiting to be replicated to a replica.
+type replicaQueue struct {
+	Replica
+	sync.Mutex
+	queued map[string]bool
+	jobs   chan replicationJob
+}
+
+// start starts the worker replicating repositories to the replica, which
+// stops along with scheduled maintenance.
+func (q *replicaQueue) start(h *handler) {
+	go func() {
+		for {
+			select {
+			case job := <-q.jobs:
+				q.Lock()
+				delete(q.queued, job.dir)
+				q.Unlock()
+				h.replicateRepo(q.Replica, job.name, job.dir)
+			case <-h.maintenance.stop:
+				return
+			}
+		}
+	}()
+}
+
+// enqueue queues the repository name in dir for replication, unless it
+// already is.
+func (q *replicaQueue) enqueue(name, dir string) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.queued[dir] {
+		return true
+	}
+
+	select {
+	case q.jobs <- replicationJob{name: name, dir: dir}:
+		q.queued[dir] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// replicate queues repo for replication to every replica, if any.
+func (h *handler) replicate(repo *repository) {
+	if len(h.replicas) == 0 || namespaced(repo.env) {
+		return
+	}
+	for _, q := range h.replicas {
+		if !q.enqueue(repo.name, repo.dir) {
+			h.logger.Warn("Too many repositories waiting to be replicated", Field{"repo", repo.name}, Field{"replica", q.URL})
+			h.recordReplication(repo.name, q.URL, "dropped")
+		}
+	}
+}
+
+// replicateRepo pushes the refs of the repository name in dir to replica,
+// retrying on failure.
+func (h *handler) replicateRepo(replica Replica, name, dir string) {
+	url := strings.TrimSuffix(replica.URL, "/") + "/" + name
+	backoff := replicationBackoff
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		cmd := h.gitCommand(dir, append([]string{"push", "--quiet", "--prune", url}, replicationRefspecs...)...)
+		cmd.Env = remoteEnv(replica.Username, replica.Password, replica.SSHKey)
+		err := h.runCommand(h.logger, ioutil.Discard, strings.NewReader(""), cmd)
+		if err == nil {
+			h.recordReplication(name, replica.URL, "success")
+			h.logger.Debug("Repository replicated", Field{"repo", name}, Field{"replica", replica.URL}, Field{"duration", time.Since(start)})
+			return
+		}
+
+		if attempt == replicationAttempts {
+			h.recordReplication(name, replica.URL, "failure")
+			h.logger.Error("Replicating repository failed", Field{"repo", name}, Field{"replica", replica.URL}, Field{"attempts", attempt}, Field{"error", err})
+			return
+		}
+
+		h.recordReplication(name, replica.URL, "retry")
+		h.logger.Warn("Replicating repository failed, retrying", Field{"repo", name}, Field{"replica", replica.URL}, Field{"retry_in", backoff}, Field{"error", err})
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-h.maintenance.stop:
+			return
+		}
+	}
+}
+
+// recordReplication records the outcome of replicating repo to replica, if
+// metrics are enabled.
+func (h *handler) recordReplication(repo, replica, result string) {
+	if h.metrics != nil {
+		h.metrics.replicated(repo, replica, result)
+	}
+}
@@ -0,0 +1,105 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	for deadline := time.Now().Add(10 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	defer func(d time.Duration) { replicationBackoff = d }(replicationBackoff)
+	replicationBackoff = time.Millisecond
+
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	standbyPath, err := ioutil.TempDir(os.TempDir(), "gitd-standby")
+	assert.Ok(t, err)
+	defer os.RemoveAll(standbyPath)
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	standby := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(standbyPath), AutoInitRepos(true)))
+	defer standby.Close()
+
+	srv, err := NewServer(http.NotFoundHandler(),
+		ReposPath(rpath),
+		Metrics("/metrics"),
+		Replicas(Replica{URL: standby.URL + "/"}, Replica{URL: filepath.Join(workspace, "missing")}),
+	)
+	assert.Ok(t, err)
+	defer srv.Shutdown(context.Background())
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "blah")
+	git(t, clone, "push", "-q", "origin", "master", "master:feature")
+
+	standbyRefs := func() string {
+		cmd := exec.Command("git", "ls-remote", standby.URL+"/test.git")
+		out, _ := cmd.Output()
+		return string(out)
+	}
+
+	head := gitOutput(t, clone, "rev-parse", "HEAD")
+	waitFor(t, func() bool {
+		return strings.Contains(standbyRefs(), head+"\trefs/heads/feature")
+	}, "push was not replicated")
+
+	// Deleted branches are deleted from replicas.
+	git(t, clone, "push", "-q", "origin", ":feature")
+	waitFor(t, func() bool {
+		refs := standbyRefs()
+		return strings.Contains(refs, "refs/heads/master") && !strings.Contains(refs, "refs/heads/feature")
+	}, "branch deletion was not replicated")
+
+	metrics := func() string {
+		res, err := http.Get(ts.URL + "/metrics")
+		assert.Ok(t, err)
+		defer res.Body.Close()
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(res.Body)
+		assert.Ok(t, err)
+		return buf.String()
+	}
+
+	missing := filepath.Join(workspace, "missing")
+	// Outcomes are recorded once pushes to replicas return.
+	waitFor(t, func() bool {
+		m := metrics()
+		return strings.Contains(m, `gitd_replications_total{replica="`+missing+`",repo="test.git",result="failure"}`) &&
+			strings.Contains(m, `gitd_replications_total{replica="`+standby.URL+`/",repo="test.git",result="success"} 2`)
+	}, "replication outcomes were not recorded")
+
+	m := metrics()
+	assert.Cond(t, strings.Contains(m, `gitd_replications_total{replica="`+missing+`",repo="test.git",result="retry"}`), "retries were not recorded: %s", m)
+}
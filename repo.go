@@ -0,0 +1,116 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// initRepo creates a bare repository in dir, using the configured template
+// directory if any.
+func (h *handler) initRepo(dir string) error {
+	args := []string{"init", "--bare"}
+	if h.templateDir != "" {
+		args = append(args, "--template="+h.templateDir)
+	}
+	args = append(args, dir)
+
+	if _, _, err := runAndLog(h.logger, h.gitCommand("", args...)); err != nil {
+		return err
+	}
+	if err := h.ownRepo(dir); err != nil {
+		return err
+	}
+	// The branch git init picks varies across Git versions and setups.
+	if h.initialBranch != "" {
+		if err := h.setDefaultBranch(dir, h.initialBranch); err != nil {
+			return err
+		}
+	}
+	return h.markExported(dir)
+}
+
+// initHiddenRepo creates a bare repository in a hidden directory next to
+// dir, to be renamed to dir once ready, returning its path.
+func (h *handler) initHiddenRepo(dir string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir)+"-")
+	if err != nil {
+		return "", err
+	}
+	if err := h.initRepo(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// validRepoName returns whether name is a relative, slash separated path that
+// stays within the repositories root, and whose parts name files of their
+// own on the platform.
+func validRepoName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return false
+	}
+
+	if path.Clean(name) != name {
+		return false
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." || part == "." || strings.HasPrefix(part, ".") || !validNamePart(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// errInvalidRepoPath is returned when looking up URL paths that are not valid
+// repository names. Clients get a 400 for it.
+var errInvalidRepoPath = errors.New("invalid repository path")
+
+// checkRepoPath validates the URL path of a repository, such as
+// "/org/repo.git", as requested by clients, which is already URL-decoded.
+// Paths with ".." or hidden segments, backslashes, NUL bytes or percent signs
+// left by encoding traversals twice are invalid. Paths not ending in ".git"
+// do not belong to any repository.
+func checkRepoPath(urlPath string) error {
+	name := strings.TrimPrefix(urlPath, "/")
+	if name == urlPath || strings.ContainsAny(name, "%\x00") || !validRepoName(name) {
+		return errInvalidRepoPath
+	}
+	if !strings.HasSuffix(name, ".git") {
+		return ErrRepoNotFound
+	}
+	return nil
+}
+
+// isBareRepo returns whether dir looks like a bare Git repository.
+func isBareRepo(dir string) bool {
+	if fi, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil || fi.IsDir() {
+		return false
+	}
+
+	for _, sub := range []string{"objects", "refs"} {
+		if fi, err := os.Stat(filepath.Join(dir, sub)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// walkRepos calls fn with the name and directory of every bare repository
+// in the repository storage, stopping at the first error it returns.
+func (h *handler) walkRepos(fn func(name, dir string) error) error {
+	return h.storage.Walk(fn)
+}
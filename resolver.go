@@ -0,0 +1,177 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// ErrRepoNotFound is returned by resolvers when a URL path does not belong
+// to any repository. Clients get a 404 for it.
+var ErrRepoNotFound = errors.New("repository not found")
+
+// RepoResolver maps the URL path of a repository, such as "/org/repo.git",
+// to the directory holding it and any environment variables, such as
+// GIT_NAMESPACE, Git processes serving it must run with. Returning an error
+// other than ErrRepoNotFound rejects the request with 500.
+type RepoResolver interface {
+	Resolve(ctx context.Context, urlPath string) (dir string, env []string, err error)
+}
+
+// RepoResolverFunc allows ordinary functions to be used as resolvers.
+type RepoResolverFunc func(ctx context.Context, urlPath string) (string, []string, error)
+
+// Resolve calls f(ctx, urlPath).
+func (f RepoResolverFunc) Resolve(ctx context.Context, urlPath string) (string, []string, error) {
+	return f(ctx, urlPath)
+}
+
+// Resolver sets the resolver used to locate repositories. By default,
+// URL paths are resolved through the repository storage.
+func Resolver(r RepoResolver) Option {
+	return func(h *handler) {
+		h.resolver = r
+	}
+}
+
+// storageResolver resolves URL paths through the repository storage.
+type storageResolver struct {
+	h *handler
+}
+
+// usesStorage tells whether r locates repositories through the repository
+// storage.
+func usesStorage(r RepoResolver) bool {
+	_, ok := r.(storageResolver)
+	return ok
+}
+
+func (r storageResolver) Resolve(ctx context.Context, urlPath string) (string, []string, error) {
+	dir, err := r.h.storage.Dir(ctx, strings.TrimPrefix(urlPath, "/"))
+	return dir, nil, err
+}
+
+func (r storageResolver) roots() []string {
+	if s, ok := r.h.storage.(rooted); ok {
+		return s.roots()
+	}
+	return nil
+}
+
+// VHost resolves repositories relative to a root directory chosen by the
+// Host header of each request, e.g. {"git.example.com": "/srv/example"}, so a
+// single handler can serve several domains with isolated repository trees.
+// Requests for unknown hosts get a 404. It replaces any resolver previously
+// set.
+func VHost(roots map[string]string) Option {
+	r := &vhostResolver{hosts: make(map[string]string, len(roots))}
+	for host, root := range roots {
+		r.hosts[strings.ToLower(host)] = root
+	}
+	return Resolver(r)
+}
+
+// vhostResolver resolves URL paths relative to the root of the requested
+// host.
+type vhostResolver struct {
+	hosts map[string]string
+}
+
+func (r *vhostResolver) Resolve(ctx context.Context, urlPath string) (string, []string, error) {
+	host, _ := ctx.Value(hostKey{}).(string)
+	host = strings.ToLower(host)
+
+	root, ok := r.hosts[host]
+	if !ok {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			root, ok = r.hosts[h]
+		}
+	}
+
+	if !ok {
+		return "", nil, ErrRepoNotFound
+	}
+	return filepath.Join(root, filepath.FromSlash(urlPath)), nil, nil
+}
+
+func (r *vhostResolver) roots() []string {
+	var roots []string
+	for _, root := range r.hosts {
+		roots = append(roots, root)
+	}
+	return roots
+}
+
+// hostKey is the context key under which the requested host is stored while
+// resolving repositories.
+type hostKey struct{}
+
+// repository is a repository a request was resolved to.
+type repository struct {
+	// name is the URL path of the repository, without its leading slash.
+	name string
+	dir  string
+	env  []string
+}
+
+// resolve locates the repository at urlPath, writing a 400, 404 or 500
+// response if that is not possible.
+func (h *handler) resolve(w http.ResponseWriter, req *http.Request, urlPath string) (*repository, bool) {
+	repo, err := h.lookup(req.Context(), req.Host, urlPath)
+	if err == errInvalidRepoPath {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Bad Request"))
+		return nil, false
+	}
+
+	if err == ErrRepoNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found"))
+		return nil, false
+	}
+
+	if err != nil {
+		h.logger.Error("Resolving repository failed", Field{"repo", strings.TrimPrefix(urlPath, "/")}, Field{"error", err})
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal Server Error"))
+		return nil, false
+	}
+	return repo, true
+}
+
+// lookup locates the repository at urlPath, as requested from host. Paths
+// that are not valid repository names never reach the resolver, and
+// directories it returns outside of its roots are not served.
+func (h *handler) lookup(ctx context.Context, host, urlPath string) (*repository, error) {
+	if err := checkRepoPath(urlPath); err != nil {
+		return nil, err
+	}
+	repo := &repository{name: strings.TrimPrefix(urlPath, "/")}
+
+	namespace, urlPath, ok := h.splitNamespace(urlPath)
+	if !ok {
+		return nil, ErrRepoNotFound
+	}
+
+	var err error
+	ctx = context.WithValue(ctx, hostKey{}, host)
+	repo.dir, repo.env, err = h.resolver.Resolve(ctx, urlPath)
+	if err != nil {
+		return nil, err
+	}
+	if !confined(h.resolver, repo.dir) {
+		return nil, ErrRepoNotFound
+	}
+
+	if namespace != "" {
+		repo.env = append(repo.env, "GIT_NAMESPACE="+namespace)
+	}
+	return repo, nil
+}
@@ -0,0 +1,156 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRepoResolver(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, filepath.Join("shard-a", "acme", "app.git"))
+
+	resolver := RepoResolverFunc(func(ctx context.Context, urlPath string) (string, []string, error) {
+		parts := strings.Split(strings.TrimPrefix(urlPath, "/"), "/")
+		if len(parts) != 2 {
+			return "", nil, ErrRepoNotFound
+		}
+		if parts[0] == "broken" {
+			return "", nil, errors.New("shard unavailable")
+		}
+		dir := filepath.Join(rpath, "shard-a", parts[0], parts[1])
+		return dir, []string{"GIT_NAMESPACE=" + parts[0]}, nil
+	})
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), Resolver(resolver)))
+	defer ts.Close()
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	dir := filepath.Join(workspace, "app")
+	cloneAndCommit(t, ts.URL+"/acme/app.git", dir, "sharded")
+	git(t, dir, "push", "origin", "master")
+
+	// The environment returned by the resolver reaches Git processes.
+	ref := filepath.Join(rpath, "shard-a", "acme", "app.git", "refs", "namespaces", "acme", "refs", "heads", "master")
+	_, err = os.Stat(ref)
+	assert.Ok(t, err)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/app.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"/acme/missing.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"/broken/app.git/info/refs?service=git-upload-pack", http.StatusInternalServerError},
+		{"/acme/app.git/info/refs?service=git-upload-pack", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		res, err := http.Get(ts.URL + tt.path)
+		assert.Ok(t, err)
+		res.Body.Close()
+		assert.Equals(t, tt.status, res.StatusCode)
+	}
+}
+
+func TestVHost(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, filepath.Join("example", "app.git"))
+	initBareRepo(t, rpath, filepath.Join("other", "lib.git"))
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), VHost(map[string]string{
+		"git.example.com": filepath.Join(rpath, "example"),
+		"git.other.com":   filepath.Join(rpath, "other"),
+	})))
+	defer ts.Close()
+
+	tests := []struct {
+		host   string
+		repo   string
+		status int
+	}{
+		{"git.example.com", "app.git", http.StatusOK},
+		{"GIT.EXAMPLE.COM:8080", "app.git", http.StatusOK},
+		{"git.example.com", "lib.git", http.StatusNotFound},
+		{"git.other.com", "lib.git", http.StatusOK},
+		{"git.other.com", "app.git", http.StatusNotFound},
+		{"git.unknown.com", "app.git", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", ts.URL+"/"+tt.repo+"/info/refs?service=git-upload-pack", nil)
+		assert.Ok(t, err)
+		req.Host = tt.host
+
+		res, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		res.Body.Close()
+		assert.Equals(t, tt.status, res.StatusCode)
+	}
+}
+
+func TestRepoPaths(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	outside, err := ioutil.TempDir(os.TempDir(), "gitd-outside")
+	assert.Ok(t, err)
+	defer os.RemoveAll(outside)
+	initBareRepo(t, outside, "secret.git")
+
+	assert.Ok(t, os.Symlink(filepath.Join(outside, "secret.git"), filepath.Join(rpath, "escape.git")))
+	assert.Ok(t, os.Symlink(outside, filepath.Join(rpath, "linked")))
+	assert.Ok(t, os.Symlink(filepath.Join(rpath, "test.git"), filepath.Join(rpath, "alias.git")))
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AutoInitRepos(true)))
+	defer ts.Close()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/test.git/info/refs?service=git-upload-pack", http.StatusOK},
+		{"/alias.git/info/refs?service=git-upload-pack", http.StatusOK},
+		{"/test/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"/escape.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"/linked/secret.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"/linked/new.git/info/refs?service=git-receive-pack", http.StatusNotFound},
+		{"/%2e%2e/test.git/info/refs?service=git-upload-pack", http.StatusBadRequest},
+		{"/a%2F..%2F..%2Ftest.git/info/refs?service=git-upload-pack", http.StatusBadRequest},
+		{"/%252e%252e/test.git/info/refs?service=git-upload-pack", http.StatusBadRequest},
+		{"/a%5C..%5Ctest.git/info/refs?service=git-upload-pack", http.StatusBadRequest},
+		{"/a%00/test.git/info/refs?service=git-upload-pack", http.StatusBadRequest},
+		{"//test.git/info/refs?service=git-upload-pack", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		res, err := http.Get(ts.URL + tt.path)
+		assert.Ok(t, err)
+		res.Body.Close()
+		assert.Equals(t, tt.status, res.StatusCode)
+	}
+
+	_, err = os.Stat(filepath.Join(outside, "new.git"))
+	assert.Cond(t, os.IsNotExist(err), "repositories should not be created outside of the root")
+}
@@ -0,0 +1,81 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+)
+
+// maxSizedResponse is the largest response sizedResponseWriter holds back.
+const maxSizedResponse = 256 * 1024
+
+// sizedResponseWriter holds a response back until Close, to send it with a
+// Content-Length, so clients and proxies know it is complete without
+// relying on chunked encoding, or the connection closing, and proxies need
+// not buffer it to find out its length. Responses growing over max bytes
+// are streamed instead. Flushes are ignored while the response is held back.
+type sizedResponseWriter struct {
+	http.ResponseWriter
+	max       int
+	status    int
+	buf       bytes.Buffer
+	streaming bool
+}
+
+func (s *sizedResponseWriter) WriteHeader(status int) {
+	if s.streaming {
+		s.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if s.status == 0 {
+		s.status = status
+	}
+}
+
+func (s *sizedResponseWriter) Write(p []byte) (int, error) {
+	if s.streaming {
+		return s.ResponseWriter.Write(p)
+	}
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if s.buf.Len()+len(p) <= s.max {
+		return s.buf.Write(p)
+	}
+
+	s.streaming = true
+	s.ResponseWriter.WriteHeader(s.status)
+	if _, err := s.ResponseWriter.Write(s.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	s.buf.Reset()
+	return s.ResponseWriter.Write(p)
+}
+
+// Flush flushes the underlying writer once the response is being streamed.
+func (s *sizedResponseWriter) Flush() {
+	if !s.streaming {
+		return
+	}
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close sends the response held back, if any.
+func (s *sizedResponseWriter) Close() error {
+	if s.streaming || s.status == 0 {
+		return nil
+	}
+
+	if s.status != http.StatusNoContent && s.status != http.StatusNotModified {
+		s.Header().Set("Content-Length", strconv.Itoa(s.buf.Len()))
+	}
+	s.ResponseWriter.WriteHeader(s.status)
+	_, err := s.ResponseWriter.Write(s.buf.Bytes())
+	return err
+}
@@ -0,0 +1,79 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestHTTP2(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+	initBareRepo(t, rpath, "broken.git")
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(rpath, "broken.git", "HEAD"), []byte("garbage\n"), 0644))
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewUnstartedServer(Handler(http.NotFoundHandler(), ReposPath(rpath)))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	client := ts.Client()
+
+	// Advertisements are sent with their length, once compressed.
+	req, err := http.NewRequest("GET", ts.URL+"/test.git/info/refs?service=git-upload-pack", nil)
+	assert.Ok(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := client.Do(req)
+	assert.Ok(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Ok(t, err)
+	assert.Equals(t, 2, res.ProtoMajor)
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+	assert.Equals(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equals(t, int64(len(body)), res.ContentLength)
+
+	// Failures do not tear the connection down.
+	res, err = client.Get(ts.URL + "/broken.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Ok(t, err)
+	assert.Equals(t, http.StatusInternalServerError, res.StatusCode)
+	assert.Equals(t, "Internal Server Error", string(body))
+	assert.Equals(t, int64(len(body)), res.ContentLength)
+	assert.Equals(t, "", res.Header.Get("Connection"))
+
+	// Git clients fetch and push over HTTP/2.
+	clone := filepath.Join(workspace, "test")
+	git(t, workspace, "-c", "http.sslVerify=false", "-c", "http.version=HTTP/2", "clone", "-q", ts.URL+"/test.git", clone)
+	git(t, clone, "config", "http.sslVerify", "false")
+	git(t, clone, "config", "http.version", "HTTP/2")
+	git(t, clone, "config", "user.name", "Gitd tests")
+	git(t, clone, "config", "user.email", "test@hooklift.io")
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(clone, "README.md"), []byte("h2"), 0644))
+	git(t, clone, "add", "--all")
+	git(t, clone, "commit", "-q", "-m", "over h2")
+	git(t, clone, "push", "-q", "origin", "master")
+
+	again := filepath.Join(workspace, "again")
+	git(t, workspace, "-c", "http.sslVerify=false", "-c", "http.version=HTTP/2", "clone", "-q", ts.URL+"/test.git", again)
+	content, err := ioutil.ReadFile(filepath.Join(again, "README.md"))
+	assert.Ok(t, err)
+	assert.Equals(t, "h2", strings.TrimSpace(string(content)))
+}
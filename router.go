@@ -0,0 +1,143 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RepoPattern sets the URL paths repositories are served from, such as
+// "/{org}/{repo}.git", where {name} matches a path segment and {name...}
+// one or more of them. Requests for other paths are passed through. The
+// parameters matched are available to authenticators, resolvers and other
+// callbacks through PathParams. Parameters cannot be named ref, format or
+// path, which routes use. By default, any path can be a repository.
+func RepoPattern(pattern string) Option {
+	return func(h *handler) {
+		h.repoPattern = pattern
+	}
+}
+
+// PathParams returns the parameters matched in the URL path of the request
+// ctx belongs to: those of RepoPattern, along with the ref and format of
+// archives and the ref and file path of raw files, as "ref", "format" and
+// "path".
+func PathParams(ctx context.Context) map[string]string {
+	params, _ := ctx.Value(paramsKey{}).(map[string]string)
+	return params
+}
+
+// paramsKey is the context key under which the parameters matched in the
+// URL path are stored.
+type paramsKey struct{}
+
+// paramNameRe matches the names of pattern parameters.
+var paramNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// routeParams are the parameters routes capture after repository paths.
+var routeParams = map[string]bool{"ref": true, "format": true, "path": true}
+
+// route serves the URL paths matching re.
+type route struct {
+	re    *regexp.Regexp
+	serve func(http.ResponseWriter, *http.Request, *repository)
+}
+
+// router routes requests to the handlers serving them by URL path, trying
+// routes in the order they were added.
+type router struct {
+	// repo matches repository paths, capturing them.
+	repo   string
+	routes []route
+}
+
+// newRouter returns a router for repositories at the paths matching
+// pattern, as set by RepoPattern, or at any path if it is empty.
+func newRouter(pattern string) (*router, error) {
+	if pattern == "" {
+		return &router{repo: "(.*?)"}, nil
+	}
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, errors.New("repository pattern must start with /")
+	}
+
+	var re bytes.Buffer
+	seen := make(map[string]bool)
+	for {
+		i := strings.IndexByte(pattern, '{')
+		if i < 0 {
+			re.WriteString(regexp.QuoteMeta(pattern))
+			break
+		}
+		j := strings.IndexByte(pattern[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("unclosed parameter in repository pattern at %q", pattern[i:])
+		}
+
+		name, expr := pattern[i+1:i+j], "[^/]+"
+		if strings.HasSuffix(name, "...") {
+			name, expr = strings.TrimSuffix(name, "..."), ".+?"
+		}
+		if !paramNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid parameter name %q in repository pattern", name)
+		}
+		if seen[name] || routeParams[name] {
+			return nil, fmt.Errorf("duplicate or reserved parameter %q in repository pattern", name)
+		}
+		seen[name] = true
+
+		re.WriteString(regexp.QuoteMeta(pattern[:i]))
+		fmt.Fprintf(&re, "(?P<%s>%s)", name, expr)
+		pattern = pattern[i+j+1:]
+	}
+	repo := "(" + re.String() + ")"
+	if _, err := regexp.Compile(repo); err != nil {
+		return nil, fmt.Errorf("invalid repository pattern: %v", err)
+	}
+	return &router{repo: repo}, nil
+}
+
+// compile returns a regular expression matching the URL paths made of a
+// repository path, captured first, followed by a path matching the regular
+// expression suffix. Suffixes are fixed and the repository path was checked
+// by newRouter, so they always compile.
+func (r *router) compile(suffix string) *regexp.Regexp {
+	return regexp.MustCompile("^" + r.repo + suffix + "$")
+}
+
+// add routes to serve the URL paths compile matches for suffix.
+func (r *router) add(suffix string, serve func(http.ResponseWriter, *http.Request, *repository)) {
+	r.routes = append(r.routes, route{re: r.compile(suffix), serve: serve})
+}
+
+// match returns the handler serving urlPath, along with the path of the
+// repository and the parameters matched, or nil if no route matches it.
+func (r *router) match(urlPath string) (func(http.ResponseWriter, *http.Request, *repository), string, map[string]string) {
+	for _, rt := range r.routes {
+		m := rt.re.FindStringSubmatch(urlPath)
+		if m == nil {
+			continue
+		}
+		return rt.serve, m[1], matchParams(rt.re, m)
+	}
+	return nil, "", nil
+}
+
+// matchParams returns the named parameters of re in m, a match of it.
+func matchParams(re *regexp.Regexp, m []string) map[string]string {
+	params := make(map[string]string)
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			params[name] = m[i]
+		}
+	}
+	return params
+}
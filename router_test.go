@@ -0,0 +1,130 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRouter(t *testing.T) {
+	var served string
+	serve := func(name string) func(http.ResponseWriter, *http.Request, *repository) {
+		return func(http.ResponseWriter, *http.Request, *repository) {
+			served = name
+		}
+	}
+
+	r, err := newRouter("/{org}/{repo}.git")
+	assert.Ok(t, err)
+	r.add("/info/refs", serve("refs"))
+	r.add(rawPath, serve("raw"))
+
+	tests := []struct {
+		path   string
+		served string
+		repo   string
+		params map[string]string
+	}{
+		{"/acme/app.git/info/refs", "refs", "/acme/app.git", map[string]string{"org": "acme", "repo": "app"}},
+		{"/acme/app.git/raw/main/README", "raw", "/acme/app.git", map[string]string{"org": "acme", "repo": "app", "path": "main/README"}},
+		{"/acme/app.git/raw/main/info/refs", "raw", "/acme/app.git", map[string]string{"org": "acme", "repo": "app", "path": "main/info/refs"}},
+		{"/app.git/info/refs", "", "", nil},
+		{"/acme/team/app.git/info/refs", "", "", nil},
+		{"/acme/app/info/refs", "", "", nil},
+	}
+	for _, tt := range tests {
+		served = ""
+		fn, repo, params := r.match(tt.path)
+		if fn != nil {
+			fn(nil, nil, nil)
+		}
+		assert.Equals(t, tt.served, served)
+		assert.Equals(t, tt.repo, repo)
+		assert.Equals(t, tt.params, params)
+	}
+
+	r, err = newRouter("/{group...}/{repo}.git")
+	assert.Ok(t, err)
+	r.add("/info/refs", serve("refs"))
+	_, repo, params := r.match("/a/b/app.git/info/refs")
+	assert.Equals(t, "/a/b/app.git", repo)
+	assert.Equals(t, map[string]string{"group": "a/b", "repo": "app"}, params)
+
+	for _, pattern := range []string{
+		"{org}/{repo}.git",
+		"/{org",
+		"/{org-name}/{repo}.git",
+		"/{}",
+		"/{org}/{org}.git",
+		"/{path...}/{repo}.git",
+	} {
+		_, err := newRouter(pattern)
+		assert.Cond(t, err != nil, "pattern %q should be rejected", pattern)
+	}
+}
+
+func TestRepoPattern(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, filepath.Join("acme", "app.git"))
+	initBareRepo(t, rpath, "app.git")
+
+	var (
+		mu       sync.Mutex
+		orgs     []string
+		resolved []string
+	)
+	auth := AuthenticatorFunc(func(r *http.Request, repo string, op Operation) error {
+		mu.Lock()
+		defer mu.Unlock()
+		orgs = append(orgs, PathParams(r.Context())["org"])
+		return nil
+	})
+	resolver := RepoResolverFunc(func(ctx context.Context, urlPath string) (string, []string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		resolved = append(resolved, PathParams(ctx)["repo"])
+		return filepath.Join(rpath, filepath.FromSlash(urlPath)), nil, nil
+	})
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		RepoPattern("/{org}/{repo}.git"),
+		Authenticate(auth),
+		Resolver(resolver),
+	))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/acme/app.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+
+	// Paths not matching the pattern are passed through.
+	res, err = http.Get(ts.URL + "/app.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusNotFound, res.StatusCode)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equals(t, []string{"acme"}, orgs)
+	assert.Equals(t, []string{"app"}, resolved)
+
+	for _, pattern := range []string{"/{org", "/{org}/{org}.git"} {
+		_, err = NewServer(http.NotFoundHandler(), ReposPath(rpath), RepoPattern(pattern))
+		assert.Cond(t, err != nil, "pattern %q should be rejected", pattern)
+	}
+}
@@ -0,0 +1,44 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+// RunAs runs Git, and so the hooks of repositories, as the user uid and
+// group gid rather than as the server, so scripts pushed to repositories
+// cannot reach what the server can. Tenants can run as accounts of their own
+// instead. Repositories gitd creates are owned by the account Git runs as on
+// them, and existing ones must be. The server needs to run as root, or with
+// the CAP_SETUID and CAP_SETGID capabilities, and the GoGit backend serving
+// in-process is not affected. RunAs is ignored on Windows.
+func RunAs(uid, gid uint32) Option {
+	return func(h *handler) {
+		h.runAs = &account{uid: uid, gid: gid}
+	}
+}
+
+// account is a user and group Git runs as.
+type account struct {
+	uid, gid uint32
+}
+
+// accountFor returns the account Git runs as on the repository in dir, nil
+// meaning the account of the server.
+func (h *handler) accountFor(dir string) *account {
+	for _, t := range h.tenants {
+		if t.UID != 0 && within(t.Root, dir) {
+			return &account{uid: t.UID, gid: t.GID}
+		}
+	}
+	return h.runAs
+}
+
+// ownRepo hands the repository in dir, and everything in it, over to the
+// account Git runs as on it.
+func (h *handler) ownRepo(dir string) error {
+	a := h.accountFor(dir)
+	if a == nil {
+		return nil
+	}
+	return a.own(dir)
+}
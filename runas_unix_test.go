@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !windows
+// +build !windows
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRunAs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("running Git as another user requires root")
+	}
+
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	assert.Ok(t, os.Chmod(rpath, 0755))
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	const nobody = 65534
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		AdminAPI(),
+		RunAs(nobody, nobody),
+	))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/api/repos", "application/json", strings.NewReader(`{"name": "repo.git"}`))
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusCreated, res.StatusCode)
+
+	dir := filepath.Join(rpath, "repo.git")
+	fi, err := os.Stat(filepath.Join(dir, "objects"))
+	assert.Ok(t, err)
+	assert.Equals(t, uint32(nobody), fi.Sys().(*syscall.Stat_t).Uid)
+
+	// Hooks run as the account Git runs as.
+	hook := "#!/bin/sh\necho \"uid $(id -u)\" >&2\n"
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(dir, "hooks", "post-receive"), []byte(hook), 0755))
+
+	clone := filepath.Join(workspace, "repo")
+	cloneAndCommit(t, ts.URL+"/repo.git", clone, "blah")
+	cmd := exec.Command("git", "push", "origin", "master")
+	cmd.Dir = clone
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err == nil, "push failed: %s", out)
+	assert.Cond(t, strings.Contains(string(out), "uid 65534"), "unexpected output: %s", out)
+}
+
+func TestTenantAccounts(t *testing.T) {
+	srv, err := NewServer(http.NotFoundHandler(),
+		RunAs(1000, 1000),
+		Tenants(
+			Tenant{Name: "acme", Root: "/srv/acme", UID: 2000, GID: 2000},
+			Tenant{Name: "globex", Root: "/srv/globex"},
+		),
+	)
+	assert.Ok(t, err)
+	h := srv.h
+
+	assert.Equals(t, &account{uid: 2000, gid: 2000}, h.accountFor("/srv/acme/app.git"))
+	assert.Equals(t, &account{uid: 1000, gid: 1000}, h.accountFor("/srv/globex/app.git"))
+	assert.Equals(t, &account{uid: 1000, gid: 1000}, h.accountFor("/srv/other/app.git"))
+}
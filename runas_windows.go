@@ -0,0 +1,18 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"os/exec"
+)
+
+// apply does nothing, as Windows processes cannot be given another user
+// this way.
+func (a *account) apply(cmd *exec.Cmd) {}
+
+// own does nothing, as RunAs is ignored on Windows.
+func (a *account) own(dir string) error {
+	return nil
+}
@@ -0,0 +1,370 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// session is a Git operation served over a stateful, bidirectional
+// transport, such as SSH or the Git daemon protocol, where a single Git
+// process talks to the client for the whole operation.
+type session struct {
+	// transport names the transport in logs and URL schemes.
+	transport  string
+	identity   string
+	host       string
+	protocol   string
+	remoteAddr string
+	rw         io.ReadWriter
+	// stderr receives messages for the user, if the transport has a
+	// channel for them. Otherwise, errors are only reported before Git
+	// starts, through an ERR packet.
+	stderr io.Writer
+}
+
+// fail reports msg to the client, which is not expecting any Git output
+// yet.
+func (s *session) fail(msg string) {
+	if s.stderr != nil {
+		fmt.Fprintln(s.stderr, msg)
+		return
+	}
+	s.rw.Write(packetWrite("ERR " + msg + "\n"))
+}
+
+// serveSession authorizes, resolves and serves the repository name through
+// the given Git service, returning whether the operation succeeded.
+func (h *handler) serveSession(s *session, service, name string) bool {
+	logger := h.logger
+	if s.identity != "" {
+		logger = fieldLogger{h.logger, []Field{{"user", s.identity}}}
+	}
+
+	op := Fetch
+	if service == "git-receive-pack" {
+		op = Push
+	}
+
+	// Transports without redirects are served moved repositories directly.
+	if to, ok := h.redirects.lookup(name); ok {
+		name = to
+	}
+
+	if h.authorize != nil && !h.authorize(s.identity, name, op) {
+		logger.Info("Authorization denied", Field{"repo", name}, Field{"operation", op})
+		s.fail(fmt.Sprintf("%s access denied to %s", op, name))
+		return false
+	}
+
+	if op == Fetch && h.readThrough != nil && !h.cacheRepo(name, true) {
+		s.fail(fmt.Sprintf("repository %s not found", name))
+		return false
+	}
+
+	ctx := context.WithValue(context.Background(), identityKey{}, s.identity)
+	ctx, span := h.startSpan(ctx, "gitd "+op.String(),
+		Field{"repo", name},
+		Field{"operation", op.String()},
+		Field{"transport", s.transport},
+	)
+	defer span.End()
+
+	repo, err := h.lookup(ctx, s.host, "/"+name)
+	if err == nil && op == Push && (h.readThrough != nil || h.isMirror(repo.name)) {
+		s.fail(fmt.Sprintf("%s is a read-only mirror", name))
+		return false
+	}
+	if err == nil && op == Push && h.autoInit && !isBareRepo(repo.dir) {
+		if err = h.initRepo(repo.dir); err == nil {
+			logger.Info("Repository initialized on push", Field{"repo", repo.name})
+		}
+	}
+	if err == nil && !h.exported(repo.dir) {
+		err = ErrRepoNotFound
+	}
+	if err != nil {
+		if err != ErrRepoNotFound && err != errInvalidRepoPath {
+			logger.Error("Resolving repository failed", Field{"repo", name}, Field{"error", err})
+		}
+		s.fail(fmt.Sprintf("repository %s not found", name))
+		return false
+	}
+
+	if h.backend == GoGit {
+		s.fail(fmt.Sprintf("%s transport is not supported by this server", s.transport))
+		return false
+	}
+
+	if err := h.activity.enter(repo.dir); err == errMaintenanceMode {
+		s.fail("server is under maintenance, try again later")
+		return false
+	} else if err != nil {
+		s.fail(fmt.Sprintf("repository %s is being moved, try again later", name))
+		return false
+	}
+	defer h.activity.leave(repo.dir)
+
+	if op == Push {
+		if err := h.pushBlocked(repo); err != nil {
+			logger.Info("Push rejected", Field{"repo", repo.name}, Field{"error", err})
+			s.fail(err.Error())
+			return false
+		}
+	}
+
+	if d := h.timeouts[service]; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	key := rateKey(s.identity, s.remoteAddr)
+	limiter := h.limiterFor(repo.name)
+	if limiter != nil {
+		if wait, ok := limiter.allow(key, time.Now()); !ok {
+			logger.Warn("Rate limit exceeded", Field{"client", key}, Field{"retry", wait})
+			s.fail(fmt.Sprintf("rate limit exceeded, try again in %d seconds", retryAfter(wait)))
+			return false
+		}
+	}
+
+	if !h.waitSlot(ctx) {
+		s.fail("too many concurrent operations, try again later")
+		return false
+	}
+	defer h.releaseSlot()
+
+	// Hooks get a request describing the session.
+	req := (&http.Request{
+		Method:     "POST",
+		URL:        &url.URL{Scheme: s.transport, Host: s.host, Path: "/" + name},
+		Header:     make(http.Header),
+		Host:       s.host,
+		RemoteAddr: s.remoteAddr,
+	}).WithContext(ctx)
+	if s.stderr != nil {
+		req = h.withMessages(req, s.stderr, repo.name, op)
+	}
+
+	cmd := h.serviceCommand(ctx, repo.dir, service, ".")
+	cmd.Env = append(os.Environ(), repo.env...)
+	if s.protocol != "" {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL="+s.protocol)
+	}
+	cmd.Env = h.hideRefsEnv(h.requestEnv(cmd.Env, req, repo), repo.name)
+	if op == Push {
+		cmd.Env = gitConfigEnv(cmd.Env, advertisePushOptions)
+	} else {
+		cmd.Env = h.uploadPackEnv(cmd.Env, repo.name)
+	}
+	if op == Push && h.pushCerts != nil {
+		cmd.Env = gitConfigEnv(cmd.Env, h.pushCerts.gitConfig())
+	}
+	// Ref updates are only known once Git is running.
+	if op == Push && h.refPolicy != nil && h.refPolicy.fastForwardOnly(nil) {
+		cmd.Env = gitConfigEnv(cmd.Env, denyNonFastForwards)
+	}
+	if s.stderr != nil {
+		cmd.Stderr = s.stderr
+	}
+
+	var r io.Reader = s.rw
+	var pushed *sessionPush
+	if op == Push {
+		if h.maxPushSize > 0 {
+			r = &maxSizeReader{r: r, n: h.maxPushSize}
+		}
+		if h.readsCommands() {
+			pushed = &sessionPush{h: h, req: req, repo: repo.name, dir: repo.dir, r: r}
+			r = pushed
+		}
+	}
+
+	// Concurrent pushes would race on packed-refs, and on what the journal
+	// records.
+	unlock := func() {}
+	if op == Push {
+		if unlock, err = h.locks.lock(ctx, repo.dir); err != nil {
+			logger.Info("Push canceled waiting for the repository", Field{"repo", repo.name}, Field{"error", err})
+			s.fail("timed out waiting for other pushes to the repository")
+			return false
+		}
+		defer unlock()
+	}
+
+	start := time.Now()
+	w := &countingWriter{w: s.rw}
+	body := &countingReader{r: r}
+
+	if h.metrics != nil {
+		h.metrics.started(service)
+	}
+
+	execCtx, execSpan := h.startSpan(ctx, "exec "+service, Field{"repo", repo.name}, Field{"user", s.identity})
+	// The report follows the ref advertisement.
+	report := &reportParser{skip: 1}
+	var gitOut io.Writer = w
+	if pushed != nil {
+		gitOut = io.MultiWriter(w, report)
+	}
+	in, out, endIO := h.traceIO(execCtx, body, gitOut)
+	if op == Fetch {
+		h.events.emit(FetchStarted{newEventInfo(req, repo.name)})
+	}
+	err = h.runCommand(logger, out, in, cmd)
+	endIO()
+	if err != nil {
+		execSpan.RecordError(err)
+	}
+	execSpan.End()
+	if pushed != nil {
+		pushed.close()
+	}
+
+	if h.metrics != nil {
+		h.metrics.finished(service, h.tenantName(repo.name), repo.name, s.identity, time.Since(start), w.n, body.count(), err)
+	}
+	if limiter != nil {
+		limiter.charge(key, w.n+body.count(), time.Now())
+	}
+
+	if h.audit != nil {
+		e := newAuditEvent(req, repo.name, op)
+		e.BytesSent, e.BytesReceived = w.n, body.count()
+		if pushed != nil && pushed.cmds != nil {
+			e.Refs = pushed.cmds.updates
+		}
+		if pushed != nil && pushed.rejected != nil {
+			e.Result, e.Error = AuditRejected, pushed.rejected.Error()
+		}
+		h.recordAudit(e, err)
+	}
+
+	if op == Push {
+		// Even failed pushes may have updated some refs.
+		h.invalidateRepo(repo.dir)
+	}
+
+	fields := []Field{
+		{"repo", repo.name},
+		{"service", service},
+		{"transport", s.transport},
+		{"duration", time.Since(start)},
+		{"bytes", w.n},
+	}
+
+	switch {
+	case op == Fetch:
+		h.fetchDone(req, repo.name, w.n, body.count(), err)
+	case pushed != nil && pushed.rejected != nil:
+		h.pushFailed(req, repo.name, pushed.rejected)
+	case err != nil:
+		h.pushFailed(req, repo.name, err)
+	}
+
+	if pushed != nil && pushed.rejected != nil {
+		logger.Info("Push rejected", Field{"repo", repo.name}, Field{"error", pushed.rejected})
+		// The client sends its pack before reading the report.
+		go io.Copy(ioutil.Discard, s.rw)
+		pushed.cmds.reject(s.rw, pushed.rejected.Error())
+		return false
+	}
+
+	if err != nil {
+		logger.Error("Git command failed", append(fields, Field{"error", err})...)
+		switch {
+		case err == errShuttingDown:
+			s.fail("server is shutting down, try again later")
+		case err == errPushTooLarge && s.stderr != nil:
+			fmt.Fprintln(s.stderr, "push exceeds maximum size")
+		}
+		return false
+	}
+
+	// Without hooks, pushes are not inspected and may not have updated refs.
+	if op == Push && (pushed == nil || pushed.cmds != nil && len(pushed.cmds.updates) > 0) {
+		h.optimizeAfterPush(repo.name, repo.dir)
+		h.dedupAfterPush(repo.name, repo.dir)
+		h.replicate(repo)
+	}
+
+	if pushed != nil && pushed.cmds != nil && len(pushed.cmds.updates) > 0 {
+		h.recordRefs(pushed.req, repo, pushed.cmds.updates)
+		unlock()
+		result := report.result(pushed.cmds.updates)
+		logPushResult(logger, repo.name, result)
+		h.postReceiveHooks(logger, withPushResult(pushed.req, result), repo.name, pushed.cmds.updates, result)
+		h.pushDone(pushed.req, repo.name, pushed.cmds.updates, result)
+	}
+
+	logger.Info("Git command completed", fields...)
+	return true
+}
+
+// close discards what was set aside to check the push.
+func (p *sessionPush) close() {
+	if p.cleanup != nil {
+		p.cleanup()
+	}
+}
+
+// errPushRejected stops feeding a push to git-receive-pack once a
+// pre-receive hook rejected it.
+var errPushRejected = errors.New("push rejected")
+
+// sessionPush feeds a push to git-receive-pack. In sessions, the push
+// commands follow the ref advertisement, so they are read and run through
+// the pre-receive hooks as soon as Git asks for them.
+type sessionPush struct {
+	h        *handler
+	req      *http.Request
+	repo     string
+	dir      string
+	r        io.Reader
+	cmds     *commandList
+	rejected error
+	cleanup  func()
+}
+
+func (p *sessionPush) Read(b []byte) (int, error) {
+	if p.cmds == nil {
+		cmds, r, err := readCommands(p.r)
+		if err != nil {
+			return 0, err
+		}
+		p.cmds, p.r = cmds, r
+		p.req = withCommands(p.req, cmds)
+
+		// Clients with nothing to push only send a flush packet.
+		if len(cmds.updates) == 0 {
+			return p.r.Read(b)
+		}
+
+		for _, hook := range p.h.preReceive {
+			if err := hook(p.req, p.repo, cmds.updates); err != nil {
+				p.rejected = err
+				break
+			}
+		}
+
+		if p.rejected == nil && p.h.inspectsPacks() {
+			p.r, p.cleanup, p.rejected = p.h.inspectPack(p.repo, p.dir, cmds)
+		}
+	}
+
+	if p.rejected != nil {
+		return 0, errPushRejected
+	}
+	return p.r.Read(b)
+}
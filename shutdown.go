@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownKillDelay is how long Git processes are given to exit once asked
+// to terminate, before being killed.
+const shutdownKillDelay = 5 * time.Second
+
+// errShuttingDown is returned when a Git process is not started because the
+// server is shutting down.
+var errShuttingDown = errors.New("server is shutting down")
+
+// processes tracks the running Git processes.
+type processes struct {
+	sync.Mutex
+	running map[*os.Process]struct{}
+	closing bool
+	// idle is closed once no process is running after closing.
+	idle chan struct{}
+}
+
+// start starts cmd, unless the server is shutting down.
+func (p *processes) start(cmd *exec.Cmd) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closing {
+		return errShuttingDown
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	if p.running == nil {
+		p.running = make(map[*os.Process]struct{})
+	}
+	p.running[cmd.Process] = struct{}{}
+	return nil
+}
+
+// done stops tracking cmd, once it was waited for.
+func (p *processes) done(cmd *exec.Cmd) {
+	p.Lock()
+	defer p.Unlock()
+
+	delete(p.running, cmd.Process)
+	if p.closing && len(p.running) == 0 && p.idle != nil {
+		close(p.idle)
+		p.idle = nil
+	}
+}
+
+// close keeps new processes from starting, returning a channel closed once
+// running ones exit.
+func (p *processes) close() <-chan struct{} {
+	p.Lock()
+	defer p.Unlock()
+
+	idle := make(chan struct{})
+	p.closing = true
+	if len(p.running) == 0 {
+		close(idle)
+	} else {
+		p.idle = idle
+	}
+	return idle
+}
+
+func (p *processes) signal(sig os.Signal) {
+	p.Lock()
+	defer p.Unlock()
+
+	for proc := range p.running {
+		proc.Signal(sig)
+	}
+}
+
+// Shutdown stops Git operations, including background maintenance, from
+// starting and waits for the running ones to finish. Once ctx is done, the
+// Git processes left are sent SIGTERM and, if they are still running a few
+// seconds later, killed. It returns ctx.Err() if processes had to be
+// stopped. Shutdown does not close any
+// listeners; it is meant to be called alongside the shutdown of the HTTP
+// server, so that Git processes are not left behind.
+func (s *Server) Shutdown(ctx context.Context) error {
+	h := s.h
+	h.maintenance.close()
+	idle := h.procs.close()
+	defer h.events.close()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+	}
+
+	h.logger.Warn("Terminating running Git processes")
+	h.procs.signal(syscall.SIGTERM)
+
+	timer := time.NewTimer(shutdownKillDelay)
+	defer timer.Stop()
+
+	select {
+	case <-idle:
+		return ctx.Err()
+	case <-timer.C:
+	}
+
+	h.logger.Warn("Killing running Git processes")
+	h.procs.signal(os.Kill)
+	<-idle
+	return ctx.Err()
+}
@@ -0,0 +1,73 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	srv, err := NewServer(http.NotFoundHandler(), ReposPath(rpath))
+	assert.Ok(t, err)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	// Shutting down an idle server returns right away.
+	idle, err := NewServer(http.NotFoundHandler(), ReposPath(rpath))
+	assert.Ok(t, err)
+	assert.Ok(t, idle.Shutdown(context.Background()))
+
+	// A client that never finishes sending its request keeps
+	// git-upload-pack running.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	done := make(chan int)
+	go func() {
+		res, err := http.Post(ts.URL+"/test.git/git-upload-pack", "application/x-git-upload-pack-request", pr)
+		assert.Ok(t, err)
+		res.Body.Close()
+		done <- res.StatusCode
+	}()
+
+	for {
+		srv.h.procs.Lock()
+		n := len(srv.h.procs.running)
+		srv.h.procs.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = srv.Shutdown(ctx)
+	assert.Equals(t, context.DeadlineExceeded, err)
+	assert.Cond(t, time.Since(start) < shutdownKillDelay, "git-upload-pack was not terminated")
+	assert.Equals(t, http.StatusInternalServerError, <-done)
+
+	// New operations are refused.
+	res, err := http.Post(ts.URL+"/test.git/git-upload-pack", "application/x-git-upload-pack-request", nil)
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusServiceUnavailable, res.StatusCode)
+}
@@ -0,0 +1,194 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SignatureVerifier verifies signatures made by Git users, returning an
+// identifier of the key signature was made with, such as its fingerprint.
+// PushKeyring is a SignatureVerifier.
+type SignatureVerifier interface {
+	Verify(payload, signature []byte) (signer string, err error)
+}
+
+// SignatureVerifierFunc is an adapter to allow the use of ordinary functions
+// as signature verifiers.
+type SignatureVerifierFunc func(payload, signature []byte) (string, error)
+
+// Verify calls f(payload, signature).
+func (f SignatureVerifierFunc) Verify(payload, signature []byte) (string, error) {
+	return f(payload, signature)
+}
+
+// ParseAllowedSigners parses the keys of an SSH allowed signers file, as
+// used by Git through gpg.ssh.allowedSignersFile, to verify signatures with
+// a PushKeyring.
+func ParseAllowedSigners(data []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Lines start with the principals the key belongs to.
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("allowed signers line %d: missing key", n+1)
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("allowed signers line %d: %v", n+1, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// RequireSignedCommits rejects pushes bringing commits or annotated tags
+// that are not signed, or whose signatures do not verify. Only commits not
+// already in the repository are checked. Pushed objects are kept aside while
+// they are checked, before Git gets to update any refs.
+func RequireSignedCommits(v SignatureVerifier) Option {
+	return func(h *handler) {
+		h.commitSigs = v
+	}
+}
+
+// verifySignatures verifies the signatures of the commits and tags the
+// pack set aside in q brings to the repository, for updates to wants.
+func (h *handler) verifySignatures(q *quarantine, wants []string) error {
+	if err := q.index(); err != nil {
+		return err
+	}
+
+	// Commits are only checked if they are new to the repository.
+	args := append([]string{"rev-list"}, wants...)
+	cmd := h.gitCommand(q.repo, append(args, "--not", "--all")...)
+	cmd.Env = q.env()
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("listing pushed commits: %v", err)
+	}
+
+	commits := make(map[string]bool)
+	for _, id := range strings.Fields(string(out)) {
+		commits[id] = true
+	}
+	return h.verifyObjects(q.repo, q.env(), append(wants, strings.Fields(string(out))...), commits, h.commitSigs)
+}
+
+// verifyObjects verifies the signatures of the tags among ids, and of the
+// commits also in commits, reading them through git cat-file.
+func (h *handler) verifyObjects(dir string, env []string, ids []string, commits map[string]bool, v SignatureVerifier) error {
+	cmd := h.gitCommand(dir, "cat-file", "--batch")
+	cmd.Env = env
+	cmd.Stdin = strings.NewReader(strings.Join(ids, "\n") + "\n")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer cmd.Wait()
+	defer io.Copy(ioutil.Discard, stdout)
+
+	r := bufio.NewReader(stdout)
+	checked := make(map[string]bool)
+	for range ids {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		// <id> <type> <size>, or <id> missing.
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return fmt.Errorf("object %s is missing", strings.TrimSpace(header))
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return err
+		}
+
+		content := make([]byte, size+1)
+		if _, err := io.ReadFull(r, content); err != nil {
+			return err
+		}
+		content = content[:size]
+
+		id, kind := fields[0], fields[1]
+		if checked[id] || (kind != "commit" || !commits[id]) && kind != "tag" {
+			continue
+		}
+		checked[id] = true
+
+		var payload, signature []byte
+		if kind == "commit" {
+			payload, signature = splitCommitSignature(content)
+		} else {
+			payload, signature = splitTagSignature(content)
+		}
+
+		if signature == nil {
+			return fmt.Errorf("%s %.7s is not signed", kind, id)
+		}
+		if _, err := v.Verify(payload, signature); err != nil {
+			return fmt.Errorf("%s %.7s signature: %v", kind, id, err)
+		}
+	}
+	return nil
+}
+
+// splitCommitSignature splits a commit into its signature, held by the
+// gpgsig header, and the rest, which is what was signed.
+func splitCommitSignature(commit []byte) (payload, signature []byte) {
+	var sig bytes.Buffer
+	inHeaders, inSig := true, false
+	for _, line := range bytes.SplitAfter(commit, []byte("\n")) {
+		switch {
+		case inSig && bytes.HasPrefix(line, []byte(" ")):
+			sig.Write(line[1:])
+			continue
+		case inHeaders && string(line) == "\n":
+			inHeaders, inSig = false, false
+		case inHeaders && (bytes.HasPrefix(line, []byte("gpgsig ")) || bytes.HasPrefix(line, []byte("gpgsig-sha256 "))):
+			inSig = true
+			sig.Write(line[bytes.IndexByte(line, ' ')+1:])
+			continue
+		default:
+			inSig = false
+		}
+		payload = append(payload, line...)
+	}
+
+	if sig.Len() == 0 {
+		return commit, nil
+	}
+	return payload, sig.Bytes()
+}
+
+// splitTagSignature splits an annotated tag into the signature ending its
+// message, and the rest, which is what was signed.
+func splitTagSignature(tag []byte) (payload, signature []byte) {
+	for _, marker := range []string{"-----BEGIN PGP SIGNATURE-----", "-----BEGIN SSH SIGNATURE-----"} {
+		if i := bytes.Index(tag, []byte("\n"+marker)); i >= 0 {
+			return tag[:i+1], tag[i+1:]
+		}
+	}
+	return tag, nil
+}
@@ -0,0 +1,111 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseAllowedSigners(t *testing.T) {
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-keys")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	_, pub := sshSigningKey(t, workspace, "key")
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	data := "# comment\n\nalice@example.com " + line + "\nbob@example.com namespaces=\"git\" " + line + " bob\n"
+
+	keys, err := ParseAllowedSigners([]byte(data))
+	assert.Ok(t, err)
+	assert.Equals(t, 2, len(keys))
+	assert.Equals(t, pub.Marshal(), keys[1].Marshal())
+
+	_, err = ParseAllowedSigners([]byte("alice@example.com\n"))
+	assert.Cond(t, err != nil, "line without key should fail")
+}
+
+func TestRequireSignedCommits(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	key, pub := sshSigningKey(t, workspace, "trusted")
+	other, _ := sshSigningKey(t, workspace, "other")
+	keyring := &PushKeyring{SSH: []ssh.PublicKey{pub}}
+
+	// The repository starts with unsigned history.
+	dir := filepath.Join(workspace, "test")
+	cloneAndCommit(t, filepath.Join(rpath, "test.git"), dir, "unsigned")
+	git(t, dir, "push", "origin", "master")
+	git(t, dir, "config", "gpg.format", "ssh")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), RequireSignedCommits(keyring)))
+	defer ts.Close()
+	url := ts.URL + "/test.git"
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer l.Close()
+	srv, err := NewServer(http.NotFoundHandler(), ReposPath(rpath), GitDaemonPush(true), RequireSignedCommits(keyring))
+	assert.Ok(t, err)
+	go srv.ServeGitDaemon(l)
+	daemonURL := "git://" + l.Addr().String() + "/test.git"
+
+	// Existing history can be pushed to new refs.
+	git(t, dir, "push", url, "master:copy")
+
+	commit := func(content string, args ...string) {
+		assert.Ok(t, ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte(content), 0644))
+		git(t, dir, append([]string{"commit", "-qam", content}, args...)...)
+	}
+
+	commit("not signed")
+	for _, u := range []string{url, daemonURL} {
+		out, err := exec.Command("git", "-C", dir, "push", u, "master").CombinedOutput()
+		assert.Cond(t, err != nil, "unsigned commit should be rejected:\n%s", out)
+		assert.Cond(t, strings.Contains(string(out), "is not signed"), "unexpected output:\n%s", out)
+	}
+
+	git(t, dir, "reset", "-q", "--hard", "HEAD~1")
+	commit("signed by someone else", "-S"+other)
+	out, err := exec.Command("git", "-C", dir, "push", url, "master").CombinedOutput()
+	assert.Cond(t, err != nil, "commit signed with unknown key should be rejected:\n%s", out)
+	assert.Cond(t, strings.Contains(string(out), "unknown key"), "unexpected output:\n%s", out)
+
+	git(t, dir, "reset", "-q", "--hard", "HEAD~1")
+	commit("signed", "-S"+key)
+	git(t, dir, "push", url, "master")
+
+	commit("signed again", "-S"+key)
+	git(t, dir, "push", daemonURL, "master")
+
+	git(t, dir, "tag", "-a", "-m", "unsigned", "v1")
+	out, err = exec.Command("git", "-C", dir, "push", url, "v1").CombinedOutput()
+	assert.Cond(t, err != nil, "unsigned tag should be rejected:\n%s", out)
+
+	git(t, dir, "tag", "-s", "-u", key, "-m", "signed", "v2")
+	git(t, dir, "push", url, "v2")
+
+	// Quarantines do not outlive pushes.
+	matches, err := filepath.Glob(filepath.Join(rpath, "test.git", "objects", "gitd-quarantine-*"))
+	assert.Ok(t, err)
+	assert.Equals(t, 0, len(matches))
+}
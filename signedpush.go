@@ -0,0 +1,335 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+// pushCertNonceSlop is how long the nonce a client signs stays valid after
+// the server advertised it.
+const pushCertNonceSlop = 5 * time.Minute
+
+// PushCert describes the certificate of a signed push.
+type PushCert struct {
+	// Pusher identifies the key the push was signed with, as configured by
+	// the user, followed by the time it was signed.
+	Pusher string
+	// Pushee is the URL the client pushed to.
+	Pushee string
+	// Nonce is the nonce advertised by the server the push signed.
+	Nonce string
+	// Signer is the fingerprint of the key the signature was verified with.
+	Signer string
+
+	payload   []byte
+	signature []byte
+	verified  bool
+}
+
+// pushCertKey is the context key under which the certificate of a signed
+// push is stored.
+type pushCertKey struct{}
+
+// PushCertificate returns the certificate of r, a request passed to a
+// ReceiveHook, if the push was signed and its signature verified.
+func PushCertificate(r *http.Request) (*PushCert, bool) {
+	cert, ok := r.Context().Value(pushCertKey{}).(*PushCert)
+	if !ok || !cert.verified {
+		return nil, false
+	}
+	return cert, true
+}
+
+// PushKeyring holds the keys pushes can be signed with.
+type PushKeyring struct {
+	// PGP holds OpenPGP keys, such as the ones read by
+	// openpgp.ReadArmoredKeyRing.
+	PGP openpgp.KeyRing
+	// SSH holds the keys of users signing with SSH keys, as Git does when
+	// gpg.format is set to ssh.
+	SSH []ssh.PublicKey
+}
+
+// pushCertVerifier verifies push certificates.
+type pushCertVerifier struct {
+	keyring   PushKeyring
+	nonceSeed string
+}
+
+// SignedPush accepts pushes signed with `git push --signed`, rejecting
+// those whose signature does not verify against keyring. Nonces clients
+// sign are derived from nonceSeed, which servers sharing repositories
+// behind a load balancer must share; a random seed is used if empty.
+// Unsigned pushes are still accepted, unless RequireSignedPush is set.
+func SignedPush(keyring PushKeyring, nonceSeed string) Option {
+	if nonceSeed == "" {
+		seed := make([]byte, 16)
+		if _, err := rand.Read(seed); err != nil {
+			panic(err)
+		}
+		nonceSeed = hex.EncodeToString(seed)
+	}
+
+	v := &pushCertVerifier{keyring: keyring, nonceSeed: nonceSeed}
+	return func(h *handler) {
+		h.pushCerts = v
+		h.preReceive = append([]ReceiveHook{v.verify}, h.preReceive...)
+	}
+}
+
+// RequireSignedPush rejects pushes that are not signed. Since pushes can
+// only be signed if SignedPush is set, all pushes are rejected otherwise.
+func RequireSignedPush() Option {
+	return func(h *handler) {
+		h.preReceive = append([]ReceiveHook{requireSignedPush}, h.preReceive...)
+	}
+}
+
+func requireSignedPush(r *http.Request, repo string, updates []RefUpdate) error {
+	if _, ok := r.Context().Value(pushCertKey{}).(*PushCert); !ok {
+		return errors.New("pushes must be signed, use git push --signed")
+	}
+	return nil
+}
+
+// verify implements ReceiveHook, rejecting pushes with certificates that
+// do not verify.
+func (v *pushCertVerifier) verify(r *http.Request, repo string, updates []RefUpdate) error {
+	cert, ok := r.Context().Value(pushCertKey{}).(*PushCert)
+	if !ok {
+		return nil
+	}
+
+	if !v.validNonce(cert.Nonce, time.Now()) {
+		return errors.New("push certificate nonce is invalid or expired")
+	}
+
+	signer, err := v.keyring.Verify(cert.payload, cert.signature)
+	if err != nil {
+		return fmt.Errorf("push certificate signature: %v", err)
+	}
+	cert.Signer = signer
+	cert.verified = true
+	return nil
+}
+
+// gitConfig returns the Git configuration making git-receive-pack advertise
+// nonces for clients to sign.
+func (v *pushCertVerifier) gitConfig() string {
+	return "receive.certnonceseed=" + v.nonceSeed
+}
+
+// validNonce returns whether nonce was advertised by git-receive-pack, run
+// in the repository directory, recently enough. Nonces are the time they
+// were generated, followed by an HMAC of it keyed as Git does.
+func (v *pushCertVerifier) validNonce(nonce string, now time.Time) bool {
+	i := strings.IndexByte(nonce, '-')
+	if i < 0 {
+		return false
+	}
+
+	stamp, err := strconv.ParseInt(nonce[:i], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	age := now.Sub(time.Unix(stamp, 0))
+	if age < -pushCertNonceSlop || age > pushCertNonceSlop {
+		return false
+	}
+
+	var hashFunc func() hash.Hash
+	switch len(nonce) - i - 1 {
+	case sha1.Size * 2:
+		hashFunc = sha1.New
+	case sha256.Size * 2:
+		hashFunc = sha256.New
+	default:
+		return false
+	}
+
+	mac := hmac.New(hashFunc, []byte(".:"+nonce[:i]))
+	mac.Write([]byte(v.nonceSeed))
+	return hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(nonce[i+1:]))
+}
+
+// Verify verifies the signature of payload, returning the fingerprint of the
+// key it was made with. It implements SignatureVerifier.
+func (k *PushKeyring) Verify(payload, signature []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(signature, []byte("-----BEGIN PGP SIGNATURE-----")):
+		if k.PGP == nil {
+			return "", errors.New("PGP signatures are not accepted")
+		}
+		signer, err := openpgp.CheckArmoredDetachedSignature(k.PGP, bytes.NewReader(payload), bytes.NewReader(signature))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint), nil
+	case bytes.HasPrefix(signature, []byte("-----BEGIN SSH SIGNATURE-----")):
+		return k.verifySSH(payload, signature)
+	default:
+		return "", errors.New("unknown signature format")
+	}
+}
+
+// sshSignature is the SSH signature format, as defined by OpenSSH's
+// PROTOCOL.sshsig.
+type sshSignature struct {
+	Magic         [6]byte
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      []byte
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshSignedData is the data actually signed by SSH signatures.
+type sshSignedData struct {
+	Magic         [6]byte
+	Namespace     string
+	Reserved      []byte
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// verifySSH verifies an SSH signature made by ssh-keygen -Y sign, which Git
+// uses when gpg.format is set to ssh.
+func (k *PushKeyring) verifySSH(payload, signature []byte) (string, error) {
+	block, _ := pem.Decode(signature)
+	if block == nil {
+		return "", errors.New("malformed SSH signature")
+	}
+
+	var sig sshSignature
+	if err := ssh.Unmarshal(block.Bytes, &sig); err != nil {
+		return "", err
+	}
+	if string(sig.Magic[:]) != "SSHSIG" || sig.Version != 1 || sig.Namespace != "git" {
+		return "", errors.New("unsupported SSH signature")
+	}
+
+	pub, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	known := false
+	for _, key := range k.SSH {
+		if bytes.Equal(key.Marshal(), pub.Marshal()) {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return "", errors.New("signed with unknown key " + ssh.FingerprintSHA256(pub))
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", errors.New("unsupported hash algorithm " + sig.HashAlgorithm)
+	}
+	io.Copy(h, bytes.NewReader(payload))
+
+	var s ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &s); err != nil {
+		return "", err
+	}
+
+	signed := ssh.Marshal(sshSignedData{
+		Magic:         sig.Magic,
+		Namespace:     sig.Namespace,
+		Reserved:      sig.Reserved,
+		HashAlgorithm: sig.HashAlgorithm,
+		Hash:          h.Sum(nil),
+	})
+	if err := pub.Verify(signed, &s); err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(pub), nil
+}
+
+// readPushCert reads the certificate of a signed push, which follows its
+// push-cert line, returning the ref updates it holds.
+func readPushCert(r io.Reader) (*PushCert, []RefUpdate, error) {
+	var payload, signature bytes.Buffer
+	var updates []RefUpdate
+	cert := new(PushCert)
+	header := true
+
+	for {
+		line, err := packetRead(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if line == nil {
+			return nil, nil, errors.New("truncated push certificate")
+		}
+
+		s := string(line)
+		if s == "push-cert-end\n" {
+			break
+		}
+
+		if signature.Len() > 0 || strings.HasPrefix(s, "-----BEGIN ") {
+			signature.WriteString(s)
+			continue
+		}
+		payload.WriteString(s)
+
+		s = strings.TrimSuffix(s, "\n")
+		switch {
+		case header && s == "":
+			header = false
+		case header:
+			kv := strings.SplitN(s, " ", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "pusher":
+				cert.Pusher = kv[1]
+			case "pushee":
+				cert.Pushee = kv[1]
+			case "nonce":
+				cert.Nonce = kv[1]
+			}
+		default:
+			fields := strings.Fields(s)
+			if len(fields) != 3 {
+				return nil, nil, fmt.Errorf("malformed certificate command: %q", s)
+			}
+			updates = append(updates, RefUpdate{OldSHA: fields[0], NewSHA: fields[1], Name: fields[2]})
+		}
+	}
+
+	cert.payload, cert.signature = payload.Bytes(), signature.Bytes()
+	return cert, updates, nil
+}
@@ -0,0 +1,116 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshSigningKey generates an SSH key for Git to sign with, returning its path
+// and public key.
+func sshSigningKey(t *testing.T, dir, name string) (string, ssh.PublicKey) {
+	path := filepath.Join(dir, name)
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", path).CombinedOutput()
+	assert.Cond(t, err == nil, "ssh-keygen failed: %s", out)
+
+	data, err := ioutil.ReadFile(path + ".pub")
+	assert.Ok(t, err)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	assert.Ok(t, err)
+	return path, pub
+}
+
+func TestSignedPush(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	key, pub := sshSigningKey(t, workspace, "trusted")
+	other, _ := sshSigningKey(t, workspace, "other")
+
+	var cert *PushCert
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		SignedPush(PushKeyring{SSH: []ssh.PublicKey{pub}}, ""),
+		RequireSignedPush(),
+		PreReceive(func(r *http.Request, repo string, updates []RefUpdate) error {
+			cert, _ = PushCertificate(r)
+			return nil
+		}),
+	))
+	defer ts.Close()
+
+	dir := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", dir, "hello")
+	git(t, dir, "config", "gpg.format", "ssh")
+
+	cmd := exec.Command("git", "push", "origin", "master")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "unsigned push should fail:\n%s", out)
+	assert.Cond(t, strings.Contains(string(out), "pushes must be signed"), "unexpected output:\n%s", out)
+
+	git(t, dir, "config", "user.signingkey", other)
+	cmd = exec.Command("git", "push", "--signed", "origin", "master")
+	cmd.Dir = dir
+	out, err = cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "push signed with an unknown key should fail:\n%s", out)
+	assert.Cond(t, strings.Contains(string(out), "unknown key"), "unexpected output:\n%s", out)
+
+	git(t, dir, "config", "user.signingkey", key)
+	git(t, dir, "push", "--signed", "origin", "master")
+	assert.Cond(t, cert != nil, "certificate should be available to hooks")
+	assert.Equals(t, ssh.FingerprintSHA256(pub), cert.Signer)
+	assert.Equals(t, ts.URL+"/test.git/", cert.Pushee)
+}
+
+func TestPushKeyringPGP(t *testing.T) {
+	entity, err := openpgp.NewEntity("Gitd tests", "", "test@hooklift.io", nil)
+	assert.Ok(t, err)
+
+	payload := []byte("certificate version 0.1\n")
+	var sig bytes.Buffer
+	assert.Ok(t, openpgp.ArmoredDetachSign(&sig, entity, bytes.NewReader(payload), nil))
+
+	keyring := &PushKeyring{PGP: openpgp.EntityList{entity}}
+	signer, err := keyring.Verify(payload, sig.Bytes())
+	assert.Ok(t, err)
+	assert.Cond(t, signer != "", "signer should be identified")
+
+	_, err = keyring.Verify([]byte("certificate version 0.2\n"), sig.Bytes())
+	assert.Cond(t, err != nil, "tampered payload should not verify")
+
+	_, err = (&PushKeyring{}).Verify(payload, sig.Bytes())
+	assert.Cond(t, err != nil, "PGP signatures need PGP keys")
+}
+
+func TestPushCertNonce(t *testing.T) {
+	v := &pushCertVerifier{nonceSeed: "abc"}
+	nonce := "1792051575-0370b045c2cad7c756756d0a1b9c9a51689e03ab"
+	stamp := time.Unix(1792051575, 0)
+
+	assert.Cond(t, v.validNonce(nonce, stamp.Add(time.Minute)), "nonce should be valid")
+	assert.Cond(t, !v.validNonce(nonce, stamp.Add(time.Hour)), "expired nonce should be invalid")
+	assert.Cond(t, !(&pushCertVerifier{nonceSeed: "xyz"}).validNonce(nonce, stamp), "nonce of another seed should be invalid")
+	assert.Cond(t, !v.validNonce("garbage", stamp), "malformed nonce should be invalid")
+}
@@ -0,0 +1,161 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHIdentityExtension is the permissions extension holding the identity of
+// SSH clients. Authentication callbacks in the ssh.ServerConfig given to
+// ServeSSH may set it, for instance to the comment of the authorized key a
+// client used. Clients are otherwise identified by their SSH user name.
+const SSHIdentityExtension = "identity"
+
+// ServeSSH accepts SSH connections on l, serving git-upload-pack and
+// git-receive-pack sessions for URLs such as git@host:org/repo.git.
+// Clients are authenticated by config, while repositories are resolved,
+// authorized and hooked the same as over HTTP. It always returns a non-nil
+// error, like http.Serve.
+func (s *Server) ServeSSH(l net.Listener, config *ssh.ServerConfig) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.h.serveSSHConn(conn, config)
+	}
+}
+
+func (h *handler) serveSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	if !h.ipFilter.allows(conn.RemoteAddr().String()) {
+		h.logger.Info("Client address denied", Field{"remote", conn.RemoteAddr()})
+		conn.Close()
+		return
+	}
+
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		h.logger.Debug("SSH handshake failed", Field{"remote", conn.RemoteAddr()}, Field{"error", err})
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	identity := sconn.User()
+	if sconn.Permissions != nil {
+		if id, ok := sconn.Permissions.Extensions[SSHIdentityExtension]; ok {
+			identity = id
+		}
+	}
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			h.logger.Debug("Accepting SSH channel failed", Field{"error", err})
+			continue
+		}
+		go h.serveSSHSession(sconn, identity, ch, chReqs)
+	}
+}
+
+// serveSSHSession waits for the exec request of a session, ignoring
+// everything but the GIT_PROTOCOL environment variable before it.
+func (h *handler) serveSSHSession(sconn *ssh.ServerConn, identity string, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	var protocol string
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var env struct{ Name, Value string }
+			ok := ssh.Unmarshal(req.Payload, &env) == nil &&
+				env.Name == "GIT_PROTOCOL" && gitProtocolRe.MatchString(env.Value)
+			if ok {
+				protocol = env.Value
+			}
+			req.Reply(ok, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+
+			var status uint32
+			if !h.serveSSHExec(sconn, identity, protocol, ch, payload.Command) {
+				status = 1
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// parseSSHCommand parses the command Git clients run over SSH, such as
+// git-upload-pack '/org/repo.git', returning the service and repository
+// name.
+func parseSSHCommand(command string) (service, name string, ok bool) {
+	if strings.HasPrefix(command, "git ") {
+		command = "git-" + command[len("git "):]
+	}
+
+	i := strings.IndexByte(command, ' ')
+	if i < 0 {
+		return "", "", false
+	}
+
+	service, arg := command[:i], strings.TrimSpace(command[i+1:])
+	switch service {
+	case "git-upload-pack", "git-receive-pack":
+	default:
+		return "", "", false
+	}
+
+	if len(arg) < 2 || arg[0] != '\'' || arg[len(arg)-1] != '\'' {
+		return "", "", false
+	}
+
+	// Git quotes embedded single quotes, which no valid name contains.
+	name = strings.TrimPrefix(arg[1:len(arg)-1], "/")
+	if strings.ContainsAny(name, "'\\") || !validRepoName(name) {
+		return "", "", false
+	}
+	return service, name, true
+}
+
+// serveSSHExec runs the Git command requested over an SSH session, returning
+// whether it succeeded.
+func (h *handler) serveSSHExec(sconn *ssh.ServerConn, identity, protocol string, ch ssh.Channel, command string) bool {
+	service, name, ok := parseSSHCommand(command)
+	if !ok {
+		h.logger.Info("Invalid SSH command", Field{"user", identity}, Field{"command", command})
+		fmt.Fprintf(ch.Stderr(), "invalid command %q\n", command)
+		return false
+	}
+
+	return h.serveSession(&session{
+		transport:  "ssh",
+		identity:   identity,
+		protocol:   protocol,
+		remoteAddr: sconn.RemoteAddr().String(),
+		rw:         ch,
+		stderr:     ch.Stderr(),
+	}, service, name)
+}
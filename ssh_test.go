@@ -0,0 +1,145 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseSSHCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		service string
+		name    string
+		ok      bool
+	}{
+		{"git-upload-pack '/org/app.git'", "git-upload-pack", "org/app.git", true},
+		{"git-receive-pack 'app.git'", "git-receive-pack", "app.git", true},
+		{"git upload-pack '/app.git'", "git-upload-pack", "app.git", true},
+		{"git-upload-archive '/app.git'", "", "", false},
+		{"git-upload-pack /app.git", "", "", false},
+		{"git-upload-pack '/../app.git'", "", "", false},
+		{"git-upload-pack ''\\''app.git'", "", "", false},
+		{"sh -c 'id'", "", "", false},
+	}
+
+	for _, tt := range tests {
+		service, name, ok := parseSSHCommand(tt.command)
+		assert.Equals(t, tt.ok, ok)
+		assert.Equals(t, tt.service, service)
+		assert.Equals(t, tt.name, name)
+	}
+}
+
+func TestServeSSH(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh client not found")
+	}
+
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "app.git")
+	initBareRepo(t, rpath, "readonly.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Ok(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	assert.Ok(t, err)
+
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Ok(t, err)
+	clientPub, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	assert.Ok(t, err)
+
+	keyFile := filepath.Join(workspace, "id_rsa")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(clientKey),
+	}), 0600)
+	assert.Ok(t, err)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientPub.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{SSHIdentityExtension: "alice"}}, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	var pushedBy string
+	var pushResult *PushResult
+	srv, err := NewServer(http.NotFoundHandler(),
+		ReposPath(rpath),
+		AuthorizeRepo(func(user, repo string, op Operation) bool {
+			return op == Fetch || repo != "readonly.git"
+		}),
+		PreReceive(func(r *http.Request, repo string, updates []RefUpdate) error {
+			if updates[0].Name == "refs/heads/locked" {
+				return errors.New("locked is frozen")
+			}
+			return nil
+		}),
+		PostReceive(func(r *http.Request, repo string, updates []RefUpdate) error {
+			pushedBy, _ = IdentityFromContext(r.Context())
+			pushResult, _ = PushReport(r)
+			return nil
+		}),
+	)
+	assert.Ok(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer l.Close()
+	go srv.ServeSSH(l, config)
+
+	port := l.Addr().(*net.TCPAddr).Port
+	os.Setenv("GIT_SSH_COMMAND", fmt.Sprintf("ssh -p %d -i %s -o IdentitiesOnly=yes -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null", port, keyFile))
+	defer os.Unsetenv("GIT_SSH_COMMAND")
+
+	url := fmt.Sprintf("ssh://git@127.0.0.1:%d/", port)
+	dir := filepath.Join(workspace, "app")
+	cloneAndCommit(t, url+"app.git", dir, "over ssh")
+	git(t, dir, "push", "origin", "master")
+	assert.Equals(t, "alice", pushedBy)
+	assert.Cond(t, pushResult != nil, "push result should have been reported")
+	assert.Equals(t, 1, len(pushResult.Accepted()))
+	assert.Equals(t, "refs/heads/master", pushResult.Refs[0].Name)
+
+	// Hooks and authorization apply the same as over HTTP.
+	err = exec.Command("git", "-C", dir, "push", "origin", "master:locked").Run()
+	assert.Cond(t, err != nil, "push rejected by pre-receive hook should fail")
+	err = exec.Command("git", "-C", dir, "push", url+"readonly.git", "master").Run()
+	assert.Cond(t, err != nil, "push to read-only repository should fail")
+	err = exec.Command("git", "-C", dir, "fetch", url+"missing.git").Run()
+	assert.Cond(t, err != nil, "fetch from missing repository should fail")
+
+	git(t, workspace, "clone", url+"app.git", "copy")
+	content, err := ioutil.ReadFile(filepath.Join(workspace, "copy", "README.md"))
+	assert.Ok(t, err)
+	assert.Equals(t, "over ssh", string(content))
+}
@@ -0,0 +1,193 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxStderrTail bounds the stderr output kept to describe Git failures.
+const maxStderrTail = 4096
+
+// stderrWriter logs the stderr output of a Git process line by line as it
+// is written, relaying it to w if set.
+type stderrWriter struct {
+	logger  Logger
+	fields  []Field
+	w       io.Writer
+	partial []byte
+	tail    []byte
+}
+
+func (s *stderrWriter) Write(p []byte) (int, error) {
+	s.tail = append(s.tail, p...)
+	if len(s.tail) > maxStderrTail {
+		s.tail = s.tail[len(s.tail)-maxStderrTail:]
+	}
+
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexAny(s.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		s.line(s.partial[:i+1])
+		s.partial = s.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (s *stderrWriter) line(line []byte) {
+	if msg := strings.TrimSpace(string(line)); msg != "" {
+		s.logger.Info("Git stderr", append(s.fields, Field{"line", msg})...)
+	}
+	if s.w != nil {
+		s.w.Write(line)
+	}
+}
+
+// Close logs and relays any incomplete last line.
+func (s *stderrWriter) Close() error {
+	if len(s.partial) > 0 {
+		s.line(append(s.partial, '\n'))
+		s.partial = nil
+	}
+	return nil
+}
+
+// String returns the end of the output, for error messages.
+func (s *stderrWriter) String() string {
+	return strings.TrimSpace(string(s.tail))
+}
+
+// sidebandRelay passes the output of a Git process through to a client,
+// injecting messages into it as sideband progress packets, which clients
+// print prefixed with "remote:". Messages are injected between packets once
+// the output turns out to be multiplexed, holding back the final flush
+// packet until Close. They are dropped if it never does.
+type sidebandRelay struct {
+	http.ResponseWriter
+	mu          sync.Mutex
+	buf         []byte
+	pending     [][]byte
+	flush       bool
+	sideband    bool
+	passthrough bool
+}
+
+func (s *sidebandRelay) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.passthrough {
+		return s.ResponseWriter.Write(p)
+	}
+
+	s.buf = append(s.buf, p...)
+	for len(s.buf) >= 4 {
+		n, err := strconv.ParseUint(string(s.buf[:4]), 16, 16)
+		if err != nil || n == 3 {
+			// Not packets, such as a pack sent without sideband.
+			s.passthrough = true
+			s.pending = nil
+			s.ResponseWriter.Write(s.buf)
+			s.buf = nil
+			break
+		}
+
+		// Flush, delimiter and response end packets have no length.
+		size := int(n)
+		if n < 4 {
+			size = 4
+		}
+		if len(s.buf) < size {
+			break
+		}
+
+		if s.flush {
+			s.ResponseWriter.Write(packetFlush())
+			s.flush = false
+		}
+
+		if n == 0 {
+			s.flush = true
+		} else {
+			if _, err := s.ResponseWriter.Write(s.buf[:size]); err != nil {
+				return 0, err
+			}
+			if size > 4 && s.buf[4] >= 1 && s.buf[4] <= 3 {
+				s.sideband = true
+			}
+			if s.sideband {
+				s.writePending()
+			}
+		}
+		s.buf = s.buf[size:]
+	}
+	return len(p), nil
+}
+
+func (s *sidebandRelay) writePending() {
+	for _, msg := range s.pending {
+		sidebandWrite(s.ResponseWriter, 2, msg, 995)
+	}
+	s.pending = nil
+}
+
+// message relays msg to the client, as soon as that is possible.
+func (s *sidebandRelay) message(msg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.passthrough:
+	case s.sideband && len(s.buf) == 0 && !s.flush:
+		sidebandWrite(s.ResponseWriter, 2, msg, 995)
+	default:
+		s.pending = append(s.pending, append([]byte(nil), msg...))
+	}
+}
+
+// Close writes the messages left and the final flush packet.
+func (s *sidebandRelay) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sideband {
+		s.writePending()
+	}
+	if s.flush {
+		s.ResponseWriter.Write(packetFlush())
+		s.flush = false
+	}
+
+	if len(s.buf) > 0 {
+		s.ResponseWriter.Write(s.buf)
+		s.buf = nil
+	}
+	return nil
+}
+
+// Flush flushes the underlying writer, if it supports it.
+func (s *sidebandRelay) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// messageWriter adapts sidebandRelay.message to io.Writer.
+type messageWriter struct {
+	relay *sidebandRelay
+}
+
+func (m messageWriter) Write(p []byte) (int, error) {
+	m.relay.message(p)
+	return len(p), nil
+}
@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestSidebandRelay(t *testing.T) {
+	report := string(packetWrite("unpack ok\n")) + string(packetWrite("ok refs/heads/master\n")) + string(packetFlush())
+
+	tests := []struct {
+		output   []string
+		messages []string
+		expected string
+	}{
+		// Messages are injected between packets and before the final
+		// flush packet, even if Git writes packets in pieces.
+		{
+			[]string{string(packetWrite("\x01" + report))[:7], string(packetWrite("\x01" + report))[7:] + string(packetFlush())},
+			[]string{"hook says hi\n"},
+			string(packetWrite("\x01"+report)) + string(packetWrite("\x02hook says hi\n")) + string(packetFlush()),
+		},
+		// Output without sideband is passed through untouched.
+		{
+			[]string{report},
+			[]string{"hook says hi\n"},
+			report,
+		},
+		{
+			[]string{"Internal Server Error"},
+			nil,
+			"Internal Server Error",
+		},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		relay := &sidebandRelay{ResponseWriter: w}
+
+		relay.Write([]byte(tt.output[0]))
+		for _, msg := range tt.messages {
+			messageWriter{relay}.Write([]byte(msg))
+		}
+		for _, out := range tt.output[1:] {
+			relay.Write([]byte(out))
+		}
+		relay.Close()
+
+		assert.Equals(t, tt.expected, w.Body.String())
+	}
+}
+
+func TestStderrWriter(t *testing.T) {
+	logger := &recordingLogger{}
+	var relayed bytes.Buffer
+	stderr := &stderrWriter{logger: logger, w: &relayed}
+
+	stderr.Write([]byte("error: hook "))
+	stderr.Write([]byte("declined\nfatal: "))
+	assert.Equals(t, 1, logger.count("Git stderr"))
+
+	stderr.Write([]byte("the remote end hung up"))
+	stderr.Close()
+	assert.Equals(t, 2, logger.count("Git stderr"))
+	assert.Equals(t, "error: hook declined\nfatal: the remote end hung up\n", relayed.String())
+	assert.Equals(t, "error: hook declined\nfatal: the remote end hung up", stderr.String())
+}
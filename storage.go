@@ -0,0 +1,352 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Storage locates the local directories repositories live in, so they can
+// be spread over several roots, such as NFS volumes, laid out per tenant or
+// synced from elsewhere, such as object storage. Git runs in the
+// directories it returns, so they must be available locally by then.
+type Storage interface {
+	// Dir returns the directory holding the repository name, such as
+	// "org/repo.git", whether or not the repository exists.
+	Dir(ctx context.Context, name string) (string, error)
+	// Walk calls fn with the name and directory of every bare repository,
+	// stopping at the first error it returns.
+	Walk(fn func(name, dir string) error) error
+}
+
+// RepoStorage sets where repositories live. By default, they live under the
+// repositories path. The default resolver locates repositories through it.
+func RepoStorage(s Storage) Option {
+	return func(h *handler) {
+		h.storage = s
+	}
+}
+
+// DirStorage keeps repositories under root, named after their path relative
+// to it.
+func DirStorage(root string) Storage {
+	return dirStorage(root)
+}
+
+type dirStorage string
+
+func (s dirStorage) Dir(ctx context.Context, name string) (string, error) {
+	return filepath.Join(string(s), filepath.FromSlash(name)), nil
+}
+
+func (s dirStorage) Walk(fn func(name, dir string) error) error {
+	return walkDir(string(s), fn)
+}
+
+func (s dirStorage) roots() []string {
+	return []string{string(s)}
+}
+
+// noStorage holds no repositories, for servers proxying to another one or
+// locating repositories with their own resolver.
+type noStorage struct{}
+
+func (noStorage) Dir(ctx context.Context, name string) (string, error) {
+	return "", ErrNoReposPath
+}
+
+func (noStorage) Walk(fn func(name, dir string) error) error {
+	return nil
+}
+
+// ShardedStorage spreads repositories over roots, such as NFS volumes,
+// picking the root of each repository by hashing its name. Adding or
+// removing roots moves most repositories to a different one, so roots are
+// meant to be fixed once repositories are stored.
+func ShardedStorage(roots ...string) Storage {
+	return shardedStorage(roots)
+}
+
+type shardedStorage []string
+
+func (s shardedStorage) Dir(ctx context.Context, name string) (string, error) {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	root := s[int(hash.Sum32()%uint32(len(s)))]
+	return filepath.Join(root, filepath.FromSlash(name)), nil
+}
+
+func (s shardedStorage) Walk(fn func(name, dir string) error) error {
+	for _, root := range s {
+		if err := walkDir(root, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s shardedStorage) roots() []string {
+	return s
+}
+
+// RootsStorage keeps repositories under several roots, looking them up in
+// each root in order. New repositories are created in the first root.
+// Repositories in a root shadow those with the same name in later ones.
+func RootsStorage(roots ...string) Storage {
+	if len(roots) == 1 {
+		return DirStorage(roots[0])
+	}
+	return rootsStorage(roots)
+}
+
+type rootsStorage []string
+
+func (s rootsStorage) Dir(ctx context.Context, name string) (string, error) {
+	for _, root := range s {
+		dir := filepath.Join(root, filepath.FromSlash(name))
+		if _, err := os.Stat(dir); err == nil {
+			return dir, nil
+		}
+	}
+	return filepath.Join(s[0], filepath.FromSlash(name)), nil
+}
+
+func (s rootsStorage) Walk(fn func(name, dir string) error) error {
+	seen := make(map[string]bool)
+	for _, root := range s {
+		err := walkDir(root, func(name, dir string) error {
+			if seen[name] {
+				return nil
+			}
+			seen[name] = true
+			return fn(name, dir)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s rootsStorage) roots() []string {
+	return s
+}
+
+// PrefixStorage keeps repositories under the root mapped to the first
+// segments of their names, such as {"legacy": "/mnt/old", "": "/srv/git"},
+// where legacy/foo.git lives in /mnt/old/foo.git and bar.git in
+// /srv/git/bar.git. The longest prefix matching a name wins. Names matching
+// no prefix do not belong to any repository.
+func PrefixStorage(roots map[string]string) Storage {
+	s := make(prefixStorage, len(roots))
+	for prefix, root := range roots {
+		s[strings.Trim(prefix, "/")] = root
+	}
+	return s
+}
+
+type prefixStorage map[string]string
+
+// split returns the root the repository name lives under, and its name
+// relative to it.
+func (s prefixStorage) split(name string) (string, string, bool) {
+	var match string
+	found := false
+	for prefix := range s {
+		if prefix != "" && !strings.HasPrefix(name, prefix+"/") {
+			continue
+		}
+		if !found || len(prefix) > len(match) {
+			match, found = prefix, true
+		}
+	}
+	if !found {
+		return "", "", false
+	}
+	return s[match], strings.TrimPrefix(strings.TrimPrefix(name, match), "/"), true
+}
+
+func (s prefixStorage) Dir(ctx context.Context, name string) (string, error) {
+	root, rel, ok := s.split(name)
+	if !ok {
+		return "", ErrRepoNotFound
+	}
+	return filepath.Join(root, filepath.FromSlash(rel)), nil
+}
+
+func (s prefixStorage) Walk(fn func(name, dir string) error) error {
+	var prefixes []string
+	for prefix := range s {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	for _, prefix := range prefixes {
+		err := walkDir(s[prefix], func(name, dir string) error {
+			if prefix != "" {
+				name = prefix + "/" + name
+			}
+			// Repositories under another root are not reachable by name.
+			if root, _, _ := s.split(name); root != s[prefix] {
+				return nil
+			}
+			return fn(name, dir)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s prefixStorage) roots() []string {
+	var roots []string
+	for _, root := range s {
+		roots = append(roots, root)
+	}
+	return roots
+}
+
+// rooted is implemented by storages and resolvers keeping repositories under
+// known roots, which the directories they return must stay within.
+type rooted interface {
+	roots() []string
+}
+
+// confined returns whether dir stays within the root holding it once
+// symbolic links are resolved, if r keeps repositories under known roots.
+// Otherwise, a link in a root could expose any directory on the host.
+func confined(r interface{}, dir string) bool {
+	rr, ok := r.(rooted)
+	if !ok {
+		return true
+	}
+	roots := rr.roots()
+	if len(roots) == 0 {
+		return true
+	}
+
+	// Roots may be nested, so dir must stay within the innermost one.
+	var root string
+	for _, rt := range roots {
+		if within(rt, dir) && len(rt) > len(root) {
+			root = rt
+		}
+	}
+	if root == "" {
+		return false
+	}
+
+	realRoot, err := evalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	realDir, err := evalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	return within(realRoot, realDir) && sameCase(root, dir, realRoot, realDir)
+}
+
+// within returns whether p is root or lies under it.
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// evalSymlinks resolves the symbolic links in p like filepath.EvalSymlinks,
+// but allows its last elements not to exist yet, as for repositories about
+// to be created. Dangling links are not followed.
+func evalSymlinks(p string) (string, error) {
+	real, err := filepath.EvalSymlinks(p)
+	if !os.IsNotExist(err) {
+		return real, err
+	}
+	if _, lerr := os.Lstat(p); lerr == nil {
+		return "", err
+	}
+
+	parent := filepath.Dir(p)
+	if parent == p {
+		return "", err
+	}
+	real, err = evalSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(real, filepath.Base(p)), nil
+}
+
+// walkDir calls fn with the name and directory of every bare repository
+// under root, stopping at the first error it returns.
+func walkDir(root string, fn func(name, dir string) error) error {
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Hidden directories hold repositories being created.
+		if fi.IsDir() && p != root && strings.HasPrefix(fi.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		if !fi.IsDir() || !isBareRepo(p) {
+			return nil
+		}
+
+		name, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if err := fn(filepath.ToSlash(name), p); err != nil {
+			return err
+		}
+		return filepath.SkipDir
+	})
+}
+
+// locateRepo returns the directory of the existing bare repository name,
+// writing an admin API error response if there is none.
+func (h *handler) locateRepo(w http.ResponseWriter, req *http.Request, name string) (string, bool) {
+	dir, err := h.repoDir(req.Context(), name)
+	switch err {
+	case nil:
+		return dir, true
+	case ErrInvalidRepoName:
+		writeError(w, http.StatusBadRequest, err.Error())
+	case ErrRepoNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, "unable to locate repository")
+	}
+	return "", false
+}
+
+// repoDir returns the directory of the existing bare repository name.
+func (h *handler) repoDir(ctx context.Context, name string) (string, error) {
+	if !validRepoName(name) {
+		return "", ErrInvalidRepoName
+	}
+
+	dir, err := h.storage.Dir(ctx, name)
+	if err == ErrRepoNotFound {
+		return "", err
+	}
+	if err != nil {
+		h.logger.Error("Locating repository failed", Field{"repo", name}, Field{"error", err})
+		return "", err
+	}
+
+	if !confined(h.storage, dir) || !isBareRepo(dir) {
+		return "", ErrRepoNotFound
+	}
+	return dir, nil
+}
@@ -0,0 +1,138 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestShardedStorage(t *testing.T) {
+	var roots []string
+	for i := 0; i < 2; i++ {
+		root, err := ioutil.TempDir(os.TempDir(), "gitd-shard")
+		assert.Ok(t, err)
+		defer os.RemoveAll(root)
+		roots = append(roots, root)
+	}
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	storage := ShardedStorage(roots...)
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), RepoStorage(storage), AdminAPI()))
+	defer ts.Close()
+
+	// Names picked so they land on different shards.
+	names := []string{"a.git", "b.git"}
+	for _, name := range names {
+		res, err := http.Post(ts.URL+"/api/repos", "application/json", strings.NewReader(`{"name": "`+name+`"}`))
+		assert.Ok(t, err)
+		res.Body.Close()
+		assert.Equals(t, http.StatusCreated, res.StatusCode)
+	}
+
+	shards := make(map[string]bool)
+	for _, name := range names {
+		dir, err := storage.Dir(context.Background(), name)
+		assert.Ok(t, err)
+		assert.Cond(t, isBareRepo(dir), "repository %s should be stored in %s", name, dir)
+		shards[filepath.Dir(dir)] = true
+	}
+	assert.Equals(t, 2, len(shards))
+
+	res, err := http.Get(ts.URL + "/api/repos")
+	assert.Ok(t, err)
+	var repos []repoInfo
+	assert.Ok(t, json.NewDecoder(res.Body).Decode(&repos))
+	res.Body.Close()
+	assert.Equals(t, 2, len(repos))
+
+	clone := filepath.Join(workspace, "b")
+	cloneAndCommit(t, ts.URL+"/b.git", clone, "blah")
+	git(t, clone, "push", "-q", "origin", "master")
+	git(t, workspace, "clone", "-q", ts.URL+"/b.git", filepath.Join(workspace, "fetched"))
+}
+
+func TestReposPaths(t *testing.T) {
+	var roots []string
+	for i := 0; i < 2; i++ {
+		root, err := ioutil.TempDir(os.TempDir(), "gitd-root")
+		assert.Ok(t, err)
+		defer os.RemoveAll(root)
+		roots = append(roots, root)
+	}
+	initBareRepo(t, roots[1], "legacy.git")
+	initBareRepo(t, roots[1], "shadowed.git")
+	initBareRepo(t, roots[0], "shadowed.git")
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(roots[0], roots[1]), AdminAPI()))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/legacy.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+
+	res, err = http.Post(ts.URL+"/api/repos", "application/json", strings.NewReader(`{"name": "new.git"}`))
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusCreated, res.StatusCode)
+	assert.Cond(t, isBareRepo(filepath.Join(roots[0], "new.git")), "new repositories should be created in the first root")
+
+	res, err = http.Get(ts.URL + "/api/repos")
+	assert.Ok(t, err)
+	var repos []repoInfo
+	assert.Ok(t, json.NewDecoder(res.Body).Decode(&repos))
+	res.Body.Close()
+	assert.Equals(t, []repoInfo{{Name: "new.git"}, {Name: "shadowed.git"}, {Name: "legacy.git"}}, repos)
+}
+
+func TestPrefixStorage(t *testing.T) {
+	legacy, err := ioutil.TempDir(os.TempDir(), "gitd-legacy")
+	assert.Ok(t, err)
+	defer os.RemoveAll(legacy)
+	current, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(current)
+
+	initBareRepo(t, legacy, "old.git")
+	initBareRepo(t, current, "new.git")
+
+	storage := PrefixStorage(map[string]string{"legacy/": legacy, "": current})
+	dir, err := storage.Dir(context.Background(), "legacy/old.git")
+	assert.Ok(t, err)
+	assert.Equals(t, filepath.Join(legacy, "old.git"), dir)
+	dir, err = storage.Dir(context.Background(), "new.git")
+	assert.Ok(t, err)
+	assert.Equals(t, filepath.Join(current, "new.git"), dir)
+
+	var names []string
+	assert.Ok(t, storage.Walk(func(name, dir string) error {
+		names = append(names, name)
+		return nil
+	}))
+	assert.Equals(t, []string{"new.git", "legacy/old.git"}, names)
+
+	_, err = PrefixStorage(map[string]string{"legacy": legacy}).Dir(context.Background(), "new.git")
+	assert.Equals(t, ErrRepoNotFound, err)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), RepoStorage(storage)))
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/legacy/old.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusOK, res.StatusCode)
+}
@@ -0,0 +1,131 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"strings"
+)
+
+// Tenant isolates the repositories of a customer sharing the server with
+// others.
+type Tenant struct {
+	// Name identifies the tenant, and is the first segment of the names of
+	// its repositories, and so of their URLs, as in /acme/app.git.
+	Name string
+	// Root is the directory the repositories of the tenant live in, by their
+	// name within the tenant, as in app.git.
+	Root string
+	// Quota limits the disk space the repositories of the tenant can take up
+	// altogether, in bytes, zero meaning no limit. Pushes that would exceed
+	// it are rejected.
+	Quota int64
+	// OpsPerMinute and BytesPerMinute limit the rate of Git operations of
+	// every client of the tenant, as RateLimit does, in its place, zero
+	// meaning no limit.
+	OpsPerMinute   int
+	BytesPerMinute int64
+	// Realm is the realm clients of the tenant are challenged with, so their
+	// credentials are not mixed up with those of other tenants.
+	Realm string
+	// UID and GID are the user and group Git runs as on the repositories of
+	// the tenant, as RunAs does, in its place, zero meaning RunAs's.
+	UID, GID uint32
+}
+
+// Tenants serves the repositories of several tenants, each from its own
+// root, with its own limits. Unless stored elsewhere with RepoStorage,
+// repositories outside of any tenant are not found. Metrics and audit events
+// carry the tenant of repositories, and the admin API lists the repositories
+// of a tenant with GET /api/repos?tenant={name}, which Authorize callbacks
+// are asked about as the repository {name}.
+func Tenants(tenants ...Tenant) Option {
+	return func(h *handler) {
+		if h.tenants == nil {
+			h.tenants = make(map[string]*tenant)
+		}
+		for _, t := range tenants {
+			tt := &tenant{Tenant: t}
+			if t.OpsPerMinute > 0 || t.BytesPerMinute > 0 {
+				tt.rateLimiter = &rateLimiter{
+					ops:     float64(t.OpsPerMinute),
+					bytes:   float64(t.BytesPerMinute),
+					clients: make(map[string]*rateBuckets),
+				}
+			}
+			h.tenants[strings.Trim(t.Name, "/")] = tt
+		}
+	}
+}
+
+// tenant holds the state of a Tenant.
+type tenant struct {
+	Tenant
+	rateLimiter *rateLimiter
+}
+
+// tenantStorage returns the storage of the repositories of tenants.
+func tenantStorage(tenants map[string]*tenant) Storage {
+	roots := make(map[string]string, len(tenants))
+	for name, t := range tenants {
+		roots[name] = t.Root
+	}
+	return PrefixStorage(roots)
+}
+
+// tenantOf returns the tenant the repository name belongs to, if any.
+func (h *handler) tenantOf(name string) *tenant {
+	if h.tenants == nil {
+		return nil
+	}
+	if i := strings.Index(name, "/"); i >= 0 {
+		name = name[:i]
+	}
+	return h.tenants[name]
+}
+
+// tenantName returns the name of the tenant the repository name belongs to,
+// if any.
+func (h *handler) tenantName(name string) string {
+	if t := h.tenantOf(name); t != nil {
+		return t.Name
+	}
+	return ""
+}
+
+// limiterFor returns the rate limiter of the clients of the repository name,
+// if they are limited.
+func (h *handler) limiterFor(name string) *rateLimiter {
+	if t := h.tenantOf(name); t != nil && t.rateLimiter != nil {
+		return t.rateLimiter
+	}
+	return h.rateLimiter
+}
+
+// checkTenantQuota returns the quota of the tenant of the repository name
+// and its usage, or quotaError if it is already exhausted.
+func (h *handler) checkTenantQuota(name string) (limit, used int64, err error) {
+	t := h.tenantOf(name)
+	if t == nil || t.Quota <= 0 {
+		return 0, 0, nil
+	}
+
+	if used, err = h.quotas.used(t.Root); err != nil {
+		return t.Quota, used, err
+	}
+	if used >= t.Quota {
+		return t.Quota, used, quotaError(t.Quota, used)
+	}
+	return t.Quota, used, nil
+}
+
+// hasTenantQuotas returns whether any tenant has a quota.
+func (h *handler) hasTenantQuotas() bool {
+	for _, t := range h.tenants {
+		if t.Quota > 0 {
+			return true
+		}
+	}
+	return false
+}
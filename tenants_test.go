@@ -0,0 +1,104 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestTenants(t *testing.T) {
+	acme, err := ioutil.TempDir(os.TempDir(), "gitd-acme")
+	assert.Ok(t, err)
+	defer os.RemoveAll(acme)
+	initBareRepo(t, acme, "app.git")
+
+	globex, err := ioutil.TempDir(os.TempDir(), "gitd-globex")
+	assert.Ok(t, err)
+	defer os.RemoveAll(globex)
+	initBareRepo(t, globex, "app.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	var audit bytes.Buffer
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		Tenants(
+			Tenant{Name: "acme", Root: acme, OpsPerMinute: 2, Realm: "Acme"},
+			Tenant{Name: "globex", Root: globex, Quota: 1},
+		),
+		BasicAuth("gitd", func(user, pass string) bool {
+			return user == "alice" && pass == "secret"
+		}),
+		AdminAPI(),
+		Metrics("/metrics"),
+		AuditLog(JSONAuditSink(&audit)),
+	))
+	defer ts.Close()
+	authURL := strings.Replace(ts.URL, "http://", "http://alice:secret@", 1)
+
+	// Clients are challenged with the realm of the tenant.
+	res, err := http.Get(ts.URL + "/acme/app.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Equals(t, `Basic realm="Acme"`, res.Header.Get("WWW-Authenticate"))
+
+	res, err = http.Get(ts.URL + "/globex/app.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, `Basic realm="gitd"`, res.Header.Get("WWW-Authenticate"))
+
+	// Repositories outside of tenants are not found.
+	res, err = http.Get(authURL + "/app.git/info/refs?service=git-upload-pack")
+	assert.Ok(t, err)
+	res.Body.Close()
+	assert.Equals(t, http.StatusNotFound, res.StatusCode)
+
+	// Rate limits apply to the clients of their tenant only.
+	for _, status := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		res, err = http.Get(authURL + "/acme/app.git/info/refs?service=git-upload-pack")
+		assert.Ok(t, err)
+		res.Body.Close()
+		assert.Equals(t, status, res.StatusCode)
+	}
+
+	clone := filepath.Join(workspace, "globex")
+	cloneAndCommit(t, authURL+"/globex/app.git", clone, "blah")
+
+	cmd := exec.Command("git", "push", "origin", "master")
+	cmd.Dir = clone
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "push exceeding the tenant quota should fail")
+	assert.Cond(t, strings.Contains(string(out), "repository quota exceeded"), "unexpected output: %s", out)
+
+	res, err = http.Get(authURL + "/api/repos?tenant=acme")
+	assert.Ok(t, err)
+	var repos []repoInfo
+	assert.Ok(t, json.NewDecoder(res.Body).Decode(&repos))
+	res.Body.Close()
+	assert.Equals(t, []repoInfo{{Name: "acme/app.git", Tenant: "acme"}}, repos)
+
+	res, err = http.Get(authURL + "/metrics")
+	assert.Ok(t, err)
+	metrics, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Ok(t, err)
+	assert.Cond(t, strings.Contains(string(metrics), `repo="acme/app.git",service="git-upload-pack",tenant="acme",user="alice"`), "unexpected metrics: %s", metrics)
+
+	assert.Cond(t, strings.Contains(audit.String(), `"repo":"globex/app.git"`), "unexpected audit log: %s", audit.String())
+	assert.Cond(t, strings.Contains(audit.String(), `"tenant":"globex"`), "unexpected audit log: %s", audit.String())
+}
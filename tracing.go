@@ -0,0 +1,262 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Tracer starts the spans operations are traced with. It adapts a tracing
+// library, such as OpenTelemetry, to gitd. Spans for requests propagating a
+// trace through the traceparent header are to be started as children of the
+// span RemoteSpanContext returns, such as with OpenTelemetry's
+// trace.ContextWithRemoteSpanContext, unless ctx already holds a span.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Field) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer. Spans may be ended from a goroutine
+// other than the one starting them.
+type Span interface {
+	SetAttributes(attrs ...Field)
+	RecordError(err error)
+	End()
+}
+
+// Tracing traces every Git operation, with a span per operation and child
+// spans for running Git, reading its input and writing its output.
+func Tracing(t Tracer) Option {
+	return func(h *handler) {
+		h.tracer = t
+	}
+}
+
+// SpanContext identifies the span of a trace a request is part of.
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Sampled    bool
+	TraceState string
+}
+
+// spanContextKey is the context key under which the span context propagated
+// by clients is stored.
+type spanContextKey struct{}
+
+// RemoteSpanContext returns the span context clients propagated, in W3C
+// Trace Context headers, for requests traced under ctx.
+func RemoteSpanContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// parseTraceParent returns the span context propagated in header, per the
+// W3C Trace Context specification.
+func parseTraceParent(header http.Header) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(header.Get("Traceparent")), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+
+	var flags [1]byte
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, false
+	}
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+
+	sc.Sampled = flags[0]&1 == 1
+	sc.TraceState = strings.Join(header["Tracestate"], ",")
+	return sc, true
+}
+
+// traceRequest starts the span of the operation req asks for, as a child of
+// the span clients propagated, if any. It returns req with the span in its
+// context, and w recording the response status in it once ended.
+func (h *handler) traceRequest(w http.ResponseWriter, req *http.Request, repo string, op Operation) (*tracedResponseWriter, *http.Request) {
+	ctx := req.Context()
+	if sc, ok := parseTraceParent(req.Header); ok {
+		ctx = context.WithValue(ctx, spanContextKey{}, sc)
+	}
+	ctx, span := h.tracer.Start(ctx, "gitd "+op.String(),
+		Field{"repo", repo},
+		Field{"operation", op.String()},
+		Field{"http.method", req.Method},
+		Field{"http.target", req.URL.Path},
+	)
+	return &tracedResponseWriter{ResponseWriter: w, span: span}, req.WithContext(ctx)
+}
+
+// tracedResponseWriter records the status of a response in the span of its
+// operation.
+type tracedResponseWriter struct {
+	http.ResponseWriter
+	span   Span
+	status int
+}
+
+func (t *tracedResponseWriter) WriteHeader(status int) {
+	if t.status == 0 {
+		t.status = status
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *tracedResponseWriter) Write(p []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	return t.ResponseWriter.Write(p)
+}
+
+// Flush flushes the underlying writer, if it supports it.
+func (t *tracedResponseWriter) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// end ends the span of the operation.
+func (t *tracedResponseWriter) end() {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	t.span.SetAttributes(Field{"http.status_code", t.status})
+	t.span.End()
+}
+
+// startSpan starts a span named name, as a child of the span in ctx.
+func (h *handler) startSpan(ctx context.Context, name string, attrs ...Field) (context.Context, Span) {
+	if h.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return h.tracer.Start(ctx, name, attrs...)
+}
+
+// traceIO traces reading r and writing to w with child spans of the span in
+// ctx, reading the input until it is exhausted, and writing the output from
+// its first byte on. The function returned ends the spans still open.
+func (h *handler) traceIO(ctx context.Context, r io.Reader, w io.Writer) (io.Reader, io.Writer, func()) {
+	if h.tracer == nil {
+		return r, w, func() {}
+	}
+
+	in := &tracedReader{r: r}
+	_, in.span = h.tracer.Start(ctx, "read input")
+	out := &tracedWriter{w: w, start: func() Span {
+		_, span := h.tracer.Start(ctx, "write output")
+		return span
+	}}
+	return in, out, func() {
+		in.end()
+		out.end()
+	}
+}
+
+// tracedReader ends its span once its input is exhausted.
+type tracedReader struct {
+	r     io.Reader
+	mu    sync.Mutex
+	span  Span
+	n     int64
+	ended bool
+}
+
+func (t *tracedReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+
+	t.mu.Lock()
+	t.n += int64(n)
+	if err != nil && err != io.EOF && !t.ended {
+		t.span.RecordError(err)
+	}
+	t.mu.Unlock()
+
+	if err != nil {
+		t.end()
+	}
+	return n, err
+}
+
+func (t *tracedReader) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.ended {
+		t.ended = true
+		t.span.SetAttributes(Field{"bytes", t.n})
+		t.span.End()
+	}
+}
+
+// tracedWriter starts its span on the first write.
+type tracedWriter struct {
+	w     io.Writer
+	start func() Span
+	mu    sync.Mutex
+	span  Span
+	n     int64
+	ended bool
+}
+
+func (t *tracedWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	if t.span == nil && !t.ended {
+		t.span = t.start()
+	}
+	t.mu.Unlock()
+
+	n, err := t.w.Write(p)
+
+	t.mu.Lock()
+	t.n += int64(n)
+	if err != nil && t.span != nil {
+		t.span.RecordError(err)
+	}
+	t.mu.Unlock()
+	return n, err
+}
+
+// Flush flushes the underlying writer, if it supports it.
+func (t *tracedWriter) Flush() {
+	if f, ok := t.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (t *tracedWriter) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ended = true
+	if t.span != nil {
+		t.span.SetAttributes(Field{"bytes", t.n})
+		t.span.End()
+		t.span = nil
+	}
+}
+
+// noopSpan is the span of operations not traced.
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attrs ...Field) {}
+func (noopSpan) RecordError(err error)        {}
+func (noopSpan) End()                         {}
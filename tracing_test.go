@@ -0,0 +1,157 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+// recordedSpan is a span kept by recordingTracer.
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	remote SpanContext
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+// recordingTracer keeps every span started through it.
+type recordingTracer struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpanKey struct{}
+
+func (r *recordingTracer) Start(ctx context.Context, name string, attrs ...Field) (context.Context, Span) {
+	r.Lock()
+	defer r.Unlock()
+
+	s := &recordedSpan{name: name, attrs: make(map[string]interface{})}
+	s.parent, _ = ctx.Value(recordedSpanKey{}).(*recordedSpan)
+	s.remote, _ = RemoteSpanContext(ctx)
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+	r.spans = append(r.spans, s)
+	return context.WithValue(ctx, recordedSpanKey{}, s), &recordingSpan{r, s}
+}
+
+func (r *recordingTracer) find(name string) []*recordedSpan {
+	r.Lock()
+	defer r.Unlock()
+
+	var spans []*recordedSpan
+	for _, s := range r.spans {
+		if s.name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+type recordingSpan struct {
+	r *recordingTracer
+	s *recordedSpan
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Field) {
+	s.r.Lock()
+	defer s.r.Unlock()
+	for _, a := range attrs {
+		s.s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordingSpan) RecordError(err error) {
+	s.SetAttributes(Field{"error", err})
+}
+
+func (s *recordingSpan) End() {
+	s.r.Lock()
+	defer s.r.Unlock()
+	s.s.ended = true
+}
+
+func TestTracing(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	tracer := new(recordingTracer)
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), Tracing(tracer)))
+	defer ts.Close()
+
+	clone := filepath.Join(workspace, "test")
+	cloneAndCommit(t, ts.URL+"/test.git", clone, "traced")
+	traceparent := "traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	git(t, clone, "-c", "http.extraHeader="+traceparent, "push", "-q", "origin", "master")
+
+	pushes := tracer.find("gitd push")
+	assert.Equals(t, 2, len(pushes))
+	for _, s := range pushes {
+		assert.Cond(t, s.ended, "operation spans should be ended")
+		assert.Equals(t, "test.git", s.attrs["repo"])
+		assert.Equals(t, http.StatusOK, s.attrs["http.status_code"])
+		assert.Equals(t, "4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(s.remote.TraceID[:]))
+		assert.Cond(t, s.remote.Sampled, "sampled flag should be propagated")
+	}
+
+	execs := tracer.find("exec git-receive-pack")
+	assert.Equals(t, 2, len(execs))
+	for _, s := range execs {
+		assert.Cond(t, s.ended, "exec spans should be ended")
+		assert.Cond(t, s.parent != nil && s.parent.name == "gitd push", "exec spans should be children of operations")
+	}
+
+	for _, name := range []string{"read input", "write output"} {
+		spans := tracer.find(name)
+		assert.Cond(t, len(spans) > 0, "missing %s spans", name)
+		for _, s := range spans {
+			assert.Cond(t, s.ended, "%s spans should be ended", name)
+			assert.Cond(t, s.parent != nil && strings.HasPrefix(s.parent.name, "exec "), "%s spans should be children of exec spans", name)
+		}
+	}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		header := make(http.Header)
+		header.Set("Traceparent", tt.value)
+		_, ok := parseTraceParent(header)
+		assert.Equals(t, tt.ok, ok)
+	}
+}
@@ -0,0 +1,165 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// trashTimeFormat is the format of the time repositories were deleted at,
+// naming them in the trash, so they sort in the order they were deleted.
+const trashTimeFormat = "20060102T150405.000Z"
+
+// trashPurgeInterval is how often repositories kept in the trash longer
+// than their retention are purged.
+var trashPurgeInterval = time.Hour
+
+// Trash moves repositories deleted through the admin API to dir, where they
+// are kept for retention and can be restored with
+// POST /api/repos/{name}/undelete, rather than removing them at once. Clones
+// and fetches running on repositories being deleted complete. The trash must
+// be on the same file system as the repositories, outside of their roots.
+// Repositories kept longer than retention are purged every hour, until
+// Shutdown.
+func Trash(dir string, retention time.Duration) Option {
+	return func(h *handler) {
+		h.trash = &trash{dir: dir, retention: retention}
+	}
+}
+
+// trash keeps deleted repositories in dir, under their name and the time
+// they were deleted at, such as org/app.git/20200101T000000.000Z.
+type trash struct {
+	dir       string
+	retention time.Duration
+}
+
+// path returns where the repository name deleted at t is kept.
+func (t *trash) path(name string, at time.Time) string {
+	return filepath.Join(t.dir, filepath.FromSlash(name), at.UTC().Format(trashTimeFormat))
+}
+
+// latest returns where the repository name deleted last is kept, if it is.
+func (t *trash) latest(name string) (string, bool) {
+	entries, err := ioutil.ReadDir(filepath.Join(t.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return "", false
+	}
+
+	// Entries are sorted by name, and so by deletion time.
+	for i := len(entries) - 1; i >= 0; i-- {
+		if _, err := time.Parse(trashTimeFormat, entries[i].Name()); err == nil && entries[i].IsDir() {
+			return filepath.Join(t.dir, filepath.FromSlash(name), entries[i].Name()), true
+		}
+	}
+	return "", false
+}
+
+// trashRepo moves the repository name in dir to the trash.
+func (h *handler) trashRepo(name, dir string) error {
+	dst := h.trash.path(name, time.Now())
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Rename(dir, dst)
+}
+
+// undeleteRepo restores the repository name deleted last from the trash.
+func (h *handler) undeleteRepo(w http.ResponseWriter, req *http.Request, name string) {
+	if !validRepoName(name) {
+		writeError(w, http.StatusBadRequest, "invalid repository name")
+		return
+	}
+
+	src, ok := "", false
+	if h.trash != nil {
+		src, ok = h.trash.latest(name)
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "repository not found in trash")
+		return
+	}
+
+	dst, err := h.storage.Dir(req.Context(), name)
+	if err != nil {
+		h.logger.Error("Locating repository failed", Field{"repo", name}, Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to locate repository")
+		return
+	}
+	if _, err := os.Stat(dst); err == nil {
+		writeError(w, http.StatusConflict, "repository already exists")
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err == nil {
+		err = os.Rename(src, dst)
+	}
+	if err != nil {
+		h.logger.Error("Undeleting repository failed", Field{"repo", name}, Field{"error", err})
+		writeError(w, http.StatusInternalServerError, "unable to undelete repository")
+		return
+	}
+	h.invalidateRepo(dst)
+
+	h.logger.Info("Repository undeleted", Field{"repo", name}, Field{"user", remoteUser(req)})
+	writeJSON(w, http.StatusOK, repoInfo{Name: name, DefaultBranch: defaultBranch(dst)})
+}
+
+// scheduleTrashPurge purges the trash every trashPurgeInterval, until
+// maintenance is closed.
+func (h *handler) scheduleTrashPurge() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		h.purgeTrash(time.Now())
+		select {
+		case <-ticker.C:
+		case <-h.maintenance.stop:
+			return
+		}
+	}
+}
+
+// purgeTrash removes the repositories deleted longer than the retention of
+// the trash before now.
+func (h *handler) purgeTrash(now time.Time) {
+	var purged int
+	err := filepath.Walk(h.trash.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+
+		deleted, err := time.Parse(trashTimeFormat, fi.Name())
+		if err != nil {
+			return nil
+		}
+		if now.Sub(deleted) > h.trash.retention {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+			purged++
+		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		h.logger.Error("Purging trash failed", Field{"error", err})
+		return
+	}
+	if purged > 0 {
+		h.logger.Info("Trash purged", Field{"repos", purged})
+	}
+}
@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestTrash(t *testing.T) {
+	defer func(d time.Duration) { drainTimeout = d }(drainTimeout)
+	drainTimeout = 50 * time.Millisecond
+
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "org/app.git")
+
+	trashDir, err := ioutil.TempDir(os.TempDir(), "gitd-trash")
+	assert.Ok(t, err)
+	defer os.RemoveAll(trashDir)
+
+	var h *handler
+	capture := func(x *handler) { h = x }
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(), ReposPath(rpath), AdminAPI(), Trash(trashDir, time.Hour), capture))
+	defer ts.Close()
+
+	admin := func(method, path string) int {
+		req, err := http.NewRequest(method, ts.URL+"/api/repos/"+path, nil)
+		assert.Ok(t, err)
+		res, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Repositories are not deleted while in use.
+	dir := filepath.Join(rpath, "org", "app.git")
+	assert.Ok(t, h.activity.enter(dir))
+	assert.Equals(t, http.StatusConflict, admin("DELETE", "org/app.git"))
+	assert.Cond(t, isBareRepo(dir), "repository in use should have been kept")
+	h.activity.leave(dir)
+
+	assert.Equals(t, http.StatusNoContent, admin("DELETE", "org/app.git"))
+	assert.Cond(t, !isBareRepo(dir), "repository should have been deleted")
+	kept, ok := h.trash.latest("org/app.git")
+	assert.Cond(t, ok && isBareRepo(kept), "repository should have been kept in the trash")
+
+	assert.Equals(t, http.StatusOK, admin("POST", "org/app.git/undelete"))
+	assert.Cond(t, isBareRepo(filepath.Join(rpath, "org", "app.git")), "repository should have been undeleted")
+	assert.Equals(t, http.StatusNotFound, admin("POST", "org/app.git/undelete"))
+
+	// Repositories are not undeleted over new ones.
+	assert.Equals(t, http.StatusNoContent, admin("DELETE", "org/app.git"))
+	initBareRepo(t, rpath, "org/app.git")
+	assert.Equals(t, http.StatusConflict, admin("POST", "org/app.git/undelete"))
+
+	h.purgeTrash(time.Now())
+	_, ok = h.trash.latest("org/app.git")
+	assert.Cond(t, ok, "repositories should be kept for their retention")
+
+	h.purgeTrash(time.Now().Add(2 * time.Hour))
+	_, ok = h.trash.latest("org/app.git")
+	assert.Cond(t, !ok, "repositories should be purged past their retention")
+}
@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+// UploadPackConfig configures how git-upload-pack serves fetches from a
+// repository, as Git configuration passed to the process the way git -c
+// does. Shallow clones, such as with --depth or --shallow-since, are always
+// allowed. Resolvers can also set any Git configuration through the
+// GIT_CONFIG_PARAMETERS variable of the environment they return.
+type UploadPackConfig struct {
+	// AllowFilter allows partial clones, such as with --filter=blob:none,
+	// setting uploadpack.allowFilter.
+	AllowFilter bool
+	// Filters, if set, restricts the filters partial clones can use to
+	// these kinds, such as blob:none, blob:limit or tree, setting
+	// uploadpackfilter.<kind>.allow.
+	Filters []string
+	// AllowAnySHA1InWant allows fetching any object by id, setting
+	// uploadpack.allowAnySHA1InWant. Partial clones fetch the objects they
+	// left out this way over protocol v0.
+	AllowAnySHA1InWant bool
+	// AllowReachableSHA1InWant allows fetching objects reachable from refs
+	// by id, setting uploadpack.allowReachableSHA1InWant.
+	AllowReachableSHA1InWant bool
+	// AllowTipSHA1InWant allows fetching the tips of hidden refs by id,
+	// setting uploadpack.allowTipSHA1InWant.
+	AllowTipSHA1InWant bool
+}
+
+// gitConfig returns the Git configuration parameters applying c.
+func (c UploadPackConfig) gitConfig() []string {
+	var params []string
+	if c.AllowFilter {
+		params = append(params, "uploadpack.allowfilter=true")
+	}
+	if c.AllowFilter && len(c.Filters) > 0 {
+		params = append(params, "uploadpackfilter.allow=false")
+		for _, kind := range c.Filters {
+			params = append(params, "uploadpackfilter."+kind+".allow=true")
+		}
+	}
+	if c.AllowAnySHA1InWant {
+		params = append(params, "uploadpack.allowanysha1inwant=true")
+	}
+	if c.AllowReachableSHA1InWant {
+		params = append(params, "uploadpack.allowreachablesha1inwant=true")
+	}
+	if c.AllowTipSHA1InWant {
+		params = append(params, "uploadpack.allowtipsha1inwant=true")
+	}
+	return params
+}
+
+// ConfigureUploadPack sets the upload-pack configuration of repositories to
+// the one config returns for them, given their name. It applies to ref
+// advertisements and fetches over all transports.
+func ConfigureUploadPack(config func(repo string) UploadPackConfig) Option {
+	return func(h *handler) {
+		h.uploadConfig = config
+	}
+}
+
+// uploadPackEnv returns env with the upload-pack configuration of the
+// repository name.
+func (h *handler) uploadPackEnv(env []string, name string) []string {
+	if h.uploadConfig == nil {
+		return env
+	}
+
+	for _, param := range h.uploadConfig(name).gitConfig() {
+		env = gitConfigEnv(env, param)
+	}
+	return env
+}
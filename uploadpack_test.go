@@ -0,0 +1,141 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+// gitOutput runs a Git command from dir, returning its output.
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestShallowAndPartialClones(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+	initBareRepo(t, rpath, "plain.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		ConfigureUploadPack(func(repo string) UploadPackConfig {
+			return UploadPackConfig{AllowFilter: repo == "test.git", AllowAnySHA1InWant: repo == "test.git"}
+		}),
+	))
+	defer ts.Close()
+
+	// The last two commits are a day apart.
+	src := filepath.Join(workspace, "src")
+	cloneAndCommit(t, ts.URL+"/test.git", src, "one")
+	for i, content := range []string{"two", "three"} {
+		assert.Ok(t, ioutil.WriteFile(filepath.Join(src, "README.md"), []byte(content), 0644))
+		cmd := exec.Command("git", "commit", "-qam", content)
+		cmd.Dir = src
+		cmd.Env = append(os.Environ(), fmt.Sprintf("GIT_COMMITTER_DATE=%d +0000", 1500000000+(i+1)*86400))
+		out, err := cmd.CombinedOutput()
+		assert.Cond(t, err == nil, "commit failed: %s", out)
+	}
+	git(t, src, "push", "origin", "master")
+	git(t, src, "push", ts.URL+"/plain.git", "master")
+
+	depth := filepath.Join(workspace, "depth")
+	git(t, workspace, "clone", "--depth", "1", ts.URL+"/test.git", depth)
+	assert.Equals(t, "1", gitOutput(t, depth, "rev-list", "--count", "HEAD"))
+
+	since := filepath.Join(workspace, "since")
+	git(t, workspace, "clone", "--shallow-since=1500100000", ts.URL+"/test.git", since)
+	assert.Equals(t, "1", gitOutput(t, since, "rev-list", "--count", "HEAD"))
+
+	for _, version := range []string{"0", "2"} {
+		partial := filepath.Join(workspace, "partial-v"+version)
+		git(t, workspace, "-c", "protocol.version="+version, "clone", "--filter=blob:none", ts.URL+"/test.git", partial)
+		missing := gitOutput(t, partial, "rev-list", "--objects", "--missing=print", "HEAD")
+		assert.Cond(t, strings.Contains(missing, "\n?"), "blobs should have been filtered out with protocol v%s", version)
+
+		// Blobs left out are fetched on demand.
+		assert.Equals(t, "one", gitOutput(t, partial, "-c", "protocol.version="+version, "show", "HEAD~2:README.md"))
+	}
+
+	// Repositories not allowing filters serve full clones.
+	full := filepath.Join(workspace, "full")
+	git(t, workspace, "clone", "--filter=blob:none", ts.URL+"/plain.git", full)
+	missing := gitOutput(t, full, "rev-list", "--objects", "--missing=print", "HEAD")
+	assert.Cond(t, !strings.Contains(missing, "?"), "clone should not be partial")
+}
+
+func TestUploadPackConfig(t *testing.T) {
+	rpath, err := ioutil.TempDir(os.TempDir(), "gitd")
+	assert.Ok(t, err)
+	defer os.RemoveAll(rpath)
+	initBareRepo(t, rpath, "test.git")
+	initBareRepo(t, rpath, "plain.git")
+
+	workspace, err := ioutil.TempDir(os.TempDir(), "gitd-clones")
+	assert.Ok(t, err)
+	defer os.RemoveAll(workspace)
+
+	ts := httptest.NewServer(Handler(http.NotFoundHandler(),
+		ReposPath(rpath),
+		ConfigureUploadPack(func(repo string) UploadPackConfig {
+			if repo != "test.git" {
+				return UploadPackConfig{}
+			}
+			return UploadPackConfig{AllowFilter: true, Filters: []string{"blob:limit"}, AllowReachableSHA1InWant: true}
+		}),
+	))
+	defer ts.Close()
+
+	src := filepath.Join(workspace, "src")
+	cloneAndCommit(t, ts.URL+"/test.git", src, "one")
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(src, "README.md"), []byte("two"), 0644))
+	git(t, src, "commit", "-qam", "two")
+	git(t, src, "push", "origin", "master")
+	git(t, src, "push", ts.URL+"/plain.git", "master")
+	parent := gitOutput(t, src, "rev-parse", "HEAD~1")
+
+	for _, repo := range []string{"test.git", "plain.git"} {
+		dir := filepath.Join(workspace, repo)
+		git(t, workspace, "init", "-q", dir)
+		cmd := exec.Command("git", "-c", "protocol.version=0", "fetch", ts.URL+"/"+repo, parent)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		assert.Cond(t, (err == nil) == (repo == "test.git"), "unexpected fetch result from %s: %v: %s", repo, err, out)
+	}
+
+	cmd := exec.Command("git", "clone", "--filter=blob:none", ts.URL+"/test.git", filepath.Join(workspace, "none"))
+	out, err := cmd.CombinedOutput()
+	assert.Cond(t, err != nil, "filters not allowed should be refused")
+	assert.Cond(t, strings.Contains(string(out), "blob:none"), "unexpected output: %s", out)
+	git(t, workspace, "clone", "--filter=blob:limit=1k", ts.URL+"/test.git", filepath.Join(workspace, "limit"))
+
+	assert.Equals(t, []string{
+		"uploadpack.allowfilter=true",
+		"uploadpackfilter.allow=false",
+		"uploadpackfilter.tree.allow=true",
+		"uploadpack.allowtipsha1inwant=true",
+	}, UploadPackConfig{AllowFilter: true, Filters: []string{"tree"}, AllowTipSHA1InWant: true}.gitConfig())
+}
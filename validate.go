@@ -0,0 +1,82 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultMinGitVersion is the oldest Git version Validate accepts, unless set
+// with MinGitVersion.
+const defaultMinGitVersion = "2.2.1"
+
+// MinGitVersion sets the oldest Git version Validate accepts, such as
+// "2.30.0", 2.2.1 by default.
+func MinGitVersion(version string) Option {
+	return func(h *handler) {
+		h.minGitVersion = version
+	}
+}
+
+// Validate checks that Git, as configured with GitPath, runs and is at least
+// the version set with MinGitVersion, returning an error telling what is
+// wrong otherwise. Servers are meant to be validated before serving clients.
+func (s *Server) Validate() error {
+	min := s.h.minGitVersion
+	if min == "" {
+		min = defaultMinGitVersion
+	}
+	required, err := parseGitVersion(min)
+	if err != nil {
+		return fmt.Errorf("invalid minimum Git version %q", min)
+	}
+
+	out, _, err := runAndLog(s.h.logger, s.h.gitCommand("", "--version"))
+	if err != nil {
+		return fmt.Errorf("running %s failed: %v", s.h.git(), err)
+	}
+
+	// Git prints its version as in "git version 2.39.5", possibly followed by
+	// a build description, as in "2.39.5.windows.1".
+	fields := strings.Fields(out)
+	if len(fields) < 3 || fields[0] != "git" || fields[1] != "version" {
+		return fmt.Errorf("unexpected Git version output %q", strings.TrimSpace(out))
+	}
+	version, err := parseGitVersion(fields[2])
+	if err != nil {
+		return fmt.Errorf("unexpected Git version %q", fields[2])
+	}
+
+	for i := range version {
+		if version[i] != required[i] {
+			if version[i] < required[i] {
+				return fmt.Errorf("Git >= %s is required, found %s", min, fields[2])
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// parseGitVersion parses the major, minor and patch numbers of version, the
+// ones missing being zero.
+func parseGitVersion(version string) ([3]int, error) {
+	var v [3]int
+	parts := strings.Split(version, ".")
+	for i := 0; i < len(v) && i < len(parts); i++ {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			// Build descriptions follow the version numbers.
+			if i > 0 {
+				break
+			}
+			return v, err
+		}
+		v[i] = n
+	}
+	return v, nil
+}
@@ -0,0 +1,50 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestParseGitVersion(t *testing.T) {
+	for version, want := range map[string][3]int{
+		"2.2.1":            {2, 2, 1},
+		"2.39":             {2, 39, 0},
+		"2.39.5.windows.1": {2, 39, 5},
+		"2.39.rc0":         {2, 39, 0},
+	} {
+		v, err := parseGitVersion(version)
+		assert.Ok(t, err)
+		assert.Equals(t, want, v)
+	}
+
+	_, err := parseGitVersion("git")
+	assert.Cond(t, err != nil, "parsing an invalid version should fail")
+}
+
+func TestValidate(t *testing.T) {
+	validate := func(opts ...Option) error {
+		srv, err := NewServer(http.NotFoundHandler(), append(opts, ReposPath(os.TempDir()))...)
+		assert.Ok(t, err)
+		return srv.Validate()
+	}
+
+	assert.Ok(t, validate())
+	assert.Ok(t, validate(MinGitVersion("1.0")))
+
+	err := validate(MinGitVersion("999.0"))
+	assert.Cond(t, err != nil, "validating an old Git should fail")
+
+	err = validate(MinGitVersion("latest"))
+	assert.Cond(t, err != nil, "validating an invalid minimum version should fail")
+
+	err = validate(GitPath(filepath.Join(os.TempDir(), "gitd-missing", "git")))
+	assert.Cond(t, err != nil, "validating a missing Git should fail")
+}
@@ -0,0 +1,119 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WebhookPayload is the JSON document posted to webhooks for every ref
+// updated by a successful push.
+type WebhookPayload struct {
+	Repo   string `json:"repo"`
+	Ref    string `json:"ref"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+	Pusher string `json:"pusher"`
+}
+
+// webhook delivers push notifications to a URL.
+type webhook struct {
+	url      string
+	secret   string
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+	h        *handler
+}
+
+// Webhook posts a WebhookPayload to url for each ref updated by a successful
+// push. If secret is not empty, payloads are signed using HMAC-SHA256 and the
+// signature sent in the X-Gitd-Signature header as "sha256=<hex digest>".
+// Deliveries are asynchronous and retried with exponential backoff.
+func Webhook(url, secret string) Option {
+	wh := &webhook{
+		url:      url,
+		secret:   secret,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		attempts: 5,
+		backoff:  time.Second,
+	}
+	return func(h *handler) {
+		wh.h = h
+		PostReceive(wh.notify)(h)
+	}
+}
+
+// notify implements ReceiveHook, dispatching one payload per updated ref.
+func (wh *webhook) notify(r *http.Request, repo string, updates []RefUpdate) error {
+	pusher := remoteUser(r)
+	for _, u := range updates {
+		payload, err := json.Marshal(WebhookPayload{
+			Repo:   repo,
+			Ref:    u.Name,
+			Before: u.OldSHA,
+			After:  u.NewSHA,
+			Pusher: pusher,
+		})
+		if err != nil {
+			return err
+		}
+		go wh.deliver(payload)
+	}
+	return nil
+}
+
+// deliver posts payload, retrying on failure.
+func (wh *webhook) deliver(payload []byte) {
+	backoff := wh.backoff
+	for attempt := 1; ; attempt++ {
+		err := wh.post(payload)
+		if err == nil {
+			return
+		}
+
+		if attempt == wh.attempts {
+			wh.h.logger.Error("Giving up delivering webhook", Field{"url", wh.url}, Field{"attempts", attempt}, Field{"error", err})
+			return
+		}
+
+		wh.h.logger.Warn("Webhook delivery failed, retrying", Field{"url", wh.url}, Field{"backoff", backoff}, Field{"error", err})
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (wh *webhook) post(payload []byte) error {
+	req, err := http.NewRequest("POST", wh.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gitd-Event", "push")
+
+	if wh.secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.secret))
+		mac.Write(payload)
+		req.Header.Set("X-Gitd-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gitd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	payloads := make(chan WebhookPayload, 1)
+	failures := 1
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		assert.Ok(t, err)
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		assert.Equals(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get("X-Gitd-Signature"))
+
+		var p WebhookPayload
+		assert.Ok(t, json.Unmarshal(body, &p))
+		payloads <- p
+	}))
+	defer ts.Close()
+
+	wh := &webhook{
+		url:      ts.URL,
+		secret:   "secret",
+		client:   http.DefaultClient,
+		attempts: 3,
+		backoff:  time.Millisecond,
+		h:        &handler{logger: stdLogger{}},
+	}
+
+	req := httptest.NewRequest("POST", "/test.git/git-receive-pack", nil)
+	req.SetBasicAuth("alice", "")
+	err := wh.notify(req, "test.git", []RefUpdate{{Name: "refs/heads/master", OldSHA: zeroSHA, NewSHA: "abc"}})
+	assert.Ok(t, err)
+
+	select {
+	case p := <-payloads:
+		assert.Equals(t, WebhookPayload{Repo: "test.git", Ref: "refs/heads/master", Before: zeroSHA, After: "abc", Pusher: "alice"}, p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+}